@@ -0,0 +1,71 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrBadAnnotation = errors.New("annotation keys must be namespaced, as namespace/key")
+)
+
+type annotationsKey struct{}
+
+// WithAnnotations returns a context that annotates the commands submitted
+// with it, e.g. by CommandContext, Apply or SessionCommand, with the key-value
+// pairs, along with any the context already carries; later values win. Keys
+// are namespaced, as namespace/key, e.g. "auth/principal", so middlewares
+// and transports that annotate commands don't collide.
+//
+// Annotations are replicated and persisted with the command's entry, but
+// aren't part of the command: the EncodeEntry and DecodeEntry hooks see them
+// in the entry, and so does the function set with SetApplyEntry, while the
+// apply function passed to NewServer gets the command alone. A follower
+// forwarding a command to the leader keeps its annotations only if the
+// leader's peer is an AnnotatingPeer.
+func WithAnnotations(ctx context.Context, annotations map[string]string) context.Context {
+	merged := map[string]string{}
+	for k, v := range AnnotationsFrom(ctx) {
+		merged[k] = v
+	}
+	for k, v := range annotations {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, annotationsKey{}, merged)
+}
+
+// AnnotationsFrom returns the annotations the context carries, if any.
+func AnnotationsFrom(ctx context.Context) map[string]string {
+	annotations, _ := ctx.Value(annotationsKey{}).(map[string]string)
+	return annotations
+}
+
+// checkAnnotations returns ErrBadAnnotation unless every key is namespaced.
+func checkAnnotations(annotations map[string]string) error {
+	for k := range annotations {
+		if i := strings.Index(k, "/"); i <= 0 || i == len(k)-1 {
+			return ErrBadAnnotation
+		}
+	}
+	return nil
+}
+
+// AnnotatingPeer is implemented by peers that can forward a command to the
+// leader with its annotations, like LocalPeer and rafthttp.Peer.
+type AnnotatingPeer interface {
+	CommandAnnotated(cmd []byte, annotations map[string]string, response chan []byte) error
+}
+
+func (p *LocalPeer) CommandAnnotated(cmd []byte, annotations map[string]string, response chan []byte) error {
+	return p.server.CommandContext(WithAnnotations(context.Background(), annotations), cmd, response)
+}
+
+// SetApplyEntry makes the server apply each command by passing its whole
+// entry, with its index, term and annotations, to the function, instead of
+// the command alone to the apply function passed to NewServer, which it
+// replaces. The entry's command is decoded, as the apply function would get
+// it. It must be called before Start.
+func (s *Server) SetApplyEntry(apply func(LogEntry) ([]byte, error)) {
+	s.log.applyEntry = apply
+}
@@ -0,0 +1,101 @@
+package raft_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/peterbourgon/raft"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAnnotations(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+
+	// every server records the annotations of the commands it applies
+	var (
+		mu      sync.Mutex
+		applied = map[uint64][]map[string]string{}
+	)
+	servers := []*raft.Server{}
+	peers := raft.Peers{}
+	for id := uint64(1); id <= 3; id++ {
+		id := id
+		server := raft.NewServer(id, &bytes.Buffer{}, noop, config)
+		server.SetApplyEntry(func(entry raft.LogEntry) ([]byte, error) {
+			if string(entry.Command) != "cmd" {
+				t.Errorf("server %d: expected the command alone, got %q", id, entry.Command)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			applied[id] = append(applied[id], entry.Annotations)
+			return []byte{}, nil
+		})
+		servers = append(servers, server)
+		peers[id] = raft.NewLocalPeer(server)
+	}
+	for _, server := range servers {
+		server.SetPeers(peers)
+		server.Start()
+		defer server.Stop()
+	}
+
+	// a command submitted to a follower is forwarded with its annotations
+	annotations := map[string]string{"auth/principal": "alice", "app/schema": "2"}
+	ctx := raft.WithAnnotations(context.Background(), map[string]string{"auth/principal": "mallory"})
+	ctx = raft.WithAnnotations(ctx, annotations)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var follower *raft.Server
+		for _, server := range servers {
+			if st := server.Status(); st.State == raft.Follower && st.Leader != 0 {
+				follower = server
+			}
+		}
+		if follower != nil {
+			response := make(chan []byte, 1)
+			if err := follower.CommandContext(ctx, []byte("cmd"), response); err == nil {
+				if _, ok := <-response; ok {
+					break
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("command never committed")
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+
+	// and replicated to every server
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(applied[1]) + len(applied[2]) + len(applied[3])
+		mu.Unlock()
+		if n >= 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	for _, server := range servers {
+		if got := applied[server.Id()]; len(got) != 1 || !reflect.DeepEqual(annotations, got[0]) {
+			t.Errorf("server %d: expected annotations %v, got %v", server.Id(), annotations, got)
+		}
+	}
+	mu.Unlock()
+
+	// keys must be namespaced
+	ctx = raft.WithAnnotations(context.Background(), map[string]string{"principal": "alice"})
+	if err := servers[0].CommandContext(ctx, []byte("cmd"), nil); err != raft.ErrBadAnnotation {
+		t.Errorf("expected %v, got %v", raft.ErrBadAnnotation, err)
+	}
+}
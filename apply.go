@@ -0,0 +1,330 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+var (
+	ErrApplyBacklog = errors.New("too many committed entries waiting to be applied")
+)
+
+// ApplyFailed is emitted when the apply function panics, or fails with an
+// error other than a CommandError. The event's Index is the entry's, and its
+// Data is the error's text. What happens next is up to the ApplyPolicy.
+const ApplyFailed = "ApplyFailed"
+
+// ApplyPolicy determines what the server does when its apply function panics,
+// or fails with an error other than a CommandError.
+type ApplyPolicy int
+
+const (
+	// ApplyRetry leaves the entry unapplied, and tries it again: on the
+	// main loop, when the log next commits, and, if entries are applied
+	// asynchronously, also after a backoff. Nothing after it is applied in
+	// the meantime. This is the default.
+	ApplyRetry ApplyPolicy = iota
+
+	// ApplySkip counts the entry as applied, and rejects its command with
+	// the error, as if the apply function had returned it in a
+	// CommandError. Servers whose apply function succeeds apply the entry,
+	// so their state machines may diverge: it's for failures, like a bug
+	// that panics on a malformed command, that are the same everywhere.
+	ApplySkip
+
+	// ApplyHalt stops the server, applying nothing more, so an operator can
+	// look into the failure before the state machine moves on.
+	ApplyHalt
+)
+
+func (p ApplyPolicy) String() string {
+	switch p {
+	case ApplyRetry:
+		return "retry"
+	case ApplySkip:
+		return "skip"
+	case ApplyHalt:
+		return "halt"
+	default:
+		return fmt.Sprintf("ApplyPolicy(%d)", int(p))
+	}
+}
+
+// ApplyPanic is the error of an apply function that panicked.
+type ApplyPanic struct {
+	Value interface{} // as passed to panic
+	Stack []byte      // of the goroutine that panicked
+}
+
+func (p *ApplyPanic) Error() string { return fmt.Sprintf("apply function panicked: %v", p.Value) }
+
+// SetApplyPolicy determines what happens when the apply function panics, or
+// fails; see ApplyPolicy. Whatever the policy, the failure is logged, with
+// the stack of a panic, and reported as an ApplyFailed event. It must be
+// called before Start.
+func (s *Server) SetApplyPolicy(p ApplyPolicy) {
+	s.log.applyPolicy = p
+}
+
+// applyFailed is called by the log when the apply function fails. Like
+// responseDropped, it may be called from any goroutine.
+func (s *Server) applyFailed(entry LogEntry, err error) {
+	policy := s.log.applyPolicy
+	s.config().logf("id=%d: applying entry %d: %s (policy: %s)", s.id, entry.Index, err, policy)
+	if p, ok := err.(*ApplyPanic); ok {
+		s.config().logf("id=%d: %s", s.id, p.Stack)
+	}
+	if policy == ApplyHalt {
+		go s.Stop() // not from the main loop, or the applier, which it waits for
+	}
+	if s.eventHandler == nil {
+		return
+	}
+	st, _ := s.status.Load().(Status) // not Status, which locks the log
+	s.eventHandler(Event{
+		Type:  ApplyFailed,
+		Id:    s.id,
+		Term:  st.Term,
+		Index: entry.Index,
+		Time:  time.Now(),
+		Data:  []byte(err.Error()),
+	})
+}
+
+// callApply calls the apply function, turning a panic into an ApplyPanic.
+func (l *Log) callApply(entry LogEntry) (resp []byte, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			resp, err = nil, &ApplyPanic{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	if l.applyEntry != nil {
+		return l.applyEntry(entry)
+	}
+	return l.apply(entry.Command)
+}
+
+// applyFailure reports the failure to apply the entry, and carries out the
+// policy: the entry is rejected with the error, if it's skipped, or else the
+// error's returned, so it's applied again later, unless the log halts.
+func (l *Log) applyFailure(entry LogEntry, err error) ([]byte, *CommandError, error) {
+	if l.applyFailed != nil {
+		l.applyFailed(entry, err)
+	}
+	switch l.applyPolicy {
+	case ApplySkip:
+		return nil, &CommandError{err}, nil
+	case ApplyHalt:
+		l.halted = err
+	}
+	return nil, nil, err
+}
+
+// SetAsyncApply makes the server apply committed entries on a goroutine of
+// its own, instead of on the main loop, as they commit, so a slow apply
+// function can't hold up heartbeats, elections, or replication. The commit
+// index advances as before; AppliedIndex trails it. Responses to commands,
+// and queries, wait for the entries before them to be applied, and queries
+// are never run while an entry is applied.
+//
+// The backlog bounds how far the state machine may fall behind: while it has
+// that many committed entries to apply, or more, the leader refuses new
+// commands with ErrApplyBacklog, which clients may retry. It must be called
+// before Start. A backlog of zero, the default, applies entries as they
+// commit.
+func (s *Server) SetAsyncApply(backlog int) {
+	if backlog <= 0 {
+		s.log.applier = nil
+		return
+	}
+	s.log.applier = &applier{
+		backlog: uint64(backlog),
+		wakeup:  make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		failed: func(err error) {
+			s.config().logf("id=%d: applying committed entries: %s", s.id, err)
+		},
+	}
+}
+
+// AppliedIndex returns the index of the last entry applied to the state
+// machine. Unless entries are applied asynchronously, it's the commit index.
+func (s *Server) AppliedIndex() uint64 {
+	return s.log.appliedIndex()
+}
+
+// applier applies the log's committed entries on a goroutine of its own; see
+// SetAsyncApply. A nil applier applies nothing, and entries are applied as
+// they commit.
+type applier struct {
+	backlog uint64
+	wakeup  chan struct{}
+	quit    chan struct{}
+	done    chan struct{}
+	failed  func(error) // reports an entry that couldn't be applied
+
+	waitMu  sync.Mutex
+	waiting []applyWaiter
+}
+
+// applyWaiter is a function waiting for an index to be applied.
+type applyWaiter struct {
+	index uint64
+	run   func(error)
+}
+
+// wake tells the applier there are entries to apply, or waiters to run.
+func (a *applier) wake() {
+	if a == nil {
+		return
+	}
+	select {
+	case a.wakeup <- struct{}{}:
+	default: // it's already due to wake
+	}
+}
+
+// runApplier applies committed entries, and runs waiters, until the log's stopped.
+// An entry that can't be applied is tried again after a backoff, or when more
+// entries commit.
+func (l *Log) runApplier() {
+	a := l.applier
+	defer close(a.done)
+	apply := l.applyBacklog
+	if l.stream != nil {
+		apply = l.applyStream
+		defer close(l.stream.ch)
+	}
+	var (
+		failures int
+		retry    <-chan time.Time
+	)
+	for {
+		select {
+		case <-a.wakeup:
+		case <-retry:
+		case <-a.quit:
+			l.runWaiters(ErrStopped)
+			return
+		}
+		retry = nil
+		if err := apply(); err != nil {
+			a.failed(err)
+			failures++
+			retry = time.After(DefaultBackoff.Delay(failures, ErrorServer))
+		} else {
+			failures = 0
+		}
+		l.runWaiters(nil)
+	}
+}
+
+// stopApplier stops the applier, if there is one, once it's done with the
+// entry it's applying, if any.
+func (l *Log) stopApplier() {
+	if l.applier == nil {
+		return
+	}
+	close(l.applier.quit)
+	<-l.applier.done
+}
+
+// applyBacklog applies the entries committed after the last one applied,
+// one at a time, with the log unlocked while the state machine runs, so the
+// main loop can go on appending and committing entries in the meantime.
+func (l *Log) applyBacklog() error {
+	unlocked := func(f func()) {
+		l.Unlock()
+		defer l.Lock()
+		f()
+	}
+	for {
+		select {
+		case <-l.applier.quit:
+			return nil
+		default:
+		}
+		l.applyMu.Lock()
+		l.Lock()
+		if l.applied >= l.getCommitIndexWithLock() {
+			l.Unlock()
+			l.applyMu.Unlock()
+			return nil
+		}
+		// Committed entries aren't truncated, and aren't compacted until
+		// they're applied, so the next is in the log.
+		pos := int(l.applied - l.compactedIndex)
+		if pos < 0 || pos >= len(l.entries) || l.entries[pos].Index != l.applied+1 {
+			l.Unlock()
+			l.applyMu.Unlock()
+			return fmt.Errorf("entry %d isn't in the log", l.applied+1)
+		}
+		err := l.applyCommitted(l.entries[pos], unlocked)
+		l.Unlock()
+		l.applyMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// whenApplied calls run once the index has been applied, between applying
+// entries, or with ErrStopped, if the server stops first. Unless entries are
+// applied asynchronously, it calls run straight away.
+func (l *Log) whenApplied(index uint64, run func(error)) {
+	if l.applier == nil {
+		run(nil)
+		return
+	}
+	l.applier.waitMu.Lock()
+	l.applier.waiting = append(l.applier.waiting, applyWaiter{index, run})
+	l.applier.waitMu.Unlock()
+	l.applier.wake()
+}
+
+// runWaiters runs the waiters whose index has been applied, or every waiter,
+// with the error, if it isn't nil.
+func (l *Log) runWaiters(err error) {
+	a := l.applier
+	l.applyMu.Lock()
+	defer l.applyMu.Unlock()
+	applied := l.appliedIndex()
+
+	a.waitMu.Lock()
+	var ready, later []applyWaiter
+	for _, w := range a.waiting {
+		if err != nil || w.index <= applied {
+			ready = append(ready, w)
+		} else {
+			later = append(later, w)
+		}
+	}
+	a.waiting = later
+	a.waitMu.Unlock()
+
+	for _, w := range ready {
+		w.run(err)
+	}
+}
+
+// appliedIndex returns the index of the last entry applied.
+func (l *Log) appliedIndex() uint64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.applied
+}
+
+// applyBacklogFull returns whether the applier has as many committed entries
+// to apply as it may, or more.
+func (l *Log) applyBacklogFull() bool {
+	if l.applier == nil {
+		return false
+	}
+	l.RLock()
+	defer l.RUnlock()
+	return l.getCommitIndexWithLock()-l.applied >= l.applier.backlog
+}
@@ -0,0 +1,119 @@
+package raft
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// ErrorClass classifies the errors RPCs fail with, so a Backoff can wait
+// longer after some than after others.
+type ErrorClass int
+
+const (
+	ErrorNetwork ErrorClass = iota // the peer couldn't be reached
+	ErrorTimeout                   // the peer didn't answer in time
+	ErrorServer                    // the peer answered, with an error
+)
+
+// ErrorClassOf returns the class of an error from a transport: ErrorTimeout
+// for timeouts, and ErrorNetwork for anything else. Transports that can tell
+// when the peer itself failed say ErrorServer instead.
+func ErrorClassOf(err error) ErrorClass {
+	if err == context.DeadlineExceeded || err == ErrTimeout {
+		return ErrorTimeout
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ErrorTimeout
+	}
+	return ErrorNetwork
+}
+
+// Backoff decides how long to wait before retrying a failed RPC. Transports
+// use it between the attempts of a single RPC, and leaders use it to stop
+// flushing to followers they keep failing to reach, for a while.
+type Backoff interface {
+	// Delay returns how long to wait before the given retry, counting from
+	// 1, after an error of the given class.
+	Delay(retry int, class ErrorClass) time.Duration
+}
+
+// ExponentialBackoff doubles its delay with every retry, from Min up to Max,
+// whatever the error, and then moves each delay by up to Jitter (a fraction
+// of it) either way, so peers that failed together don't retry together.
+type ExponentialBackoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Jitter float64
+}
+
+// DefaultBackoff is the Backoff used unless another is set.
+var DefaultBackoff Backoff = ExponentialBackoff{Min: 10 * time.Millisecond, Max: time.Second, Jitter: 0.2}
+
+func (b ExponentialBackoff) Delay(retry int, class ErrorClass) time.Duration {
+	d := b.Min
+	for i := 1; i < retry && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max || d <= 0 {
+		d = b.Max
+	}
+	if b.Jitter > 0 {
+		d += time.Duration((2*rand.Float64() - 1) * b.Jitter * float64(d))
+	}
+	return d
+}
+
+// SetBackoff sets the backoff a leader uses to stop flushing to followers it
+// keeps failing to reach, so it doesn't wait on them with every heartbeat. It
+// must be called before Start. Delays are capped at half the minimum election
+// timeout, so a follower that recovers hears from the leader before it can
+// call an election. The default is DefaultBackoff.
+func (s *Server) SetBackoff(b Backoff) {
+	s.backoff = b
+}
+
+// retrier tracks the followers a leader keeps failing to flush to, and when
+// it may flush to each of them again. It's only used from the main loop.
+type retrier struct {
+	backoff  Backoff
+	max      time.Duration
+	failures map[uint64]int
+	next     map[uint64]time.Time
+}
+
+func (s *Server) newRetrier() *retrier {
+	b := s.backoff
+	if b == nil {
+		b = DefaultBackoff
+	}
+	return &retrier{
+		backoff:  b,
+		max:      s.config().MinElectionTimeout / 2,
+		failures: map[uint64]int{},
+		next:     map[uint64]time.Time{},
+	}
+}
+
+// due reports whether the follower may be flushed to.
+func (r *retrier) due(id uint64, now time.Time) bool {
+	return !now.Before(r.next[id])
+}
+
+// observe records the result of a flush to the follower. Flushes it answered,
+// even to refuse, mean it's reachable.
+func (r *retrier) observe(id uint64, err error, now time.Time) {
+	switch err {
+	case nil, ErrAppendEntriesRejected, ErrSnapshotRejected, ErrDeposed:
+		delete(r.failures, id)
+		delete(r.next, id)
+		return
+	}
+	r.failures[id]++
+	delay := r.backoff.Delay(r.failures[id], ErrorClassOf(err))
+	if delay > r.max {
+		delay = r.max
+	}
+	r.next[id] = now.Add(delay)
+}
@@ -0,0 +1,59 @@
+package raft
+
+import (
+	"sync"
+	"time"
+)
+
+// beacons are the subscribers to a server's leader beacons.
+type beacons struct {
+	sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+// Beacons subscribes to the server's leader beacons, which it emits while it's
+// the leader, and sure of it, if the config has a BeaconInterval. Clients can
+// watch them to notice that the leader is gone, and fail over, before a
+// command waits out a dead connection. The chan holds only the latest beacon.
+// The returned func unsubscribes.
+func (s *Server) Beacons() (<-chan Event, func()) {
+	c := make(chan Event, 1)
+	s.beacons.Lock()
+	defer s.beacons.Unlock()
+	if s.beacons.subscribers == nil {
+		s.beacons.subscribers = map[chan Event]struct{}{}
+	}
+	s.beacons.subscribers[c] = struct{}{}
+	return c, func() {
+		s.beacons.Lock()
+		defer s.beacons.Unlock()
+		delete(s.beacons.subscribers, c)
+	}
+}
+
+// beacon emits a leader beacon to the event handler, and every subscriber.
+// Beacons aren't logged, as they'd drown out everything else.
+func (s *Server) beacon() {
+	e := Event{
+		Type:  LeaderBeacon,
+		Id:    s.id,
+		Term:  s.term,
+		Index: s.log.getCommitIndex(),
+		Time:  time.Now(),
+	}
+	if s.eventHandler != nil {
+		s.eventHandler(e)
+	}
+	s.beacons.Lock()
+	defer s.beacons.Unlock()
+	for c := range s.beacons.subscribers {
+		select {
+		case <-c: // replace the beacon the subscriber hasn't received
+		default:
+		}
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
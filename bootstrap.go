@@ -0,0 +1,62 @@
+package raft
+
+import (
+	"errors"
+)
+
+var (
+	ErrBootstrapped = errors.New("log isn't empty; already bootstrapped")
+	ErrNoDialer     = errors.New("no dialer for a bootstrapped peer")
+)
+
+// Dialer returns a peer for the server with the given id, at the given
+// address, which is in the format of the transport's Addresser.
+type Dialer func(id uint64, addr string) (Peer, error)
+
+// Bootstrap makes the passed peers, which must include this server, the
+// initial membership of a new cluster, and writes it to the log as the first
+// entry. It must be called before Start, on exactly one server. The others
+// are started without peers: they don't stand for election, and learn the
+// membership as the entry is replicated to them, building their peers with
+// the function passed to SetDialer. Peers' addresses are taken from their
+// Addresser implementations.
+//
+// Since the membership is in the log, a server restarted with its log
+// recovers it, along with any changes to it since; see SetPeers.
+func (s *Server) Bootstrap(peers Peers) error {
+	if _, ok := peers[s.id]; !ok {
+		return ErrUnknownPeer
+	}
+	if s.log.lastIndex() > 0 {
+		return ErrBootstrapped
+	}
+	if err := s.appendConfigurationChange(configurationChange{Bootstrap: membersOf(peers)}); err != nil {
+		return err
+	}
+	s.SetPeers(peers)
+	return nil
+}
+
+// SetDialer installs the function a server uses to build the peers it learns
+// of from its log, rather than from SetPeers or SetLearners. It's called from
+// Start, and from the server's main loop, so it shouldn't block for long.
+func (s *Server) SetDialer(dial Dialer) {
+	s.dial = dial
+}
+
+// bootstrap makes the members of a bootstrap configuration entry our peers,
+// unless we already have some, e.g. the server that wrote the entry, or one
+// that's been given peers with SetPeers.
+func (s *Server) bootstrap(members []member) error {
+	if len(s.peers) > 0 {
+		return nil
+	}
+	peers, err := s.peersOf(members)
+	if err != nil {
+		return err
+	}
+	s.setMembers(peers, s.learners)
+	s.setLeader(s.leader) // the leader may now be reachable
+	s.logGeneric("bootstrapped with %d peer(s)", len(peers))
+	return nil
+}
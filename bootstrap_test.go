@@ -0,0 +1,157 @@
+package raft_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/peterbourgon/raft"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBootstrap(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	stores := map[uint64]*bytes.Buffer{}
+	servers := map[uint64]*raft.Server{}
+	peers := raft.Peers{}
+	for id := uint64(1); id <= 3; id++ {
+		stores[id] = &bytes.Buffer{}
+		servers[id] = raft.NewServer(id, stores[id], noop, config)
+		peers[id] = raft.NewLocalPeer(servers[id])
+	}
+	dial := func(id uint64, addr string) (raft.Peer, error) {
+		if peer, ok := peers[id]; ok {
+			return peer, nil
+		}
+		return nil, raft.ErrUnknownPeer
+	}
+
+	// only server 1 is given the membership
+	if err := servers[1].Bootstrap(peers); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := raft.ErrBootstrapped, servers[1].Bootstrap(peers); expected != got {
+		t.Errorf("bootstrapping again: expected %v, got %v", expected, got)
+	}
+	for _, server := range servers {
+		server.SetDialer(dial)
+		server.Start()
+		defer server.Stop()
+	}
+
+	// the others learn it from the log
+	for id, server := range servers {
+		for i := 0; ; i++ {
+			if expected, got := "[1 2 3]", fmt.Sprint(server.Status().Peers); expected == got {
+				break
+			} else if i > 100 {
+				t.Fatalf("server %d: expected peers %s, got %s", id, expected, got)
+			}
+			time.Sleep(config.MinElectionTimeout)
+		}
+	}
+	response := make(chan []byte, 1)
+	if err := servers[2].Command([]byte(`{}`), response); err != nil {
+		t.Fatal(err)
+	}
+	<-response
+
+	// and recover it from the log on restart
+	servers[2].Stop()
+	restarted := raft.NewServer(2, bytes.NewBuffer(stores[2].Bytes()), noop, config)
+	restarted.SetDialer(dial)
+	restarted.Start()
+	defer restarted.Stop()
+	if expected, got := "[1 2 3]", fmt.Sprint(restarted.Status().Peers); expected != got {
+		t.Errorf("after restart, expected peers %s, got %s", expected, got)
+	}
+}
+
+func TestAddLearner(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	servers := map[uint64]*raft.Server{}
+	peers := raft.Peers{}
+	for id := uint64(1); id <= 4; id++ {
+		servers[id] = raft.NewServer(id, &bytes.Buffer{}, noop, config)
+		peers[id] = raft.NewLocalPeer(servers[id])
+	}
+	dial := func(id uint64, addr string) (raft.Peer, error) {
+		if peer, ok := peers[id]; ok {
+			return peer, nil
+		}
+		return nil, raft.ErrUnknownPeer
+	}
+
+	// server 4 starts without peers, and isn't in the bootstrap membership
+	if err := servers[1].Bootstrap(peers.Except(4)); err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range servers {
+		server.SetDialer(dial)
+		server.Start()
+		defer server.Stop()
+	}
+	for i := 0; servers[1].Status().Leader == 0; i++ {
+		if i > 100 {
+			t.Fatal("no leader")
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+
+	var leader *raft.Server
+	for id, server := range servers {
+		if id == servers[1].Status().Leader {
+			leader = server
+		} else if expected, got := raft.ErrNotLeader, server.AddLearner(4, "server-4"); expected != got {
+			t.Errorf("server %d: expected %v, got %v", id, expected, got)
+		}
+	}
+	if leader == nil {
+		t.Fatal("no leader")
+	}
+	if expected, got := raft.ErrPeerExists, leader.AddLearner(2, "server-2"); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	for i := 0; ; i++ {
+		err := leader.AddLearnerOnce("add-4", 4, "server-4")
+		if err == nil {
+			break
+		} else if err != raft.ErrConfigChangeInProgress || i > 100 {
+			t.Fatal(err) // e.g. the bootstrap entry hasn't committed
+		}
+		time.Sleep(config.HeartbeatInterval)
+	}
+	if err := leader.AddLearnerOnce("add-4", 4, "server-4"); err != nil {
+		t.Errorf("retrying the change: %s", err)
+	}
+
+	// it's added to every server, and then promoted once it's caught up
+	for id, server := range servers {
+		for i := 0; ; i++ {
+			if expected, got := "[1 2 3 4]", fmt.Sprint(server.Status().Peers); expected == got {
+				break
+			} else if i > 100 {
+				t.Fatalf("server %d: expected peers %s, got %s", id, expected, got)
+			}
+			time.Sleep(config.MinElectionTimeout)
+		}
+	}
+	response := make(chan []byte, 1)
+	if err := servers[4].Command([]byte(`{}`), response); err != nil {
+		t.Fatal(err)
+	}
+	<-response
+}
@@ -0,0 +1,64 @@
+package raft
+
+import (
+	"fmt"
+)
+
+// ConsistencyError describes how a server's persistent state contradicts
+// itself, as found by Check.
+type ConsistencyError struct {
+	Problem string
+}
+
+func (e *ConsistencyError) Error() string {
+	return fmt.Sprintf("inconsistent state: %s", e.Problem)
+}
+
+// Check verifies that the server's persistent state is consistent: that the
+// log follows on from the snapshot it was restored from, if any, which is
+// still in the snapshot store, with no gaps in its indexes and no decrease in
+// its terms, that the state machine's checkpoint, if any, is in the log, and
+// that the stable store's term is no older than the log's. It
+// returns a *ConsistencyError describing the first problem it finds.
+//
+// It must be called before Start, once the stores are set. Start calls it,
+// and panics with its error, rather than running on state that would only
+// fail later, e.g. mid-election.
+func (s *Server) Check() error {
+	if problem := s.log.check(); problem != "" {
+		return &ConsistencyError{problem}
+	}
+	s.log.RLock()
+	index, term := s.log.compactedIndex, s.log.compactedTerm
+	s.log.RUnlock()
+	if index > 0 {
+		snapshots := []SnapshotMeta{}
+		if s.snapshots != nil {
+			var err error
+			if snapshots, err = s.snapshots.List(); err != nil {
+				return err
+			}
+		}
+		if len(snapshots) == 0 {
+			return &ConsistencyError{fmt.Sprintf("the log follows a snapshot through index=%d term=%d, but there are no snapshots", index, term)}
+		}
+		if snapshots[0].Index < index {
+			return &ConsistencyError{fmt.Sprintf(
+				"the log follows a snapshot through index=%d term=%d, but the newest snapshot, %s, is only through index=%d",
+				index,
+				term,
+				snapshots[0].Id,
+				snapshots[0].Index,
+			)}
+		}
+	}
+	if checkpoint := s.log.pendingCheckpoint(); checkpoint > 0 {
+		return &ConsistencyError{fmt.Sprintf("the state machine is checkpointed at index=%d, which isn't in the log, nor a snapshot", checkpoint)}
+	}
+	if s.stable != nil { // a new store begins at the log's term
+		if lastTerm := s.log.lastTerm(); s.saved.Term > 0 && s.saved.Term < lastTerm {
+			return &ConsistencyError{fmt.Sprintf("the stable store's term=%d is older than the log's last term=%d", s.saved.Term, lastTerm)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package raft
+
+import (
+	"errors"
+)
+
+var (
+	ErrCheckpointSessions = errors.New("sessions can't be recovered from a checkpoint")
+)
+
+// Checkpointer is implemented by state machines that keep their own state
+// durable as they apply commands, e.g. in an embedded database, so a server
+// restarted on the same state needn't apply the whole log again, nor restore
+// a snapshot, to rebuild it.
+type Checkpointer interface {
+	// Checkpoint returns the index of the last entry the state machine has
+	// durably applied, or 0 if it's applied none. The index must be made
+	// durable together with the state it describes, e.g. written in the
+	// same transaction, which SetApplyEntry makes possible by passing the
+	// apply function each entry's index: a checkpoint ahead of the state
+	// skips entries that were never applied, and one behind it applies
+	// entries twice.
+	Checkpoint() (uint64, error)
+}
+
+// SetCheckpointer makes the server count the entries up to and including the
+// state machine's checkpoint as applied, so only those after it are applied
+// as they're committed. If the snapshot store has a snapshot at or before the
+// checkpoint, it isn't restored, as the state machine is already past it; a
+// newer one is, and entries are applied from there.
+//
+// It must be called after SetSessions, and before SetSnapshotStore and Start.
+// Sessions are kept in memory, and only recovered from snapshots, so it fails
+// with ErrCheckpointSessions if they're enabled. A checkpoint past the end of
+// the log is an inconsistency, which Check reports.
+func (s *Server) SetCheckpointer(c Checkpointer) error {
+	if s.log.sessions != nil {
+		return ErrCheckpointSessions
+	}
+	index, err := c.Checkpoint()
+	if err != nil {
+		return err
+	}
+	s.log.Lock()
+	s.log.checkpoint = index
+	s.log.Unlock()
+	if s.log.skipCheckpointed() {
+		s.logGeneric("the state machine is checkpointed at index %d; applying entries after it", index)
+	}
+	s.publishStatus()
+	return nil
+}
+
+// pendingCheckpoint returns the state machine's checkpoint, if it's past the
+// last entry applied, or else 0.
+func (l *Log) pendingCheckpoint() uint64 {
+	l.RLock()
+	defer l.RUnlock()
+	if l.checkpoint <= l.applied {
+		return 0
+	}
+	return l.checkpoint
+}
+
+// skipCheckpointed counts the entries up to and including the checkpoint as
+// committed and applied, if they're in the log, and reports whether it did.
+// Entries that were applied were committed, so the commit index may safely
+// jump ahead to it. The checkpoint may be in entries compacted into a snapshot
+// that's yet to be restored, in which case it's tried again once it is.
+func (l *Log) skipCheckpointed() bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.checkpoint <= l.applied {
+		return false
+	}
+	pos := -1
+	for i := l.commitPos + 1; i < len(l.entries); i++ {
+		if l.entries[i].Index == l.checkpoint {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		return false
+	}
+	for _, entry := range l.entries[l.commitPos+1 : pos+1] {
+		switch entry.Type {
+		case EntryConfiguration:
+			l.configuration = entry.Command
+		case EntryCommand, EntrySessionCommand:
+			l.sinceSnapshot += int64(len(entry.Command))
+		}
+	}
+	l.commitPos, l.applied = pos, l.checkpoint
+	return true
+}
@@ -0,0 +1,185 @@
+package raft_test
+
+import (
+	"bytes"
+	"github.com/peterbourgon/raft"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCheckpointer(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+
+	dir, err := ioutil.TempDir("", "raft-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshots, err := raft.NewFileSnapshotStore(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	// the state machine and the log outlive each server, as if on disk
+	fsm, saved := &checkpointFSM{}, &bytes.Buffer{}
+	newServer := func() *raft.Server {
+		store := struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewReader(saved.Bytes()), saved}
+		server := raft.NewServer(1, store, nil, config)
+		server.SetApplyEntry(fsm.apply)
+		server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+		return server
+	}
+	start := func(server *raft.Server) {
+		server.Start()
+		select {
+		case <-server.LeaderCh():
+		case <-time.After(10 * config.MaxElectionTimeout):
+			t.Fatal("never became leader")
+		}
+	}
+	command := func(server *raft.Server, n int) {
+		response := make(chan []byte, 1)
+		if err := server.Command([]byte(strconv.Itoa(n)), response); err != nil {
+			t.Fatal(err)
+		}
+		<-response
+	}
+	server := newServer()
+	start(server)
+	for n := 1; n <= 5; n++ {
+		command(server, n)
+	}
+	server.Stop()
+
+	// a restarted server applies only what's committed after the checkpoint
+	server = newServer()
+	if err := server.SetCheckpointer(fsm); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := fsm.checkpoint(), server.Status().AppliedIndex; expected != got {
+		t.Errorf("expected applied index %d, got %d", expected, got)
+	}
+	if expected, got := fsm.checkpoint(), server.Status().CommitIndex; expected != got {
+		t.Errorf("expected commit index %d, got %d", expected, got)
+	}
+	start(server)
+	command(server, 6)
+	if sum, applies := fsm.counts(); sum != 21 || applies != 6 {
+		t.Errorf("after restarting: expected a sum of 21 from 6 applies, got %d from %d", sum, applies)
+	}
+
+	server.Stop()
+
+	// nor does it restore a snapshot the state machine is past
+	server = newServer()
+	if err := server.SetCheckpointer(fsm); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetSnapshotStore(snapshots, fsm); err != nil {
+		t.Fatal(err)
+	}
+	start(server)
+	meta, err := server.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	command(server, 7)
+	server.Stop()
+	fsm.Lock()
+	fsm.applies = 0
+	fsm.Unlock()
+
+	server = newServer()
+	if err := server.SetCheckpointer(fsm); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetSnapshotStore(snapshots, fsm); err != nil {
+		t.Fatal(err)
+	}
+	start(server)
+	command(server, 8)
+	if sum, applies := fsm.counts(); sum != 36 || applies != 1 {
+		t.Errorf("after restarting: expected a sum of 36 from 1 apply, got %d from %d", sum, applies)
+	}
+	if fsm.restored() {
+		t.Errorf("expected the snapshot through index %d not to be restored", meta.Index)
+	}
+	server.Stop()
+
+	// a checkpoint past the end of the log is inconsistent
+	server = raft.NewServer(1, &bytes.Buffer{}, nil, config)
+	if err := server.SetCheckpointer(fsm); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.Check().(*raft.ConsistencyError); !ok {
+		t.Errorf("expected a ConsistencyError, got %v", server.Check())
+	}
+
+	// and sessions can't be recovered from one
+	server = raft.NewServer(1, &bytes.Buffer{}, nil, config)
+	server.SetSessions(10)
+	if err := server.SetCheckpointer(fsm); err != raft.ErrCheckpointSessions {
+		t.Errorf("with sessions: expected %v, got %v", raft.ErrCheckpointSessions, err)
+	}
+}
+
+// checkpointFSM is a sumFSM that records the index of each entry it applies
+// with the sum, as a state machine on disk would.
+type checkpointFSM struct {
+	sumFSM
+	index    uint64
+	applies  int
+	restores int
+}
+
+func (f *checkpointFSM) apply(entry raft.LogEntry) ([]byte, error) {
+	n, err := strconv.Atoi(string(entry.Command))
+	if err != nil {
+		return nil, err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.sum += n
+	f.index = entry.Index
+	f.applies++
+	return entry.Command, nil
+}
+
+func (f *checkpointFSM) Checkpoint() (uint64, error) { return f.checkpoint(), nil }
+
+func (f *checkpointFSM) Restore(r io.Reader) error {
+	f.Lock()
+	f.restores++
+	f.Unlock()
+	return f.sumFSM.Restore(r)
+}
+
+func (f *checkpointFSM) checkpoint() uint64 {
+	f.Lock()
+	defer f.Unlock()
+	return f.index
+}
+
+func (f *checkpointFSM) counts() (int, int) {
+	f.Lock()
+	defer f.Unlock()
+	return f.sum, f.applies
+}
+
+func (f *checkpointFSM) restored() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.restores > 0
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/peterbourgon/raft"
+	"io"
+	"sync"
+)
+
+var errNotFound = errors.New("key not found")
+
+// kvCommand is a command to the key-value store, as it's replicated.
+type kvCommand struct {
+	Op    string `json:"op"` // "set" or "delete"
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// kv is an in-memory key-value store, replicated by applying its commands
+// in the order they're committed. It's the server's FSM, so it's snapshotted,
+// and the log compacted behind it.
+type kv struct {
+	sync.RWMutex
+	m map[string]string
+}
+
+func newKV() *kv {
+	return &kv{m: map[string]string{}}
+}
+
+// apply applies a committed command. Malformed commands are rejected, on
+// every server alike, rather than stopping the log.
+func (s *kv) apply(cmd []byte) ([]byte, error) {
+	var c kvCommand
+	if err := json.Unmarshal(cmd, &c); err != nil {
+		return nil, &raft.CommandError{Err: err}
+	}
+	s.Lock()
+	defer s.Unlock()
+	switch c.Op {
+	case "set":
+		s.m[c.Key] = c.Value
+	case "delete":
+		delete(s.m, c.Key)
+	default:
+		return nil, &raft.CommandError{Err: errors.New("unknown op " + c.Op)}
+	}
+	return []byte{}, nil
+}
+
+// get is the server's query function: the query is a key.
+func (s *kv) get(key []byte) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	v, ok := s.m[string(key)]
+	if !ok {
+		return nil, errNotFound
+	}
+	return []byte(v), nil
+}
+
+func (s *kv) Snapshot() (func(io.Writer) error, error) {
+	s.RLock()
+	m := make(map[string]string, len(s.m))
+	for k, v := range s.m {
+		m[k] = v
+	}
+	s.RUnlock()
+	return func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(m)
+	}, nil
+}
+
+func (s *kv) Restore(r io.Reader) error {
+	m := map[string]string{}
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.m = m
+	return nil
+}
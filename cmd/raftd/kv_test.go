@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/peterbourgon/raft"
+	"testing"
+)
+
+func TestKV(t *testing.T) {
+	apply := func(s *kv, c kvCommand) error {
+		cmd, _ := json.Marshal(c)
+		_, err := s.apply(cmd)
+		return err
+	}
+	s := newKV()
+	if err := apply(s, kvCommand{Op: "set", Key: "a", Value: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(s, kvCommand{Op: "set", Key: "b", Value: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(s, kvCommand{Op: "delete", Key: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.get([]byte("a")); err != nil || string(v) != "1" {
+		t.Errorf("a: expected 1, got %q (%v)", v, err)
+	}
+	if _, err := s.get([]byte("b")); err != errNotFound {
+		t.Errorf("b: expected %v, got %v", errNotFound, err)
+	}
+
+	// bad commands are rejected, not fatal
+	if _, err := s.apply([]byte(`{"op": "rename"}`)); err == nil {
+		t.Error("expected an unknown op to be rejected")
+	} else if _, ok := err.(*raft.CommandError); !ok {
+		t.Errorf("expected a CommandError, got %v", err)
+	}
+
+	// a snapshot restores the same state
+	write, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(s, kvCommand{Op: "set", Key: "c", Value: "3"}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := newKV()
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := restored.get([]byte("a")); err != nil || string(v) != "1" {
+		t.Errorf("restored a: expected 1, got %q (%v)", v, err)
+	}
+	if _, err := restored.get([]byte("c")); err != errNotFound {
+		t.Errorf("restored c: expected it to postdate the snapshot, got %v", err)
+	}
+}
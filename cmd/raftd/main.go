@@ -0,0 +1,299 @@
+// Command raftd is a reference server: a replicated, in-memory key-value
+// store, with the raft core, the rafthttp transport, and the raftwal store.
+//
+// To run a three-node cluster on one machine:
+//
+//	peers=1=http://127.0.0.1:8001,2=http://127.0.0.1:8002,3=http://127.0.0.1:8003
+//	raftd -id 1 -listen 127.0.0.1:8001 -dir /tmp/raftd1 -peers $peers &
+//	raftd -id 2 -listen 127.0.0.1:8002 -dir /tmp/raftd2 -peers $peers &
+//	raftd -id 3 -listen 127.0.0.1:8003 -dir /tmp/raftd3 -peers $peers &
+//
+// Each server waits for its peers to come up before it starts. Then, on any
+// of them:
+//
+//	curl -XPUT -d world http://127.0.0.1:8002/kv/hello
+//	curl http://127.0.0.1:8003/kv/hello
+//	curl -XDELETE http://127.0.0.1:8001/kv/hello
+//	curl http://127.0.0.1:8001/raft/leader
+//
+// Writes and reads are forwarded to the leader; reads are linearizable,
+// unless they ask for ?consistency=lease or stale. The raft endpoints,
+// e.g. /raft/stats and /raft/dashboard, are served alongside.
+//
+// A server's log, snapshots, and term and vote are kept in its -dir, so it
+// can be stopped, with SIGINT or SIGTERM, and restarted. With -config, the
+// server's config is read from a JSON file (see raft.LoadConfig), and
+// reloaded on SIGHUP.
+//
+// Two servers can be joined by a witness, which votes, and counts towards a
+// quorum, but keeps no log, so it can run cheaply in a third location. Every
+// process is given the same -witness, as id=url; the one whose -id is the
+// witness's serves only the witness, keeping its state in its -dir:
+//
+//	peers=1=http://127.0.0.1:8001,2=http://127.0.0.1:8002
+//	witness=3=http://127.0.0.1:8003
+//	raftd -id 1 -listen 127.0.0.1:8001 -dir /tmp/raftd1 -peers $peers -witness $witness &
+//	raftd -id 2 -listen 127.0.0.1:8002 -dir /tmp/raftd2 -peers $peers -witness $witness &
+//	raftd -id 3 -listen 127.0.0.1:8003 -dir /tmp/raftd3 -witness $witness &
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/peterbourgon/raft"
+	"github.com/peterbourgon/raft/http"
+	"github.com/peterbourgon/raft/wal"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// KVPath is where the key-value store is served, followed by a key.
+const KVPath = "/kv/"
+
+func main() {
+	var (
+		id         = flag.Uint64("id", 0, "this server's id, greater than 0")
+		listen     = flag.String("listen", "127.0.0.1:8001", "address to serve the raft and key-value endpoints on")
+		dir        = flag.String("dir", "", "directory to keep the log, snapshots and stable state in")
+		peers      = flag.String("peers", "", "every server in the cluster, including this one, as id=url,...")
+		configPath = flag.String("config", "", "JSON file to read the config from, and reload on SIGHUP")
+		witness    = flag.String("witness", "", "the cluster's witness, as id=url; with its id as -id, serve only the witness")
+	)
+	flag.Parse()
+	if *id == 0 || *dir == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var witnessId uint64
+	var witnessURL url.URL
+	if *witness != "" {
+		urls, err := parsePeers("-witness", *witness)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(urls) != 1 {
+			log.Fatal("-witness: expected a single id=url")
+		}
+		for witnessId, witnessURL = range urls {
+		}
+	}
+	if witnessId == *id {
+		serveWitness(*id, *listen, *dir)
+		return
+	}
+	if *peers == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	urls, err := parsePeers("-peers", *peers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := urls[*id]; !ok {
+		log.Fatalf("-peers doesn't include this server, %d", *id)
+	}
+
+	config := raft.Config{HandoffOnStop: true, CheckQuorum: true}
+	if *configPath != "" {
+		if config, err = raft.LoadConfig(*configPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	store, err := raftwal.Open(filepath.Join(*dir, "wal"), 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+	fsm := newKV()
+	server, err := raft.NewServerErr(*id, store, fsm.apply, config)
+	if err != nil {
+		log.Fatalf("recovering the log: %s", err)
+	}
+	server.SetQueryFunc(fsm.get)
+	stable, err := raft.NewFileStableStore(filepath.Join(*dir, "stable"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := server.SetStableStore(stable); err != nil {
+		log.Fatal(err)
+	}
+	snapshots, err := raft.NewFileSnapshotStore(filepath.Join(*dir, "snapshots"), 2)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := server.SetSnapshotStore(snapshots, fsm); err != nil {
+		log.Fatal(err)
+	}
+
+	// Peers learn each other's ids over HTTP, so serve before dialing them.
+	mux := http.NewServeMux()
+	rafthttp.NewServer(server).Install(mux)
+	mux.Handle(KVPath, kvHandler{server})
+	go func() {
+		log.Fatal(http.ListenAndServe(*listen, mux))
+	}()
+
+	members := raft.Peers{*id: raft.NewLocalPeer(server)}
+	for peerId, u := range urls {
+		if peerId != *id {
+			members[peerId] = dial(peerId, u)
+		}
+	}
+	server.SetPeers(members)
+	if witnessId != 0 {
+		server.SetWitness(witnessId, raft.RemoteWitness(dial(witnessId, witnessURL)))
+	}
+	server.Start()
+	if *configPath != "" {
+		server.ReloadOnHangup(*configPath)
+	}
+	log.Printf("raftd %d: serving on %s", *id, *listen)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	server.Stop()
+}
+
+// serveWitness serves a witness, whose state is kept in the dir, until it's
+// interrupted.
+func serveWitness(id uint64, listen, dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	witness, err := raft.NewFileWitness(filepath.Join(dir, "witness"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer witness.Close()
+
+	mux := http.NewServeMux()
+	rafthttp.NewServer(raft.NewWitnessPeer(id, witness)).Install(mux)
+	go func() {
+		log.Fatal(http.ListenAndServe(listen, mux))
+	}()
+	log.Printf("raftd %d: serving the witness on %s", id, listen)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+}
+
+// parsePeers parses a flag listing servers, as id=url,...
+func parsePeers(name, s string) (map[uint64]url.URL, error) {
+	urls := map[uint64]url.URL{}
+	for _, peer := range strings.Split(s, ",") {
+		fields := strings.SplitN(peer, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: %q isn't id=url", name, peer)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("%s: bad id %q", name, fields[0])
+		}
+		u, err := url.Parse(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		urls[id] = *u
+	}
+	return urls, nil
+}
+
+// dial returns a peer for the server at the URL, waiting for it to come up,
+// and checking that it has the expected id.
+func dial(id uint64, u url.URL) raft.Peer {
+	for {
+		peer, err := rafthttp.NewPeer(u)
+		switch {
+		case err != nil:
+			log.Printf("waiting for peer %d at %s: %s", id, u.String(), err)
+		case peer.Id() != id:
+			log.Fatalf("peer at %s has id %d, not %d", u.String(), peer.Id(), id)
+		default:
+			return peer
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// kvHandler serves the key-value store: GET reads a key, and PUT (or POST)
+// and DELETE change it.
+type kvHandler struct {
+	server *raft.Server
+}
+
+func (h kvHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, KVPath)
+	if key == "" {
+		http.Error(w, "no key", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		consistency := raft.Linearizable
+		switch r.URL.Query().Get("consistency") {
+		case "lease":
+			consistency = raft.Lease
+		case "stale":
+			consistency = raft.Stale
+		}
+		value, err := h.server.Query(consistency, []byte(key))
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.Write(value)
+	case "PUT", "POST":
+		value, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.command(w, r, kvCommand{Op: "set", Key: key, Value: string(value)})
+	case "DELETE":
+		h.command(w, r, kvCommand{Op: "delete", Key: key})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// command replicates the command, and waits for it to be applied.
+func (h kvHandler) command(w http.ResponseWriter, r *http.Request, c kvCommand) {
+	cmd, err := json.Marshal(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if _, err := h.server.Apply(ctx, cmd); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// httpError responds with the error, and a status that says whether it's
+// worth retrying.
+func httpError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case err.Error() == errNotFound.Error():
+		status = http.StatusNotFound // it may have come from the leader
+	case err == raft.ErrUnknownLeader || err == raft.ErrNoQuorum || err == raft.ErrTooBusy || err == context.DeadlineExceeded:
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,195 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrNoCommitStream = errors.New("no commit stream")
+	ErrNotDelivered   = errors.New("entry not yet delivered on the commit stream")
+	ErrStreamSessions = errors.New("sessions can't be applied from a commit stream")
+)
+
+// CommittedEntry is a committed command, as delivered on the commit stream.
+// The command is decoded, as an apply function would get it.
+type CommittedEntry struct {
+	Index   uint64
+	Term    uint64
+	Command []byte
+}
+
+// SetCommitStream makes the server deliver committed commands on the chan
+// returned by CommitCh, instead of passing them to an apply function, for
+// applications that consume them on their own schedule, e.g. by feeding them
+// to a downstream queue. Commands are delivered in order, as they commit,
+// ahead of being applied: an entry counts as applied once the application
+// acknowledges it, or a later one, with Acknowledge. Until then, its
+// command's response, which is empty, and queries after it, wait, as they do
+// for entries applied asynchronously (see SetAsyncApply), and the backlog
+// bounds how many committed entries may wait to be acknowledged.
+//
+// An application that keeps what it's acknowledged durable can report it as
+// a Checkpointer, so a restarted server delivers only what comes after. It
+// must be called after SetSessions, and before Start; it fails with
+// ErrStreamSessions if sessions are enabled, as they're applied by the server,
+// not the application. A backlog of zero leaves the stream disabled.
+func (s *Server) SetCommitStream(backlog int) error {
+	if backlog <= 0 {
+		return nil
+	}
+	if s.log.sessions != nil {
+		return ErrStreamSessions
+	}
+	s.SetAsyncApply(backlog)
+	s.log.stream = &commitStream{ch: make(chan CommittedEntry, backlog)}
+	s.log.applyEntry = func(LogEntry) ([]byte, error) {
+		return nil, nil // the application has it, and has acknowledged it
+	}
+	return nil
+}
+
+// CommitCh returns the chan committed commands are delivered on, if the
+// server has a commit stream, or else nil. It's closed when the server stops.
+func (s *Server) CommitCh() <-chan CommittedEntry {
+	if s.log.stream == nil {
+		return nil
+	}
+	return s.log.stream.ch
+}
+
+// Acknowledge tells the server that the application has applied the entries
+// delivered on the commit stream up to and including the index. Earlier
+// acknowledgements are ignored. It fails with ErrNotDelivered if the entry
+// hasn't been delivered yet.
+func (s *Server) Acknowledge(index uint64) error {
+	st := s.log.stream
+	if st == nil {
+		return ErrNoCommitStream
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if index > st.sent {
+		return ErrNotDelivered
+	}
+	if index > st.acked {
+		st.acked = index
+		s.log.applier.wake()
+	}
+	return nil
+}
+
+// commitStream delivers committed commands to the application, which
+// acknowledges them once they're applied. Only the applier sends.
+type commitStream struct {
+	ch    chan CommittedEntry
+	mu    sync.Mutex
+	sent  uint64 // index of the last command delivered
+	acked uint64 // index of the last command acknowledged
+}
+
+func (st *commitStream) indexes() (sent, acked uint64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.sent, st.acked
+}
+
+// applyStream applies the committed entries that have been acknowledged, and
+// those that aren't delivered, like configuration entries, which needn't be,
+// and delivers the commands after them, until it's delivered every command
+// committed, or the log's stopped. Acknowledgements wake it, even while it
+// waits for the application to receive a command.
+func (l *Log) applyStream() error {
+	st, a := l.stream, l.applier
+	for {
+		if err := l.applyAcknowledged(); err != nil {
+			return err
+		}
+		l.runWaiters(nil)
+		entry, ok, err := l.nextUndelivered()
+		if err != nil || !ok {
+			return err
+		}
+		select {
+		case st.ch <- entry:
+			st.mu.Lock()
+			st.sent = entry.Index
+			st.mu.Unlock()
+		case <-a.wakeup:
+		case <-a.quit:
+			return nil
+		}
+	}
+}
+
+// applyAcknowledged applies committed entries after the last one applied, up
+// to the first command that hasn't been acknowledged.
+func (l *Log) applyAcknowledged() error {
+	for {
+		_, acked := l.stream.indexes()
+		l.applyMu.Lock()
+		l.Lock()
+		if l.applied >= l.getCommitIndexWithLock() {
+			l.Unlock()
+			l.applyMu.Unlock()
+			return nil
+		}
+		pos := int(l.applied - l.compactedIndex)
+		if pos < 0 || pos >= len(l.entries) || l.entries[pos].Index != l.applied+1 {
+			l.Unlock()
+			l.applyMu.Unlock()
+			return fmt.Errorf("entry %d isn't in the log", l.applied+1)
+		}
+		entry := l.entries[pos]
+		if entry.Type == EntryCommand && entry.Index > acked {
+			l.Unlock()
+			l.applyMu.Unlock()
+			return nil
+		}
+		err := l.applyCommitted(entry, func(f func()) { f() })
+		l.Unlock()
+		l.applyMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// nextUndelivered returns the first committed command that hasn't been
+// delivered, decoded, if there is one.
+func (l *Log) nextUndelivered() (CommittedEntry, bool, error) {
+	sent, _ := l.stream.indexes()
+	l.RLock()
+	from := sent
+	if l.applied > from {
+		from = l.applied // e.g. a snapshot was restored
+	}
+	var (
+		entry LogEntry
+		found bool
+	)
+	for index := from + 1; index <= l.getCommitIndexWithLock(); index++ {
+		pos := int(index - l.compactedIndex - 1)
+		if pos < 0 || pos >= len(l.entries) {
+			break
+		}
+		if l.entries[pos].Type == EntryCommand {
+			entry, found = l.entries[pos], true
+			break
+		}
+	}
+	l.RUnlock()
+	if !found {
+		return CommittedEntry{}, false, nil
+	}
+	cmd := entry.Command
+	if l.decodeEntry != nil {
+		decoded, err := l.decodeEntry(entry)
+		if err != nil {
+			return CommittedEntry{}, false, err
+		}
+		cmd = decoded
+	}
+	return CommittedEntry{Index: entry.Index, Term: entry.Term, Command: cmd}, true, nil
+}
@@ -0,0 +1,266 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	ErrNoSnapshotStore  = errors.New("no snapshot store")
+	ErrNothingCommitted = errors.New("nothing committed yet")
+)
+
+// FSM is implemented by state machines that can be snapshotted, so the log
+// entries they've applied can be discarded, and a server that's far behind
+// can be caught up without them.
+type FSM interface {
+	// Snapshot captures the state machine's state, as of the last command
+	// applied, and returns a function that writes it. No commands are
+	// applied while Snapshot runs, so it should only capture the state,
+	// e.g. by copying it, or with copy-on-write. The returned function is
+	// called in the background, while commands continue to be applied.
+	Snapshot() (func(io.Writer) error, error)
+
+	// Restore replaces the state machine's state with the snapshot's.
+	Restore(io.Reader) error
+}
+
+// SetSnapshotStore makes the server snapshot the state machine, as the config
+// says, keeping the snapshots in the store, and discarding the log entries
+// they make redundant. It must be called before Start. If the store has a
+// snapshot, the newest is restored to the state machine, unless it's
+// checkpointed past it (see SetCheckpointer), and only the log entries after
+// it are applied as they're committed.
+func (s *Server) SetSnapshotStore(store SnapshotStore, fsm FSM) error {
+	if s.log.sessions != nil {
+		fsm = sessionsFSM{fsm, s.log.sessions}
+	}
+	s.snapshots, s.fsm = &snapshotSwitch{store: store}, fsm
+	snapshots, err := store.List()
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		return nil
+	}
+	return s.restoreSnapshot(snapshots[0].Id)
+}
+
+// restoreSnapshot restores the snapshot with the given id to the state
+// machine and the log, and recovers the membership recorded with it.
+func (s *Server) restoreSnapshot(id string) error {
+	meta, r, err := s.snapshots.Open(id)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	configuration, err := configurationOf(meta)
+	if err != nil {
+		return err
+	}
+	restore := func() error { return s.fsm.Restore(r) }
+	s.log.RLock()
+	checkpoint := s.log.checkpoint
+	s.log.RUnlock()
+	if checkpoint >= meta.Index {
+		restore = func() error { return nil } // the state machine's past it
+	}
+	if err := s.log.restore(meta.Index, meta.Term, configuration, restore); err != nil {
+		return err
+	}
+	if configuration != nil {
+		if err := s.restoreMembership(configuration); err != nil {
+			return err
+		}
+	}
+	s.logGeneric("restored snapshot %s, through index %d", meta.Id, meta.Index)
+	if s.log.skipCheckpointed() {
+		s.logGeneric("the state machine is checkpointed at index %d; applying entries after it", checkpoint)
+	}
+	s.publishStatus()
+	return nil
+}
+
+// snapshotLoop takes a snapshot whenever enough has been committed since the
+// last one, until the server stops.
+func (s *Server) snapshotLoop() {
+	ticker := time.NewTicker(s.config().MinElectionTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !s.log.snapshotDue(s.config().SnapshotThresholdEntries, s.config().SnapshotIntervalBytes) {
+				continue
+			}
+			if _, err := s.takeSnapshot(); err != nil {
+				s.config().logf("id=%d: snapshot: %s", s.id, err)
+			}
+		case <-s.stopped:
+			return
+		}
+	}
+}
+
+// Snapshot snapshots the state machine now, rather than when enough has been
+// committed, e.g. before taking a backup, and returns the snapshot's metadata.
+// If nothing's been committed since the last snapshot, it returns that one.
+func (s *Server) Snapshot() (SnapshotMeta, error) {
+	if s.snapshots == nil {
+		return SnapshotMeta{}, ErrNoSnapshotStore
+	}
+	meta, err := s.takeSnapshot()
+	if err != nil || meta.Id != "" {
+		return meta, err
+	}
+	snapshots, err := s.snapshots.List()
+	if err != nil {
+		return SnapshotMeta{}, err
+	}
+	if len(snapshots) == 0 {
+		return SnapshotMeta{}, ErrNothingCommitted
+	}
+	return snapshots[0], nil
+}
+
+// Restore replaces the state machine's state with the snapshot data read from
+// r, e.g. a backup of another server's, as of the last committed entry. The
+// data is kept in the snapshot store, so it's restored again if the server
+// restarts, and the log entries it replaces are discarded. Nothing's applied
+// to the state machine, nor appended to the log, while Restore runs.
+//
+// Restore only changes this server. Restoring data that differs from the rest
+// of the cluster's state makes this server's state machine diverge from
+// theirs; it's meant for recovering a single server, or seeding a new cluster
+// before anything but its first entries are committed.
+func (s *Server) Restore(r io.Reader) error {
+	if s.snapshots == nil {
+		return ErrNoSnapshotStore
+	}
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+
+	var meta SnapshotMeta
+	err := s.log.replace(func(index, term uint64, configuration []byte) error {
+		if index == 0 {
+			return ErrNothingCommitted
+		}
+		meta = SnapshotMeta{Index: index, Term: term}
+		if err := membershipOf(configuration, &meta); err != nil {
+			return err
+		}
+		sink, err := s.snapshots.Create(meta)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(sink, r); err != nil {
+			sink.Cancel()
+			return err
+		}
+		if err := sink.Close(); err != nil {
+			return err
+		}
+		meta = sink.Meta()
+		_, data, err := s.snapshots.Open(meta.Id)
+		if err != nil {
+			s.snapshots.Delete(meta.Id)
+			return err
+		}
+		defer data.Close()
+		if err := s.fsm.Restore(data); err != nil {
+			s.snapshots.Delete(meta.Id)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.config().logf("id=%d: restored snapshot %s, through index %d", s.id, meta.Id, meta.Index)
+	return nil
+}
+
+// takeSnapshot snapshots the state machine, as of the last command applied,
+// into the snapshot store, and then discards the log entries before it, but
+// for the configured number of trailing entries. It returns a zero meta if
+// nothing's been committed since the last snapshot.
+func (s *Server) takeSnapshot() (SnapshotMeta, error) {
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+
+	index, term, configuration, write, err := s.log.capture(s.fsm.Snapshot)
+	if err != nil || write == nil {
+		return SnapshotMeta{}, err
+	}
+	meta := SnapshotMeta{Index: index, Term: term}
+	if err := membershipOf(configuration, &meta); err != nil {
+		return SnapshotMeta{}, err
+	}
+	sink, err := s.snapshots.Create(meta)
+	if err != nil {
+		return SnapshotMeta{}, err
+	}
+	if err := write(sink); err != nil {
+		sink.Cancel()
+		return SnapshotMeta{}, err
+	}
+	if err := sink.Close(); err != nil {
+		return SnapshotMeta{}, err
+	}
+	meta = sink.Meta()
+	s.config().logf("id=%d: took snapshot %s, through index %d", s.id, meta.Id, meta.Index)
+
+	if trailing := uint64(s.config().SnapshotTrailingEntries); index > trailing {
+		if err := s.log.compact(index - trailing); err != nil {
+			return meta, err
+		}
+	}
+	return meta, nil
+}
+
+// membershipOf records the membership of the configuration change in the
+// snapshot's metadata. A nil configuration records nothing, and the peers
+// the application sets stand.
+func membershipOf(configuration []byte, meta *SnapshotMeta) error {
+	if configuration == nil {
+		return nil
+	}
+	var c configurationChange
+	if err := json.Unmarshal(configuration, &c); err != nil {
+		return err
+	}
+	members := c.Members
+	if c.Bootstrap != nil {
+		members = c.Bootstrap
+	}
+	if members == nil {
+		return nil
+	}
+	meta.Peers, meta.Learners = map[uint64]string{}, map[uint64]string{}
+	for _, m := range members {
+		meta.Peers[m.Id] = m.Address
+	}
+	for _, m := range c.Learners {
+		meta.Learners[m.Id] = m.Address
+	}
+	return nil
+}
+
+// configurationOf returns a configuration change recording the membership in
+// the snapshot's metadata, or nil if it has none.
+func configurationOf(meta SnapshotMeta) ([]byte, error) {
+	if meta.Peers == nil {
+		return nil, nil
+	}
+	c := configurationChange{Members: []member{}, Learners: []member{}}
+	for id, addr := range meta.Peers {
+		c.Members = append(c.Members, member{Id: id, Address: addr})
+	}
+	for id, addr := range meta.Learners {
+		c.Learners = append(c.Learners, member{Id: id, Address: addr})
+	}
+	sortMembers(c.Members)
+	sortMembers(c.Learners)
+	return json.Marshal(c)
+}
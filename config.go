@@ -0,0 +1,212 @@
+package raft
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+)
+
+var (
+	ErrElectionTimeouts = errors.New("maximum election timeout must be >= minimum election timeout")
+	ErrProtocolVersion  = errors.New("unsupported protocol version")
+)
+
+// Config tunes a server. Each field has a default, which is used if the field
+// is zero, so the zero Config is a reasonable one. Every server in a cluster
+// should use the same timeouts.
+type Config struct {
+	// MinElectionTimeout and MaxElectionTimeout bound the random time a
+	// follower waits to hear from the leader, before it calls an election.
+	// They default to 250ms, and twice the minimum.
+	MinElectionTimeout time.Duration
+	MaxElectionTimeout time.Duration
+
+	// MaxElectionBackoff caps the election timeout of a server that keeps
+	// failing to be elected, e.g. because it can't reach a quorum. Each
+	// failure in a row after the first doubles its timeout, up to this, so
+	// it doesn't call election after election; it's reset when the server
+	// wins, or hears from a leader. It defaults to four times the maximum
+	// election timeout; the maximum election timeout itself disables it.
+	MaxElectionBackoff time.Duration
+
+	// HeartbeatInterval is how often the leader sends AppendEntries, even
+	// when it has no entries to send. The spec requires that it be much less
+	// than the election timeout; it defaults to a tenth of the minimum.
+	HeartbeatInterval time.Duration
+
+	// MaxAppendEntries and MaxAppendBytes limit the number of entries in
+	// each AppendEntries, and the bytes of their commands and annotations,
+	// as the log stores them, so a follower far behind is caught up in
+	// several smaller RPCs, sent one after another, rather than one that
+	// overwhelms it, or its transport. An entry larger than MaxAppendBytes
+	// is sent on its own. The defaults, zero, mean no limit.
+	MaxAppendEntries int
+	MaxAppendBytes   int64
+
+	// CommandTimeout is how long the leader waits for a client to receive
+	// the response to its command, under the ResponseTimeout policy, unless
+	// the client submitted it with a context that has a deadline. It
+	// defaults to the maximum election timeout.
+	CommandTimeout time.Duration
+
+	// BeaconInterval is how often the leader emits a LeaderBeacon, while it's
+	// sure it's still the leader. The default, zero, disables beacons.
+	BeaconInterval time.Duration
+
+	// RPCQueueSize is how many inbound AppendEntries, and separately how
+	// many RequestVotes, may wait for the server's main loop. Senders beyond
+	// that wait to be queued. It defaults to 16.
+	RPCQueueSize int
+
+	// CommandQueueSize is how many commands may wait for the server's main
+	// loop. Commands submitted while it's full fail at once with ErrTooBusy,
+	// so clients can shed load, rather than pile up waiting. It defaults to
+	// 256.
+	CommandQueueSize int
+
+	// RPCTimeout bounds how long an inbound RPC waits, queued and being
+	// handled, before it fails with context.DeadlineExceeded. RPCs still
+	// queued when their deadline passes are dropped unhandled, since their
+	// senders have given up on them. It defaults to the minimum election
+	// timeout, after which an answer is of no use.
+	RPCTimeout time.Duration
+
+	// SnapshotThresholdEntries and SnapshotIntervalBytes determine when a
+	// server with a snapshot store snapshots its state machine: once that
+	// many entries, or commands adding up to that many bytes, have been
+	// committed since the last snapshot. Entries default to 8192; bytes, to
+	// no limit.
+	SnapshotThresholdEntries int
+	SnapshotIntervalBytes    int64
+
+	// SnapshotTrailingEntries is how many entries before a snapshot are kept
+	// in the log, so followers just behind can be caught up without being
+	// sent the snapshot. It defaults to 1024.
+	SnapshotTrailingEntries int
+
+	// MembershipChangeInterval is the minimum time between a membership
+	// change taking effect on the leader and the leader accepting the next,
+	// so scripts can't rush the cluster through several changes. The leader
+	// also refuses a change until the last has been applied by every member
+	// it can reach. The default, zero, adds no interval.
+	MembershipChangeInterval time.Duration
+
+	// HandoffOnStop makes a leader that's stopped try to hand leadership to
+	// an up to date follower first, so the cluster isn't left waiting for an
+	// election timeout.
+	HandoffOnStop bool
+
+	// CheckQuorum makes a leader that hasn't reached a quorum of voters for
+	// the minimum election timeout step down, rather than wait, refusing
+	// commands with ErrNoQuorum, for the quorum to return. Its clients then
+	// look for the new leader, which the rest of the cluster is electing.
+	// It also makes servers that have a healthy leader ignore candidates,
+	// besides one the leader hands off to, so that a server returning from a
+	// partition can't depose it.
+	CheckQuorum bool
+
+	// ProtocolVersion is the version of the RPCs the server sends, and of
+	// its handshakes. During a rolling upgrade, it's the version the oldest
+	// server speaks; see the ProtocolVersion const, its default.
+	ProtocolVersion int
+
+	// Logger receives the server's log. It defaults to the standard logger.
+	Logger *log.Logger
+}
+
+const (
+	defaultMinElectionTimeout = 250 * time.Millisecond
+	defaultRPCQueueSize       = 16
+	defaultCommandQueueSize   = 256
+	defaultSnapshotThreshold  = 8192
+	defaultSnapshotTrailing   = 1024
+)
+
+// withDefaults returns the config with the default of each zero field. It
+// panics if the election timeouts are out of order, like NewServer does with
+// an invalid id.
+func (c Config) withDefaults() Config {
+	c, err := c.defaults()
+	if err != nil {
+		panic(err.Error())
+	}
+	return c
+}
+
+// defaults is like withDefaults, but returns ErrElectionTimeouts, or
+// ErrProtocolVersion, instead of panicking.
+func (c Config) defaults() (Config, error) {
+	if c.MinElectionTimeout <= 0 {
+		c.MinElectionTimeout = defaultMinElectionTimeout
+	}
+	if c.MaxElectionTimeout <= 0 {
+		c.MaxElectionTimeout = 2 * c.MinElectionTimeout
+	}
+	if c.MaxElectionTimeout < c.MinElectionTimeout {
+		return c, ErrElectionTimeouts
+	}
+	if c.MaxElectionBackoff <= 0 {
+		c.MaxElectionBackoff = 4 * c.MaxElectionTimeout
+	}
+	if c.HeartbeatInterval <= 0 {
+		c.HeartbeatInterval = c.MinElectionTimeout / 10
+	}
+	if c.CommandTimeout <= 0 {
+		c.CommandTimeout = c.MaxElectionTimeout
+	}
+	if c.RPCQueueSize <= 0 {
+		c.RPCQueueSize = defaultRPCQueueSize
+	}
+	if c.CommandQueueSize <= 0 {
+		c.CommandQueueSize = defaultCommandQueueSize
+	}
+	if c.RPCTimeout <= 0 {
+		c.RPCTimeout = c.MinElectionTimeout
+	}
+	if c.SnapshotThresholdEntries <= 0 {
+		c.SnapshotThresholdEntries = defaultSnapshotThreshold
+	}
+	if c.SnapshotTrailingEntries <= 0 {
+		c.SnapshotTrailingEntries = defaultSnapshotTrailing
+	}
+	if c.ProtocolVersion <= 0 {
+		c.ProtocolVersion = ProtocolVersion
+	}
+	if c.ProtocolVersion < MinProtocolVersion || c.ProtocolVersion > ProtocolVersion {
+		return c, ErrProtocolVersion
+	}
+	return c, nil
+}
+
+// Config returns the server's configuration, with the defaults of the fields
+// that were passed as zero.
+func (s *Server) Config() Config {
+	return s.config()
+}
+
+// config returns the server's current configuration.
+func (s *Server) config() Config {
+	config, _ := s.cfg.Load().(Config)
+	return config
+}
+
+// electionTimeout returns a random election timeout, between the minimum and
+// maximum.
+func (s *Server) electionTimeout() time.Duration {
+	config := s.config()
+	min, max := config.MinElectionTimeout, config.MaxElectionTimeout
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(rand.Int63n(int64(max-min)))
+}
+
+// logf writes to the configured logger.
+func (c Config) logf(format string, args ...interface{}) {
+	if c.Logger == nil {
+		log.Printf(format, args...)
+		return
+	}
+	c.Logger.Printf(format, args...)
+}
@@ -0,0 +1,168 @@
+package raftdiscovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// consulWait is how long a blocking query waits for a change, before
+	// Consul answers with the members as they are.
+	consulWait = 5 * time.Minute
+
+	// consulRetry is how long a watch waits to ask Consul again, after an
+	// error.
+	consulRetry = time.Second
+
+	// The service metadata keys holding a member.
+	metaId      = "raft_id"
+	metaAddress = "raft_address"
+)
+
+// Consul is a Registry backed by a Consul agent's HTTP API. Members are
+// registered as instances of a service, with their id and address in the
+// service's metadata, and watched with blocking queries of the catalog.
+type Consul struct {
+	Agent   string // base URL of the agent, e.g. "http://127.0.0.1:8500"
+	Service string // registered by every member of the cluster
+	Client  *http.Client
+}
+
+// NewConsul returns a Registry that registers members as instances of the
+// named service, with the agent at the given base URL.
+func NewConsul(agent, service string) *Consul {
+	return &Consul{
+		Agent:   agent,
+		Service: service,
+		Client:  &http.Client{Timeout: consulWait + 30*time.Second},
+	}
+}
+
+// serviceId is the id of the member's instance of the service. It's unique
+// to the member, so registering a member again replaces its old address.
+func (c *Consul) serviceId(id uint64) string {
+	return fmt.Sprintf("%s-%d", c.Service, id)
+}
+
+func (c *Consul) Register(ctx context.Context, m Member) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"ID":   c.serviceId(m.Id),
+		"Name": c.Service,
+		"Meta": map[string]string{
+			metaId:      strconv.FormatUint(m.Id, 10),
+			metaAddress: m.Address,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, "PUT", "/v1/agent/service/register", nil, body, nil)
+	return err
+}
+
+func (c *Consul) Deregister(ctx context.Context, id uint64) error {
+	_, err := c.do(ctx, "PUT", "/v1/agent/service/deregister/"+url.PathEscape(c.serviceId(id)), nil, nil, nil)
+	return err
+}
+
+func (c *Consul) Watch(ctx context.Context) (<-chan []Member, error) {
+	members := make(chan []Member)
+	go func() {
+		defer close(members)
+		var index uint64 // of the last answer; 0 answers immediately
+		var last []Member
+		for {
+			m, next, err := c.members(ctx, index)
+			if err != nil {
+				select {
+				case <-time.After(consulRetry):
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+			// The index only ever increases, unless Consul's state is
+			// reset, in which case we must start again from the beginning.
+			if next < index {
+				next = 0
+			}
+			index = next
+			if last != nil && reflect.DeepEqual(m, last) {
+				continue // nothing we care about changed
+			}
+			select {
+			case members <- m:
+				last = m
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return members, nil
+}
+
+// members queries the catalog for the registered members, waiting for a
+// change after the given index. It returns the members, ordered by id, and the
+// index of the answer.
+func (c *Consul) members(ctx context.Context, index uint64) ([]Member, uint64, error) {
+	query := url.Values{}
+	query.Set("index", strconv.FormatUint(index, 10))
+	query.Set("wait", fmt.Sprintf("%ds", int(consulWait.Seconds())))
+	var services []struct {
+		ServiceMeta map[string]string
+	}
+	h, err := c.do(ctx, "GET", "/v1/catalog/service/"+url.PathEscape(c.Service), query, nil, &services)
+	if err != nil {
+		return nil, 0, err
+	}
+	next, _ := strconv.ParseUint(h.Get("X-Consul-Index"), 10, 64)
+
+	members := []Member{}
+	for _, s := range services {
+		id, err := strconv.ParseUint(s.ServiceMeta[metaId], 10, 64)
+		if err != nil || id == 0 {
+			continue // not one of ours
+		}
+		members = append(members, Member{Id: id, Address: s.ServiceMeta[metaAddress]})
+	}
+	sort.Sort(byId(members))
+	return members, next, nil
+}
+
+// do makes a request of the agent, and decodes the response into v, if it
+// isn't nil.
+func (c *Consul) do(ctx context.Context, method, path string, query url.Values, body []byte, v interface{}) (http.Header, error) {
+	u := c.Agent + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("consul: %s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return nil, err
+		}
+	}
+	return resp.Header, nil
+}
@@ -0,0 +1,131 @@
+// Package raftdiscovery assembles Raft clusters from a service discovery
+// registry, like Consul, or DNS, for environments where servers' addresses
+// aren't known in advance.
+// Each server registers its id and address, waits for enough others to do the
+// same to form the cluster, and then follows the registry, so a server that
+// moves to a new address is found there.
+//
+//	registry := raftdiscovery.NewConsul("http://127.0.0.1:8500", "raft")
+//	members, err := raftdiscovery.Await(ctx, registry, self, 3)
+//	if err != nil {
+//		return err
+//	}
+//	// ...construct a peer for each member, SetPeers, and Start...
+//	go raftdiscovery.Follow(ctx, registry, server)
+//
+// Clusters that grow as servers start can use gossip, like memberlist or
+// serf, instead: see Gossip, and Manage, which adds the servers that join.
+package raftdiscovery
+
+import (
+	"context"
+	"errors"
+	"github.com/peterbourgon/raft"
+	"sort"
+	"strings"
+)
+
+var ErrWatchClosed = errors.New("registry watch closed")
+
+// Member is a server as it's registered.
+type Member struct {
+	Id        uint64   `json:"id"`
+	Address   string   `json:"address"`             // in the transport's format, e.g. a rafthttp base URL
+	Addresses []string `json:"addresses,omitempty"` // more, tried after Address
+}
+
+// Registry is a service discovery registry, like Consul.
+type Registry interface {
+	// Register adds the member to the registry, or updates its address.
+	Register(context.Context, Member) error
+
+	// Deregister removes the member with the given id from the registry.
+	Deregister(context.Context, uint64) error
+
+	// Watch sends every registered member, first as soon as it can, and
+	// then whenever they change, until the context is done. Then it closes
+	// the chan. Errors talking to the registry are retried.
+	Watch(context.Context) (<-chan []Member, error)
+}
+
+// Updater is the part of a raft.Server that Follow drives.
+type Updater interface {
+	UpdatePeerAddress(id uint64, addr string) error
+}
+
+// MultiUpdater is implemented by Updaters that can give a peer several
+// addresses, like raft.Server. Follow uses it for members with Addresses.
+type MultiUpdater interface {
+	UpdatePeerAddresses(id uint64, addrs []string) error
+}
+
+// Await registers self, and waits until at least n members, including self,
+// are registered, e.g. the expected size of the cluster. It returns them,
+// ordered by id.
+func Await(ctx context.Context, r Registry, self Member, n int) ([]Member, error) {
+	if err := r.Register(ctx, self); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	members, err := r.Watch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		select {
+		case m, ok := <-members:
+			if !ok {
+				return nil, ErrWatchClosed
+			}
+			if len(m) >= n {
+				sort.Sort(byId(m))
+				return m, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Follow watches the registry, and passes each change of a member's address
+// to the server, until the context is done. Members who aren't peers of the
+// server, or whose peers have no address, are ignored: a new server joins a
+// running cluster through a membership change, not the registry.
+func Follow(ctx context.Context, r Registry, u Updater) error {
+	members, err := r.Watch(ctx)
+	if err != nil {
+		return err
+	}
+	addresses := map[uint64]string{}
+	for m := range members {
+		for _, member := range m {
+			key := strings.Join(append([]string{member.Address}, member.Addresses...), " ")
+			if addresses[member.Id] == key {
+				continue
+			}
+			switch err := update(u, member); err {
+			case nil, raft.ErrUnknownPeer, raft.ErrAddressNotSupported:
+				addresses[member.Id] = key
+			default:
+				// leave it, so we try again next time
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// update passes the member's addresses to the updater. An updater that takes
+// only one address is given the first.
+func update(u Updater, member Member) error {
+	if mu, ok := u.(MultiUpdater); ok && len(member.Addresses) > 0 {
+		return mu.UpdatePeerAddresses(member.Id, append([]string{member.Address}, member.Addresses...))
+	}
+	return u.UpdatePeerAddress(member.Id, member.Address)
+}
+
+type byId []Member
+
+func (a byId) Len() int           { return len(a) }
+func (a byId) Less(i, j int) bool { return a[i].Id < a[j].Id }
+func (a byId) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -0,0 +1,426 @@
+package raftdiscovery_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/peterbourgon/raft"
+	"github.com/peterbourgon/raft/discovery"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConsul(t *testing.T) {
+	agent := newFakeConsul()
+	ts := httptest.NewServer(agent)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// three servers start at once, and find each other
+	results := make(chan []raftdiscovery.Member, 3)
+	for id := uint64(1); id <= 3; id++ {
+		go func(id uint64) {
+			registry := raftdiscovery.NewConsul(ts.URL, "raft")
+			self := raftdiscovery.Member{Id: id, Address: "http://10.0.0." + strconv.FormatUint(id, 10)}
+			members, err := raftdiscovery.Await(ctx, registry, self, 3)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- members
+		}(id)
+	}
+	for i := 0; i < 3; i++ {
+		members := <-results
+		if expected, got := "1=http://10.0.0.1 2=http://10.0.0.2 3=http://10.0.0.3", describe(members); expected != got {
+			t.Errorf("expected %s, got %s", expected, got)
+		}
+	}
+
+	// server 1 follows the registry as server 2 moves
+	registry := raftdiscovery.NewConsul(ts.URL, "raft")
+	updates := &recordingUpdater{updates: make(chan string, 10)}
+	followCtx, stopFollowing := context.WithCancel(ctx)
+	followed := make(chan error)
+	go func() { followed <- raftdiscovery.Follow(followCtx, registry, updates) }()
+	for i := 0; i < 3; i++ {
+		<-updates.updates // the current addresses
+	}
+	if err := registry.Register(ctx, raftdiscovery.Member{Id: 2, Address: "http://10.0.1.2"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-updates.updates:
+		if expected := "2=http://10.0.1.2"; expected != got {
+			t.Errorf("expected %s, got %s", expected, got)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the new address")
+	}
+
+	// leaving changes nobody's address
+	if err := registry.Deregister(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	stopFollowing()
+	if err := <-followed; err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	select {
+	case got := <-updates.updates:
+		t.Errorf("unexpected update %s", got)
+	default:
+	}
+}
+
+func TestDNS(t *testing.T) {
+	resolver := &fakeResolver{
+		srv: []*net.SRV{
+			{Target: "raft-1.raft.example.com.", Port: 8001},
+			{Target: "raft-2.raft.example.com.", Port: 8001},
+			{Target: "raft-3.raft.example.com.", Port: 8001},
+			{Target: "web.example.com.", Port: 80}, // not one of ours
+		},
+		hosts: map[string][]string{
+			"raft-1.example.com": {"10.0.0.1"},
+			"raft-2.example.com": {"10.1.0.2", "10.0.0.2"},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// SRV records list the members, with ids from their names
+	registry := raftdiscovery.NewDNSSRV("raft", "tcp", "raft.example.com")
+	registry.Scheme, registry.Interval, registry.Resolver = "http", time.Millisecond, resolver
+	members, err := raftdiscovery.Await(ctx, registry, raftdiscovery.Member{Id: 1}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "1=http://raft-1.raft.example.com:8001 2=http://raft-2.raft.example.com:8001 3=http://raft-3.raft.example.com:8001", describe(members); expected != got {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	// host names' addresses are looked up, and followed as they change
+	registry = raftdiscovery.NewDNSHosts(map[uint64]string{1: "raft-1.example.com", 2: "raft-2.example.com"}, 9000)
+	registry.Interval, registry.Resolver = time.Millisecond, resolver
+	updates := &recordingMultiUpdater{recordingUpdater{updates: make(chan string, 10)}}
+	go raftdiscovery.Follow(ctx, registry, updates)
+	for _, expected := range []string{"1=10.0.0.1:9000", "2=10.0.0.2:9000,10.1.0.2:9000"} {
+		if got := <-updates.updates; expected != got {
+			t.Errorf("expected %s, got %s", expected, got)
+		}
+	}
+	resolver.set("raft-1.example.com", "10.0.2.1")
+	select {
+	case got := <-updates.updates:
+		if expected := "1=10.0.2.1:9000"; expected != got {
+			t.Errorf("expected %s, got %s", expected, got)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the new address")
+	}
+}
+
+func TestIdFromName(t *testing.T) {
+	for name, expected := range map[string]uint64{
+		"raft-3.raft.example.com": 3,
+		"raft12":                  12,
+		"raft-0.example.com":      0,
+		"raft.example3.com":       0,
+		"":                        0,
+	} {
+		if got, ok := raftdiscovery.IdFromName(name); got != expected || ok != (expected > 0) {
+			t.Errorf("%q: expected %d, got %d (%v)", name, expected, got, ok)
+		}
+	}
+}
+
+func TestManage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server := &fakeMembership{
+		state: raft.Follower,
+		peers: []uint64{1, 2, 3},
+		calls: make(chan string, 100),
+	}
+	gossip := raftdiscovery.NewGossip()
+	for id := uint64(1); id <= 3; id++ {
+		gossip.Join(raftdiscovery.Member{Id: id, Address: "a" + strconv.FormatUint(id, 10)})
+	}
+	done := make(chan error)
+	go func() {
+		done <- raftdiscovery.Manage(ctx, gossip, server, raftdiscovery.ManageOptions{RemoveLeft: true, Interval: 5 * time.Millisecond})
+	}()
+	expect := func(expected string) {
+		t.Helper()
+		select {
+		case got := <-server.calls:
+			if expected != got {
+				t.Fatalf("expected %q, got %q", expected, got)
+			}
+		case <-ctx.Done():
+			t.Fatalf("expected %q, got nothing", expected)
+		}
+	}
+	for id := 1; id <= 3; id++ {
+		expect(fmt.Sprintf("update %d=a%d", id, id))
+	}
+
+	// members that join, gossiping their metadata, or tags, are added by
+	// whichever server is the leader
+	m, err := raftdiscovery.MemberFromMeta(raftdiscovery.Meta(raftdiscovery.Member{Id: 4, Address: "a4"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gossip.Join(m)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case got := <-server.calls:
+		t.Fatalf("a follower proposed %q", got)
+	default:
+	}
+	server.setState(raft.Leader)
+	expect("add 4=a4")
+	expect("update 4=a4") // now that it's a peer
+	m, err = raftdiscovery.MemberFromTags(raftdiscovery.Tags(raftdiscovery.Member{Id: 5, Address: "a5", Addresses: []string{"b5"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gossip.Join(m)
+	expect("add 5=a5")
+	expect("update 5=a5,b5")
+
+	// addresses change
+	gossip.Update(raftdiscovery.Member{Id: 3, Address: "b3"})
+	expect("update 3=b3")
+
+	// members that leave are removed, but never the leader
+	gossip.Leave(raftdiscovery.Member{Id: 1})
+	gossip.Leave(raftdiscovery.Member{Id: 2})
+	expect("remove 2")
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	select {
+	case got := <-server.calls:
+		t.Errorf("unexpected %q", got)
+	default:
+	}
+
+	for _, tags := range []map[string]string{nil, {"raft-id": "one", "raft-address": "a"}, {"raft-id": "1"}} {
+		if _, err := raftdiscovery.MemberFromTags(tags); err != raftdiscovery.ErrNotRaftMember {
+			t.Errorf("%v: expected %v, got %v", tags, raftdiscovery.ErrNotRaftMember, err)
+		}
+	}
+	if _, err := raftdiscovery.MemberFromMeta([]byte("other")); err != raftdiscovery.ErrNotRaftMember {
+		t.Errorf("expected %v, got %v", raftdiscovery.ErrNotRaftMember, err)
+	}
+}
+
+func describe(members []raftdiscovery.Member) string {
+	s := []string{}
+	for _, m := range members {
+		s = append(s, strconv.FormatUint(m.Id, 10)+"="+m.Address)
+	}
+	return strings.Join(s, " ")
+}
+
+// recordingMultiUpdater also records updates with several addresses.
+type recordingMultiUpdater struct {
+	recordingUpdater
+}
+
+func (u *recordingMultiUpdater) UpdatePeerAddresses(id uint64, addrs []string) error {
+	u.updates <- strconv.FormatUint(id, 10) + "=" + strings.Join(addrs, ",")
+	return nil
+}
+
+// fakeResolver answers lookups from its records, which can be changed.
+type fakeResolver struct {
+	sync.Mutex
+	srv   []*net.SRV
+	hosts map[string][]string
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.Lock()
+	defer r.Unlock()
+	return "_" + service + "._" + proto + "." + name, r.srv, nil
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+	ips, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return append([]string{}, ips...), nil
+}
+
+func (r *fakeResolver) set(host string, ips ...string) {
+	r.Lock()
+	defer r.Unlock()
+	r.hosts[host] = ips
+}
+
+type recordingUpdater struct {
+	updates chan string
+}
+
+func (u *recordingUpdater) UpdatePeerAddress(id uint64, addr string) error {
+	u.updates <- strconv.FormatUint(id, 10) + "=" + addr
+	if id == 3 {
+		return raft.ErrUnknownPeer // ignored
+	}
+	return nil
+}
+
+// fakeMembership is a server that records the changes proposed to it, and
+// makes them at once.
+type fakeMembership struct {
+	sync.Mutex
+	state           string
+	peers, learners []uint64
+	calls           chan string
+}
+
+func (f *fakeMembership) setState(state string) {
+	f.Lock()
+	defer f.Unlock()
+	f.state = state
+}
+
+func (f *fakeMembership) Status() raft.Status {
+	f.Lock()
+	defer f.Unlock()
+	return raft.Status{Id: 1, State: f.state, Peers: append([]uint64{}, f.peers...), Learners: append([]uint64{}, f.learners...)}
+}
+
+func (f *fakeMembership) member(id uint64) bool {
+	for _, p := range append(f.Status().Peers, f.Status().Learners...) {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeMembership) UpdatePeerAddress(id uint64, addr string) error {
+	return f.UpdatePeerAddresses(id, []string{addr})
+}
+
+func (f *fakeMembership) UpdatePeerAddresses(id uint64, addrs []string) error {
+	if !f.member(id) {
+		return raft.ErrUnknownPeer
+	}
+	f.calls <- fmt.Sprintf("update %d=%s", id, strings.Join(addrs, ","))
+	return nil
+}
+
+func (f *fakeMembership) AddLearner(id uint64, addr string) error {
+	if f.Status().State != raft.Leader {
+		return raft.ErrNotLeader
+	}
+	f.Lock()
+	f.learners = append(f.learners, id)
+	f.Unlock()
+	f.calls <- fmt.Sprintf("add %d=%s", id, addr)
+	return nil
+}
+
+func (f *fakeMembership) RemovePeer(id uint64, force bool) error {
+	f.Lock()
+	defer f.Unlock()
+	for i, p := range f.peers {
+		if p == id {
+			f.peers = append(f.peers[:i:i], f.peers[i+1:]...)
+			f.calls <- fmt.Sprintf("remove %d", id)
+			return nil
+		}
+	}
+	return raft.ErrUnknownPeer
+}
+
+// fakeConsul implements the parts of the Consul agent API used by
+// raftdiscovery.Consul, including blocking queries.
+type fakeConsul struct {
+	sync.Mutex
+	index    uint64
+	services map[string]map[string]string // service id: meta
+	changed  chan struct{}                // closed, and replaced, on each change
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		index:    1,
+		services: map[string]map[string]string{},
+		changed:  make(chan struct{}),
+	}
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v1/agent/service/register":
+		var service struct {
+			ID   string
+			Meta map[string]string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&service); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.change(func() { c.services[service.ID] = service.Meta })
+
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+		c.change(func() { delete(c.services, id) })
+
+	case r.URL.Path == "/v1/catalog/service/raft":
+		index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+		c.Lock()
+		for index >= c.index {
+			changed := c.changed
+			c.Unlock()
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+			c.Lock()
+		}
+		ids := []string{}
+		for id := range c.services {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		services := []map[string]interface{}{}
+		for _, id := range ids {
+			services = append(services, map[string]interface{}{"ServiceID": id, "ServiceMeta": c.services[id]})
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+		c.Unlock()
+		json.NewEncoder(w).Encode(services)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (c *fakeConsul) change(f func()) {
+	c.Lock()
+	defer c.Unlock()
+	f()
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
@@ -0,0 +1,176 @@
+package raftdiscovery
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDNSInterval is how often a DNS registry looks its members up again,
+// unless it says otherwise.
+const DefaultDNSInterval = 30 * time.Second
+
+// Resolver looks up DNS records. A *net.Resolver is one.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// DNS is a Registry that reads the members from DNS, and looks them up again
+// on an interval, for environments that publish servers there, e.g. a
+// Kubernetes headless service. Either SRV records list the members, or each
+// member has a host name, whose A (or AAAA) records are its addresses.
+//
+// The records are managed elsewhere, so Register and Deregister do nothing;
+// a server that's started registers itself by appearing in DNS.
+type DNS struct {
+	// Service, Proto and Name are the SRV records' name, e.g. "raft",
+	// "tcp", and "raft.default.svc.cluster.local". Each target is a member,
+	// whose id is parsed from the target's name by Id.
+	Service, Proto, Name string
+
+	// Hosts are the host names of the members, by id, if there are no SRV
+	// records. Each address of a host is an address of its member, with
+	// Port.
+	Hosts map[uint64]string
+	Port  int
+
+	// Id returns the id of the member that's the SRV target, or false if
+	// it isn't one. The default is IdFromName.
+	Id func(target string) (uint64, bool)
+
+	// Scheme, if set, makes addresses URLs, e.g. "http" for rafthttp.
+	// Otherwise they're host:port, as rafttcp expects.
+	Scheme string
+
+	// Interval is how often the members are looked up again. The default
+	// is DefaultDNSInterval.
+	Interval time.Duration
+
+	// Resolver looks the records up. The default is net.DefaultResolver.
+	Resolver Resolver
+}
+
+// NewDNSSRV returns a Registry whose members are the targets of the SRV
+// records of the service, e.g. NewDNSSRV("raft", "tcp", "raft.example.com")
+// looks up _raft._tcp.raft.example.com.
+func NewDNSSRV(service, proto, name string) *DNS {
+	return &DNS{Service: service, Proto: proto, Name: name}
+}
+
+// NewDNSHosts returns a Registry whose members have the given host names, by
+// id, and listen on the port.
+func NewDNSHosts(hosts map[uint64]string, port int) *DNS {
+	return &DNS{Hosts: hosts, Port: port}
+}
+
+// IdFromName parses the id of a member from the number at the end of the
+// first label of its name, e.g. 3 from "raft-3.raft.example.com".
+func IdFromName(target string) (uint64, bool) {
+	label := strings.SplitN(target, ".", 2)[0]
+	i := len(label)
+	for i > 0 && label[i-1] >= '0' && label[i-1] <= '9' {
+		i--
+	}
+	id, err := strconv.ParseUint(label[i:], 10, 64)
+	return id, err == nil && id > 0
+}
+
+func (d *DNS) Register(context.Context, Member) error { return nil }
+
+func (d *DNS) Deregister(context.Context, uint64) error { return nil }
+
+func (d *DNS) Watch(ctx context.Context) (<-chan []Member, error) {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = DefaultDNSInterval
+	}
+	members := make(chan []Member)
+	go func() {
+		defer close(members)
+		var last []Member
+		for {
+			m, err := d.members(ctx)
+			if err == nil && (last == nil || !reflect.DeepEqual(m, last)) {
+				select {
+				case members <- m:
+					last = m
+				case <-ctx.Done():
+					return
+				}
+			}
+			// Errors are retried at the next interval, keeping the
+			// members as they were.
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return members, nil
+}
+
+// members looks up the members, ordered by id.
+func (d *DNS) members(ctx context.Context) ([]Member, error) {
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	members := []Member{}
+	if d.Hosts == nil {
+		_, records, err := r.LookupSRV(ctx, d.Service, d.Proto, d.Name)
+		if err != nil {
+			return nil, err
+		}
+		parse := d.Id
+		if parse == nil {
+			parse = IdFromName
+		}
+		seen := map[uint64]int{} // index in members
+		for _, srv := range records {
+			target := strings.TrimSuffix(srv.Target, ".")
+			id, ok := parse(target)
+			if !ok {
+				continue // not one of ours
+			}
+			addr := d.address(target, int(srv.Port))
+			if i, ok := seen[id]; ok {
+				members[i].Addresses = append(members[i].Addresses, addr)
+				continue
+			}
+			seen[id] = len(members)
+			members = append(members, Member{Id: id, Address: addr})
+		}
+	}
+	for id, host := range d.Hosts {
+		ips, err := r.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			continue
+		}
+		sort.Strings(ips)
+		m := Member{Id: id, Address: d.address(ips[0], d.Port)}
+		for _, ip := range ips[1:] {
+			m.Addresses = append(m.Addresses, d.address(ip, d.Port))
+		}
+		members = append(members, m)
+	}
+	sort.Sort(byId(members))
+	return members, nil
+}
+
+// address formats the host and port as the transport expects.
+func (d *DNS) address(host string, port int) string {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if d.Scheme != "" {
+		return d.Scheme + "://" + addr
+	}
+	return addr
+}
@@ -0,0 +1,306 @@
+package raftdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/peterbourgon/raft"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotRaftMember = errors.New("not a raft member")
+
+// The types of MemberEvent.
+const (
+	MemberJoined  = "joined"
+	MemberLeft    = "left"
+	MemberUpdated = "updated" // e.g. its address changed
+)
+
+// DefaultManageInterval is how often Manage reconciles the cluster with the
+// members it's discovered, unless its options say otherwise.
+const DefaultManageInterval = time.Second
+
+// MemberEvent is a change to one member, as gossip protocols report them.
+type MemberEvent struct {
+	Type   string `json:"type"`
+	Member Member `json:"member"`
+}
+
+// Discovery reports members as they join, leave, and change, rather than the
+// whole membership at once, as a Registry does. Gossip is one.
+type Discovery interface {
+	// Events sends each change, in order, until the context is done. Then
+	// it closes the chan.
+	Events(context.Context) (<-chan MemberEvent, error)
+}
+
+// Membership is the part of a raft.Server that Manage drives.
+type Membership interface {
+	Updater
+	Status() raft.Status
+	AddLearner(id uint64, addr string) error
+	RemovePeer(id uint64, force bool) error
+}
+
+// ManageOptions are the options of Manage.
+type ManageOptions struct {
+	// RemoveLeft removes members that leave from the cluster. Gossip can't
+	// tell a server that's left for good from one that's failed, or been
+	// cut off for a while, so it's off by default: removing a server that
+	// returns takes an operator to add it back.
+	RemoveLeft bool
+
+	// Interval is how often the leader proposes the changes it's waiting
+	// to make. The default is DefaultManageInterval.
+	Interval time.Duration
+}
+
+// Manage keeps the cluster's membership in step with the members discovered,
+// until the context is done, for clusters that grow by starting servers,
+// rather than by an operator adding them. Every server runs it, and each
+// passes address changes to its own peers, as Follow does; whichever server
+// is the leader proposes the membership changes. A member that joins, and
+// isn't yet a peer or learner, is added as a learner, and promoted once it's
+// caught up. One that leaves is removed, if the options say so. Changes are
+// made one at a time, and those refused, e.g. as the last is in progress, are
+// proposed again at the next interval, so a new leader takes up where the
+// last left off.
+//
+// A server that joins should be started without peers, and with a dialer, as
+// described at raft.Server.AddLearner.
+func Manage(ctx context.Context, d Discovery, m Membership, opts ManageOptions) error {
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = DefaultManageInterval
+	}
+	events, err := d.Events(ctx)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var (
+		live = map[uint64]Member{} // as discovered
+		left = map[uint64]bool{}   // seen to leave, and not since rejoin
+		sent = map[uint64]string{} // addresses passed to the server
+	)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return ctx.Err()
+			}
+			switch e.Type {
+			case MemberJoined, MemberUpdated:
+				live[e.Member.Id] = e.Member
+				delete(left, e.Member.Id)
+			case MemberLeft:
+				delete(live, e.Member.Id)
+				left[e.Member.Id] = true
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		updateAddresses(m, live, sent)
+		reconcile(m, live, left, opts.RemoveLeft)
+	}
+}
+
+// updateAddresses passes the addresses of the members discovered to the
+// server, unless it's been passed them already. Members who aren't peers are
+// tried again, as they may have been added since.
+func updateAddresses(u Updater, live map[uint64]Member, sent map[uint64]string) {
+	for id, member := range live {
+		key := strings.Join(append([]string{member.Address}, member.Addresses...), " ")
+		if sent[id] == key {
+			continue
+		}
+		switch err := update(u, member); err {
+		case nil, raft.ErrAddressNotSupported:
+			sent[id] = key
+		}
+	}
+}
+
+// reconcile proposes the first change needed to bring the cluster in step
+// with the members discovered, if the server is the leader.
+func reconcile(m Membership, live map[uint64]Member, left map[uint64]bool, removeLeft bool) {
+	status := m.Status()
+	if status.State != raft.Leader {
+		return
+	}
+	members := map[uint64]bool{}
+	for _, id := range status.Peers {
+		members[id] = true
+	}
+	for _, id := range status.Learners {
+		members[id] = true
+	}
+	for _, id := range sortedIds(live) {
+		if !members[id] {
+			m.AddLearner(id, live[id].Address) // if refused, tried again later
+			return
+		}
+	}
+	if !removeLeft {
+		return
+	}
+	for id := range left {
+		if !members[id] || id == status.Id {
+			delete(left, id) // already gone, or us, if we're only cut off
+			continue
+		}
+		if err := m.RemovePeer(id, false); err == nil || err == raft.ErrUnknownPeer {
+			delete(left, id)
+		}
+		return
+	}
+}
+
+func sortedIds(members map[uint64]Member) []uint64 {
+	m := make([]Member, 0, len(members))
+	for _, member := range members {
+		m = append(m, member)
+	}
+	sort.Sort(byId(m))
+	ids := make([]uint64, len(m))
+	for i := range m {
+		ids[i] = m[i].Id
+	}
+	return ids
+}
+
+// Gossip is a Discovery fed by a gossip library, like HashiCorp's memberlist
+// or serf, which this package doesn't depend on. Each server gossips its
+// Member, encoded with Meta, as memberlist's node metadata, or with Tags, as
+// serf's tags, and the library's callbacks pass each member they report to
+// Join, Leave, or Update. For memberlist, that's an EventDelegate like
+//
+//	type events struct{ g *raftdiscovery.Gossip }
+//
+//	func (e events) NotifyJoin(n *memberlist.Node)   { e.notify(e.g.Join, n) }
+//	func (e events) NotifyLeave(n *memberlist.Node)  { e.notify(e.g.Leave, n) }
+//	func (e events) NotifyUpdate(n *memberlist.Node) { e.notify(e.g.Update, n) }
+//
+//	func (e events) notify(f func(raftdiscovery.Member), n *memberlist.Node) {
+//		if m, err := raftdiscovery.MemberFromMeta(n.Meta); err == nil {
+//			f(m)
+//		}
+//	}
+//
+// and for serf, each member of each serf.MemberEvent read from the config's
+// EventCh is passed, after MemberFromTags, to Join for EventMemberJoin, Update
+// for EventMemberUpdate, and Leave for the rest. The callbacks never block.
+type Gossip struct {
+	sync.Mutex
+	queue  []MemberEvent
+	notify chan struct{}
+}
+
+func NewGossip() *Gossip {
+	return &Gossip{notify: make(chan struct{}, 1)}
+}
+
+// Join reports that the member joined.
+func (g *Gossip) Join(m Member) { g.push(MemberEvent{MemberJoined, m}) }
+
+// Leave reports that the member left, or failed.
+func (g *Gossip) Leave(m Member) { g.push(MemberEvent{MemberLeft, m}) }
+
+// Update reports that the member changed, e.g. its address.
+func (g *Gossip) Update(m Member) { g.push(MemberEvent{MemberUpdated, m}) }
+
+func (g *Gossip) push(e MemberEvent) {
+	g.Lock()
+	g.queue = append(g.queue, e)
+	g.Unlock()
+	select {
+	case g.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Events sends the events reported, starting with those reported before it
+// was called, which are queued until then. It should have one caller.
+func (g *Gossip) Events(ctx context.Context) (<-chan MemberEvent, error) {
+	events := make(chan MemberEvent)
+	go func() {
+		defer close(events)
+		for {
+			g.Lock()
+			queue := g.queue
+			g.queue = nil
+			g.Unlock()
+			for _, e := range queue {
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-g.notify:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Meta encodes the member as gossip node metadata, e.g. for memberlist's
+// Delegate.NodeMeta.
+func Meta(m Member) []byte {
+	buf, _ := json.Marshal(m)
+	return buf
+}
+
+// MemberFromMeta decodes a member from node metadata encoded with Meta. It
+// fails with ErrNotRaftMember for nodes that don't gossip one.
+func MemberFromMeta(meta []byte) (Member, error) {
+	var m Member
+	if err := json.Unmarshal(meta, &m); err != nil || m.Id == 0 {
+		return Member{}, ErrNotRaftMember
+	}
+	return m, nil
+}
+
+// The tags Tags sets.
+const (
+	TagId        = "raft-id"
+	TagAddress   = "raft-address"
+	TagAddresses = "raft-addresses" // space separated
+)
+
+// Tags encodes the member as gossip tags, e.g. for serf's Config.Tags. Tags
+// can be merged with the application's own.
+func Tags(m Member) map[string]string {
+	tags := map[string]string{
+		TagId:      strconv.FormatUint(m.Id, 10),
+		TagAddress: m.Address,
+	}
+	if len(m.Addresses) > 0 {
+		tags[TagAddresses] = strings.Join(m.Addresses, " ")
+	}
+	return tags
+}
+
+// MemberFromTags decodes a member from tags set with Tags. It fails with
+// ErrNotRaftMember for nodes that don't have them.
+func MemberFromTags(tags map[string]string) (Member, error) {
+	id, err := strconv.ParseUint(tags[TagId], 10, 64)
+	if err != nil || id == 0 || tags[TagAddress] == "" {
+		return Member{}, ErrNotRaftMember
+	}
+	m := Member{Id: id, Address: tags[TagAddress]}
+	if addrs := tags[TagAddresses]; addrs != "" {
+		m.Addresses = strings.Fields(addrs)
+	}
+	return m, nil
+}
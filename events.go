@@ -0,0 +1,78 @@
+package raft
+
+import (
+	"time"
+)
+
+const (
+	QuorumLost     = "QuorumLost"
+	QuorumRestored = "QuorumRestored"
+
+	// ResponseDropped is emitted when the response to a command couldn't be
+	// delivered to the client, per the ResponsePolicy. The event's Index and
+	// Term identify the command's log entry.
+	ResponseDropped = "ResponseDropped"
+
+	// LeaderBeacon is emitted periodically by the leader, if the config has a
+	// BeaconInterval, asserting that it's still the leader in the event's
+	// Term. The event's Index is the leader's commit index.
+	LeaderBeacon = "LeaderBeacon"
+
+	// Journaled is emitted by every server as it commits a journal entry.
+	// The event's Index is the entry's, and its Data is the entry's data.
+	Journaled = "Journaled"
+)
+
+// Event describes something notable that happened to a server, which an
+// application may want to react to. Events are delivered to the handler
+// installed with SetEventHandler.
+type Event struct {
+	Type  string    `json:"type"`
+	Id    uint64    `json:"id"`   // of the server emitting the event
+	Term  uint64    `json:"term"` // of the server, when the event was emitted
+	Index uint64    `json:"index,omitempty"`
+	Time  time.Time `json:"time"`
+	Data  []byte    `json:"data,omitempty"`
+}
+
+// SetEventHandler installs a function that will be called with every event
+// the server emits. The handler is called synchronously from the server's
+// main loop, so it must not block, or call back into the server. The
+// exceptions are ResponseDropped and ApplyFailed, which may be emitted from
+// another goroutine, and ConfigReloaded, which is emitted from the goroutine
+// calling Reload.
+func (s *Server) SetEventHandler(h func(Event)) {
+	s.eventHandler = h
+}
+
+func (s *Server) emit(typ string) {
+	s.logGeneric("event: %s", typ)
+	if s.eventHandler == nil {
+		return
+	}
+	s.eventHandler(Event{
+		Type: typ,
+		Id:   s.id,
+		Term: s.term,
+		Time: time.Now(),
+	})
+}
+
+// setQuorum records whether or not this server believes a quorum of the
+// cluster is reachable, and emits an event if that belief changed.
+//
+// The leader knows best: it determines quorum from the results of its flushes.
+// A candidate determines it from the number of peers that respond to its vote
+// requests. And a follower assumes the quorum is restored whenever it hears
+// from a leader.
+func (s *Server) setQuorum(ok bool) {
+	if s.noQuorum == !ok {
+		return
+	}
+	s.noQuorum = !ok
+	if ok {
+		s.emit(QuorumRestored)
+	} else {
+		s.emit(QuorumLost)
+	}
+}
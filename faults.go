@@ -0,0 +1,162 @@
+package raft
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var ErrInjectedFault = errors.New("injected storage fault")
+
+// Faults describes the misbehavior a FaultyStore injects into the store it
+// wraps. Rates are probabilities, between 0 and 1, evaluated per operation.
+type Faults struct {
+	ReadLatency  time.Duration // added to every read
+	WriteLatency time.Duration // added to every write
+
+	ReadErrorRate  float64 // reads that fail, reading nothing
+	WriteErrorRate float64 // writes that fail
+
+	// PartialWriteRate is the fraction of failed writes that write a prefix
+	// of the data before failing, as a torn write to a real disk might.
+	PartialWriteRate float64
+
+	// FailWrite, if positive, makes that write fail, counting from when the
+	// faults were set, e.g. 1 for the next. Each entry the log persists is
+	// one write.
+	FailWrite int
+
+	SyncLatency time.Duration // added to every sync
+
+	// LoseUnsynced holds writes back from the wrapped store until they're
+	// synced, so Crash can lose them, as a machine that crashes loses what
+	// it had written but not yet synced to its disk.
+	LoseUnsynced bool
+}
+
+// FaultyStore wraps the store of a server's log, and injects latency and
+// errors into its reads, writes and syncs. It's intended to test how a
+// deployment behaves with a slow or failing disk, before a real one shows
+// you. The faults may be changed at any time, e.g. to simulate a disk that
+// fails and recovers. It's a Syncer, which syncs the wrapped store, if that's
+// a Syncer.
+type FaultyStore struct {
+	sync.Mutex
+	store    io.ReadWriter
+	faults   Faults
+	rand     *rand.Rand
+	writes   int    // since the faults were set
+	unsynced []byte // held back, if the faults say to lose them
+}
+
+// NewFaultyStore returns a FaultyStore wrapping the passed store. The seed
+// determines which operations fail, so failures can be reproduced.
+func NewFaultyStore(store io.ReadWriter, faults Faults, seed int64) *FaultyStore {
+	return &FaultyStore{
+		store:  store,
+		faults: faults,
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetFaults replaces the faults injected into subsequent operations.
+// Writes held back until they're synced are written to the wrapped store,
+// unless the new faults hold them back, too.
+func (s *FaultyStore) SetFaults(faults Faults) error {
+	s.Lock()
+	defer s.Unlock()
+	s.faults, s.writes = faults, 0
+	if faults.LoseUnsynced {
+		return nil
+	}
+	return s.release()
+}
+
+// release writes the writes held back to the wrapped store.
+func (s *FaultyStore) release() error {
+	if len(s.unsynced) == 0 {
+		return nil
+	}
+	_, err := s.store.Write(s.unsynced)
+	s.unsynced = nil
+	return err
+}
+
+// Sync writes any writes held back to the wrapped store, and syncs it, if
+// it's a Syncer, after the faults' SyncLatency.
+func (s *FaultyStore) Sync() error {
+	s.Lock()
+	latency := s.faults.SyncLatency
+	s.Unlock()
+
+	time.Sleep(latency)
+	s.Lock()
+	defer s.Unlock()
+	if err := s.release(); err != nil {
+		return err
+	}
+	if syncer, ok := s.store.(Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// Crash loses the writes held back since the last sync, if the faults say to
+// lose them, and returns how many bytes were lost. A server whose store has
+// crashed should be stopped first, and then replaced by one restarted on the
+// wrapped store, to see that it recovers.
+func (s *FaultyStore) Crash() int {
+	s.Lock()
+	defer s.Unlock()
+	n := len(s.unsynced)
+	s.unsynced = nil
+	return n
+}
+
+func (s *FaultyStore) Read(p []byte) (int, error) {
+	s.Lock()
+	latency, fail := s.faults.ReadLatency, s.rand.Float64() < s.faults.ReadErrorRate
+	s.Unlock()
+
+	time.Sleep(latency)
+	if fail {
+		return 0, ErrInjectedFault
+	}
+	return s.store.Read(p)
+}
+
+func (s *FaultyStore) Write(p []byte) (int, error) {
+	s.Lock()
+	s.writes++
+	latency := s.faults.WriteLatency
+	fail := s.rand.Float64() < s.faults.WriteErrorRate || s.writes == s.faults.FailWrite
+	partial := fail && len(p) > 1 && s.rand.Float64() < s.faults.PartialWriteRate
+	n := 0
+	if partial {
+		n = 1 + s.rand.Intn(len(p)-1) // at least one byte, but not all
+	}
+	s.Unlock()
+
+	time.Sleep(latency)
+	s.Lock()
+	defer s.Unlock()
+	if !fail {
+		return s.write(p)
+	}
+	if n > 0 {
+		n, _ = s.write(p[:n])
+	}
+	return n, ErrInjectedFault
+}
+
+// write writes to the wrapped store, or holds the write back until it's
+// synced.
+func (s *FaultyStore) write(p []byte) (int, error) {
+	if s.faults.LoseUnsynced {
+		s.unsynced = append(s.unsynced, p...)
+		return len(p), nil
+	}
+	return s.store.Write(p)
+}
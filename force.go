@@ -0,0 +1,42 @@
+package raft
+
+import (
+	"fmt"
+)
+
+type forceTuple struct {
+	State string
+	Term  uint64
+	Err   chan error
+}
+
+// force moves the server into the passed state and term at once, as if it had
+// got there by itself, and persists the term. Only the rafttest build calls it;
+// see Force. The term may stay the same, but not go backwards.
+func (s *Server) force(state string, term uint64) error {
+	switch state {
+	case Follower, Candidate, Leader:
+	default:
+		return fmt.Errorf("can't force unknown state %q", state)
+	}
+	if term < s.term || term < s.log.lastTerm() {
+		return ErrTermRegression
+	}
+	s.logGeneric("forced to %s in term %d", state, term)
+	if term > s.term {
+		s.term, s.vote = term, noVote
+	}
+	switch state {
+	case Follower:
+		s.setLeader(unknownLeader)
+	case Candidate:
+		s.vote = noVote // candidateSelect votes for us
+		s.setLeader(unknownLeader)
+	case Leader:
+		s.vote = noVote
+		s.setLeader(s.id)
+	}
+	s.state.Set(state)
+	s.resetElectionTimeout()
+	return s.saveStable()
+}
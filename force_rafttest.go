@@ -0,0 +1,23 @@
+//go:build rafttest
+
+package raft
+
+// Force puts a started server into the passed state, Follower, Candidate or
+// Leader, in the passed term, without an election. It's for tests of
+// transports and state machines that need a server in a particular state:
+// a forced leader replicates to its peers, and a forced candidate calls an
+// election, just as if they'd got there by themselves. The term can't go
+// backwards.
+//
+// Force is only built with the rafttest tag, e.g.
+//
+//	go test -tags rafttest ./...
+func (s *Server) Force(state string, term uint64) error {
+	err := make(chan error)
+	select {
+	case s.forceChan <- forceTuple{state, term, err}:
+	case <-s.stopped:
+		return ErrStopped
+	}
+	return <-err
+}
@@ -0,0 +1,3 @@
+module github.com/peterbourgon/raft
+
+go 1.21
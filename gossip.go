@@ -0,0 +1,101 @@
+package raft
+
+import (
+	"sync"
+	"time"
+)
+
+// SoftState is what a server tells its leader about itself, with each
+// AppendEntries response, so the leader can show operators the whole cluster
+// at once. It's neither persisted, nor used by the protocol.
+type SoftState struct {
+	Applied uint64          `json:"applied"`           // index of the last entry applied
+	Health  map[string]bool `json:"health,omitempty"`  // as set with SetHealth
+	Version int             `json:"version,omitempty"` // of the protocol the server speaks
+}
+
+// PeerState is a server's soft state, as it last reported it to the leader.
+type PeerState struct {
+	SoftState
+	Updated time.Time `json:"updated"`
+}
+
+// SetHealth sets a health flag, which the server reports to its leader with
+// its soft state, e.g. SetHealth("disk", false) when its disk is filling up.
+// It's safe to call at any time. Flags should be few, and their names short,
+// as they're sent with every AppendEntries response.
+func (s *Server) SetHealth(name string, healthy bool) {
+	s.gossip.Lock()
+	defer s.gossip.Unlock()
+	if s.gossip.health == nil {
+		s.gossip.health = map[string]bool{}
+	}
+	s.gossip.health[name] = healthy
+}
+
+// gossip holds our health flags, and, while we're the leader, the soft state
+// our followers have reported.
+type gossip struct {
+	sync.Mutex
+	health map[string]bool
+	peers  map[uint64]PeerState
+}
+
+// softState returns our soft state. It's safe to call from any goroutine.
+func (s *Server) softState() *SoftState {
+	s.gossip.Lock()
+	defer s.gossip.Unlock()
+	state := &SoftState{Applied: s.log.appliedIndex(), Version: s.protocolVersion()}
+	if len(s.gossip.health) > 0 {
+		state.Health = make(map[string]bool, len(s.gossip.health))
+		for name, healthy := range s.gossip.health {
+			state.Health[name] = healthy
+		}
+	}
+	return state
+}
+
+// observe records the soft state a follower reported.
+func (g *gossip) observe(id uint64, state SoftState) {
+	g.Lock()
+	defer g.Unlock()
+	if g.peers == nil {
+		g.peers = map[uint64]PeerState{}
+	}
+	g.peers[id] = PeerState{SoftState: state, Updated: time.Now()}
+}
+
+// reset forgets what followers reported to an earlier leadership.
+func (g *gossip) reset() {
+	g.Lock()
+	defer g.Unlock()
+	g.peers = nil
+}
+
+// cluster returns the soft state of the servers with the passed ids, as
+// they've reported it, and ours, and the spread of their applied indexes.
+func (s *Server) cluster(ids []uint64) (map[uint64]PeerState, uint64) {
+	self := PeerState{SoftState: *s.softState(), Updated: time.Now()}
+
+	s.gossip.Lock()
+	defer s.gossip.Unlock()
+	cluster := map[uint64]PeerState{}
+	min, max := self.Applied, self.Applied
+	for _, id := range ids {
+		state, ok := s.gossip.peers[id]
+		if id == s.id {
+			state, ok = self, true
+		}
+		if !ok {
+			continue
+		}
+		cluster[id] = state
+		if state.Applied < min {
+			min = state.Applied
+		}
+		if state.Applied > max {
+			max = state.Applied
+		}
+	}
+	return cluster, max - min
+}
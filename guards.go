@@ -0,0 +1,26 @@
+package raft
+
+import (
+	"errors"
+	"math"
+)
+
+// Terms and indexes only ever increase. These errors report transitions that
+// would break that, whether they come from a store, or from a server that's
+// been running for a very long time (or a test that starts one at the limit).
+// They're caught where the values cross into the server, so the bad value is
+// never acted on.
+var (
+	ErrTermRegression  = errors.New("term regressed")
+	ErrIndexRegression = errors.New("log index regressed")
+	ErrTermOverflow    = errors.New("term overflowed")
+	ErrIndexOverflow   = errors.New("log index overflowed")
+)
+
+// nextTerm returns the term after the passed one.
+func nextTerm(term uint64) (uint64, error) {
+	if term == math.MaxUint64 {
+		return term, ErrTermOverflow
+	}
+	return term + 1, nil
+}
@@ -0,0 +1,157 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ProtocolVersion and MinProtocolVersion are the newest and oldest versions
+// of the Raft RPCs this package speaks. A server speaks the version in its
+// config, and accepts RPCs in any version it knows, so servers of adjacent
+// releases of the package can run in one network during a rolling upgrade:
+//
+//	version  added                                    speaks
+//	1        the original RPCs                        1
+//	2        versions in RPCs and handshakes          1, 2
+//	3        barrier entries                          1, 2, 3
+//
+// Upgrade every server with its config's ProtocolVersion set to the version
+// the old servers speak, then raise it on each, e.g. with Reload. Servers
+// speaking 1 predate versions, and only accept handshakes of version 1.
+const (
+	ProtocolVersion    = 3
+	MinProtocolVersion = 1
+)
+
+// barrierVersion is the first version whose servers know EntryBarrier; at
+// older versions, barriers are appended as EntryNoop.
+const barrierVersion = 3
+
+var (
+	ErrClusterMismatch = errors.New("cluster ID mismatch")
+	ErrVersionMismatch = errors.New("protocol version mismatch")
+)
+
+// Handshake identifies a server to its peers. Transports should exchange
+// handshakes before a peer participates in a Raft network, so that miswired
+// nodes are rejected with a clear error, rather than a series of strange RPC
+// failures.
+type Handshake struct {
+	Id        uint64 `json:"id"`
+	ClusterId string `json:"cluster_id"`
+	Version   int    `json:"version"` // the version the server speaks
+
+	// MinVersion and MaxVersion are the versions the server accepts, or
+	// zero, from servers that accept only Version.
+	MinVersion int `json:"min_version,omitempty"`
+	MaxVersion int `json:"max_version,omitempty"`
+}
+
+// accepts reports whether the server accepts RPCs of the version.
+func (h Handshake) accepts(version int) bool {
+	min, max := h.versions()
+	return min <= version && version <= max
+}
+
+// versions returns the versions the server accepts.
+func (h Handshake) versions() (int, int) {
+	min, max := h.MinVersion, h.MaxVersion
+	if min == 0 {
+		min = h.Version
+	}
+	if max == 0 {
+		max = h.Version
+	}
+	return min, max
+}
+
+// Handshaker is implemented by peers that can verify a remote handshake.
+type Handshaker interface {
+	Handshake(Handshake) (Handshake, error)
+}
+
+// HandshakeError describes an incompatibility between two handshakes.
+type HandshakeError struct {
+	Err    error // ErrClusterMismatch or ErrVersionMismatch
+	Local  Handshake
+	Remote Handshake
+}
+
+func (e *HandshakeError) Error() string {
+	switch e.Err {
+	case ErrClusterMismatch:
+		return fmt.Sprintf("%s: local server %d is in %q, remote server %d is in %q", e.Err, e.Local.Id, e.Local.ClusterId, e.Remote.Id, e.Remote.ClusterId)
+	case ErrVersionMismatch:
+		localMin, localMax := e.Local.versions()
+		remoteMin, remoteMax := e.Remote.versions()
+		return fmt.Sprintf("%s: local server %d speaks %d, and accepts %d-%d; remote server %d speaks %d, and accepts %d-%d", e.Err, e.Local.Id, e.Local.Version, localMin, localMax, e.Remote.Id, e.Remote.Version, remoteMin, remoteMax)
+	default:
+		return e.Err.Error()
+	}
+}
+
+// CheckHandshake returns a *HandshakeError if the remote handshake isn't
+// compatible with the local one: each server must accept the version the
+// other speaks. An empty cluster ID is compatible with any other cluster ID.
+func CheckHandshake(local, remote Handshake) error {
+	if !local.accepts(remote.Version) || !remote.accepts(local.Version) {
+		return &HandshakeError{ErrVersionMismatch, local, remote}
+	}
+	if local.ClusterId != "" && remote.ClusterId != "" && local.ClusterId != remote.ClusterId {
+		return &HandshakeError{ErrClusterMismatch, local, remote}
+	}
+	return nil
+}
+
+// SetClusterId sets the ID of the Raft network this server belongs to, which
+// it presents to peers during handshakes, and sends with its RPCs. It rejects
+// RPCs from servers in other clusters, whichever transport they arrive on, so
+// a miswired server can't vote in or replicate to this one, even if it never
+// exchanged handshakes. As with handshakes, an empty cluster ID is compatible
+// with any other. It must be called before Start.
+func (s *Server) SetClusterId(id string) {
+	s.clusterId = id
+}
+
+// acceptsCluster reports whether we accept RPCs from a server in the cluster.
+func (s *Server) acceptsCluster(id string) bool {
+	return s.clusterId == "" || id == "" || id == s.clusterId
+}
+
+// Handshake verifies the passed (remote) handshake against this server, and
+// returns this server's handshake. Both are returned, even on error, so the
+// remote side can produce its own diagnostic.
+//
+// This is a public method only to facilitate the construction of peers
+// on arbitrary transports.
+func (s *Server) Handshake(remote Handshake) (Handshake, error) {
+	local := Handshake{
+		Id:         s.id,
+		ClusterId:  s.clusterId,
+		Version:    s.protocolVersion(),
+		MinVersion: MinProtocolVersion,
+		MaxVersion: ProtocolVersion,
+	}
+	return local, CheckHandshake(local, remote)
+}
+
+// protocolVersion returns the version of the RPCs we send.
+func (s *Server) protocolVersion() int {
+	if v := s.config().ProtocolVersion; v > 0 {
+		return v
+	}
+	return ProtocolVersion
+}
+
+// acceptsVersion reports whether we accept RPCs of the version. RPCs from
+// servers that predate versions have none, and are of version 1.
+func acceptsVersion(version int) bool {
+	if version == 0 {
+		version = 1
+	}
+	return MinProtocolVersion <= version && version <= ProtocolVersion
+}
+
+func (p *LocalPeer) Handshake(remote Handshake) (Handshake, error) {
+	return p.server.Handshake(remote)
+}
@@ -0,0 +1,55 @@
+package rafthttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/peterbourgon/raft"
+	"net/http"
+)
+
+// beaconer is implemented by servers that emit leader beacons, like
+// raft.Server.
+type beaconer interface {
+	Beacons() (<-chan raft.Event, func())
+}
+
+// beaconHandler streams the server's leader beacons as server-sent events,
+// each a "beacon" event with the raft.Event as JSON data. Only the leader
+// emits beacons, so a client watching the leader's stream knows to fail over
+// when it falls silent.
+func (s *Server) beaconHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := s.server.(beaconer)
+		if !ok {
+			http.Error(w, "beacons not supported", http.StatusNotImplemented)
+			return
+		}
+		f, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		beacons, unsubscribe := b.Beacons()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		f.Flush()
+		for {
+			select {
+			case e := <-beacons:
+				buf, err := json.Marshal(e)
+				if err != nil {
+					return
+				}
+				if _, err := fmt.Fprintf(w, "event: beacon\ndata: %s\n\n", buf); err != nil {
+					return
+				}
+				f.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package rafthttp
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"mime"
+)
+
+// Codec encodes and decodes the bodies of RPCs between peers. The codec a
+// Peer uses is identified by its ContentType; servers answer with whichever
+// codec the request was made with.
+type Codec interface {
+	ContentType() string
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+var (
+	// JSONCodec is the default codec, readable by humans, and by servers
+	// that predate codec negotiation.
+	JSONCodec Codec = jsonCodec{}
+
+	// GobCodec is a binary codec, which doesn't inflate the (already
+	// opaque) commands in log entries the way JSON's base64 does.
+	GobCodec Codec = gobCodec{}
+)
+
+// codecs are the codecs a server understands.
+var codecs = []Codec{JSONCodec, GobCodec}
+
+// codecFor returns the codec with the given content type, or the JSON codec if
+// the content type is empty or unknown.
+func codecFor(contentType string) Codec {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return JSONCodec
+	}
+	for _, c := range codecs {
+		if c.ContentType() == mediaType {
+			return c
+		}
+	}
+	return JSONCodec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                     { return "application/json" }
+func (jsonCodec) Encode(w io.Writer, v interface{}) error { return json.NewEncoder(w).Encode(v) }
+func (jsonCodec) Decode(r io.Reader, v interface{}) error { return json.NewDecoder(r).Decode(v) }
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string                     { return "application/x-gob" }
+func (gobCodec) Encode(w io.Writer, v interface{}) error { return gob.NewEncoder(w).Encode(v) }
+func (gobCodec) Decode(r io.Reader, v interface{}) error { return gob.NewDecoder(r).Decode(v) }
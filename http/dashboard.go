@@ -0,0 +1,161 @@
+package rafthttp
+
+import (
+	"encoding/json"
+	"github.com/peterbourgon/raft"
+	"html/template"
+	"net/http"
+)
+
+// statuser is implemented by servers that can report their status, like
+// raft.Server.
+type statuser interface {
+	Status() raft.Status
+}
+
+// statusHandler serves the server's status as JSON.
+func (s *Server) statusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.server.(statuser)
+		if !ok {
+			http.Error(w, "status not supported", http.StatusNotImplemented)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(st.Status()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// statser is implemented by servers that can report their status flattened
+// into strings, like raft.Server.
+type statser interface {
+	Stats() map[string]string
+}
+
+// statsHandler serves the server's stats as a JSON object of strings.
+func (s *Server) statsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.server.(statser)
+		if !ok {
+			http.Error(w, "stats not supported", http.StatusNotImplemented)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(st.Stats()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// replicator is implemented by servers that report how far the leader has
+// replicated its log to each follower, like raft.Server.
+type replicator interface {
+	ReplicationStatus() map[uint64]raft.PeerProgress
+}
+
+// Membership is the body served at PeersPath.
+type Membership struct {
+	Peers    []uint64 `json:"peers"` // voting members, including the server
+	Learners []uint64 `json:"learners"`
+	Witness  bool     `json:"witness,omitempty"`
+
+	// Progress is how far the leader has replicated its log to each
+	// follower. Only the leader knows it.
+	Progress map[uint64]raft.PeerProgress `json:"progress,omitempty"`
+}
+
+// peersHandler serves the server's current membership, as it sees it.
+func (s *Server) peersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.server.(statuser)
+		if !ok {
+			http.Error(w, "status not supported", http.StatusNotImplemented)
+			return
+		}
+		status := st.Status()
+		m := Membership{Peers: status.Peers, Learners: status.Learners, Witness: status.Witness}
+		if rs, ok := s.server.(replicator); ok {
+			m.Progress = rs.ReplicationStatus()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(m); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// LeaderInfo is the body served at LeaderPath.
+type LeaderInfo struct {
+	Id      uint64 `json:"id"`                // 0 if unknown
+	Address string `json:"address,omitempty"` // if known, and it's not the server itself
+	Self    bool   `json:"self"`              // the server is the leader
+}
+
+// leaderHandler serves who the server believes is the leader.
+func (s *Server) leaderHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l, ok := s.server.(leaderer)
+		if !ok {
+			http.Error(w, "leader not supported", http.StatusNotImplemented)
+			return
+		}
+		id, addr := l.Leader()
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(LeaderInfo{Id: id, Address: addr, Self: id != 0 && id == s.server.Id()}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// dashboardHandler serves the server's status as a single HTML page, which
+// refreshes itself, for a quick look at a server without any other tooling.
+// It only observes: there's nothing on the page that changes the server.
+func (s *Server) dashboardHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.server.(statuser)
+		if !ok {
+			http.Error(w, "status not supported", http.StatusNotImplemented)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboard.Execute(w, st.Status()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+var dashboard = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="2">
+<title>raft {{.Id}}: {{.State}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.25em 1em 0.25em 0; }
+th { color: #666; font-weight: normal; }
+.Leader { color: #080; }
+.Candidate { color: #a60; }
+</style>
+</head>
+<body>
+<h1>raft server {{.Id}}</h1>
+<table>
+<tr><th>state</th><td class="{{.State}}">{{.State}}</td></tr>
+<tr><th>term</th><td>{{.Term}}</td></tr>
+<tr><th>leader</th><td>{{if .Leader}}{{.Leader}}{{else}}unknown{{end}}</td></tr>
+<tr><th>log</th><td>last index {{.LastIndex}} (term {{.LastTerm}}), committed {{.CommitIndex}}</td></tr>
+<tr><th>snapshot</th><td>{{if .Snapshot}}through {{.Snapshot}}, compacted through {{.CompactedIndex}}{{else}}none{{end}}</td></tr>
+{{if not .LastContact.IsZero}}<tr><th>last contact</th><td>{{.LastContact.Format "15:04:05.000"}}</td></tr>{{end}}
+<tr><th>peers</th><td>{{range $i, $id := .Peers}}{{if $i}}, {{end}}{{$id}}{{else}}none{{end}}</td></tr>
+<tr><th>learners</th><td>{{range $i, $id := .Learners}}{{if $i}}, {{end}}{{$id}}{{else}}none{{end}}</td></tr>
+<tr><th>lag</th><td>{{.Lag.Last}} entries (max {{.Lag.Max}})</td></tr>
+<tr><th>elections</th><td>{{.Elections.Won}} won, {{.Elections.Lost}} lost, {{.Elections.Abandoned}} abandoned{{if .Elections.Failing}} ({{.Elections.Failing}} failed in a row){{end}}</td></tr>
+{{if .Cluster}}<tr><th>applied</th><td>{{range $id, $p := .Cluster}}{{$id}}: {{$p.Applied}}{{range $name, $ok := $p.Health}}{{if not $ok}} ({{$name}} unhealthy){{end}}{{end}}<br>{{end}}spread {{.AppliedSpread}}</td></tr>{{end}}
+</table>
+</body>
+</html>
+`))
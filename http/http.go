@@ -2,22 +2,53 @@ package rafthttp
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/peterbourgon/raft"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	IdPath            = "/raft/id"
-	AppendEntriesPath = "/raft/appendentries"
-	RequestVotePath   = "/raft/requestvote"
-	CommandPath       = "/raft/command"
+	IdPath              = "/raft/id"
+	AppendEntriesPath   = "/raft/appendentries"
+	RequestVotePath     = "/raft/requestvote"
+	CommandPath         = "/raft/command"
+	HandshakePath       = "/raft/handshake"
+	QueryPath           = "/raft/query"
+	StatusPath          = "/raft/status"
+	StatsPath           = "/raft/stats"
+	PeersPath           = "/raft/peers"
+	LeaderPath          = "/raft/leader"
+	DashboardPath       = "/raft/dashboard"
+	OperationPath       = "/raft/operations/" // followed by the id of an async command
+	ProbePath           = "/raft/probe"
+	BeaconPath          = "/raft/beacons"
+	InstallSnapshotPath = "/raft/installsnapshot" // in chunks; see Peer.InstallSnapshotContext
 )
 
+// AnnotationsHeader carries the annotations of a command, as a query string,
+// e.g. "auth%2Fprincipal=alice". Middleware in front of a server can set it,
+// e.g. to the principal it authenticated; it should strip whatever clients
+// send in namespaces it owns.
+const AnnotationsHeader = "Raft-Annotations"
+
+// GroupHeader carries the id of the group a request is for, when a process
+// hosts many, with a MultiServer. Peers with a Group in their options set it.
+const GroupHeader = "Raft-Group"
+
+var ErrNoClientCAs = errors.New("TLS config has no client CAs")
+
 var (
 	emptyAppendEntriesResponse bytes.Buffer
 	emptyRequestVoteResponse   bytes.Buffer
@@ -28,94 +59,575 @@ func init() {
 	json.NewEncoder(&emptyRequestVoteResponse).Encode(raft.RequestVoteResponse{})
 }
 
+const (
+	// DefaultTimeout bounds each attempt of an RPC to a remote server, unless
+	// PeerOptions say otherwise, so a hung server can't hold a connection (and
+	// the goroutine waiting on it) forever.
+	DefaultTimeout = 2 * time.Second
+
+	// DefaultRetries is how many times a failed idempotent RPC is retried,
+	// unless PeerOptions say otherwise.
+	DefaultRetries = 2
+
+	// maxIdleConnsPerHost is the number of keep-alive connections a peer's
+	// default transport keeps to each remote server. The leader may have a
+	// heartbeat, a forwarded command, and a query in flight at once.
+	maxIdleConnsPerHost = 8
+)
+
 type Peer struct {
-	id  uint64
-	url url.URL
+	sync.RWMutex
+	id            uint64
+	url           url.URL      // the one of urls in use
+	urls          []url.URL    // of the remote server, tried in turn
+	client        *http.Client // for RPCs, with a timeout per attempt
+	commandClient *http.Client // for commands, which wait until they commit
+	retries       int
+	codec         Codec
+	rtt           time.Duration // moving average, of successful RPCs
+	chunkSize     int           // of snapshots
+	snapshotRate  int64         // bytes per second, if limited
+	backoff       raft.Backoff
+}
+
+// PeerOptions configures how a Peer connects to the remote server.
+type PeerOptions struct {
+	// TLSConfig is used for https URLs. To be accepted as a cluster member
+	// by a server using ServeTLS, it must carry a client certificate signed
+	// by one of that server's ClientCAs.
+	TLSConfig *tls.Config
+
+	// Codec encodes RPCs to the remote server. The default is JSONCodec.
+	Codec Codec
+
+	// Client, if set, makes all requests to the remote server, and TLSConfig
+	// is ignored. By default, peers share a transport that keeps a few
+	// keep-alive connections open to each remote server.
+	Client *http.Client
+
+	// Timeout bounds each attempt of an RPC, other than Command. The default
+	// is DefaultTimeout; a negative timeout means none.
+	Timeout time.Duration
+
+	// Retries is how many times a failed AppendEntries, RequestVote or
+	// handshake is retried, after waiting as the Backoff says. Those RPCs
+	// are idempotent, so a retry is always safe. Only network errors and 5xx
+	// responses are retried. The default is DefaultRetries; a negative value
+	// means none.
+	Retries int
+
+	// Backoff decides how long to wait between retries. 5xx responses are
+	// raft.ErrorServer errors. The default is raft.DefaultBackoff.
+	Backoff raft.Backoff
+
+	// SnapshotChunkSize is the size of the chunks snapshots are sent in. The
+	// default is DefaultSnapshotChunkSize.
+	SnapshotChunkSize int
+
+	// SnapshotRate limits the rate snapshots are sent at, in bytes per
+	// second, so catching up a follower doesn't starve the cluster's other
+	// traffic. It's per peer; raft.Server.SetSnapshotRate caps all of a
+	// leader's snapshots together. By default, it's unlimited.
+	SnapshotRate int64
+
+	// Group, if set, is the group of the remote server, which hosts many
+	// with a MultiServer. Every request carries it, in the GroupHeader.
+	Group uint64
+
+	// Addresses are more base URLs of the remote server, e.g. on other
+	// networks. When it can't be reached at one, the peer moves on to the
+	// next, after the URL it was created with.
+	Addresses []url.URL
+}
+
+// defaultTransport is shared by peers without a TLSConfig, so connections to
+// the same remote server are pooled between them.
+var defaultTransport = newTransport(nil)
+
+func newTransport(config *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+		TLSClientConfig:     config,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+// clients returns the client for RPCs, which times out, and the one for
+// commands, which doesn't. They share a transport, and so connections.
+func (o PeerOptions) clients() (rpc, command *http.Client) {
+	switch {
+	case o.Client != nil:
+		command = o.Client
+	case o.TLSConfig != nil:
+		command = &http.Client{Transport: newTransport(o.TLSConfig)}
+	default:
+		command = &http.Client{Transport: defaultTransport}
+	}
+
+	if o.Group > 0 {
+		transport := command.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		grouped := *command
+		grouped.Transport = groupTransport{group: strconv.FormatUint(o.Group, 10), transport: transport}
+		command = &grouped
+	}
+
+	timeout := o.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	rpc = &http.Client{}
+	*rpc = *command
+	if timeout > 0 {
+		rpc.Timeout = timeout
+	}
+	return rpc, command
+}
+
+// groupTransport sets the GroupHeader of every request, including those that
+// follow redirects.
+type groupTransport struct {
+	group     string
+	transport http.RoundTripper
+}
+
+func (t groupTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context()) // a RoundTripper mustn't modify the request
+	req.Header.Set(GroupHeader, t.group)
+	return t.transport.RoundTrip(req)
+}
+
+func (o PeerOptions) retries() int {
+	switch {
+	case o.Retries < 0:
+		return 0
+	case o.Retries == 0:
+		return DefaultRetries
+	}
+	return o.Retries
+}
+
+// newPeer returns a peer for the remote server at the URL, and the options'
+// addresses, without an ID.
+func newPeer(u url.URL, o PeerOptions) *Peer {
+	urls := append([]url.URL{u}, o.Addresses...)
+	for i := range urls {
+		urls[i].Path = ""
+	}
+	client, commandClient := o.clients()
+	return &Peer{
+		url:           urls[0],
+		urls:          urls,
+		client:        client,
+		commandClient: commandClient,
+		retries:       o.retries(),
+		codec:         o.Codec,
+		chunkSize:     o.SnapshotChunkSize,
+		snapshotRate:  o.SnapshotRate,
+		backoff:       o.Backoff,
+	}
 }
 
 func NewPeer(u url.URL) (*Peer, error) {
-	u.Path = ""
+	return NewPeerWithOptions(u, PeerOptions{})
+}
 
-	idUrl := u
-	idUrl.Path = IdPath
-	resp, err := http.Get(idUrl.String())
+// NewPeerWithOptions is like NewPeer, with the passed options.
+func NewPeerWithOptions(u url.URL, o PeerOptions) (*Peer, error) {
+	p := newPeer(u, o)
+	var id uint64
+	var err error
+	for range p.urls {
+		if id, err = p.fetchId(); err == nil {
+			break
+		}
+		p.failover(p.url)
+	}
 	if err != nil {
 		return nil, err
 	}
+	p.id = id
+	return p, nil
+}
+
+// fetchId asks the remote server for its ID.
+func (p *Peer) fetchId() (uint64, error) {
+	idUrl := p.url
+	idUrl.Path = IdPath
+	resp, err := p.client.Get(idUrl.String())
+	if err != nil {
+		return 0, err
+	}
 	defer resp.Body.Close()
 
 	buf, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	id, err := strconv.ParseUint(string(buf), 10, 64)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	if id <= 0 {
-		return nil, fmt.Errorf("invalid peer ID %d", id)
+		return 0, fmt.Errorf("invalid peer ID %d", id)
 	}
+	return id, nil
+}
 
-	return &Peer{
-		id:  id,
-		url: u,
-	}, nil
+// NewVerifiedPeer is like NewPeer, but instead of simply asking for the remote
+// server's ID, it exchanges handshakes with it. If either side finds the other
+// incompatible (e.g. a different cluster ID or protocol version) an error
+// describing the mismatch is returned, and no peer is created. The handshake
+// also seeds the estimate of the round-trip time to the remote server.
+func NewVerifiedPeer(u url.URL, local raft.Handshake) (*Peer, error) {
+	return NewVerifiedPeerWithOptions(u, local, PeerOptions{})
+}
+
+// NewVerifiedPeerWithOptions is like NewVerifiedPeer, with the passed options.
+func NewVerifiedPeerWithOptions(u url.URL, local raft.Handshake, o PeerOptions) (*Peer, error) {
+	p := newPeer(u, o)
+	var resp handshakeResponse
+	if err := p.rpc(context.Background(), local, HandshakePath, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("handshake rejected by %s: %s", u.String(), resp.Error)
+	}
+	if err := raft.CheckHandshake(local, resp.Handshake); err != nil {
+		return nil, err
+	}
+	if resp.Handshake.Id <= 0 {
+		return nil, fmt.Errorf("invalid peer ID %d", resp.Handshake.Id)
+	}
+
+	p.id = resp.Handshake.Id
+	return p, nil
 }
 
 func (p *Peer) Id() uint64 { return p.id }
 
+// Address returns the base URL of the remote server.
+func (p *Peer) Address() string {
+	p.RLock()
+	defer p.RUnlock()
+	return p.url.String()
+}
+
+// SetAddress changes the base URL of the remote server. RPCs already in flight
+// complete against the old URL; subsequent RPCs use the new one.
+func (p *Peer) SetAddress(addr string) error {
+	return p.SetAddresses([]string{addr})
+}
+
+// Addresses returns the base URLs of the remote server, in the order they're
+// tried.
+func (p *Peer) Addresses() []string {
+	p.RLock()
+	defer p.RUnlock()
+	addrs := make([]string, len(p.urls))
+	for i, u := range p.urls {
+		addrs[i] = u.String()
+	}
+	return addrs
+}
+
+// SetAddresses changes the base URLs of the remote server, which are tried in
+// turn, starting with the first, like SetAddress.
+func (p *Peer) SetAddresses(addrs []string) error {
+	if len(addrs) == 0 {
+		return errors.New("no peer addresses")
+	}
+	urls := make([]url.URL, len(addrs))
+	for i, addr := range addrs {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid peer address %q", addr)
+		}
+		u.Path = ""
+		urls[i] = *u
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.url, p.urls = urls[0], urls
+	return nil
+}
+
+// failover moves on to the next of the remote server's URLs, after it couldn't
+// be reached at the given one, unless another RPC already has.
+func (p *Peer) failover(failed url.URL) {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.urls) < 2 || p.url.Scheme != failed.Scheme || p.url.Host != failed.Host {
+		return
+	}
+	for i, u := range p.urls {
+		if u == p.url {
+			p.url = p.urls[(i+1)%len(p.urls)]
+			return
+		}
+	}
+}
+
+// RoundTripTime returns the moving average of the round-trip time of the RPCs
+// made to the remote server, or zero if none have succeeded yet. Command RPCs
+// aren't measured, as they include the time to commit the command.
+func (p *Peer) RoundTripTime() time.Duration {
+	p.RLock()
+	defer p.RUnlock()
+	return p.rtt
+}
+
+func (p *Peer) observe(rtt time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	if p.rtt == 0 {
+		p.rtt = rtt
+		return
+	}
+	p.rtt += (rtt - p.rtt) / 8
+}
+
 func (p *Peer) AppendEntries(ae raft.AppendEntries) raft.AppendEntriesResponse {
-	var aer raft.AppendEntriesResponse
-	p.rpc(ae, AppendEntriesPath, &aer)
+	aer, _ := p.AppendEntriesContext(context.Background(), ae)
 	return aer
 }
 
 func (p *Peer) RequestVote(rv raft.RequestVote) raft.RequestVoteResponse {
-	var rvr raft.RequestVoteResponse
-	p.rpc(rv, RequestVotePath, &rvr)
+	rvr, _ := p.RequestVoteContext(context.Background(), rv)
 	return rvr
 }
 
+// AppendEntriesContext is like AppendEntries, but abandons the request, and
+// any retries, when the context is done.
+func (p *Peer) AppendEntriesContext(ctx context.Context, ae raft.AppendEntries) (raft.AppendEntriesResponse, error) {
+	var aer raft.AppendEntriesResponse
+	err := p.rpc(ctx, ae, AppendEntriesPath, &aer)
+	return aer, err
+}
+
+// RequestVoteContext is like RequestVote, but abandons the request, and any
+// retries, when the context is done.
+func (p *Peer) RequestVoteContext(ctx context.Context, rv raft.RequestVote) (raft.RequestVoteResponse, error) {
+	var rvr raft.RequestVoteResponse
+	err := p.rpc(ctx, rv, RequestVotePath, &rvr)
+	return rvr, err
+}
+
+// Probe asks the remote server whether it's still the leader.
+func (p *Peer) Probe(ctx context.Context) (raft.ProbeResponse, error) {
+	var resp raft.ProbeResponse
+	err := p.rpc(ctx, struct{}{}, ProbePath, &resp)
+	return resp, err
+}
+
+// Command forwards the command to the remote server. Commands and their
+// responses are opaque, so they're sent as-is, regardless of the codec. If the
+// remote server isn't the leader, and redirects to it, the redirect is
+// followed. If the command fails, the response chan is closed without a
+// response.
 func (p *Peer) Command(cmd []byte, response chan []byte) error {
+	return p.CommandAnnotated(cmd, nil, response)
+}
+
+// CommandAnnotated is like Command, but the command carries annotations, in
+// the AnnotationsHeader; see raft.WithAnnotations.
+func (p *Peer) CommandAnnotated(cmd []byte, annotations map[string]string, response chan []byte) error {
 	go func() {
-		var responseBuf bytes.Buffer
-		p.rpc(cmd, CommandPath, &responseBuf)
-		response <- responseBuf.Bytes()
+		p.RLock()
+		u := p.url
+		p.RUnlock()
+		u.Path = CommandPath
+
+		client := p.commandClient
+		if client == nil {
+			client = http.DefaultClient
+		}
+		req, err := http.NewRequest("POST", u.String(), bytes.NewReader(cmd))
+		if err != nil {
+			close(response)
+			return
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		if len(annotations) > 0 {
+			values := url.Values{}
+			for k, v := range annotations {
+				values.Set(k, v)
+			}
+			req.Header.Set(AnnotationsHeader, values.Encode())
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			close(response)
+			return
+		}
+		defer resp.Body.Close()
+		buf, err := ioutil.ReadAll(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			close(response)
+			return
+		}
+		response <- buf
 	}()
-	return nil // TODO could make this smarter (i.e. timeout), with more work
+	return nil
+}
+
+// Query sends the query to the remote server, which answers it (or forwards it
+// to the leader) according to the consistency level.
+func (p *Peer) Query(c raft.Consistency, query []byte) ([]byte, error) {
+	p.RLock()
+	u := p.url
+	p.RUnlock()
+	u.Path = QueryPath
+	u.RawQuery = url.Values{"consistency": {c.String()}}.Encode()
+
+	resp, err := p.httpClient().Post(u.String(), "application/octet-stream", bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, queryError(strings.TrimSpace(string(buf)))
+	}
+	return buf, nil
+}
+
+// queryErrors are the errors a query handler may report, which clients can
+// recognize by their text.
+var queryErrors = []error{
+	raft.ErrInvalidConsistency,
+	raft.ErrNoQueryFunc,
+	raft.ErrQueryNotSupported,
+	raft.ErrUnknownLeader,
+	raft.ErrNoQuorum,
+	raft.ErrQuorumLost,
+	raft.ErrDeposed,
+}
+
+func queryError(msg string) error {
+	for _, err := range queryErrors {
+		if msg == err.Error() {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
+
+func (p *Peer) httpClient() *http.Client {
+	if p.client == nil {
+		return http.DefaultClient
+	}
+	return p.client
 }
 
-func (p *Peer) rpc(request interface{}, path string, response interface{}) error {
+// rpc makes an idempotent RPC, retrying it if it fails in a way that another
+// attempt might not.
+func (p *Peer) rpc(ctx context.Context, request interface{}, path string, response interface{}) error {
+	codec := p.codec
+	if codec == nil {
+		codec = JSONCodec
+	}
 	body := &bytes.Buffer{}
-	if err := json.NewEncoder(body).Encode(request); err != nil {
+	if err := codec.Encode(body, request); err != nil {
 		return err
 	}
 
+	for attempt := 0; ; attempt++ {
+		retry, err := p.attempt(ctx, codec, body.Bytes(), path, response)
+		if err == nil || !retry || attempt >= p.retries {
+			return err
+		}
+		if err := p.wait(ctx, attempt+1, err); err != nil {
+			return err
+		}
+	}
+}
+
+// wait waits before the given retry, after the error, as the backoff says.
+func (p *Peer) wait(ctx context.Context, retry int, err error) error {
+	b := p.backoff
+	if b == nil {
+		b = raft.DefaultBackoff
+	}
+	class := raft.ErrorClassOf(err)
+	if _, ok := err.(statusError); ok {
+		class = raft.ErrorServer
+	}
+	select {
+	case <-time.After(b.Delay(retry, class)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// statusError is an unsuccessful HTTP status.
+type statusError int
+
+func (e statusError) Error() string { return fmt.Sprintf("HTTP %d", int(e)) }
+
+// attempt makes a single attempt at an RPC. It reports whether a failure is
+// worth retrying: network errors and server errors are, but e.g. a refusal
+// isn't.
+func (p *Peer) attempt(ctx context.Context, codec Codec, body []byte, path string, response interface{}) (bool, error) {
+	p.RLock()
 	url := p.url
+	p.RUnlock()
 	url.Path = path
-	resp, err := http.Post(url.String(), "application/json", body)
+	req, err := http.NewRequestWithContext(ctx, "POST", url.String(), bytes.NewReader(body))
 	if err != nil {
-		return err
+		return false, err
+	}
+	req.Header.Set("Content-Type", codec.ContentType())
+	began := time.Now()
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			p.failover(url)
+		}
+		return ctx.Err() == nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP %d", resp.StatusCode)
+		io.Copy(ioutil.Discard, resp.Body)
+		return resp.StatusCode >= 500, statusError(resp.StatusCode)
 	}
+	p.observe(time.Since(began))
 
-	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
-		return err
+	// A server that predates codec negotiation answers in JSON.
+	if err := codecFor(resp.Header.Get("Content-Type")).Decode(resp.Body, response); err != nil {
+		return true, err
 	}
-
-	return nil
+	io.Copy(ioutil.Discard, resp.Body) // so the connection can be reused
+	return false, nil
 }
 
 type Server struct {
-	server raft.Peer
+	server      raft.Peer
+	membersOnly bool // require a verified client certificate for peer RPCs
+	results     *results
+	uploads     uploads
 }
 
 func NewServer(server raft.Peer) *Server {
 	return &Server{
-		server: server,
+		server:  server,
+		results: newResults(),
 	}
 }
 
@@ -125,9 +637,65 @@ type Muxer interface {
 
 func (s *Server) Install(mux Muxer) {
 	mux.HandleFunc(IdPath, s.idHandler())
-	mux.HandleFunc(AppendEntriesPath, s.appendEntriesHandler())
-	mux.HandleFunc(RequestVotePath, s.requestVoteHandler())
+	mux.HandleFunc(AppendEntriesPath, s.memberHandler(s.appendEntriesHandler()))
+	mux.HandleFunc(RequestVotePath, s.memberHandler(s.requestVoteHandler()))
+	mux.HandleFunc(ProbePath, s.memberHandler(s.probeHandler()))
+	mux.HandleFunc(InstallSnapshotPath, s.memberHandler(s.installSnapshotHandler()))
 	mux.HandleFunc(CommandPath, s.commandHandler())
+	mux.HandleFunc(HandshakePath, s.memberHandler(s.handshakeHandler()))
+	mux.HandleFunc(QueryPath, s.queryHandler())
+	mux.HandleFunc(StatusPath, s.statusHandler())
+	mux.HandleFunc(StatsPath, s.statsHandler())
+	mux.HandleFunc(PeersPath, s.peersHandler())
+	mux.HandleFunc(LeaderPath, s.leaderHandler())
+	mux.HandleFunc(DashboardPath, s.dashboardHandler())
+	mux.HandleFunc(OperationPath, s.operationHandler())
+	mux.HandleFunc(BeaconPath, s.beaconHandler())
+}
+
+// ListenAndServeTLS listens on the TCP network address addr, and then calls
+// ServeTLS.
+func (s *Server) ListenAndServeTLS(addr string, config *tls.Config) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(ln, config)
+}
+
+// ServeTLS installs the server's handlers on a new mux, and serves them over
+// TLS on the listener. The config must carry the server's certificate, and the
+// pool of CAs that sign the client certificates of cluster members.
+//
+// Only cluster members may make peer RPCs (AppendEntries, RequestVote,
+// InstallSnapshot, and handshakes): clients that don't present a certificate
+// signed by one of the ClientCAs are refused. Commands and queries are accepted from anyone, since
+// they come from ordinary clients too.
+func (s *Server) ServeTLS(ln net.Listener, config *tls.Config) error {
+	if config == nil || config.ClientCAs == nil {
+		return ErrNoClientCAs
+	}
+	config = config.Clone()
+	if config.ClientAuth == tls.NoClientCert {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	s.membersOnly = true
+	mux := http.NewServeMux()
+	s.Install(mux)
+	return (&http.Server{Handler: mux}).Serve(tls.NewListener(ln, config))
+}
+
+// memberHandler refuses requests from clients that haven't presented a
+// verified certificate, if the server requires it.
+func (s *Server) memberHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.membersOnly && (r.TLS == nil || len(r.TLS.VerifiedChains) <= 0) {
+			http.Error(w, "cluster members only", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
 }
 
 func (s *Server) idHandler() http.HandlerFunc {
@@ -139,14 +707,20 @@ func (s *Server) idHandler() http.HandlerFunc {
 func (s *Server) appendEntriesHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
+		codec := codecFor(r.Header.Get("Content-Type"))
 		var ae raft.AppendEntries
-		if err := json.NewDecoder(r.Body).Decode(&ae); err != nil {
+		if err := codec.Decode(r.Body, &ae); err != nil {
 			http.Error(w, emptyAppendEntriesResponse.String(), http.StatusBadRequest)
 			return
 		}
 
-		aer := s.server.AppendEntries(ae)
-		if err := json.NewEncoder(w).Encode(aer); err != nil {
+		aer, err := s.appendEntries(r.Context(), ae)
+		if err != nil {
+			http.Error(w, emptyAppendEntriesResponse.String(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", codec.ContentType())
+		if err := codec.Encode(w, aer); err != nil {
 			http.Error(w, emptyAppendEntriesResponse.String(), http.StatusInternalServerError)
 			return
 		}
@@ -156,20 +730,68 @@ func (s *Server) appendEntriesHandler() http.HandlerFunc {
 func (s *Server) requestVoteHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
+		codec := codecFor(r.Header.Get("Content-Type"))
 		var rv raft.RequestVote
-		if err := json.NewDecoder(r.Body).Decode(&rv); err != nil {
+		if err := codec.Decode(r.Body, &rv); err != nil {
 			http.Error(w, emptyRequestVoteResponse.String(), http.StatusBadRequest)
 			return
 		}
 
-		rvr := s.server.RequestVote(rv)
-		if err := json.NewEncoder(w).Encode(rvr); err != nil {
+		rvr, err := s.requestVote(r.Context(), rv)
+		if err != nil {
+			http.Error(w, emptyRequestVoteResponse.String(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", codec.ContentType())
+		if err := codec.Encode(w, rvr); err != nil {
 			http.Error(w, emptyRequestVoteResponse.String(), http.StatusInternalServerError)
 			return
 		}
 	}
 }
 
+// commandHandler answers with the command's response, once it's committed. If
+// the request has the query parameter async=true, it instead answers with 202
+// as soon as the command is accepted, and the response is fetched later from
+// OperationPath.
+func (s *Server) probeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		p, ok := s.server.(raft.Prober)
+		if !ok {
+			http.Error(w, "probe not supported", http.StatusNotImplemented)
+			return
+		}
+		resp, err := p.Probe(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		codec := codecFor(r.Header.Get("Content-Type"))
+		w.Header().Set("Content-Type", codec.ContentType())
+		if err := codec.Encode(w, resp); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// appendEntries passes the RPC to the server, with the request's context if
+// the server takes one, so it stops working on it if the client goes away.
+func (s *Server) appendEntries(ctx context.Context, ae raft.AppendEntries) (raft.AppendEntriesResponse, error) {
+	if cp, ok := s.server.(raft.ContextPeer); ok {
+		return cp.AppendEntriesContext(ctx, ae)
+	}
+	return s.server.AppendEntries(ae), nil
+}
+
+func (s *Server) requestVote(ctx context.Context, rv raft.RequestVote) (raft.RequestVoteResponse, error) {
+	if cp, ok := s.server.(raft.ContextPeer); ok {
+		return cp.RequestVoteContext(ctx, rv)
+	}
+	return s.server.RequestVote(rv), nil
+}
+
 func (s *Server) commandHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
@@ -184,12 +806,21 @@ func (s *Server) commandHandler() http.HandlerFunc {
 			return
 		}
 
+		if s.redirectCommand(w, r) {
+			return
+		}
+
 		response := make(chan []byte, 1)
-		if err := s.server.Command(cmd, response); err != nil {
+		if err := s.command(r, cmd, response); err != nil {
 			http.Error(w, "", http.StatusInternalServerError)
 			return
 		}
 
+		if async, _ := strconv.ParseBool(r.URL.Query().Get("async")); async {
+			s.startAsyncCommand(w, response)
+			return
+		}
+
 		resp, ok := <-response
 		if !ok {
 			http.Error(w, "", http.StatusInternalServerError)
@@ -199,3 +830,159 @@ func (s *Server) commandHandler() http.HandlerFunc {
 		w.Write(resp)
 	}
 }
+
+// contextCommander is implemented by servers that take commands with a
+// context, which may carry annotations, like raft.Server.
+type contextCommander interface {
+	CommandContext(ctx context.Context, cmd []byte, response chan []byte) error
+}
+
+// command passes the command to the server, with the annotations in the
+// request's AnnotationsHeader, if the server takes them.
+func (s *Server) command(r *http.Request, cmd []byte, response chan []byte) error {
+	cc, ok := s.server.(contextCommander)
+	header := r.Header.Get(AnnotationsHeader)
+	if !ok || header == "" {
+		return s.server.Command(cmd, response)
+	}
+	values, err := url.ParseQuery(header)
+	if err != nil {
+		return err
+	}
+	annotations := map[string]string{}
+	for k := range values {
+		annotations[k] = values.Get(k)
+	}
+	return cc.CommandContext(raft.WithAnnotations(r.Context(), annotations), cmd, response)
+}
+
+// leaderer is implemented by servers that know who the leader is, like
+// raft.Server.
+type leaderer interface {
+	Leader() (id uint64, address string)
+}
+
+// commandError is the body of a failed or redirected command.
+type commandError struct {
+	Error  string `json:"error"`
+	Leader string `json:"leader,omitempty"` // address of the leader, if known
+}
+
+// redirectCommand sends clients of a server that isn't the leader to the
+// leader, with a 307, so that the HTTP API works behind a load balancer that
+// doesn't know which server is the leader. Peers follow the redirect. If the
+// leader is unknown, the command fails with 503. It returns false if the
+// command should be handled here: if this server is the leader, or if it knows
+// the leader but not its address, in which case the command is forwarded.
+func (s *Server) redirectCommand(w http.ResponseWriter, r *http.Request) bool {
+	l, ok := s.server.(leaderer)
+	if !ok {
+		return false
+	}
+	id, addr := l.Leader()
+	if id == s.server.Id() {
+		return false
+	}
+
+	if id == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(commandError{Error: raft.ErrUnknownLeader.Error()})
+		return true
+	}
+	u, err := url.Parse(addr)
+	if err != nil || addr == "" {
+		return false
+	}
+	u.Path, u.RawQuery = CommandPath, r.URL.RawQuery
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", u.String())
+	w.WriteHeader(http.StatusTemporaryRedirect)
+	json.NewEncoder(w).Encode(commandError{Error: raft.ErrNotLeader.Error(), Leader: addr})
+	return true
+}
+
+// handshakeResponse carries the server's handshake, and the reason it rejected
+// the client's handshake, if it did.
+type handshakeResponse struct {
+	Handshake raft.Handshake `json:"handshake"`
+	Error     string         `json:"error,omitempty"`
+}
+
+func (s *Server) handshakeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		h, ok := s.server.(raft.Handshaker)
+		if !ok {
+			http.Error(w, "handshake not supported", http.StatusNotImplemented)
+			return
+		}
+
+		codec := codecFor(r.Header.Get("Content-Type"))
+		var remote raft.Handshake
+		if err := codec.Decode(r.Body, &remote); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var resp handshakeResponse
+		local, err := h.Handshake(remote)
+		resp.Handshake = local
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		w.Header().Set("Content-Type", codec.ContentType())
+		if err := codec.Encode(w, resp); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// queryHandler answers read-only queries. The consistency level is given by the
+// consistency parameter (linearizable, the default, lease, or stale) and the
+// query payload by the request body. The response body is the response from
+// the query function.
+func (s *Server) queryHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		q, ok := s.server.(raft.Querier)
+		if !ok {
+			http.Error(w, raft.ErrQueryNotSupported.Error(), http.StatusNotImplemented)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		c := raft.Linearizable
+		if name := r.URL.Query().Get("consistency"); name != "" {
+			var err error
+			if c, err = raft.ParseConsistency(name); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		query, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp, err := q.Query(c, query)
+		switch err {
+		case nil:
+			w.Write(resp)
+		case raft.ErrUnknownLeader, raft.ErrNoQuorum, raft.ErrQuorumLost, raft.ErrDeposed:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case raft.ErrNoQueryFunc, raft.ErrQueryNotSupported:
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
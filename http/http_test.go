@@ -1,15 +1,32 @@
 package rafthttp_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
 	"github.com/peterbourgon/raft"
 	"github.com/peterbourgon/raft/http"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestId(t *testing.T) {
@@ -114,6 +131,861 @@ func TestRequestVote(t *testing.T) {
 	}
 }
 
+func TestCodecs(t *testing.T) {
+	aer := raft.AppendEntriesResponse{
+		Term:    3,
+		Success: false,
+		Gap:     &raft.LogGap{LastIndex: 9, CommitIndex: 7},
+	}
+	rvr := raft.RequestVoteResponse{Term: 5, VoteGranted: true}
+	mux := http.NewServeMux()
+	rafthttp.NewServer(&echoServer{id: 1, aer: aer, rvr: rvr}).Install(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	for _, codec := range []rafthttp.Codec{rafthttp.JSONCodec, rafthttp.GobCodec} {
+		peer, err := rafthttp.NewPeerWithOptions(*u, rafthttp.PeerOptions{Codec: codec})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ae := raft.AppendEntries{
+			Term:    3,
+			Entries: []raft.LogEntry{{Index: 1, Term: 3, Command: []byte{0, 1, 2}}},
+		}
+		got := peer.AppendEntries(ae)
+		if got.Term != aer.Term || got.Gap == nil || *got.Gap != *aer.Gap {
+			t.Errorf("%s: expected %+v, got %+v", codec.ContentType(), aer, got)
+		}
+		if got := peer.RequestVote(raft.RequestVote{Term: 5}); got != rvr {
+			t.Errorf("%s: expected %+v, got %+v", codec.ContentType(), rvr, got)
+		}
+
+		response := make(chan []byte, 1)
+		if err := peer.Command([]byte{0xff, 0x00}, response); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-response; !bytes.Equal(got, []byte{0xff, 0x00}) {
+			t.Errorf("%s: expected command echoed, got %v", codec.ContentType(), got)
+		}
+	}
+}
+
+func TestWitness(t *testing.T) {
+	mux := http.NewServeMux()
+	rafthttp.NewServer(raft.NewWitnessPeer(3, raft.NewLocalWitness())).Install(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	peer, err := rafthttp.NewPeer(*u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Id() != 3 {
+		t.Errorf("expected the witness's id, 3, got %d", peer.Id())
+	}
+
+	ctx := context.Background()
+	witness := raft.RemoteWitness(peer)
+	if term, ok, err := witness.Record(ctx, 2, 2, 5); err != nil || !ok || term != 2 {
+		t.Errorf("Record: expected term 2, recorded, got %d, %v (%v)", term, ok, err)
+	}
+	if _, granted, err := witness.Vote(ctx, 3, 1, 2, 4); err != nil || granted {
+		t.Errorf("Vote: expected a candidate behind the recorded log refused, got %v (%v)", granted, err)
+	}
+	if _, granted, err := witness.Vote(ctx, 3, 2, 2, 5); err != nil || !granted {
+		t.Errorf("Vote: expected an up-to-date candidate granted, got %v (%v)", granted, err)
+	}
+	if term, granted, err := witness.Vote(ctx, 1, 1, 2, 5); err != nil || granted || term != 3 {
+		t.Errorf("Vote: expected a stale candidate refused with term 3, got %d, %v (%v)", term, granted, err)
+	}
+}
+
+func TestCommandRedirect(t *testing.T) {
+	mux := http.NewServeMux()
+	rafthttp.NewServer(&echoServer{id: 1}).Install(mux)
+	leader := httptest.NewServer(mux)
+	defer leader.Close()
+
+	follower := &followerServer{echoServer: echoServer{id: 2}, leader: 1, addr: leader.URL}
+	mux = http.NewServeMux()
+	rafthttp.NewServer(follower).Install(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	peer, err := rafthttp.NewPeer(*u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := make(chan []byte, 1)
+	if err := peer.Command([]byte("cmd"), response); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := <-response; !ok || string(got) != "cmd" {
+		t.Errorf("expected command to be redirected to the leader, got %q (%v)", got, ok)
+	}
+
+	// without a redirect to follow, the client gets the reason
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	for _, c := range []struct {
+		leader   uint64
+		status   int
+		expected string
+	}{
+		{1, http.StatusTemporaryRedirect, raft.ErrNotLeader.Error()},
+		{0, http.StatusServiceUnavailable, raft.ErrUnknownLeader.Error()},
+	} {
+		follower.leader = c.leader
+		resp, err := client.Post(ts.URL+rafthttp.CommandPath, "application/octet-stream", bytes.NewBufferString("cmd"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Error  string `json:"error"`
+			Leader string `json:"leader"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("leader %d: expected HTTP %d, got %d", c.leader, c.status, resp.StatusCode)
+		}
+		if body.Error != c.expected {
+			t.Errorf("leader %d: expected error %q, got %q", c.leader, c.expected, body.Error)
+		}
+		if loc := resp.Header.Get("Location"); c.status == http.StatusTemporaryRedirect && loc != leader.URL+rafthttp.CommandPath {
+			t.Errorf("expected redirect to %s, got %q", leader.URL+rafthttp.CommandPath, loc)
+		}
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	server := raft.NewServer(7, &bytes.Buffer{}, noop, raft.Config{})
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+	mux := http.NewServeMux()
+	rafthttp.NewServer(server).Install(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + rafthttp.StatusPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status raft.Status
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Id != 7 || status.State != raft.Follower || len(status.Peers) != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	resp, err = http.Get(ts.URL + rafthttp.DashboardPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, s := range []string{"<title>raft 7: Follower</title>", "<td>unknown</td>"} {
+		if !bytes.Contains(page, []byte(s)) {
+			t.Errorf("dashboard doesn't contain %q:\n%s", s, page)
+		}
+	}
+
+	// servers that can't report their status say so
+	mux = http.NewServeMux()
+	rafthttp.NewServer(&echoServer{id: 1}).Install(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", rafthttp.DashboardPath, nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("expected HTTP %d, got %d", http.StatusNotImplemented, rec.Code)
+	}
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	server := raft.NewServer(7, &bytes.Buffer{}, noop, config)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+	server.SetLearners(raft.MakePeers(&echoServer{id: 8})) // never catches up
+	server.Start()
+	defer server.Stop()
+	select {
+	case <-server.LeaderCh():
+	case <-time.After(10 * config.MaxElectionTimeout):
+		t.Fatal("never became leader")
+	}
+	mux := http.NewServeMux()
+	rafthttp.NewServer(server).Install(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	get := func(path string, v interface{}) {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+	}
+
+	var leader rafthttp.LeaderInfo
+	get(rafthttp.LeaderPath, &leader)
+	if expected := (rafthttp.LeaderInfo{Id: 7, Self: true}); expected != leader {
+		t.Errorf("leader: expected %+v, got %+v", expected, leader)
+	}
+
+	var stats map[string]string
+	get(rafthttp.StatsPath, &stats)
+	if stats["state"] != raft.Leader || stats["leader"] != "7" || stats["num_learners"] != "1" {
+		t.Errorf("unexpected stats %v", stats)
+	}
+
+	var m rafthttp.Membership
+	get(rafthttp.PeersPath, &m)
+	if fmt.Sprint(m.Peers, m.Learners) != "[7] [8]" {
+		t.Errorf("expected peers [7] and learners [8], got %+v", m)
+	}
+	if _, ok := m.Progress[8]; !ok || len(m.Progress) != 1 {
+		t.Errorf("expected the progress of learner 8, got %+v", m.Progress)
+	}
+
+	// a follower points at its leader
+	mux = http.NewServeMux()
+	rafthttp.NewServer(&followerServer{echoServer: echoServer{id: 2}, leader: 1, addr: "http://leader:8080"}).Install(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", rafthttp.LeaderPath, nil))
+	if err := json.NewDecoder(rec.Body).Decode(&leader); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (rafthttp.LeaderInfo{Id: 1, Address: "http://leader:8080"}); expected != leader {
+		t.Errorf("follower's leader: expected %+v, got %+v", expected, leader)
+	}
+}
+
+func TestAsyncCommand(t *testing.T) {
+	s := rafthttp.NewServer(&echoServer{id: 1})
+	mux := http.NewServeMux()
+	s.Install(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	command := func(cmd string) string {
+		resp, err := http.Post(ts.URL+rafthttp.CommandPath+"?async=true", "application/octet-stream", bytes.NewBufferString(cmd))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("expected HTTP %d, got %d", http.StatusAccepted, resp.StatusCode)
+		}
+		return resp.Header.Get("Location")
+	}
+	fetch := func(location string) (int, string) {
+		resp, err := http.Get(ts.URL + location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	settle := func() rafthttp.ResultStats {
+		for i := 0; i < 100; i++ {
+			if stats := s.ResultStats(); stats.Pending == 0 {
+				return stats
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatal("commands still pending")
+		panic("unreachable")
+	}
+
+	first := command("a")
+	settle()
+	if status, body := fetch(first); status != http.StatusOK || body != "a" {
+		t.Errorf("expected HTTP 200 with %q, got %d with %q", "a", status, body)
+	}
+
+	s.SetResultRetention(1, time.Hour)
+	command("b")
+	last := command("c")
+	stats := settle()
+	if stats.Retained != 1 || stats.EvictedByCount != 2 {
+		t.Errorf("expected 1 retained, 2 evicted by count, got %+v", stats)
+	}
+	if status, _ := fetch(first); status != http.StatusNotFound {
+		t.Errorf("expected evicted result to be HTTP 404, got %d", status)
+	}
+	if status, body := fetch(last); status != http.StatusOK || body != "c" {
+		t.Errorf("expected HTTP 200 with %q, got %d with %q", "c", status, body)
+	}
+
+	s.SetResultRetention(1, 0)
+	if stats := s.ResultStats(); stats.Retained != 0 || stats.EvictedByAge != 1 {
+		t.Errorf("expected 1 evicted by age, got %+v", stats)
+	}
+}
+
+func TestCommandAsync(t *testing.T) {
+	s := rafthttp.NewServer(&echoServer{id: 1})
+	mux := http.NewServeMux()
+	s.Install(mux)
+	leader := httptest.NewServer(mux)
+	defer leader.Close()
+
+	follower := &followerServer{echoServer: echoServer{id: 2}, leader: 1, addr: leader.URL}
+	mux = http.NewServeMux()
+	rafthttp.NewServer(follower).Install(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	peer, err := rafthttp.NewPeer(*u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// the command is redirected to the leader, which holds its result
+	op, err := peer.CommandAsync(ctx, []byte("cmd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := op.Wait(ctx); err != nil || string(got) != "cmd" {
+		t.Errorf("expected response %q, got %q (%v)", "cmd", got, err)
+	}
+
+	// an evicted result can't be fetched
+	s.SetResultRetention(1, 0)
+	if op, err = peer.CommandAsync(ctx, []byte("cmd")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := op.Wait(ctx); err != rafthttp.ErrUnknownOperation {
+		t.Errorf("after eviction: expected %v, got %v", rafthttp.ErrUnknownOperation, err)
+	}
+
+	// nor can the result of a command that's lost
+	mux = http.NewServeMux()
+	rafthttp.NewServer(&lossyServer{echoServer{id: 1}}).Install(mux)
+	lossy := httptest.NewServer(mux)
+	defer lossy.Close()
+	follower.addr = lossy.URL
+	if op, err = peer.CommandAsync(ctx, []byte("cmd")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := op.Wait(ctx); err != rafthttp.ErrOperationLost {
+		t.Errorf("when lost: expected %v, got %v", rafthttp.ErrOperationLost, err)
+	}
+
+	// without a leader, it's not accepted
+	follower.leader = 0
+	if _, err := peer.CommandAsync(ctx, []byte("cmd")); err != raft.ErrUnknownLeader {
+		t.Errorf("without a leader: expected %v, got %v", raft.ErrUnknownLeader, err)
+	}
+}
+
+func TestCommandAnnotations(t *testing.T) {
+	server := &annotatingServer{echoServer: echoServer{id: 1}}
+	mux := http.NewServeMux()
+	rafthttp.NewServer(server).Install(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	peer, err := rafthttp.NewPeer(*u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations := map[string]string{"auth/principal": "alice", "app/schema": "2 & 3"}
+	response := make(chan []byte, 1)
+	if err := peer.CommandAnnotated([]byte("cmd"), annotations, response); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := <-response; !ok || string(got) != "cmd" {
+		t.Errorf("expected response %q, got %q (%v)", "cmd", got, ok)
+	}
+	if !reflect.DeepEqual(annotations, server.annotations) {
+		t.Errorf("expected annotations %v, got %v", annotations, server.annotations)
+	}
+}
+
+func TestPeerTimeoutsAndRetries(t *testing.T) {
+	var attempts, conns int32
+	status := http.StatusInternalServerError
+	mux := http.NewServeMux()
+	mux.HandleFunc(rafthttp.IdPath, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("1")) })
+	mux.HandleFunc(rafthttp.AppendEntriesPath, func(w http.ResponseWriter, r *http.Request) {
+		if n := atomic.AddInt32(&attempts, 1); n < 3 {
+			w.WriteHeader(status)
+			return
+		}
+		json.NewEncoder(w).Encode(raft.AppendEntriesResponse{Term: 4})
+	})
+	hung := make(chan struct{})
+	mux.HandleFunc(rafthttp.RequestVotePath, func(w http.ResponseWriter, r *http.Request) { <-hung })
+	ts := httptest.NewUnstartedServer(mux)
+	ts.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+	defer close(hung) // before the server closes, which waits for handlers
+	u, _ := url.Parse(ts.URL)
+
+	peer, err := rafthttp.NewPeerWithOptions(*u, rafthttp.PeerOptions{Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two server errors, then success
+	if aer := peer.AppendEntries(raft.AppendEntries{}); aer.Term != 4 {
+		t.Errorf("expected the third attempt to succeed, got %+v after %d attempts", aer, attempts)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("expected every attempt to use the same connection, got %d connections", n)
+	}
+
+	// refusals aren't retried
+	atomic.StoreInt32(&attempts, 0)
+	status = http.StatusForbidden
+	peer.AppendEntries(raft.AppendEntries{})
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("expected 1 attempt, got %d", n)
+	}
+
+	// a caller with a shorter deadline isn't kept waiting
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	began := time.Now()
+	if _, err := peer.RequestVoteContext(ctx, raft.RequestVote{}); err == nil {
+		t.Errorf("expected an error from a hung server")
+	}
+	if elapsed := time.Since(began); elapsed > 40*time.Millisecond {
+		t.Errorf("RequestVoteContext took %s, despite the deadline", elapsed)
+	}
+
+	// a hung server doesn't hang the peer
+	began = time.Now()
+	if rvr := peer.RequestVote(raft.RequestVote{}); rvr.VoteGranted {
+		t.Errorf("expected no vote from a hung server")
+	}
+	if elapsed := time.Since(began); elapsed > time.Second {
+		t.Errorf("RequestVote took %s, despite the timeout", elapsed)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	server := raft.NewServer(7, &bytes.Buffer{}, noop, raft.Config{}) // a follower, as it's not started
+	mux := http.NewServeMux()
+	rafthttp.NewServer(server).Install(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	peer, err := rafthttp.NewPeer(*u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := peer.Probe(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (raft.ProbeResponse{Term: 1, Leader: false}); resp != expected {
+		t.Errorf("expected %+v, got %+v", expected, resp)
+	}
+}
+
+func TestVerifiedPeer(t *testing.T) {
+	server := raft.NewServer(7, &bytes.Buffer{}, noop, raft.Config{})
+	server.SetClusterId("alpha")
+	mux := http.NewServeMux()
+	rafthttp.NewServer(server).Install(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := rafthttp.NewVerifiedPeer(*u, raft.Handshake{ClusterId: "alpha", Version: raft.ProtocolVersion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(7), peer.Id(); expected != got {
+		t.Errorf("expected ID %d, got %d", expected, got)
+	}
+	if peer.RoundTripTime() <= 0 {
+		t.Errorf("expected the handshake to seed the round-trip time")
+	}
+
+	for _, local := range []raft.Handshake{
+		{ClusterId: "beta", Version: raft.ProtocolVersion},
+		{ClusterId: "alpha", Version: raft.ProtocolVersion + 1},
+	} {
+		if _, err := rafthttp.NewVerifiedPeer(*u, local); err == nil {
+			t.Errorf("%+v: expected error, got none", local)
+		} else {
+			t.Logf("%+v: %s", local, err)
+		}
+	}
+}
+
+func TestPeerSetAddress(t *testing.T) {
+	servers := []*httptest.Server{}
+	for _, term := range []uint64{1, 2} {
+		mux := http.NewServeMux()
+		rafthttp.NewServer(&echoServer{
+			id:  1,
+			aer: raft.AppendEntriesResponse{Term: term},
+		}).Install(mux)
+		ts := httptest.NewServer(mux)
+		defer ts.Close()
+		servers = append(servers, ts)
+	}
+
+	u, _ := url.Parse(servers[0].URL)
+	peer, err := rafthttp.NewPeer(*u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(1), peer.AppendEntries(raft.AppendEntries{}).Term; expected != got {
+		t.Fatalf("expected term %d, got %d", expected, got)
+	}
+
+	if err := peer.SetAddress(servers[1].URL); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := servers[1].URL, peer.Address(); expected != got {
+		t.Errorf("expected address %s, got %s", expected, got)
+	}
+	if expected, got := uint64(2), peer.AppendEntries(raft.AppendEntries{}).Term; expected != got {
+		t.Errorf("after SetAddress, expected term %d, got %d", expected, got)
+	}
+
+	if err := peer.SetAddress("not a url"); err == nil {
+		t.Errorf("expected error for invalid address")
+	}
+}
+
+func TestPeerAddresses(t *testing.T) {
+	mux := http.NewServeMux()
+	rafthttp.NewServer(&echoServer{id: 1, aer: raft.AppendEntriesResponse{Term: 4}}).Install(mux)
+	live := httptest.NewServer(mux)
+	defer live.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	// a server unreachable at its first address is reached at the next
+	deadURL, _ := url.Parse(dead.URL)
+	liveURL, _ := url.Parse(live.URL)
+	peer, err := rafthttp.NewPeerWithOptions(*deadURL, rafthttp.PeerOptions{Addresses: []url.URL{*liveURL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := []string{dead.URL, live.URL}, peer.Addresses(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected addresses %v, got %v", expected, got)
+	}
+
+	// an RPC that fails at one address is retried at the next
+	if err := peer.SetAddresses([]string{dead.URL, live.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(4), peer.AppendEntries(raft.AppendEntries{}).Term; expected != got {
+		t.Errorf("expected term %d, got %d", expected, got)
+	}
+	if expected, got := live.URL, peer.Address(); expected != got {
+		t.Errorf("expected address %s, got %s", expected, got)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	server.SetQueryFunc(func(q []byte) ([]byte, error) { return append([]byte("re: "), q...), nil })
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+	server.Start()
+	defer server.Stop()
+
+	mux := http.NewServeMux()
+	rafthttp.NewServer(server).Install(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	peer, err := rafthttp.NewPeer(*u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stale query can be answered straight away, even by a follower
+	resp, err := peer.Query(raft.Stale, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "re: hello", string(resp); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	// a linearizable query needs a leader
+	cutoff := time.Now().Add(10 * config.MaxElectionTimeout)
+	for {
+		resp, err = peer.Query(raft.Linearizable, []byte("hello"))
+		if err != raft.ErrUnknownLeader || time.Now().After(cutoff) {
+			break
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "re: hello", string(resp); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	// unknown consistency levels are rejected
+	r, err := http.Post(ts.URL+rafthttp.QueryPath+"?consistency=eventual", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if expected, got := http.StatusBadRequest, r.StatusCode; expected != got {
+		t.Errorf("expected HTTP %d, got %d", expected, got)
+	}
+}
+
+func TestBeacons(t *testing.T) {
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond, BeaconInterval: 5 * time.Millisecond}
+
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+	server.Start()
+	defer server.Stop()
+
+	mux := http.NewServeMux()
+	rafthttp.NewServer(server).Install(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+rafthttp.BeaconPath, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if expected, got := "text/event-stream", resp.Header.Get("Content-Type"); expected != got {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+
+	// the stream is silent until the server is the leader
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var e raft.Event
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != raft.LeaderBeacon || e.Id != 1 || e.Term != server.Status().Term {
+			t.Errorf("unexpected beacon %+v", e)
+		}
+		return
+	}
+	t.Fatalf("stream ended without a beacon: %v", s.Err())
+}
+
+func TestTLS(t *testing.T) {
+	ca, caKey := newCert(t, "ca", nil, nil)
+	serverCert := newTLSCert(t, "server", ca, caKey)
+	memberCert := newTLSCert(t, "member", ca, caKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go rafthttp.NewServer(&echoServer{
+		id:  1,
+		aer: raft.AppendEntriesResponse{Term: 3, Success: true},
+	}).ServeTLS(ln, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+	})
+
+	u, _ := url.Parse("https://" + ln.Addr().String())
+
+	// a member, with a client certificate, can make peer RPCs
+	member, err := rafthttp.NewPeerWithOptions(*u, rafthttp.PeerOptions{
+		TLSConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{memberCert}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aer := member.AppendEntries(raft.AppendEntries{}); aer.Term != 3 || !aer.Success {
+		t.Errorf("member: expected AppendEntries to succeed, got %+v", aer)
+	}
+
+	// anyone else can't
+	strangerTLS := &tls.Config{RootCAs: pool}
+	stranger, err := rafthttp.NewPeerWithOptions(*u, rafthttp.PeerOptions{TLSConfig: strangerTLS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aer := stranger.AppendEntries(raft.AppendEntries{}); aer.Term != 0 {
+		t.Errorf("stranger: expected AppendEntries to fail, got %+v", aer)
+	}
+
+	// but they can send commands
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: strangerTLS}}
+	resp, err := client.Post(u.String()+rafthttp.CommandPath, "", bytes.NewBufferString(`"hi"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != `"hi"` {
+		t.Errorf("stranger: expected command response %s, got HTTP %d %s", `"hi"`, resp.StatusCode, body)
+	}
+}
+
+// newCert returns a certificate for name, signed by parent, or self-signed
+// (as a CA) if parent is nil.
+func newCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func newTLSCert(t *testing.T, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) tls.Certificate {
+	cert, key := newCert(t, name, ca, caKey)
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+}
+
+func TestInstallSnapshot(t *testing.T) {
+	data := []byte(strings.Repeat("0123456789abcdef", 4))
+	follower := &snapshotServer{echoServer: echoServer{id: 2}}
+	s := rafthttp.NewServer(follower)
+	inner := http.NewServeMux()
+	s.Install(inner)
+
+	// every other chunk is cut short, and some are refused outright
+	var posts, received int64
+	var refuse int32
+	mux := http.NewServeMux()
+	mux.HandleFunc(rafthttp.IdPath, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("2")) })
+	mux.HandleFunc(rafthttp.InstallSnapshotPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			if atomic.LoadInt32(&refuse) != 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if atomic.AddInt64(&posts, 1)%2 == 0 {
+				r.Body = ioutil.NopCloser(io.MultiReader(io.LimitReader(r.Body, 3), errorReader{}))
+			}
+			r.Body = ioutil.NopCloser(&countingReader{r: r.Body, n: &received})
+		}
+		inner.ServeHTTP(w, r)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	peer, err := rafthttp.NewPeerWithOptions(*u, rafthttp.PeerOptions{SnapshotChunkSize: 10, SnapshotRate: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := raft.InstallSnapshot{Term: 3, LeaderId: 1, Meta: raft.SnapshotMeta{Id: "3-40-1", Index: 40, Term: 3, Size: int64(len(data))}}
+
+	// a transfer that's refused half way through
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() {
+		for atomic.LoadInt64(&received) < int64(len(data))/2 {
+			time.Sleep(time.Millisecond)
+		}
+		atomic.StoreInt32(&refuse, 1)
+	}()
+	if _, err := peer.InstallSnapshotContext(ctx, is, bytes.NewReader(data)); err == nil {
+		t.Fatal("expected the refused transfer to fail")
+	}
+	if got := atomic.LoadInt64(&received); got < int64(len(data))/2 || got >= int64(len(data)) {
+		t.Fatalf("expected the refused transfer to send some of the data, got %d of %d", got, len(data))
+	}
+
+	// resumes from where it got to, and at the configured rate
+	atomic.StoreInt32(&refuse, 0)
+	began := time.Now()
+	resp, err := peer.InstallSnapshotContext(ctx, is, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Success || resp.Term != 3 {
+		t.Errorf("expected success in term 3, got %+v", resp)
+	}
+	if !bytes.Equal(data, follower.installed) {
+		t.Errorf("expected %q to be installed, got %q", data, follower.installed)
+	}
+	if expected, got := int64(len(data)), atomic.LoadInt64(&received); expected != got {
+		t.Errorf("expected %d bytes to be sent, once each, got %d", expected, got)
+	}
+	if elapsed := time.Since(began); elapsed < 10*time.Millisecond {
+		t.Errorf("expected the transfer to be rate limited, took %s", elapsed)
+	}
+
+	// a server that can't install snapshots says so
+	s = rafthttp.NewServer(&echoServer{id: 3})
+	inner = http.NewServeMux()
+	s.Install(inner)
+	ts2 := httptest.NewServer(inner)
+	defer ts2.Close()
+	u, _ = url.Parse(ts2.URL)
+	peer, err = rafthttp.NewPeer(*u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.InstallSnapshotContext(ctx, is, bytes.NewReader(data)); err != raft.ErrSnapshotNotSupported {
+		t.Errorf("expected %v, got %v", raft.ErrSnapshotNotSupported, err)
+	}
+}
+
 type mockMux struct {
 	registry map[string]http.HandlerFunc
 }
@@ -141,6 +1013,19 @@ func (m *mockMux) Call(path string, r *http.Request) ([]byte, error) {
 	return w.Body.Bytes(), nil
 }
 
+// followerServer is an echoServer that believes another server is the leader,
+// and refuses commands.
+type followerServer struct {
+	echoServer
+	leader uint64
+	addr   string
+}
+
+func (p *followerServer) Leader() (uint64, string) { return p.leader, p.addr }
+func (p *followerServer) Command([]byte, chan []byte) error {
+	return raft.ErrNotLeader
+}
+
 type echoServer struct {
 	id  uint64
 	aer raft.AppendEntriesResponse
@@ -158,3 +1043,56 @@ func (p *echoServer) Command(cmd []byte, response chan []byte) error {
 	go func() { response <- cmd }()
 	return nil
 }
+
+// annotatingServer is an echoServer that records the annotations of the
+// latest command.
+type annotatingServer struct {
+	echoServer
+	annotations map[string]string
+}
+
+func (p *annotatingServer) CommandContext(ctx context.Context, cmd []byte, response chan []byte) error {
+	p.annotations = raft.AnnotationsFrom(ctx)
+	return p.Command(cmd, response)
+}
+
+// lossyServer is an echoServer that loses every command.
+type lossyServer struct {
+	echoServer
+}
+
+func (p *lossyServer) Command(cmd []byte, response chan []byte) error {
+	close(response)
+	return nil
+}
+
+// snapshotServer is an echoServer that installs snapshots.
+type snapshotServer struct {
+	echoServer
+	installed []byte
+}
+
+func (p *snapshotServer) InstallSnapshotContext(ctx context.Context, is raft.InstallSnapshot, data io.Reader) (raft.InstallSnapshotResponse, error) {
+	buf, err := ioutil.ReadAll(data)
+	if err != nil {
+		return raft.InstallSnapshotResponse{}, err
+	}
+	p.installed = buf
+	return raft.InstallSnapshotResponse{Term: is.Term, Success: true}, nil
+}
+
+type errorReader struct{}
+
+func (errorReader) Read([]byte) (int, error) { return 0, fmt.Errorf("connection reset") }
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
@@ -2,12 +2,16 @@ package rafthttp_test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/peterbourgon/raft"
 	"github.com/peterbourgon/raft/http"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"sync"
 	"testing"
 	"time"
 )
@@ -29,8 +33,7 @@ func Test8Servers(t *testing.T) {
 
 func testServers(t *testing.T, n int) {
 	log.SetFlags(log.Lmicroseconds)
-	oldMin, oldMax := raft.ResetElectionTimeoutMs(50, 100)
-	defer raft.ResetElectionTimeoutMs(oldMin, oldMax)
+	config := raft.Config{MinElectionTimeout: 50 * time.Millisecond, MaxElectionTimeout: 100 * time.Millisecond, HeartbeatInterval: 5 * time.Millisecond}
 
 	// node = Raft protocol server + a HTTP server + a transport bridge
 	raftServers := make([]*raft.Server, n)
@@ -40,7 +43,7 @@ func testServers(t *testing.T, n int) {
 	// create them individually
 	for i := 0; i < n; i++ {
 		// create a Raft protocol server
-		raftServers[i] = raft.NewServer(uint64(i+1), &bytes.Buffer{}, noop)
+		raftServers[i] = raft.NewServer(uint64(i+1), &bytes.Buffer{}, noop, config)
 
 		// wrap that server in a HTTP transport
 		raftHttpServers[i] = rafthttp.NewServer(raftServers[i])
@@ -67,6 +70,10 @@ func testServers(t *testing.T, n int) {
 			t.Fatal(err)
 		}
 		peer, err := rafthttp.NewPeer(*u)
+		for cutoff := time.Now().Add(time.Second); err != nil && time.Now().Before(cutoff); {
+			time.Sleep(time.Millisecond) // the HTTP server may not be listening yet
+			peer, err = rafthttp.NewPeer(*u)
+		}
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -84,5 +91,193 @@ func testServers(t *testing.T, n int) {
 		defer raftServer.Stop()
 	}
 
-	time.Sleep(2 * raft.MaximumElectionTimeout())
+	time.Sleep(2 * config.MaxElectionTimeout)
+}
+
+func TestMultiServer(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 50 * time.Millisecond, MaxElectionTimeout: 100 * time.Millisecond, HeartbeatInterval: 5 * time.Millisecond}
+	groups := []uint64{1, 2}
+
+	// three processes, each hosting both groups on one listener, and
+	// recording the commands each group applies
+	var mu sync.Mutex
+	applied := map[uint64][]string{}
+	apply := func(group uint64) func([]byte) ([]byte, error) {
+		return func(cmd []byte) ([]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			applied[group] = append(applied[group], string(cmd))
+			return cmd, nil
+		}
+	}
+	hosts := make([]*raft.MultiServer, 3)
+	urls := make([]*url.URL, 3)
+	for i := range hosts {
+		hosts[i] = raft.NewMultiServer()
+		for _, group := range groups {
+			if err := hosts[i].Add(group, raft.NewServer(uint64(i+1), &bytes.Buffer{}, apply(group), config)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mux := http.NewServeMux()
+		rafthttp.NewMultiServer(hosts[i]).Install(mux)
+		ts := httptest.NewServer(mux)
+		defer ts.Close()
+		urls[i], _ = url.Parse(ts.URL)
+	}
+	if err := hosts[0].Add(1, raft.NewServer(1, &bytes.Buffer{}, noop, config)); err != raft.ErrGroupExists {
+		t.Errorf("expected %s, got %v", raft.ErrGroupExists, err)
+	}
+
+	// each group's peers reach the same group on the other processes
+	for _, group := range groups {
+		peers := raft.Peers{}
+		for _, u := range urls {
+			peer, err := rafthttp.NewPeerWithOptions(*u, rafthttp.PeerOptions{Group: group})
+			if err != nil {
+				t.Fatal(err)
+			}
+			peers[peer.Id()] = peer
+		}
+		for _, host := range hosts {
+			server, _ := host.Group(group)
+			server.SetPeers(peers)
+			server.Start()
+		}
+	}
+	for _, host := range hosts {
+		defer host.Stop()
+	}
+
+	// commands to a group, forwarded by its followers, reach only its
+	// state machines
+	for _, group := range groups {
+		server, _ := hosts[2].Group(group)
+		cmd := []byte(fmt.Sprintf("to group %d", group))
+		for cutoff := time.Now().Add(2 * time.Second); ; time.Sleep(config.MinElectionTimeout) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			_, err := server.Apply(ctx, cmd)
+			cancel()
+			if err == nil {
+				break
+			}
+			if time.Now().After(cutoff) {
+				t.Fatalf("group %d: %s", group, err)
+			}
+		}
+	}
+	for cutoff := time.Now().Add(time.Second); time.Now().Before(cutoff); time.Sleep(time.Millisecond) {
+		mu.Lock()
+		done := len(applied[1]) == 3 && len(applied[2]) == 3
+		mu.Unlock()
+		if done {
+			break
+		}
+	}
+	mu.Lock()
+	for _, group := range groups {
+		for _, cmd := range applied[group] {
+			if expected := fmt.Sprintf("to group %d", group); cmd != expected {
+				t.Errorf("group %d: expected only %q applied, got %q", group, expected, cmd)
+			}
+		}
+		if len(applied[group]) != 3 {
+			t.Errorf("group %d: expected its command applied by 3 servers, got %d", group, len(applied[group]))
+		}
+	}
+	mu.Unlock()
+
+	// requests without a group, or for one that isn't hosted, are refused
+	for header, expected := range map[string]int{"": http.StatusBadRequest, "3": http.StatusNotFound} {
+		req, _ := http.NewRequest("GET", urls[0].String()+rafthttp.IdPath, nil)
+		req.Header.Set(rafthttp.GroupHeader, header)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("group %q: expected status %d, got %d", header, expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestVerifiedCluster(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 50 * time.Millisecond, MaxElectionTimeout: 100 * time.Millisecond, HeartbeatInterval: 5 * time.Millisecond}
+
+	// three servers in cluster alpha, and one in beta
+	servers := make([]*raft.Server, 4)
+	urls := make([]*url.URL, 4)
+	for i := range servers {
+		servers[i] = raft.NewServer(uint64(i+1), &bytes.Buffer{}, noop, config)
+		servers[i].SetClusterId("alpha")
+		if i == 3 {
+			servers[i].SetClusterId("beta")
+		}
+		mux := http.NewServeMux()
+		rafthttp.NewServer(servers[i]).Install(mux)
+		ts := httptest.NewServer(mux)
+		defer ts.Close()
+		urls[i], _ = url.Parse(ts.URL)
+	}
+
+	// alpha's servers peer after handshakes, which beta's fails
+	alpha := raft.Peers{}
+	for _, u := range urls[:3] {
+		peer, err := rafthttp.NewVerifiedPeer(*u, raft.Handshake{ClusterId: "alpha", Version: raft.ProtocolVersion})
+		if err != nil {
+			t.Fatal(err)
+		}
+		alpha[peer.Id()] = peer
+	}
+	if _, err := rafthttp.NewVerifiedPeer(*urls[0], raft.Handshake{ClusterId: "beta", Version: raft.ProtocolVersion}); err == nil {
+		t.Errorf("expected beta's handshake with alpha to fail")
+	}
+
+	// beta's server, miswired to alpha's without a handshake, campaigns in
+	// vain, and without disturbing them
+	beta := raft.Peers{}
+	for _, u := range urls {
+		peer, err := rafthttp.NewPeer(*u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		beta[peer.Id()] = peer
+	}
+	for i, server := range servers {
+		if i < 3 {
+			server.SetPeers(alpha)
+		} else {
+			server.SetPeers(beta)
+		}
+		server.Start()
+		defer server.Stop()
+	}
+	for cutoff := time.Now().Add(2 * time.Second); ; time.Sleep(config.MinElectionTimeout) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := servers[0].Apply(ctx, []byte("to alpha"))
+		cancel()
+		if err == nil {
+			break
+		}
+		if time.Now().After(cutoff) {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(5 * config.MaxElectionTimeout)
+	if state := servers[3].State(); state == raft.Leader {
+		t.Errorf("expected beta's server not to be elected by alpha's")
+	}
+	betaTerm := servers[3].Status().Term
+	for _, server := range servers[:3] {
+		if term := server.Status().Term; term >= betaTerm {
+			t.Errorf("server %d: expected alpha's term to stay below beta's %d, got %d", server.Id(), betaTerm, term)
+		}
+	}
 }
@@ -0,0 +1,81 @@
+package rafthttp
+
+import (
+	"github.com/peterbourgon/raft"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// MultiServer serves every group of a raft.MultiServer on one listener. It
+// installs the paths a Server does, and hands each request to the Server of
+// the group in its GroupHeader, which peers set when their options have a
+// Group. Requests for groups that aren't hosted get a 404.
+type MultiServer struct {
+	sync.Mutex
+	groups  *raft.MultiServer
+	servers map[uint64]groupServer
+}
+
+// groupServer is the Server of a group, with its handlers installed.
+type groupServer struct {
+	server *raft.Server
+	mux    *http.ServeMux
+}
+
+func NewMultiServer(groups *raft.MultiServer) *MultiServer {
+	return &MultiServer{
+		groups:  groups,
+		servers: map[uint64]groupServer{},
+	}
+}
+
+// Install installs the handlers of every group's Server at once; groups that
+// are added to the raft.MultiServer later are served, too.
+func (m *MultiServer) Install(mux Muxer) {
+	NewServer(nil).Install(groupMuxer{mux, m})
+}
+
+// groupMuxer installs a MultiServer's dispatch in place of each handler.
+type groupMuxer struct {
+	mux Muxer
+	m   *MultiServer
+}
+
+func (g groupMuxer) HandleFunc(path string, _ func(http.ResponseWriter, *http.Request)) {
+	g.mux.HandleFunc(path, g.m.ServeHTTP)
+}
+
+// ServeHTTP hands the request to the Server of its group.
+func (m *MultiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	group, err := strconv.ParseUint(r.Header.Get(GroupHeader), 10, 64)
+	if err != nil || group <= 0 {
+		http.Error(w, "no "+GroupHeader, http.StatusBadRequest)
+		return
+	}
+	mux, err := m.mux(group)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	mux.ServeHTTP(w, r)
+}
+
+// mux returns the handlers of the group's Server, creating them the first
+// time, or when the group's been replaced.
+func (m *MultiServer) mux(group uint64) (*http.ServeMux, error) {
+	server, err := m.groups.Group(group)
+	m.Lock()
+	defer m.Unlock()
+	if err != nil {
+		delete(m.servers, group)
+		return nil, err
+	}
+	gs, ok := m.servers[group]
+	if !ok || gs.server != server {
+		gs = groupServer{server: server, mux: http.NewServeMux()}
+		NewServer(server).Install(gs.mux)
+		m.servers[group] = gs
+	}
+	return gs.mux, nil
+}
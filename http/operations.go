@@ -0,0 +1,291 @@
+package rafthttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/peterbourgon/raft"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxResults is the default number of completed async command
+	// results a server retains.
+	DefaultMaxResults = 1024
+
+	// DefaultResultTTL is the default time a server retains the result of a
+	// completed async command.
+	DefaultResultTTL = 5 * time.Minute
+)
+
+// ResultStats describes the results of async commands a server holds, and how
+// many it has evicted, either because there were too many or they were too old.
+type ResultStats struct {
+	Pending        int    `json:"pending"`
+	Retained       int    `json:"retained"`
+	EvictedByCount uint64 `json:"evicted_by_count"`
+	EvictedByAge   uint64 `json:"evicted_by_age"`
+}
+
+// SetResultRetention bounds the results of completed async commands the
+// server retains, until they're fetched from OperationPath: at most max
+// results, each for at most ttl. Results beyond either bound are evicted, and
+// fetching them fails with 404. Pending commands aren't subject to the bounds.
+func (s *Server) SetResultRetention(max int, ttl time.Duration) {
+	s.results.Lock()
+	defer s.results.Unlock()
+	s.results.max, s.results.ttl = max, ttl
+	s.results.evict(time.Now())
+}
+
+// ResultStats returns statistics about the results of async commands.
+func (s *Server) ResultStats() ResultStats {
+	s.results.Lock()
+	defer s.results.Unlock()
+	s.results.evict(time.Now())
+	return ResultStats{
+		Pending:        len(s.results.m) - len(s.results.completed),
+		Retained:       len(s.results.completed),
+		EvictedByCount: s.results.evictedByCount,
+		EvictedByAge:   s.results.evictedByAge,
+	}
+}
+
+// operation is an async command.
+type operation struct {
+	done      bool
+	lost      bool // the command was accepted, but no response arrived
+	response  []byte
+	completed time.Time
+}
+
+// results holds async commands, by id, until they're evicted.
+type results struct {
+	sync.Mutex
+	next      uint64
+	m         map[uint64]*operation
+	completed []uint64 // ids of completed operations, oldest first
+	max       int
+	ttl       time.Duration
+
+	evictedByCount uint64
+	evictedByAge   uint64
+}
+
+func newResults() *results {
+	return &results{
+		m:   map[uint64]*operation{},
+		max: DefaultMaxResults,
+		ttl: DefaultResultTTL,
+	}
+}
+
+// start registers a pending operation, and completes it with the response
+// when it arrives.
+func (r *results) start(response chan []byte) uint64 {
+	r.Lock()
+	r.next++
+	id := r.next
+	r.m[id] = &operation{}
+	r.Unlock()
+
+	go func() {
+		resp, ok := <-response
+		r.Lock()
+		defer r.Unlock()
+		now := time.Now()
+		op := r.m[id]
+		op.done, op.lost, op.response, op.completed = true, !ok, resp, now
+		r.completed = append(r.completed, id)
+		r.evict(now)
+	}()
+	return id
+}
+
+func (r *results) get(id uint64) (operation, bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.evict(time.Now())
+	op, ok := r.m[id]
+	if !ok {
+		return operation{}, false
+	}
+	return *op, true
+}
+
+// evict drops the oldest completed operations, while there are too many, or
+// they're too old. The caller must hold the lock.
+func (r *results) evict(now time.Time) {
+	n := 0
+	for _, id := range r.completed {
+		switch {
+		case len(r.completed)-n > r.max:
+			r.evictedByCount++
+		case now.Sub(r.m[id].completed) > r.ttl:
+			r.evictedByAge++
+		default:
+			r.completed = r.completed[n:]
+			return
+		}
+		delete(r.m, id)
+		n++
+	}
+	r.completed = r.completed[:0]
+}
+
+// operationResponse is the body of a pending or accepted async command.
+type operationResponse struct {
+	Id   uint64 `json:"id"`
+	Done bool   `json:"done"`
+}
+
+// startAsyncCommand answers an accepted async command with 202, and the
+// location of its eventual result.
+func (s *Server) startAsyncCommand(w http.ResponseWriter, response chan []byte) {
+	id := s.results.start(response)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", OperationPath+strconv.FormatUint(id, 10))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(operationResponse{Id: id})
+}
+
+// operationHandler serves the results of async commands. A pending command is
+// answered with 202, and a completed one with its response, as a synchronous
+// command would be.
+func (s *Server) operationHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, OperationPath), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid operation id", http.StatusBadRequest)
+			return
+		}
+		op, ok := s.results.get(id)
+		switch {
+		case !ok:
+			http.Error(w, "unknown or evicted operation", http.StatusNotFound)
+		case !op.done:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(operationResponse{Id: id})
+		case op.lost:
+			http.Error(w, "", http.StatusInternalServerError)
+		default:
+			w.Write(op.response)
+		}
+	}
+}
+
+var (
+	ErrOperationLost    = errors.New("async command lost, or its result unknown")
+	ErrUnknownOperation = errors.New("unknown or evicted async command")
+)
+
+// operationPollInterval is how often Operation.Wait polls for the result.
+const operationPollInterval = 10 * time.Millisecond
+
+// Operation is a handle to an async command, submitted with CommandAsync.
+type Operation struct {
+	Id     uint64
+	url    string // of its result, on the server that accepted it
+	client *http.Client
+}
+
+// CommandAsync submits the command to the remote server, or the leader it
+// redirects to, and returns as soon as the leader has appended it to its log,
+// without waiting for it to commit. It's meant for high volumes of writes that
+// can tolerate the rare loss of a command, e.g. when the leader fails before
+// replicating it. The returned Operation fetches the command's response from
+// the leader, once it's committed, which it holds until it's fetched, or
+// evicted; see Server.SetResultRetention.
+func (p *Peer) CommandAsync(ctx context.Context, cmd []byte) (*Operation, error) {
+	p.RLock()
+	u := p.url
+	p.RUnlock()
+	u.Path, u.RawQuery = CommandPath, "async=true"
+
+	client := p.commandClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(cmd))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		var ce commandError
+		if json.NewDecoder(resp.Body).Decode(&ce) == nil && ce.Error == raft.ErrUnknownLeader.Error() {
+			return nil, raft.ErrUnknownLeader
+		}
+		return nil, statusError(resp.StatusCode)
+	}
+	var op operationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&op); err != nil {
+		return nil, err
+	}
+	// The result is on the server that accepted the command, which may be
+	// the leader we were redirected to.
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return nil, err
+	}
+	return &Operation{Id: op.Id, url: location.String(), client: client}, nil
+}
+
+// Poll fetches the command's response, if it's been committed. It returns
+// ErrOperationLost if the command was lost, e.g. truncated by a new leader, and
+// ErrUnknownOperation if the leader doesn't hold its result, e.g. because
+// it's been evicted, or the leader restarted.
+func (o *Operation) Poll(ctx context.Context) (response []byte, done bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", o.url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		buf, err := ioutil.ReadAll(resp.Body)
+		return buf, err == nil, err
+	case http.StatusAccepted:
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, false, nil
+	case http.StatusNotFound:
+		return nil, false, ErrUnknownOperation
+	case http.StatusInternalServerError:
+		return nil, false, ErrOperationLost
+	default:
+		return nil, false, statusError(resp.StatusCode)
+	}
+}
+
+// Wait polls for the command's response until it's committed, or the context
+// is done. See Poll.
+func (o *Operation) Wait(ctx context.Context) ([]byte, error) {
+	for {
+		resp, done, err := o.Poll(ctx)
+		if err != nil || done {
+			return resp, err
+		}
+		select {
+		case <-time.After(operationPollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package rafthttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/peterbourgon/raft"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultSnapshotChunkSize is the size of the chunks a snapshot is sent in,
+// unless PeerOptions say otherwise.
+const DefaultSnapshotChunkSize = 1 << 20
+
+// snapshotHeader carries the InstallSnapshot RPC, as JSON, with each chunk of
+// its data.
+const snapshotHeader = "X-Raft-Install-Snapshot"
+
+var errSnapshotTruncated = errors.New("snapshot data is shorter than its size")
+
+// snapshotResponse answers a chunk of a snapshot, or a request for how much of
+// one the server has. Offset is how much of the snapshot it has received.
+// Once it has all of it, and the snapshot's been installed, Response is its
+// answer to the InstallSnapshot RPC.
+type snapshotResponse struct {
+	Offset   int64                         `json:"offset"`
+	Response *raft.InstallSnapshotResponse `json:"response,omitempty"`
+	Error    string                        `json:"error,omitempty"`
+}
+
+// InstallSnapshotContext sends the snapshot to the remote server, in chunks of
+// the configured size, each acknowledged before the next is sent, at no more
+// than the configured rate. If a chunk fails, it's retried as AppendEntries
+// are, from as much of it as the server acknowledges having received. If the
+// server already has part of the snapshot, e.g. from an earlier call that
+// failed, or whose context was done, the data it has is skipped, so a large
+// snapshot is sent once, even over a connection that keeps failing.
+//
+// Chunks aren't subject to the peer's timeout; the last one waits for the
+// snapshot to be installed, which may take a while. Only the context bounds
+// them.
+func (p *Peer) InstallSnapshotContext(ctx context.Context, is raft.InstallSnapshot, data io.Reader) (raft.InstallSnapshotResponse, error) {
+	header, err := json.Marshal(is)
+	if err != nil {
+		return raft.InstallSnapshotResponse{}, err
+	}
+	offset, err := p.snapshotOffset(ctx, is.Meta.Id)
+	if err != nil {
+		return raft.InstallSnapshotResponse{}, err
+	}
+	if offset > 0 {
+		if err := skip(data, offset); err != nil {
+			return raft.InstallSnapshotResponse{}, err
+		}
+	}
+
+	chunkSize := p.chunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultSnapshotChunkSize
+	}
+	chunk := make([]byte, chunkSize)
+	began, sent := time.Now(), int64(0)
+	for {
+		n, err := io.ReadFull(data, chunk)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return raft.InstallSnapshotResponse{}, err
+		}
+		resp, err := p.sendChunk(ctx, header, is.Meta.Id, offset, chunk[:n])
+		if err != nil {
+			return raft.InstallSnapshotResponse{}, err
+		}
+		if resp.Response != nil {
+			return *resp.Response, nil
+		}
+		if last {
+			return raft.InstallSnapshotResponse{}, errSnapshotTruncated
+		}
+		offset += int64(n)
+		sent += int64(n)
+		if err := p.throttle(ctx, began, sent); err != nil {
+			return raft.InstallSnapshotResponse{}, err
+		}
+	}
+}
+
+// skip discards the first n bytes of the data, by seeking past them, if it
+// can.
+func skip(data io.Reader, n int64) error {
+	if s, ok := data.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekCurrent)
+		return err
+	}
+	if _, err := io.CopyN(ioutil.Discard, data, n); err != nil {
+		if err == io.EOF {
+			return errSnapshotTruncated
+		}
+		return err
+	}
+	return nil
+}
+
+// throttle waits until sending the bytes sent since began doesn't exceed the
+// configured rate.
+func (p *Peer) throttle(ctx context.Context, began time.Time, sent int64) error {
+	if p.snapshotRate <= 0 {
+		return nil
+	}
+	wait := time.Duration(float64(sent)/float64(p.snapshotRate)*float64(time.Second)) - time.Since(began)
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendChunk sends a chunk of the snapshot, which begins at the offset. If it
+// fails, it asks the server how much of the chunk it received, and retries
+// with the rest, after waiting as the backoff says.
+func (p *Peer) sendChunk(ctx context.Context, header []byte, id string, offset int64, chunk []byte) (snapshotResponse, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := p.postChunk(ctx, header, id, offset, chunk)
+		if err == nil && resp.Response == nil && resp.Offset != offset+int64(len(chunk)) {
+			err = fmt.Errorf("chunk of snapshot %s at offset %d acknowledged through %d", id, offset, resp.Offset)
+		}
+		if err == nil || attempt >= p.retries || ctx.Err() != nil {
+			return resp, err
+		}
+		if err := p.wait(ctx, attempt+1, err); err != nil {
+			return snapshotResponse{}, err
+		}
+
+		acked, err := p.snapshotOffset(ctx, id)
+		if err != nil {
+			continue
+		}
+		if acked < offset || acked > offset+int64(len(chunk)) {
+			return snapshotResponse{}, fmt.Errorf("can't resume snapshot %s at offset %d: it's sent through %d", id, acked, offset)
+		}
+		chunk, offset = chunk[acked-offset:], acked
+	}
+}
+
+func (p *Peer) postChunk(ctx context.Context, header []byte, id string, offset int64, chunk []byte) (snapshotResponse, error) {
+	p.RLock()
+	u := p.url
+	p.RUnlock()
+	u.Path = InstallSnapshotPath
+	u.RawQuery = url.Values{"id": {id}, "offset": {strconv.FormatInt(offset, 10)}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(chunk))
+	if err != nil {
+		return snapshotResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(snapshotHeader, string(header))
+	return p.snapshotRequest(req)
+}
+
+// snapshotOffset asks the server how much of the snapshot it has received.
+func (p *Peer) snapshotOffset(ctx context.Context, id string) (int64, error) {
+	p.RLock()
+	u := p.url
+	p.RUnlock()
+	u.Path = InstallSnapshotPath
+	u.RawQuery = url.Values{"id": {id}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := p.snapshotRequest(req)
+	return resp.Offset, err
+}
+
+func (p *Peer) snapshotRequest(req *http.Request) (snapshotResponse, error) {
+	client := p.commandClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return snapshotResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotImplemented {
+		io.Copy(ioutil.Discard, resp.Body)
+		return snapshotResponse{}, raft.ErrSnapshotNotSupported
+	}
+	var sr snapshotResponse
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		return snapshotResponse{}, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return sr, fmt.Errorf("HTTP %d: %s", resp.StatusCode, sr.Error)
+	}
+	return sr, nil
+}
+
+// upload is a snapshot the server is receiving, which it keeps in a temporary
+// file until it has all of it.
+type upload struct {
+	is     raft.InstallSnapshot
+	f      *os.File
+	offset int64
+}
+
+func (u *upload) discard() {
+	u.f.Close()
+	os.Remove(u.f.Name())
+}
+
+// uploads holds the snapshot being received, if any. A server only installs
+// one snapshot at a time, so a new snapshot replaces the one before.
+type uploads struct {
+	sync.Mutex
+	current *upload
+}
+
+// installSnapshotHandler receives a snapshot in chunks, and installs it once
+// it has all of it. A POST carries a chunk of the snapshot given by the id
+// parameter, from the offset parameter, which must be how much of it the
+// server already has. A GET answers how much of the snapshot that is, so a
+// client can resume sending it.
+func (s *Server) installSnapshotHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		sp, ok := s.server.(raft.SnapshotPeer)
+		if !ok {
+			http.Error(w, raft.ErrSnapshotNotSupported.Error(), http.StatusNotImplemented)
+			return
+		}
+		id := r.URL.Query().Get("id")
+
+		s.uploads.Lock()
+		defer s.uploads.Unlock()
+		u := s.uploads.current
+		if u != nil && u.is.Meta.Id != id {
+			u = nil
+		}
+		have := int64(0)
+		if u != nil {
+			have = u.offset
+		}
+		if r.Method == "GET" {
+			writeSnapshotResponse(w, http.StatusOK, snapshotResponse{Offset: have})
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		if err != nil {
+			writeSnapshotResponse(w, http.StatusBadRequest, snapshotResponse{Offset: have, Error: err.Error()})
+			return
+		}
+		if offset != have {
+			writeSnapshotResponse(w, http.StatusConflict, snapshotResponse{Offset: have, Error: fmt.Sprintf("expected offset %d", have)})
+			return
+		}
+		if u == nil {
+			var is raft.InstallSnapshot
+			if err := json.Unmarshal([]byte(r.Header.Get(snapshotHeader)), &is); err != nil || is.Meta.Id != id {
+				writeSnapshotResponse(w, http.StatusBadRequest, snapshotResponse{Error: "missing or invalid " + snapshotHeader})
+				return
+			}
+			f, err := ioutil.TempFile("", "rafthttp-snapshot-")
+			if err != nil {
+				writeSnapshotResponse(w, http.StatusInternalServerError, snapshotResponse{Error: err.Error()})
+				return
+			}
+			if s.uploads.current != nil {
+				s.uploads.current.discard()
+			}
+			u = &upload{is: is, f: f}
+			s.uploads.current = u
+		}
+
+		// Whatever arrives counts, even if the chunk is cut short, so the
+		// client can resume from there.
+		n, err := io.Copy(u.f, io.LimitReader(r.Body, u.is.Meta.Size-u.offset+1))
+		u.offset += n
+		switch {
+		case u.offset > u.is.Meta.Size:
+			u.discard()
+			s.uploads.current = nil
+			writeSnapshotResponse(w, http.StatusBadRequest, snapshotResponse{Error: "snapshot data is longer than its size"})
+			return
+		case err != nil:
+			writeSnapshotResponse(w, http.StatusBadRequest, snapshotResponse{Offset: u.offset, Error: err.Error()})
+			return
+		case u.offset < u.is.Meta.Size:
+			writeSnapshotResponse(w, http.StatusOK, snapshotResponse{Offset: u.offset})
+			return
+		}
+
+		// That's all of it.
+		s.uploads.current = nil
+		defer u.discard()
+		if _, err := u.f.Seek(0, io.SeekStart); err != nil {
+			writeSnapshotResponse(w, http.StatusInternalServerError, snapshotResponse{Error: err.Error()})
+			return
+		}
+		resp, err := sp.InstallSnapshotContext(r.Context(), u.is, u.f)
+		if err != nil {
+			writeSnapshotResponse(w, http.StatusServiceUnavailable, snapshotResponse{Error: err.Error()})
+			return
+		}
+		writeSnapshotResponse(w, http.StatusOK, snapshotResponse{Offset: u.offset, Response: &resp})
+	}
+}
+
+func writeSnapshotResponse(w http.ResponseWriter, code int, resp snapshotResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,203 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	ErrSnapshotNotSupported = errors.New("peer can't install snapshots")
+	ErrSnapshotRejected     = errors.New("snapshot rejected")
+)
+
+// InstallSnapshot is sent by the leader to a follower whose next entries it's
+// discarded, with the data of its latest snapshot, to replace the follower's
+// state machine, and its log up to the snapshot's index.
+type InstallSnapshot struct {
+	Term      uint64       `json:"term"`
+	LeaderId  uint64       `json:"leader_id"`
+	Meta      SnapshotMeta `json:"meta"`
+	ClusterId string       `json:"cluster_id,omitempty"` // see SetClusterId
+}
+
+// InstallSnapshotResponse is the follower's answer to an InstallSnapshot.
+type InstallSnapshotResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	reason  string
+}
+
+// SnapshotPeer is implemented by peers that can send a snapshot to their
+// server, so it can be caught up after the leader has discarded the entries
+// it needs. A leader can't catch up a follower behind its snapshot through a
+// peer that doesn't implement it.
+type SnapshotPeer interface {
+	InstallSnapshotContext(context.Context, InstallSnapshot, io.Reader) (InstallSnapshotResponse, error)
+}
+
+type installSnapshotTuple struct {
+	Request  InstallSnapshot
+	Id       string // of the snapshot, as we stored it
+	Response chan InstallSnapshotResponse
+}
+
+// InstallSnapshotContext stores the snapshot's data in our snapshot store,
+// and then, if the leader is still legitimate, restores it. Transports should
+// call it with the data as it arrives. It gives up when the context is done,
+// returning its error, and fails with ErrCorruptSnapshot if the data doesn't
+// match the snapshot's size and checksum, or with ErrClusterMismatch if the
+// leader is in another cluster.
+func (s *Server) InstallSnapshotContext(ctx context.Context, is InstallSnapshot, data io.Reader) (InstallSnapshotResponse, error) {
+	if !s.acceptsCluster(is.ClusterId) {
+		s.logGeneric("rejecting InstallSnapshot from %d, of cluster %q", is.LeaderId, is.ClusterId)
+		return InstallSnapshotResponse{}, ErrClusterMismatch
+	}
+	if s.snapshots == nil {
+		return InstallSnapshotResponse{}, ErrNoSnapshotStore
+	}
+	sink, err := s.snapshots.Create(is.Meta)
+	if err != nil {
+		return InstallSnapshotResponse{}, err
+	}
+	if _, err := io.Copy(sink, data); err != nil {
+		sink.Cancel()
+		return InstallSnapshotResponse{}, err
+	}
+	if err := sink.Close(); err != nil {
+		return InstallSnapshotResponse{}, err
+	}
+	stored := sink.Meta()
+	if stored.Size != is.Meta.Size || stored.CRC != is.Meta.CRC {
+		s.snapshots.Delete(stored.Id)
+		return InstallSnapshotResponse{}, ErrCorruptSnapshot
+	}
+
+	t := installSnapshotTuple{
+		Request:  is,
+		Id:       stored.Id,
+		Response: make(chan InstallSnapshotResponse, 1),
+	}
+	select {
+	case s.installSnapshotChan <- t:
+	case <-s.stopped:
+		return InstallSnapshotResponse{}, ErrStopped
+	case <-ctx.Done():
+		return InstallSnapshotResponse{}, ctx.Err()
+	}
+	select {
+	case resp := <-t.Response:
+		return resp, nil
+	case <-s.stopped:
+		return InstallSnapshotResponse{}, ErrStopped
+	case <-ctx.Done():
+		return InstallSnapshotResponse{}, ctx.Err()
+	}
+}
+
+// handleInstallSnapshot restores the stored snapshot, unless the leader's term
+// is stale, or we've already committed past the snapshot. Like
+// handleAppendEntries, it returns whether we should step down.
+func (s *Server) handleInstallSnapshot(r InstallSnapshot, id string) (InstallSnapshotResponse, bool) {
+	if r.Term < s.term {
+		return InstallSnapshotResponse{
+			Term:   s.term,
+			reason: fmt.Sprintf("Term %d < %d", r.Term, s.term),
+		}, false
+	}
+
+	stepDown := false
+	if r.Term > s.term || (s.State() == Candidate && r.LeaderId != s.leader) {
+		s.term = r.Term
+		s.vote = noVote
+		stepDown = true
+	}
+	if err := s.saveStable(); err != nil {
+		return InstallSnapshotResponse{
+			Term:   s.term,
+			reason: fmt.Sprintf("persisting term: %s", err),
+		}, stepDown
+	}
+	s.resetElectionTimeout()
+	s.lastContact = time.Now()
+
+	if r.Meta.Index <= s.log.getCommitIndex() {
+		return InstallSnapshotResponse{Term: s.term, Success: true, reason: "already committed"}, stepDown
+	}
+	if err := s.restoreSnapshot(id); err != nil {
+		return InstallSnapshotResponse{
+			Term:   s.term,
+			reason: fmt.Sprintf("restoring snapshot: %s", err),
+		}, stepDown
+	}
+	return InstallSnapshotResponse{Term: s.term, Success: true, reason: "restored"}, stepDown
+}
+
+func (s *Server) logInstallSnapshotResponse(req InstallSnapshot, resp InstallSnapshotResponse, stepDown bool) {
+	s.logGeneric(
+		"got InstallSnapshot, leader=%d index/term=%d/%d: responded with success=%v (%s) stepDown=%v",
+		req.LeaderId,
+		req.Meta.Index,
+		req.Meta.Term,
+		resp.Success,
+		resp.reason,
+		stepDown,
+	)
+}
+
+// sendSnapshot sends our latest snapshot to a follower whose next entries
+// we've discarded, and, if it's installed, moves the follower's prevLogIndex
+// up to the snapshot's index. Like flush, it's synchronous.
+func (s *Server) sendSnapshot(ctx context.Context, peer Peer, ni *nextIndex, prevLogIndex uint64) error {
+	peerId := peer.Id()
+	sp, ok := peer.(SnapshotPeer)
+	if !ok || s.snapshots == nil {
+		return ErrSnapshotNotSupported
+	}
+	currentTerm := s.term
+	snapshots, err := s.snapshots.List()
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		return ErrUnknownSnapshot
+	}
+	meta, data, err := s.snapshots.Open(snapshots[0].Id)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	s.logGeneric("flush to %d: prevLogIndex=%d is compacted: sending snapshot %s, through index %d", peerId, prevLogIndex, meta.Id, meta.Index)
+	ni.sendingSnapshot(peerId, true)
+	defer ni.sendingSnapshot(peerId, false)
+	began := time.Now()
+	resp, err := sp.InstallSnapshotContext(ctx, InstallSnapshot{
+		Term:      currentTerm,
+		LeaderId:  s.id,
+		Meta:      meta,
+		ClusterId: s.clusterId,
+	}, s.snapshotRate.throttle(ctx, data))
+	s.metrics.rpc("install_snapshot", peerId, began, err)
+	if err != nil {
+		return err
+	}
+	if resp.Term > currentTerm {
+		s.logGeneric("flush to %d: responseTerm=%d > currentTerm=%d: deposed", peerId, resp.Term, currentTerm)
+		s.observeTerm(resp.Term)
+		return ErrDeposed
+	}
+	if !resp.Success {
+		return ErrSnapshotRejected
+	}
+	ni.contacted(peerId, meta.Index)
+	newPrevLogIndex, err := ni.set(peerId, meta.Index, prevLogIndex)
+	if err != nil {
+		return err
+	}
+	ni.matched(peerId, newPrevLogIndex)
+	s.logGeneric("flush to %d: snapshot installed; prevLogIndex(%d) becomes %d", peerId, peerId, newPrevLogIndex)
+	return nil
+}
@@ -0,0 +1,66 @@
+package raft
+
+import (
+	"time"
+)
+
+type journalTuple struct {
+	Data     []byte
+	Response chan journalResponse
+}
+
+type journalResponse struct {
+	index uint64
+	err   error
+}
+
+// Journal appends the data to the log as a journal entry, which is replicated
+// like a command, but never reaches the state machine. Instead, each server
+// emits a Journaled event as it commits the entry, carrying the data, e.g. for
+// audit trails, or notifying every server of something without changing the
+// application's state. It must be called on the leader; other servers return
+// ErrNotLeader. It returns the entry's index once it's appended, which
+// identifies its events.
+func (s *Server) Journal(data []byte) (uint64, error) {
+	if len(data) == 0 {
+		return 0, ErrNoCommand
+	}
+	response := make(chan journalResponse, 1)
+	select {
+	case s.journalChan <- journalTuple{data, response}:
+	case <-s.stopped:
+		return 0, ErrStopped
+	}
+	r := <-response
+	return r.index, r.err
+}
+
+// appendJournal appends a journal entry to our log.
+func (s *Server) appendJournal(data []byte) (uint64, error) {
+	entry := LogEntry{
+		Index:   s.log.lastIndex() + 1,
+		Term:    s.term,
+		Type:    EntryJournal,
+		Command: data,
+	}
+	if err := s.log.appendEntry(entry); err != nil {
+		return 0, err
+	}
+	return entry.Index, nil
+}
+
+// journaled is called by the log when a journal entry is committed.
+func (s *Server) journaled(entry LogEntry) {
+	s.logGeneric("journal entry %d committed", entry.Index)
+	if s.eventHandler == nil {
+		return
+	}
+	s.eventHandler(Event{
+		Type:  Journaled,
+		Id:    s.id,
+		Term:  s.term,
+		Index: entry.Index,
+		Time:  time.Now(),
+		Data:  entry.Command,
+	})
+}
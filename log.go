@@ -2,10 +2,13 @@ package raft
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"math"
 	"sync"
 	"time"
 )
@@ -19,29 +22,126 @@ var (
 	ErrNoCommand       = errors.New("no command")
 	ErrBadIndex        = errors.New("bad index")
 	ErrBadTerm         = errors.New("bad term")
+	ErrBadEntryType    = errors.New("bad entry type")
 )
 
+// Syncer is implemented by log stores that buffer writes until they're
+// synced, like a raftwal.WAL in group commit mode. The log writes all the
+// entries committed at once, and then syncs them as its SyncPolicy says;
+// under the default policy, with a single call, before applying any of them,
+// or responding to any client. Followers do the same with the entries of
+// each AppendEntries request, before acknowledging them. Stores that don't
+// implement it must make each write durable before it returns.
+type Syncer interface {
+	Sync() error
+}
+
+// SyncPolicy determines when the log syncs a store that's a Syncer. Only
+// SyncAlways keeps the promise Raft makes to clients, that a committed
+// command survives the crash of every server: the others trade it for
+// throughput, and should be chosen knowing what can be lost.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs each batch of committed entries before they're
+	// applied. This is the default.
+	SyncAlways SyncPolicy = iota
+
+	// SyncInterval syncs at most once per interval, so entries committed in
+	// between may be applied, and acknowledged, before they're durable, and
+	// lost in a crash, for up to the interval.
+	SyncInterval
+
+	// SyncNever leaves syncing to the store, or the operating system, and to
+	// explicit calls to Sync.
+	SyncNever
+)
+
+// Compactor is implemented by log stores that can discard the entries a
+// snapshot has made redundant, like a raftwal.WAL. Compact(n) discards the
+// records before the nth; the log writes a record for each entry, in order,
+// so the nth record holds the entry with index n, or, if conflicting entries
+// were replaced, a later one does, and the records before it are no longer
+// needed either way.
+type Compactor interface {
+	Compact(n uint64) error
+}
+
+// Resetter is implemented by log stores that can discard all their records,
+// so the next record written is the nth. The log resets its store when it's
+// replaced by a snapshot from the leader, which its entries don't reach, to
+// keep the nth record holding the entry with index n. Stores that aren't
+// Resetters keep their records, which are discarded as they're recovered.
+type Resetter interface {
+	Reset(n uint64) error
+}
+
 type Log struct {
 	sync.RWMutex
-	store     io.Writer
-	entries   []LogEntry
-	commitPos int
-	apply     func([]byte) ([]byte, error)
+	store       io.Writer
+	entries     []LogEntry
+	commitPos   int
+	persistPos  int  // entries up to and including this one are in the store
+	unsynced    bool // written to the store, but not yet synced
+	replacing   bool // the store has entries we've discarded; see replacesFlag
+	syncPolicy  SyncPolicy
+	syncEvery   time.Duration // under SyncInterval
+	lastSync    time.Time
+	syncTimer   *time.Timer // pending sync of entries deferred by SyncInterval
+	apply       func([]byte) ([]byte, error)
+	applyEntry  func(LogEntry) ([]byte, error) // replaces apply; see SetApplyEntry
+	configure   func([]byte) error             // called for committed configuration entries
+	journal     func(LogEntry)                 // called for committed journal entries
+	applied     uint64                         // index of the last entry applied
+	applyMu     sync.Mutex                     // held while an entry's applied; see SetAsyncApply
+	applier     *applier                       // if entries are applied asynchronously
+	applyPolicy ApplyPolicy                    // when the apply function fails
+	applyFailed func(LogEntry, error)          // reports it
+	halted      error                          // why the policy halted the log
+	checkpoint  uint64                         // the state machine's; see SetCheckpointer
+	stream      *commitStream                  // replaces apply; see SetCommitStream
+
+	// The entries up to and including compactedIndex have been discarded,
+	// and are in a snapshot. lastSnapshot is the index of the latest
+	// snapshot, which may be later, since entries are kept for a while after
+	// they're snapshotted, for followers that are just behind.
+	compactedIndex uint64
+	compactedTerm  uint64
+	lastSnapshot   uint64
+	sinceSnapshot  int64  // bytes of commands committed after lastSnapshot
+	configuration  []byte // the command of the latest committed configuration entry
+
+	decodeEntry DecodeEntry
+	sessions    *sessions // if enabled; see SetSessions
+	inflight    *inflight
+	recovered   error // why recovery from the store stopped, if it stopped early
+	metrics     *metrics
+
+	recoveredEntries int   // read from the store by recover
+	recoveredBytes   int64 // in them
 }
 
 func NewLog(store io.ReadWriter, apply func([]byte) ([]byte, error)) *Log {
 	l := &Log{
-		store:     store,
-		entries:   []LogEntry{},
-		commitPos: -1, // no commits to begin with
-		apply:     apply,
+		store:      store,
+		entries:    []LogEntry{},
+		commitPos:  -1, // no commits to begin with
+		persistPos: -1,
+		apply:      apply,
+		inflight:   newInflight(),
 	}
-	l.recover(store)
+
+	l.recovered = l.recover(store)
+	l.persistPos = len(l.entries) - 1 // they're already in the store
 	return l
 }
 
 // recover reads from the log's store, to populate the log with log entries
 // from persistent storage. It should be called once, at log instantiation.
+// An entry that can't be decoded, e.g. because a crash tore its write, ends
+// the log. An entry that decodes, but doesn't follow the one before it, means
+// the store is broken, and is reported as a regression, unless it's marked as
+// replacing the entries it doesn't follow.
 func (l *Log) recover(r io.Reader) error {
 	for {
 		var entry LogEntry
@@ -51,7 +151,21 @@ func (l *Log) recover(r io.Reader) error {
 		default:
 			return err // unsuccessful completion
 		case nil:
-			if err = l.appendEntry(entry); err != nil {
+			if entry.Type&replacesFlag != 0 {
+				entry.Type &^= replacesFlag
+				for len(l.entries) > 0 && l.entries[len(l.entries)-1].Index >= entry.Index {
+					l.entries = l.entries[:len(l.entries)-1]
+				}
+			}
+			switch err = l.appendEntry(entry); err {
+			case nil:
+				l.recoveredEntries++
+				l.recoveredBytes += entry.encodedSize()
+			case ErrTermTooSmall:
+				return ErrTermRegression
+			case ErrIndexTooSmall:
+				return ErrIndexRegression
+			default:
 				return err
 			}
 		}
@@ -63,20 +177,21 @@ func (l *Log) recover(r io.Reader) error {
 // convenience to the caller. (This function is only used by a leader attempting
 // to flush log entries to its followers.)
 //
-// This function is called to populate an AppendEntries RPC. That implies they
-// are destined for a follower, which implies the application of the commands
-// should have the response thrown away, which implies we shouldn't pass a
-// commandResponse channel (see: commitTo implementation). In the normal case,
-// the LogEntries we return here will get serialized as they pass thru their
-// transport, and lose their commandResponse channel anyway. But in the case of
-// a LocalPeer (or equivalent) this doesn't happen. So, we must make sure to
-// proactively strip commandResponse channels.
-func (l *Log) entriesAfter(index uint64) ([]LogEntry, uint64) {
+// The returned entries are a copy, so they can safely be handed to a transport
+// (or a LocalPeer) while the log continues to change. If the entries after the
+// index have been compacted into a snapshot, it returns false.
+func (l *Log) entriesAfter(index uint64) ([]LogEntry, uint64, bool) {
 	l.RLock()
 	defer l.RUnlock()
 
+	if index < l.compactedIndex {
+		return nil, 0, false
+	}
 	pos := 0
 	lastTerm := uint64(0)
+	if index == l.compactedIndex {
+		lastTerm = l.compactedTerm
+	}
 	for ; pos < len(l.entries); pos++ {
 		if l.entries[pos].Index > index {
 			break
@@ -86,23 +201,30 @@ func (l *Log) entriesAfter(index uint64) ([]LogEntry, uint64) {
 
 	a := l.entries[pos:]
 	if len(a) == 0 {
-		return []LogEntry{}, lastTerm
+		return []LogEntry{}, lastTerm, true
 	}
 
-	return stripResponseChannels(a), lastTerm
+	return append([]LogEntry{}, a...), lastTerm, true
 }
 
-func stripResponseChannels(a []LogEntry) []LogEntry {
-	stripped := make([]LogEntry, len(a))
-	for i, entry := range a {
-		stripped[i] = LogEntry{
-			Index:           entry.Index,
-			Term:            entry.Term,
-			Command:         entry.Command,
-			commandResponse: nil,
+// retained returns a copy of the entries that haven't been compacted.
+func (l *Log) retained() []LogEntry {
+	l.RLock()
+	defer l.RUnlock()
+	return append([]LogEntry{}, l.entries...)
+}
+
+// lastOfType returns the index of the last retained entry of the given type,
+// or zero if there isn't one.
+func (l *Log) lastOfType(t EntryType) uint64 {
+	l.RLock()
+	defer l.RUnlock()
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if l.entries[i].Type == t {
+			return l.entries[i].Index
 		}
 	}
-	return stripped
+	return 0
 }
 
 // contains returns true if a log entry with the given index and term exists in
@@ -111,6 +233,9 @@ func (l *Log) contains(index, term uint64) bool {
 	l.RLock()
 	defer l.RUnlock()
 
+	if index == l.compactedIndex && index > 0 {
+		return term == l.compactedTerm
+	}
 	// It's not necessarily true that l.entries[i] has index == i.
 	for _, entry := range l.entries {
 		if entry.Index == index && entry.Term == term {
@@ -147,13 +272,23 @@ func (l *Log) ensureLastIs(index, term uint64) error {
 	// decide we need a complete log rebuild. Of course, that's only valid if we
 	// haven't committed anything, so this check comes after that one.
 	if index == 0 {
-		for pos := 0; pos < len(l.entries); pos++ {
-			if l.entries[pos].commandResponse != nil {
-				close(l.entries[pos].commandResponse)
-				l.entries[pos].commandResponse = nil
-			}
-		}
+		l.inflight.truncate(0)
 		l.entries = []LogEntry{}
+		l.discardPersisted(0)
+		return nil
+	}
+
+	// The passed index may be the last one we've compacted, in which case
+	// everything we have follows it.
+	if index == l.compactedIndex {
+		if term != l.compactedTerm {
+			return ErrBadTerm
+		}
+		if len(l.entries) > 0 {
+			l.inflight.truncate(index)
+			l.entries = []LogEntry{}
+			l.discardPersisted(0)
+		}
 		return nil
 	}
 
@@ -190,20 +325,25 @@ func (l *Log) ensureLastIs(index, term uint64) error {
 	// If we blow away log entries that haven't yet sent responses to clients,
 	// signal the clients to stop waiting, by closing the channel without a
 	// response value.
-	for pos = truncateFrom; pos < len(l.entries); pos++ {
-		if l.entries[pos].commandResponse != nil {
-			close(l.entries[pos].commandResponse)
-			l.entries[pos].commandResponse = nil
-		}
-	}
+	l.inflight.truncate(index)
 
 	// Truncate the log.
 	l.entries = l.entries[:truncateFrom]
+	l.discardPersisted(truncateFrom)
 
 	// Done.
 	return nil
 }
 
+// discardPersisted notes that the entries from the passed position on have
+// been discarded, after truncating the log. Those that were in the store
+// stay there, to be replaced by the next entry written.
+func (l *Log) discardPersisted(pos int) {
+	if l.persistPos >= pos {
+		l.persistPos, l.replacing = pos-1, true
+	}
+}
+
 // getCommitIndex returns the commit index of the log. That is, the index of the
 // last log entry which can be considered committed.
 func (l *Log) getCommitIndex() uint64 {
@@ -214,7 +354,7 @@ func (l *Log) getCommitIndex() uint64 {
 
 func (l *Log) getCommitIndexWithLock() uint64 {
 	if l.commitPos < 0 {
-		return 0
+		return l.compactedIndex
 	}
 	if l.commitPos >= len(l.entries) {
 		panic(fmt.Sprintf("commitPos %d > len(l.entries) %d; bad bookkeeping in Log", l.commitPos, len(l.entries)))
@@ -222,6 +362,88 @@ func (l *Log) getCommitIndexWithLock() uint64 {
 	return l.entries[l.commitPos].Index
 }
 
+// termAt returns the term of the log entry with the given index, or 0 if no
+// such entry exists.
+func (l *Log) termAt(index uint64) uint64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.termAtWithLock(index)
+}
+
+func (l *Log) termAtWithLock(index uint64) uint64 {
+	if index == l.compactedIndex && index > 0 {
+		return l.compactedTerm
+	}
+	for pos := len(l.entries) - 1; pos >= 0; pos-- {
+		if l.entries[pos].Index == index {
+			return l.entries[pos].Term
+		}
+		if l.entries[pos].Index < index {
+			break
+		}
+	}
+	return 0
+}
+
+// lastIndexOfTerm returns the index of the last log entry with the given term,
+// or 0 if there are none.
+func (l *Log) lastIndexOfTerm(term uint64) uint64 {
+	l.RLock()
+	defer l.RUnlock()
+
+	for pos := len(l.entries) - 1; pos >= 0; pos-- {
+		if l.entries[pos].Term == term {
+			return l.entries[pos].Index
+		}
+		if l.entries[pos].Term < term {
+			break
+		}
+	}
+	return 0
+}
+
+// gap describes how our log differs from a leader's whose previous log entry
+// has the given index, and which we've rejected.
+func (l *Log) gap(index uint64) *LogGap {
+	l.RLock()
+	defer l.RUnlock()
+
+	g := &LogGap{
+		LastIndex:   l.lastIndexWithLock(),
+		CommitIndex: l.getCommitIndexWithLock(),
+	}
+	if index <= g.CommitIndex || index > g.LastIndex {
+		return g
+	}
+
+	pos := len(l.entries) - 1
+	for ; pos >= 0 && l.entries[pos].Index > index; pos-- {
+	}
+	if pos < 0 || l.entries[pos].Index != index {
+		return g
+	}
+	g.ConflictTerm = l.entries[pos].Term
+	for ; pos > 0 && l.entries[pos-1].Term == g.ConflictTerm; pos-- {
+	}
+	g.ConflictIndex = l.entries[pos].Index
+	return g
+}
+
+// size returns the number of entries in the log.
+func (l *Log) size() int {
+	l.RLock()
+	defer l.RUnlock()
+	return len(l.entries)
+}
+
+// snapshotted returns the index of the latest snapshot, and of the last entry
+// compacted into one.
+func (l *Log) snapshotted() (lastSnapshot, compactedIndex uint64) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.lastSnapshot, l.compactedIndex
+}
+
 // lastIndex returns the index of the most recent log entry.
 func (l *Log) lastIndex() uint64 {
 	l.RLock()
@@ -231,7 +453,7 @@ func (l *Log) lastIndex() uint64 {
 
 func (l *Log) lastIndexWithLock() uint64 {
 	if len(l.entries) <= 0 {
-		return 0
+		return l.compactedIndex
 	}
 	return l.entries[len(l.entries)-1].Index
 }
@@ -245,25 +467,29 @@ func (l *Log) lastTerm() uint64 {
 
 func (l *Log) lastTermWithLock() uint64 {
 	if len(l.entries) <= 0 {
-		return 0
+		return l.compactedTerm
 	}
 	return l.entries[len(l.entries)-1].Term
 }
 
 // appendEntry appends the passed log entry to the log. It will return an error
-// if the entry's term is smaller than the log's most recent term, or if the
-// entry's index is too small relative to the log's most recent entry.
+// if the entry's term is smaller than the log's most recent term, if the
+// entry's index is too small relative to the log's most recent entry, or if
+// there's no index left after it.
 func (l *Log) appendEntry(entry LogEntry) error {
 	l.Lock()
 	defer l.Unlock()
 
-	if len(l.entries) > 0 {
+	if len(l.entries) > 0 || l.compactedIndex > 0 {
 		lastTerm := l.lastTermWithLock()
 		if entry.Term < lastTerm {
 			return ErrTermTooSmall
 		}
 		lastIndex := l.lastIndexWithLock()
-		if entry.Term == lastTerm && entry.Index <= lastIndex {
+		if lastIndex == math.MaxUint64 {
+			return ErrIndexOverflow
+		}
+		if entry.Index <= lastIndex {
 			return ErrIndexTooSmall
 		}
 	}
@@ -274,7 +500,8 @@ func (l *Log) appendEntry(entry LogEntry) error {
 
 // commitTo commits all log entries up to and including the passed commitIndex.
 // Commit means: synchronize the log entry to persistent storage, and call the
-// state machine apply function for the log entry's command.
+// state machine apply function for the log entry's command, or, if entries
+// are applied asynchronously, leave that to the applier.
 func (l *Log) commitTo(commitIndex uint64) error {
 	if commitIndex == 0 {
 		panic("commitTo(0)")
@@ -304,6 +531,13 @@ func (l *Log) commitTo(commitIndex uint64) error {
 		panic("pending commit pos < 0")
 	}
 
+	// Persist the entries up to the commit index that aren't already in the
+	// store, e.g. because we're the leader, and appended them ourselves, and
+	// sync them all at once, before acting on any of them.
+	if err := l.persistTo(commitIndex); err != nil {
+		return err
+	}
+
 	// Commit entries between our existing commit index and the passed index.
 	// Remember to include the passed index.
 	for {
@@ -315,27 +549,22 @@ func (l *Log) commitTo(commitIndex uint64) error {
 			panic("commitTo advanced past the desired commitIndex")
 		}
 
-		// Encode the entry to persistent storage.
-		if err := l.entries[pos].encode(l.store); err != nil {
-			return err
-		}
-
-		// Apply the entry's command to our state machine.
-		resp, err := l.apply(l.entries[pos].Command)
-		if err != nil {
-			return err
+		// Configuration and journal entries are for the server, which acts
+		// on them as they commit, however far behind the state machine is.
+		switch entry := l.entries[pos]; {
+		case entry.Type == EntryConfiguration && l.configure != nil:
+			if err := l.configure(entry.Command); err != nil {
+				return err
+			}
+		case entry.Type == EntryJournal && l.journal != nil:
+			l.journal(entry)
 		}
 
-		// Transmit the response to waiting client, if applicable.
-		if l.entries[pos].commandResponse != nil {
-			select {
-			case l.entries[pos].commandResponse <- resp: // TODO could `go` this
-				//
-			case <-time.After(BroadcastInterval()): // << ElectionInterval
-				panic("uncoöperative command response receiver")
+		// Unless the applier applies it later, apply the entry now.
+		if l.applier == nil {
+			if err := l.applyCommitted(l.entries[pos], func(f func()) { f() }); err != nil {
+				return err
 			}
-			close(l.entries[pos].commandResponse)
-			l.entries[pos].commandResponse = nil
 		}
 
 		// Mark our commit position cursor.
@@ -354,24 +583,410 @@ func (l *Log) commitTo(commitIndex uint64) error {
 	}
 
 	// Done.
+	l.applier.wake()
+	return nil
+}
+
+// applyCommitted applies the committed entry after the last one applied, with
+// the log locked, and transmits its response to the waiting client, if any.
+// The state machine is called through call, which runs the function it's
+// passed, perhaps with the log unlocked.
+func (l *Log) applyCommitted(entry LogEntry, call func(func())) error {
+	if l.halted != nil {
+		return l.halted
+	}
+	apply := func(entry LogEntry) (resp []byte, rejected *CommandError, err error) {
+		call(func() { resp, rejected, err = l.applyCommand(entry) })
+		return resp, rejected, err
+	}
+
+	// Apply the entry's command to our state machine. Configuration
+	// entries are for the server, not the state machine.
+	var (
+		resp     []byte
+		rejected *CommandError
+	)
+	switch entry.Type {
+	case EntryCommand:
+		applied, rejection, err := apply(entry)
+		if err != nil {
+			return err
+		}
+		resp, rejected = applied, rejection
+		l.sinceSnapshot += int64(len(entry.Command))
+		l.metrics.add(MetricCommandBytes, float64(len(entry.Command)))
+	case EntrySession:
+		resp = l.sessions.register(entry.Index)
+	case EntrySessionCommand:
+		entry, id, seq, err := untagSessionCommand(entry)
+		if err != nil {
+			return err
+		}
+		switch cached, ok := l.sessions.lookup(id, seq); {
+		case !ok:
+			// The session's expired, or the client's moved on.
+			l.inflight.lose(entry.Index)
+		case cached != nil:
+			// The response the client missed.
+			resp, rejected = cached.Response, cached.rejection()
+		default:
+			applied, rejection, err := apply(entry)
+			if err != nil {
+				return err
+			}
+			l.sessions.applied(id, seq, entry.Index, applied, rejection)
+			resp, rejected = applied, rejection
+		}
+		l.sinceSnapshot += int64(len(entry.Command))
+		l.metrics.add(MetricCommandBytes, float64(len(entry.Command)))
+	case EntryConfiguration:
+		l.configuration = entry.Command
+	case EntryBarrier:
+		l.metrics.incr(MetricBarriers)
+	case EntryJournal, EntryNoop:
+		// nothing to do
+	default:
+		return ErrBadEntryType
+	}
+
+	// Transmit the response to waiting client, if applicable.
+	if rejected != nil {
+		l.inflight.reject(entry.Index, rejected)
+	} else {
+		l.inflight.commit(entry.Index, entry.Term, resp)
+	}
+	l.applied = entry.Index
+	return nil
+}
+
+// applyCommand decodes the command entry, if entries are encoded, and applies
+// it to the state machine, which either answers it, or rejects it with a
+// CommandError. Any other error means it couldn't be applied.
+func (l *Log) applyCommand(entry LogEntry) ([]byte, *CommandError, error) {
+	cmd := entry.Command
+	if l.decodeEntry != nil {
+		decoded, err := l.decodeEntry(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		cmd = decoded
+	}
+	entry.Command = cmd
+	resp, err := l.callApply(entry)
+	if rejected, ok := err.(*CommandError); ok {
+		return nil, rejected, nil
+	}
+	if err != nil {
+		return l.applyFailure(entry, err)
+	}
+	return resp, nil, nil
+}
+
+// CommandError is returned by apply functions to reject a command, e.g.
+// because it's invalid in the state machine's current state. The command
+// counts as applied, and the error is its result, which Server.Apply returns
+// to the client. Like a response, it must be the same on every server, so it
+// can only depend on the state machine and the command. Any other error from
+// an apply function means the server couldn't apply the command, e.g. because
+// its disk failed: its log stops before the command, which is applied again
+// when the log next commits, and until then, nothing after it is. A panic is
+// treated the same way. SetApplyPolicy can skip such commands instead, or
+// stop the server.
+type CommandError struct {
+	Err error
+}
+
+func (e *CommandError) Error() string { return e.Err.Error() }
+
+// persistAppended persists the entries appended to the log that aren't yet in
+// the store, as persistTo does. Followers call it before they acknowledge
+// entries to the leader, which counts them toward a quorum.
+func (l *Log) persistAppended() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.persistTo(l.lastIndexWithLock())
+}
+
+// persistTo writes the entries up to and including the passed index that
+// aren't yet in the store, and syncs the store, if it's a Syncer, as the sync
+// policy says.
+func (l *Log) persistTo(index uint64) error {
+	for pos := l.persistPos + 1; pos < len(l.entries) && l.entries[pos].Index <= index; pos++ {
+		entry := l.entries[pos]
+		if l.replacing {
+			entry.Type |= replacesFlag
+		}
+		if err := entry.encode(l.store); err != nil {
+			return err
+		}
+		l.persistPos, l.unsynced, l.replacing = pos, true, false
+		l.metrics.incr(MetricStoreAppends)
+		l.metrics.add(MetricStoreAppendBytes, float64(l.entries[pos].encodedSize()))
+	}
+	switch l.syncPolicy {
+	case SyncNever:
+		return nil
+	case SyncInterval:
+		if wait := l.syncEvery - time.Since(l.lastSync); wait > 0 {
+			// Sync later, so the entries aren't left unsynced for longer
+			// than the interval, even if nothing else is committed.
+			if l.unsynced && l.syncTimer == nil {
+				l.syncTimer = time.AfterFunc(wait, func() { l.Sync() })
+			}
+			return nil
+		}
+	}
+	return l.sync()
+}
+
+// Sync makes every entry written to the store durable, if the store is a
+// Syncer, whatever the sync policy.
+func (l *Log) Sync() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.sync()
+}
+
+func (l *Log) sync() error {
+	if l.syncTimer != nil {
+		l.syncTimer.Stop()
+		l.syncTimer = nil
+	}
+	if s, ok := l.store.(Syncer); ok && l.unsynced {
+		if err := l.syncStore(s); err != nil {
+			return err
+		}
+	}
+	l.unsynced, l.lastSync = false, time.Now()
 	return nil
 }
 
+// syncStore syncs a store, and reports how long it took.
+func (l *Log) syncStore(s Syncer) error {
+	began := time.Now()
+	defer l.metrics.since(MetricStoreSyncLatency, began)
+	l.metrics.incr(MetricStoreSyncs)
+	return s.Sync()
+}
+
+// latestConfiguration returns the command of the latest configuration entry
+// committed, or restored with a snapshot, or nil if there's none.
+func (l *Log) latestConfiguration() []byte {
+	l.RLock()
+	defer l.RUnlock()
+	return l.configuration
+}
+
+// snapshotDue reports whether the commands committed since the last snapshot
+// have passed either threshold. A threshold of zero is ignored.
+func (l *Log) snapshotDue(entries int, bytes int64) bool {
+	l.RLock()
+	defer l.RUnlock()
+	since := l.applied - l.lastSnapshot
+	return since > 0 && ((entries > 0 && since >= uint64(entries)) || (bytes > 0 && l.sinceSnapshot >= bytes))
+}
+
+// capture calls snapshot with the log locked, so no entries are applied while
+// it runs, and returns what it returns, along with the index and term of the
+// last entry applied, and the latest configuration applied. It returns a nil
+// write func if nothing's been applied since the last snapshot.
+func (l *Log) capture(snapshot func() (func(io.Writer) error, error)) (uint64, uint64, []byte, func(io.Writer) error, error) {
+	l.applyMu.Lock()
+	defer l.applyMu.Unlock()
+	l.Lock()
+	defer l.Unlock()
+
+	index := l.applied
+	if index == 0 || index == l.lastSnapshot {
+		return 0, 0, nil, nil, nil
+	}
+	term := l.termAtWithLock(index)
+	write, err := snapshot()
+	if err != nil {
+		return 0, 0, nil, nil, err
+	}
+	l.lastSnapshot, l.sinceSnapshot = index, 0
+	return index, term, l.configuration, write, nil
+}
+
+// compact discards the entries up to and including the passed index, which
+// must be committed, and are in a snapshot, and then those records of the
+// store, if it's a Compactor.
+func (l *Log) compact(index uint64) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if index <= l.compactedIndex {
+		return nil
+	}
+	if index > l.applied || index > l.lastSnapshot {
+		return ErrIndexTooBig
+	}
+	n := 0
+	for n < len(l.entries) && l.entries[n].Index <= index {
+		n++
+	}
+	l.compactedIndex, l.compactedTerm = index, l.entries[n-1].Term
+	l.entries = append([]LogEntry{}, l.entries[n:]...)
+	l.commitPos -= n
+	if l.persistPos -= n; l.persistPos < -1 {
+		l.persistPos = -1
+	}
+	if c, ok := l.store.(Compactor); ok {
+		l.metrics.incr(MetricStoreTruncations, Label{"kind", "compact"})
+		return c.Compact(index + 1)
+	}
+	return nil
+}
+
+// restore replaces the entries up to and including the passed index with a
+// snapshot, whose data restore loads into the state machine, with the log
+// locked. Entries after the index are kept, if the log has the entry at the
+// index, in the passed term; otherwise, they conflict with the snapshot, and
+// are discarded, as are the store's records, if it's a Resetter.
+// Configuration is the latest configuration committed as of the snapshot.
+func (l *Log) restore(index, term uint64, configuration []byte, restore func() error) error {
+	l.applyMu.Lock()
+	defer l.applyMu.Unlock()
+	l.Lock()
+	defer l.Unlock()
+
+	if err := restore(); err != nil {
+		return err
+	}
+	return l.restoreWithLock(index, term, configuration)
+}
+
+// replace is like restore, but the snapshot is of the state as of the last
+// applied entry, which replace passes to the function that stores it, and
+// loads it into the state machine, with the log locked, so nothing's applied
+// in the meantime.
+func (l *Log) replace(replace func(index, term uint64, configuration []byte) error) error {
+	l.applyMu.Lock()
+	defer l.applyMu.Unlock()
+	l.Lock()
+	defer l.Unlock()
+
+	index := l.applied
+	term := l.termAtWithLock(index)
+	if err := replace(index, term, l.configuration); err != nil {
+		return err
+	}
+	return l.restoreWithLock(index, term, l.configuration)
+}
+
+func (l *Log) restoreWithLock(index, term uint64, configuration []byte) error {
+	n := 0
+	for n < len(l.entries) && l.entries[n].Index <= index {
+		n++
+	}
+	if n > 0 && l.entries[n-1].Index == index && l.entries[n-1].Term == term {
+		l.entries = append([]LogEntry{}, l.entries[n:]...)
+		if l.persistPos -= n; l.persistPos < -1 {
+			l.persistPos = -1
+		}
+	} else {
+		l.inflight.truncate(0)
+		l.entries = []LogEntry{}
+		l.discardPersisted(0)
+		l.unsynced = false
+		if r, ok := l.store.(Resetter); ok {
+			l.metrics.incr(MetricStoreTruncations, Label{"kind", "reset"})
+			if err := r.Reset(index + 1); err != nil {
+				return err
+			}
+			l.replacing = false
+		}
+	}
+	l.commitPos, l.applied = -1, index
+	l.compactedIndex, l.compactedTerm = index, term
+	l.lastSnapshot, l.sinceSnapshot = index, 0
+	l.configuration = configuration
+	return nil
+}
+
+// check describes the first way the log breaks its invariants, or returns ""
+// if it doesn't: its entries follow on from the snapshot, if any, with no
+// gaps in their indexes, and no decrease in their terms.
+func (l *Log) check() string {
+	l.RLock()
+	defer l.RUnlock()
+
+	if len(l.entries) > 0 && l.compactedIndex == 0 && l.entries[0].Index != 1 {
+		return fmt.Sprintf("the log begins at index=%d, with no snapshot before it", l.entries[0].Index)
+	}
+	prev, prevIndex, prevTerm := "the snapshot through", l.compactedIndex, l.compactedTerm
+	for _, entry := range l.entries {
+		if entry.Index != prevIndex+1 {
+			return fmt.Sprintf("%s index=%d term=%d is followed by entry index=%d", prev, prevIndex, prevTerm, entry.Index)
+		}
+		if entry.Term < prevTerm {
+			return fmt.Sprintf("%s index=%d term=%d is followed by entry index=%d with older term=%d", prev, prevIndex, prevTerm, entry.Index, entry.Term)
+		}
+		prev, prevIndex, prevTerm = "entry", entry.Index, entry.Term
+	}
+	return ""
+}
+
+// EncodeEntry transforms the command of a log entry before it's appended to the
+// log. The entry's index, term and type are provided for context (e.g. to derive
+// a nonce) but can't be changed; only the returned command is used.
+type EncodeEntry func(LogEntry) ([]byte, error)
+
+// DecodeEntry reverses the transformation of an EncodeEntry, immediately before
+// the command is applied to the state machine.
+type DecodeEntry func(LogEntry) ([]byte, error)
+
+// EntryType distinguishes log entries carrying user commands from those
+// carrying instructions for the Raft servers themselves.
+type EntryType uint8
+
+const (
+	EntryCommand        EntryType = iota // passed to the apply function
+	EntryConfiguration                   // changes the cluster membership
+	EntryNoop                            // appended by new leaders; no command
+	EntryJournal                         // replicated for the application; see Journal
+	EntrySession                         // registers a client session; no command
+	EntrySessionCommand                  // a command tagged with a session; see SessionCommand
+	EntryBarrier                         // appended by Barrier; no command
+)
+
+// annotatedFlag marks the type of an annotated entry in the log's store.
+const annotatedFlag EntryType = 0x80
+
+// replacesFlag marks the type of an entry written to the log's store after
+// entries in it were discarded, because they conflicted with the leader's.
+// Recovery discards them again when it reads the entry, which would otherwise
+// be a regression.
+const replacesFlag EntryType = 0x40
+
 // LogEntry is the atomic unit being managed by the distributed log. A log entry
 // always has an index (monotonically increasing), a term in which the Raft
 // network leader first sees the entry, and a command. The command is what gets
 // executed against the node state machine when the log entry is successfully
-// replicated.
+// replicated. Entries that aren't of type EntryCommand are consumed by the
+// servers, and never reach the state machine.
 type LogEntry struct {
-	Index           uint64      `json:"index"`
-	Term            uint64      `json:"term"` // when received by leader
-	Command         []byte      `json:"command,omitempty"`
-	commandResponse chan []byte `json:"-"` // only present on receiver's log
+	Index       uint64            `json:"index"`
+	Term        uint64            `json:"term"` // when received by leader
+	Type        EntryType         `json:"type,omitempty"`
+	Command     []byte            `json:"command,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"` // see WithAnnotations
 }
 
+// Entries are stored as binary records: a marker byte, the length of the
+// payload as a uvarint, the payload, and the CRC32 of the length and payload,
+// big-endian. The payload is the index and term, as uvarints, the type, and
+// the command. The annotations of an annotated entry precede its command, as
+// a uvarint length and JSON, and the annotated flag is set in its type.
+//
+// Logs written before the binary format existed hold text records, with the
+// fields in hex, a line each. They're still read, but never written.
+const binaryMarker = 0xfe // which can't begin a text record
+
 // encode serializes the log entry to the passed io.Writer.
 func (e *LogEntry) encode(w io.Writer) error {
-	if len(e.Command) <= 0 {
+	if typ := e.Type &^ replacesFlag; typ != EntryNoop && typ != EntrySession && typ != EntryBarrier && len(e.Command) <= 0 {
 		return ErrNoCommand
 	}
 	if e.Index <= 0 {
@@ -381,18 +996,139 @@ func (e *LogEntry) encode(w io.Writer) error {
 		return ErrBadTerm
 	}
 
-	buf := &bytes.Buffer{}
-	if _, err := fmt.Fprintf(buf, "%016x %016x %s\n", e.Index, e.Term, e.Command); err != nil {
+	record, err := e.record()
+	if err != nil {
 		return err
 	}
-
-	checksum := crc32.ChecksumIEEE(buf.Bytes())
-	_, err := fmt.Fprintf(w, "%08x %s", checksum, buf.String())
+	_, err = w.Write(record)
 	return err
 }
 
-// decode deserializes one log entry from the passed io.Reader.
+// record returns the entry as encode writes it.
+func (e *LogEntry) record() ([]byte, error) {
+	typ, annotations := e.Type, []byte(nil)
+	if len(e.Annotations) > 0 {
+		var err error
+		if annotations, err = json.Marshal(e.Annotations); err != nil {
+			return nil, err
+		}
+		typ |= annotatedFlag
+	}
+	payload := make([]byte, 0, 3*binary.MaxVarintLen64+1+len(annotations)+len(e.Command))
+	payload = binary.AppendUvarint(payload, e.Index)
+	payload = binary.AppendUvarint(payload, e.Term)
+	payload = append(payload, byte(typ))
+	if typ&annotatedFlag != 0 {
+		payload = binary.AppendUvarint(payload, uint64(len(annotations)))
+		payload = append(payload, annotations...)
+	}
+	payload = append(payload, e.Command...)
+
+	record := make([]byte, 0, 1+binary.MaxVarintLen64+len(payload)+4)
+	record = append(record, binaryMarker)
+	record = binary.AppendUvarint(record, uint64(len(payload)))
+	record = append(record, payload...)
+	return binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(record[1:])), nil
+}
+
+// encodedSize returns the number of bytes encode writes for the entry.
+func (e *LogEntry) encodedSize() int64 {
+	record, _ := e.record()
+	return int64(len(record))
+}
+
+// decode deserializes one log entry from the passed io.Reader. It reads
+// exactly the entry's record, so the reader needn't buffer. A record cut
+// short, e.g. by a torn write, is io.ErrUnexpectedEOF, and one that's been
+// damaged is ErrInvalidChecksum.
 func (e *LogEntry) decode(r io.Reader) error {
+	br := byteReader{r}
+	marker, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	if marker != binaryMarker {
+		return e.decodeText(r, marker)
+	}
+
+	// the length, and the payload, are read as they're checked, so a length
+	// that's been damaged can't make us allocate much more than the store
+	// holds
+	var record bytes.Buffer
+	n, err := binary.ReadUvarint(byteReader{io.TeeReader(r, &record)})
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(&record, r, int64(n)); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	var checksum [4]byte
+	if _, err := io.ReadFull(r, checksum[:]); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(record.Bytes()) != binary.BigEndian.Uint32(checksum[:]) {
+		return ErrInvalidChecksum
+	}
+
+	payload := bytes.NewReader(record.Bytes()[record.Len()-int(n):])
+	if e.Index, err = binary.ReadUvarint(payload); err != nil {
+		return ErrInvalidLogLine
+	}
+	if e.Term, err = binary.ReadUvarint(payload); err != nil {
+		return ErrInvalidLogLine
+	}
+	typ, err := payload.ReadByte()
+	if err != nil {
+		return ErrInvalidLogLine
+	}
+	e.Type = EntryType(typ)
+	if e.Type&annotatedFlag != 0 {
+		e.Type &^= annotatedFlag
+		n, err := binary.ReadUvarint(payload)
+		if err != nil || n > uint64(payload.Len()) {
+			return ErrInvalidLogLine
+		}
+		annotations := make([]byte, n)
+		payload.Read(annotations)
+		if err := json.Unmarshal(annotations, &e.Annotations); err != nil {
+			return err
+		}
+	}
+	if payload.Len() > 0 {
+		e.Command = make([]byte, payload.Len())
+		payload.Read(e.Command)
+	}
+	return nil
+}
+
+// byteReader reads a byte at a time, for binary.ReadUvarint, without reading
+// past it.
+type byteReader struct{ io.Reader }
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+// decodeText deserializes an entry from a text record, whose first byte has
+// been read already.
+func (e *LogEntry) decodeText(r io.Reader, first byte) error {
+	if rs, ok := r.(interface {
+		io.Reader
+		io.RuneScanner
+	}); ok {
+		r = &textReader{first: first, r: rs}
+	} else {
+		r = io.MultiReader(bytes.NewReader([]byte{first}), r)
+	}
+
 	var readChecksum uint32
 	if _, err := fmt.Fscanf(r, "%08x ", &readChecksum); err != nil {
 		return err
@@ -406,16 +1142,84 @@ func (e *LogEntry) decode(r io.Reader) error {
 		return err
 	}
 
+	if _, err := fmt.Fscanf(r, "%02x ", &e.Type); err != nil {
+		return err
+	}
+
 	if err := consumeUntil(r, '\n', &e.Command); err != nil {
 		return err
 	}
 
-	b := fmt.Sprintf("%016x %016x %s\n", e.Index, e.Term, e.Command)
+	b := fmt.Sprintf("%016x %016x %02x %s\n", e.Index, e.Term, e.Type, e.Command)
 	computedChecksum := crc32.ChecksumIEEE([]byte(b))
 	if computedChecksum != readChecksum {
 		return ErrInvalidChecksum
 	}
 
+	if e.Type&annotatedFlag != 0 {
+		e.Type &^= annotatedFlag
+		return e.splitAnnotations()
+	}
+	return nil
+}
+
+// textReader puts back the first byte of a text record, for a store that's
+// an io.RuneScanner, which the text decoder needs to read the record without
+// losing the character after each field.
+type textReader struct {
+	first byte
+	state int // of the first byte: unread, just read, or read before
+	r     interface {
+		io.Reader
+		io.RuneScanner
+	}
+}
+
+func (t *textReader) Read(p []byte) (int, error) {
+	if t.state == 0 && len(p) > 0 {
+		p[0], t.state = t.first, 2
+		return 1, nil
+	}
+	t.state = 2
+	return t.r.Read(p)
+}
+
+func (t *textReader) ReadRune() (rune, int, error) {
+	if t.state == 0 {
+		t.state = 1
+		return rune(t.first), 1, nil
+	}
+	t.state = 2
+	return t.r.ReadRune()
+}
+
+func (t *textReader) UnreadRune() error {
+	if t.state == 1 {
+		t.state = 0
+		return nil
+	}
+	return t.r.UnreadRune()
+}
+
+// splitAnnotations parses the annotations that precede the command of an
+// annotated text record.
+func (e *LogEntry) splitAnnotations() error {
+	var n int
+	if len(e.Command) < 9 {
+		return ErrInvalidLogLine
+	}
+	if _, err := fmt.Sscanf(string(e.Command[:9]), "%08x ", &n); err != nil {
+		return err
+	}
+	if 9+n > len(e.Command) {
+		return ErrInvalidLogLine
+	}
+	if err := json.Unmarshal(e.Command[9:9+n], &e.Annotations); err != nil {
+		return err
+	}
+	if e.Command = e.Command[9+n:]; len(e.Command) == 0 {
+		e.Command = nil
+	}
 	return nil
 }
 
@@ -437,3 +1241,161 @@ func consumeUntil(r io.Reader, delim byte, dst *[]byte) error {
 		*dst = append(*dst, p[0])
 	}
 }
+
+// ResponsePolicy determines what the server does with the response to a
+// command when the client isn't ready to receive it.
+type ResponsePolicy int
+
+const (
+	// ResponseTimeout waits up to the server's CommandTimeout for the client
+	// to receive the response, or until the deadline of the context it
+	// submitted the command with, if it has one, and then drops it. This is
+	// the default.
+	ResponseTimeout ResponsePolicy = iota
+
+	// ResponseNonBlocking delivers the response only if the client is ready
+	// to receive it at the moment the command commits, and drops it
+	// otherwise. Clients should pass a buffered response chan. No goroutine
+	// is spawned per command, so abandoned chans never pin any resources.
+	ResponseNonBlocking
+)
+
+// inflight tracks the clients waiting for the response to their commands,
+// keyed by the index of the command's log entry. Responses are delivered
+// asynchronously, so a slow (or absent) client never blocks the log.
+type inflight struct {
+	sync.Mutex
+	m         map[uint64]chan []byte
+	errs      map[uint64]chan error // for rejections; see Server.Apply
+	deadlines map[uint64]time.Time  // of the clients that have one
+	policy    ResponsePolicy
+	timeout   time.Duration            // under ResponseTimeout; see Server.Reload
+	dropped   func(index, term uint64) // called when a response is dropped
+}
+
+func newInflight() *inflight {
+	return &inflight{
+		m:         map[uint64]chan []byte{},
+		errs:      map[uint64]chan error{},
+		deadlines: map[uint64]time.Time{},
+		timeout:   Config{}.withDefaults().CommandTimeout,
+	}
+}
+
+// register arranges for the response to the command at index to be sent on
+// the passed channel, until the deadline, if it's not zero, under the
+// ResponseTimeout policy. A nil channel is ignored.
+func (i *inflight) register(index uint64, response chan []byte, deadline time.Time) {
+	if response == nil {
+		return
+	}
+	i.Lock()
+	defer i.Unlock()
+	i.m[index] = response
+	if !deadline.IsZero() {
+		i.deadlines[index] = deadline
+	}
+}
+
+// registerErr arranges for a rejection of the command at index to be sent on
+// the passed channel, which must be buffered.
+func (i *inflight) registerErr(index uint64, errs chan error) {
+	i.Lock()
+	defer i.Unlock()
+	i.errs[index] = errs
+}
+
+// reject delivers the rejection to the client waiting on index, if it asked
+// for it, and closes the response channel without a response.
+func (i *inflight) reject(index uint64, rejected *CommandError) {
+	i.Lock()
+	defer i.Unlock()
+	if errs, ok := i.errs[index]; ok {
+		errs <- rejected
+		delete(i.errs, index)
+	}
+	if response, ok := i.m[index]; ok {
+		close(response)
+		delete(i.m, index)
+	}
+	delete(i.deadlines, index)
+}
+
+// commit delivers the response to the client waiting on index, if any,
+// according to the response policy. Either way, the channel is closed.
+func (i *inflight) commit(index, term uint64, resp []byte) {
+	i.Lock()
+	response, ok := i.m[index]
+	delete(i.m, index)
+	delete(i.errs, index)
+	timeout := i.timeout
+	if deadline, ok := i.deadlines[index]; ok {
+		timeout = time.Until(deadline)
+		delete(i.deadlines, index)
+	}
+	i.Unlock()
+	if !ok {
+		return
+	}
+
+	switch i.policy {
+	case ResponseNonBlocking:
+		defer close(response)
+		select {
+		case response <- resp:
+		default:
+			i.drop(index, term)
+		}
+	default:
+		go func() {
+			defer close(response)
+			select {
+			case response <- resp:
+			case <-time.After(timeout):
+				i.drop(index, term) // the client has gone away
+			}
+		}()
+	}
+}
+
+func (i *inflight) drop(index, term uint64) {
+	if i.dropped != nil {
+		i.dropped(index, term)
+	}
+}
+
+// lose signals the client waiting on index, if any, that its command won't
+// be applied, by closing the channel without a response value.
+func (i *inflight) lose(index uint64) {
+	i.Lock()
+	defer i.Unlock()
+	if response, ok := i.m[index]; ok {
+		close(response)
+		delete(i.m, index)
+	}
+	delete(i.errs, index)
+	delete(i.deadlines, index)
+}
+
+// truncate signals every client waiting on an index after the passed index to
+// stop waiting, by closing the channel without a response value.
+func (i *inflight) truncate(after uint64) {
+	i.Lock()
+	defer i.Unlock()
+	for index, response := range i.m {
+		if index > after {
+			close(response)
+			delete(i.m, index)
+		}
+	}
+	for index := range i.errs {
+		if index > after {
+			delete(i.errs, index)
+		}
+	}
+	for index := range i.deadlines {
+		if index > after {
+			delete(i.deadlines, index)
+		}
+	}
+}
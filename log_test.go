@@ -2,9 +2,14 @@ package raft
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"math"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func oneshot() chan []byte {
@@ -33,7 +38,7 @@ func TestLogEntriesAfter(t *testing.T) {
 		{3, 0, 0},
 		{4, 0, 0},
 	} {
-		entries, term := log.entriesAfter(tu.AfterIndex)
+		entries, term, _ := log.entriesAfter(tu.AfterIndex)
 		if expected, got := tu.ExpectedEntries, len(entries); expected != got {
 			t.Errorf("with %d, After(%d): entries: expected %d got %d", 0, tu.AfterIndex, expected, got)
 		}
@@ -42,7 +47,7 @@ func TestLogEntriesAfter(t *testing.T) {
 		}
 	}
 
-	log.appendEntry(LogEntry{1, 1, c, oneshot()})
+	log.appendEntry(LogEntry{Index: 1, Term: 1, Command: c})
 	for _, tu := range []tuple{
 		{0, 1, 0},
 		{1, 0, 1},
@@ -50,7 +55,7 @@ func TestLogEntriesAfter(t *testing.T) {
 		{3, 0, 1},
 		{4, 0, 1},
 	} {
-		entries, term := log.entriesAfter(tu.AfterIndex)
+		entries, term, _ := log.entriesAfter(tu.AfterIndex)
 		if expected, got := tu.ExpectedEntries, len(entries); expected != got {
 			t.Errorf("with %d, After(%d): entries: expected %d got %d", 1, tu.AfterIndex, expected, got)
 		}
@@ -59,7 +64,7 @@ func TestLogEntriesAfter(t *testing.T) {
 		}
 	}
 
-	log.appendEntry(LogEntry{2, 1, c, oneshot()})
+	log.appendEntry(LogEntry{Index: 2, Term: 1, Command: c})
 	for _, tu := range []tuple{
 		{0, 2, 0},
 		{1, 1, 1},
@@ -67,7 +72,7 @@ func TestLogEntriesAfter(t *testing.T) {
 		{3, 0, 1},
 		{4, 0, 1},
 	} {
-		entries, term := log.entriesAfter(tu.AfterIndex)
+		entries, term, _ := log.entriesAfter(tu.AfterIndex)
 		if expected, got := tu.ExpectedEntries, len(entries); expected != got {
 			t.Errorf("with %d, After(%d): entries: expected %d got %d", 2, tu.AfterIndex, expected, got)
 		}
@@ -76,7 +81,7 @@ func TestLogEntriesAfter(t *testing.T) {
 		}
 	}
 
-	log.appendEntry(LogEntry{3, 2, c, oneshot()})
+	log.appendEntry(LogEntry{Index: 3, Term: 2, Command: c})
 	for _, tu := range []tuple{
 		{0, 3, 0},
 		{1, 2, 1},
@@ -84,7 +89,7 @@ func TestLogEntriesAfter(t *testing.T) {
 		{3, 0, 2},
 		{4, 0, 2},
 	} {
-		entries, term := log.entriesAfter(tu.AfterIndex)
+		entries, term, _ := log.entriesAfter(tu.AfterIndex)
 		if expected, got := tu.ExpectedEntries, len(entries); expected != got {
 			t.Errorf("with %d, After(%d): entries: expected %d got %d", 3, tu.AfterIndex, expected, got)
 		}
@@ -96,24 +101,33 @@ func TestLogEntriesAfter(t *testing.T) {
 
 func TestLogEntryEncodeDecode(t *testing.T) {
 	for _, logEntry := range []LogEntry{
-		LogEntry{1, 1, []byte(`{}`), oneshot()},
-		LogEntry{1, 2, []byte(`{}`), oneshot()},
-		LogEntry{1, 2, []byte(`{}`), oneshot()},
-		LogEntry{2, 2, []byte(`{}`), oneshot()},
-		LogEntry{255, 3, []byte(`{"cmd": 123}`), oneshot()},
-		LogEntry{math.MaxUint64 - 1, math.MaxUint64, []byte(`{}`), oneshot()},
+		LogEntry{Index: 1, Term: 1, Command: []byte(`{}`)},
+		LogEntry{Index: 1, Term: 2, Command: []byte(`{}`)},
+		LogEntry{Index: 1, Term: 2, Command: []byte(`{}`)},
+		LogEntry{Index: 2, Term: 2, Command: []byte(`{}`)},
+		LogEntry{Index: 255, Term: 3, Command: []byte(`{"cmd": 123}`)},
+		LogEntry{Index: math.MaxUint64 - 1, Term: math.MaxUint64, Command: []byte(`{}`)},
+		LogEntry{Index: 3, Term: 3, Type: EntryNoop},
+		LogEntry{Index: 4, Term: 3, Command: []byte(`{}`), Annotations: map[string]string{"auth/principal": "alice"}},
+		LogEntry{Index: 5, Term: 3, Type: EntryNoop, Annotations: map[string]string{"app/note": "a b\nc"}},
 	} {
 		b := &bytes.Buffer{}
 		if err := logEntry.encode(b); err != nil {
 			t.Errorf("%v: Encode: %s", logEntry, err)
 			continue
 		}
-		t.Logf("%v: Encode: %s", logEntry, strings.TrimSpace(b.String()))
+		t.Logf("%v: Encode: %x", logEntry, b.Bytes())
+		if expected, got := int64(b.Len()), logEntry.encodedSize(); expected != got {
+			t.Errorf("%v: expected encoded size %d, got %d", logEntry, expected, got)
+		}
 
 		var e LogEntry
 		if err := e.decode(b); err != nil {
 			t.Errorf("%v: Decode: %s", logEntry, err)
 		}
+		if !reflect.DeepEqual(logEntry, e) {
+			t.Errorf("expected %+v, decoded %+v", logEntry, e)
+		}
 	}
 }
 
@@ -123,21 +137,21 @@ func TestLogAppend(t *testing.T) {
 	log := NewLog(buf, noop)
 
 	// Append 3 valid LogEntries
-	if err := log.appendEntry(LogEntry{1, 1, c, oneshot()}); err != nil {
+	if err := log.appendEntry(LogEntry{Index: 1, Term: 1, Command: c}); err != nil {
 		t.Errorf("Append: %s", err)
 	}
-	if err := log.appendEntry(LogEntry{2, 1, c, oneshot()}); err != nil {
+	if err := log.appendEntry(LogEntry{Index: 2, Term: 1, Command: c}); err != nil {
 		t.Errorf("Append: %s", err)
 	}
-	if err := log.appendEntry(LogEntry{3, 2, c, oneshot()}); err != nil {
+	if err := log.appendEntry(LogEntry{Index: 3, Term: 2, Command: c}); err != nil {
 		t.Errorf("Append: %s", err)
 	}
 
 	// Append some invalid LogEntries
-	if err := log.appendEntry(LogEntry{4, 1, c, oneshot()}); err != ErrTermTooSmall {
+	if err := log.appendEntry(LogEntry{Index: 4, Term: 1, Command: c}); err != ErrTermTooSmall {
 		t.Errorf("Append: expected ErrTermTooSmall, got %v", err)
 	}
-	if err := log.appendEntry(LogEntry{2, 2, c, oneshot()}); err != ErrIndexTooSmall {
+	if err := log.appendEntry(LogEntry{Index: 2, Term: 2, Command: c}); err != ErrIndexTooSmall {
 		t.Errorf("Append: expected ErrIndexTooSmall, got %v", nil)
 	}
 
@@ -152,13 +166,14 @@ func TestLogAppend(t *testing.T) {
 		t.Fatalf("commitTo: %s", err)
 	}
 
-	// Check our flush buffer
-	lines := []string{
-		`02869b0c 0000000000000001 0000000000000001 {}`,
-		`3bfe364c 0000000000000002 0000000000000001 {}`,
+	// Check our flush buffer: marker, length, index, term, type, command, and
+	// checksum
+	records := []string{
+		"\xfe\x05\x01\x01\x00{}\x86\xac\xd3\x79",
+		"\xfe\x05\x02\x01\x00{}\xc1\x0c\xa9\xa9",
 	}
-	if expected, got := strings.Join(lines, "\n")+"\n", buf.String(); expected != got {
-		t.Errorf("after commit, expected:\n%s\ngot:\n%s\n", expected, got)
+	if expected, got := strings.Join(records, ""), buf.String(); expected != got {
+		t.Errorf("after commit, expected:\n%q\ngot:\n%q\n", expected, got)
 	}
 
 	// Make some invalid commits
@@ -175,12 +190,12 @@ func TestLogAppend(t *testing.T) {
 	}
 
 	// Check our flush buffer again
-	lines = append(
-		lines,
-		`6b76285c 0000000000000003 0000000000000002 {}`,
+	records = append(
+		records,
+		"\xfe\x05\x03\x02\x00{}\xee\xd9\x2f\xf7",
 	)
-	if expected, got := strings.Join(lines, "\n")+"\n", buf.String(); expected != got {
-		t.Errorf("after commit, expected:\n%s\ngot:\n%s\n", expected, got)
+	if expected, got := strings.Join(records, ""), buf.String(); expected != got {
+		t.Errorf("after commit, expected:\n%q\ngot:\n%q\n", expected, got)
 	}
 }
 
@@ -197,7 +212,7 @@ func TestLogContains(t *testing.T) {
 		{2, 1},
 		{3, 2},
 	} {
-		e := LogEntry{tuple.Index, tuple.Term, c, oneshot()}
+		e := LogEntry{Index: tuple.Index, Term: tuple.Term, Command: c}
 		if err := log.appendEntry(e); err != nil {
 			t.Fatalf("appendEntry(%v): %s", e, err)
 		}
@@ -241,7 +256,7 @@ func TestLogTruncation(t *testing.T) {
 		{2, 1},
 		{3, 2},
 	} {
-		e := LogEntry{tuple.Index, tuple.Term, c, oneshot()}
+		e := LogEntry{Index: tuple.Index, Term: tuple.Term, Command: c}
 		if err := log.appendEntry(e); err != nil {
 			t.Fatalf("appendEntry(%v): %s", e, err)
 		}
@@ -300,6 +315,33 @@ func TestLogCommitNoDuplicate(t *testing.T) {
 	}
 }
 
+func TestLogCommitRetry(t *testing.T) {
+	// A command that fails to apply, and is retried, is counted once.
+	fail := true
+	apply := func([]byte) ([]byte, error) {
+		if fail {
+			return nil, errors.New("not yet")
+		}
+		return []byte{}, nil
+	}
+	log := NewLog(&bytes.Buffer{}, apply)
+
+	log.appendEntry(LogEntry{Index: 1, Term: 1, Command: []byte(`{}`)})
+	if err := log.commitTo(1); err == nil {
+		t.Fatal("expected the failed apply to fail the commit")
+	}
+	if expected, got := int64(0), log.sinceSnapshot; expected != got {
+		t.Errorf("after the failure, expected %d bytes since the snapshot, got %d", expected, got)
+	}
+	fail = false
+	if err := log.commitTo(1); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := int64(len(`{}`)), log.sinceSnapshot; expected != got {
+		t.Errorf("after the retry, expected %d bytes since the snapshot, got %d", expected, got)
+	}
+}
+
 func TestLogCommitTwice(t *testing.T) {
 	// A pathological case: commitTo(N) twice in a row should be fine.
 	log := NewLog(&bytes.Buffer{}, noop)
@@ -316,11 +358,91 @@ func TestLogCommitTwice(t *testing.T) {
 	}
 }
 
+func TestLogGroupCommit(t *testing.T) {
+	store := &syncingStore{}
+	log := NewLog(store, noop)
+
+	// entries committed together are synced together
+	for i := uint64(1); i <= 5; i++ {
+		log.appendEntry(LogEntry{Index: i, Term: 1, Command: []byte(`{}`)})
+	}
+	if err := log.commitTo(5); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "5 writes, 1 sync(s)", fmt.Sprintf("%d writes, %d sync(s)", store.writes, store.syncs); expected != got {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	// entries recovered from the store aren't written to it again
+	recovered := &syncingStore{Buffer: *bytes.NewBuffer(store.Bytes())}
+	log = NewLog(recovered, noop)
+	log.appendEntry(LogEntry{Index: 6, Term: 1, Command: []byte(`{}`)})
+	if err := log.commitTo(6); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "1 writes, 1 sync(s)", fmt.Sprintf("%d writes, %d sync(s)", recovered.writes, recovered.syncs); expected != got {
+		t.Errorf("after recovery, expected %s, got %s", expected, got)
+	}
+}
+
+func TestLogSyncPolicy(t *testing.T) {
+	commit := func(log *Log, index uint64) {
+		log.appendEntry(LogEntry{Index: index, Term: 1, Command: []byte(`{}`)})
+		if err := log.commitTo(index); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// never: only when asked
+	store := &syncingStore{}
+	log := NewLog(store, noop)
+	log.syncPolicy = SyncNever
+	commit(log, 1)
+	commit(log, 2)
+	if expected, got := 0, store.syncs; expected != got {
+		t.Errorf("expected %d syncs, got %d", expected, got)
+	}
+	if err := log.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 1, store.syncs; expected != got {
+		t.Errorf("expected %d syncs, got %d", expected, got)
+	}
+
+	// interval: once, and then again once the interval is up
+	store = &syncingStore{}
+	log = NewLog(store, noop)
+	log.syncPolicy, log.syncEvery = SyncInterval, 50*time.Millisecond
+	commit(log, 1)
+	commit(log, 2)
+	commit(log, 3)
+	log.Lock()
+	if expected, got := 1, store.syncs; expected != got {
+		t.Errorf("expected %d syncs, got %d", expected, got)
+	}
+	log.Unlock()
+	time.Sleep(200 * time.Millisecond)
+	log.Lock()
+	if expected, got := 2, store.syncs; expected != got {
+		t.Errorf("after the interval, expected %d syncs, got %d", expected, got)
+	}
+	log.Unlock()
+}
+
+// syncingStore is a Syncer, counting its writes and syncs.
+type syncingStore struct {
+	bytes.Buffer
+	writes, syncs int
+}
+
+func (s *syncingStore) Write(p []byte) (int, error) { s.writes++; return s.Buffer.Write(p) }
+func (s *syncingStore) Sync() error                 { s.syncs++; return nil }
+
 func TestCleanLogRecovery(t *testing.T) {
 	lines := []string{
-		`02869b0c 0000000000000001 0000000000000001 {}`,
-		`3bfe364c 0000000000000002 0000000000000001 {}`,
-		`6b76285c 0000000000000003 0000000000000002 {}`,
+		`48a615a9 0000000000000001 0000000000000001 00 {}`,
+		`7d4ba3fa 0000000000000002 0000000000000001 00 {}`,
+		`564f3417 0000000000000003 0000000000000002 00 {}`,
 	}
 
 	buf := bytes.NewBufferString(strings.Join(lines, "\n") + "\n")
@@ -357,9 +479,9 @@ func TestCleanLogRecovery(t *testing.T) {
 
 func TestCorruptedLogRecovery(t *testing.T) {
 	lines := []string{
-		`02869b0c 0000000000000001 0000000000000001 {}`,
-		`3000000c 0000000000000002 0000000000000001 {}`, // bad line
-		`6b76285c 0000000000000003 0000000000000002 {}`,
+		`48a615a9 0000000000000001 0000000000000001 00 {}`,
+		`3000000c 0000000000000002 0000000000000001 00 {}`, // bad line
+		`564f3417 0000000000000003 0000000000000002 00 {}`,
 	}
 
 	buf := bytes.NewBufferString(strings.Join(lines, "\n") + "\n")
@@ -394,3 +516,469 @@ func TestCorruptedLogRecovery(t *testing.T) {
 	}
 
 }
+
+func TestCorruptedBinaryLogRecovery(t *testing.T) {
+	encode := func(entries ...LogEntry) []byte {
+		buf := &bytes.Buffer{}
+		for _, e := range entries {
+			if err := e.encode(buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return buf.Bytes()
+	}
+	e1 := LogEntry{Index: 1, Term: 1, Command: []byte(`{}`)}
+	e2 := LogEntry{Index: 2, Term: 1, Command: []byte(`{"foo": "bar"}`), Annotations: map[string]string{"app/k": "v"}}
+	e3 := LogEntry{Index: 3, Term: 2, Command: []byte(`{}`)}
+	good := encode(e1, e2, e3)
+
+	for name, tc := range map[string]struct {
+		store     []byte
+		entries   int
+		recovered error
+	}{
+		"clean": {good, 3, nil},
+		"bit rot": {
+			func() []byte {
+				b := append([]byte{}, good...)
+				b[len(encode(e1))+8] ^= 0x10
+				return b
+			}(),
+			1, ErrInvalidChecksum,
+		},
+		"torn write": {good[:len(good)-2], 2, io.ErrUnexpectedEOF},
+		"huge length": {
+			append(encode(e1), binaryMarker, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f),
+			1, io.ErrUnexpectedEOF,
+		},
+		"text then binary": {
+			append([]byte("48a615a9 0000000000000001 0000000000000001 00 {}\n"), encode(e2, e3)...),
+			3, nil,
+		},
+	} {
+		log := NewLog(bytes.NewBuffer(tc.store), noop)
+		if expected, got := tc.entries, len(log.entries); expected != got {
+			t.Errorf("%s: expected %d entries, got %d", name, expected, got)
+		}
+		if expected, got := tc.recovered, log.recovered; expected != got {
+			t.Errorf("%s: expected %v, got %v", name, expected, got)
+		}
+		if tc.entries >= 2 && !reflect.DeepEqual(e2, log.entries[1]) {
+			t.Errorf("%s: expected %+v, got %+v", name, e2, log.entries[1])
+		}
+	}
+}
+
+func TestLogCommitConfiguration(t *testing.T) {
+	// configuration entries go to the server, not the state machine
+	applied, configured := 0, 0
+	log := NewLog(&bytes.Buffer{}, func([]byte) ([]byte, error) { applied++; return []byte{}, nil })
+	log.configure = func([]byte) error { configured++; return nil }
+
+	log.appendEntry(LogEntry{Index: 1, Term: 1, Command: []byte(`{}`)})
+	log.appendEntry(LogEntry{Index: 2, Term: 1, Type: EntryConfiguration, Command: []byte(`{"promote":3}`)})
+	log.appendEntry(LogEntry{Index: 3, Term: 1, Command: []byte(`{}`)})
+	if err := log.commitTo(3); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, got := 2, applied; expected != got {
+		t.Errorf("expected %d applied, got %d", expected, got)
+	}
+	if expected, got := 1, configured; expected != got {
+		t.Errorf("expected %d configured, got %d", expected, got)
+	}
+}
+
+func TestLogCommitNoop(t *testing.T) {
+	// no-op entries are committed, but never applied
+	hits := 0
+	apply := func([]byte) ([]byte, error) { hits++; return []byte{}, nil }
+	buf := &bytes.Buffer{}
+	log := NewLog(buf, apply)
+
+	log.appendEntry(LogEntry{Index: 1, Term: 1, Command: []byte(`{}`)})
+	log.appendEntry(LogEntry{Index: 2, Term: 2, Type: EntryNoop})
+	if err := log.commitTo(2); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 1, hits; expected != got {
+		t.Errorf("expected %d hits, got %d", expected, got)
+	}
+
+	// and survive recovery
+	recovered := NewLog(buf, apply)
+	if !recovered.contains(2, 2) {
+		t.Fatalf("recovered log doesn't contain no-op index=2 term=2")
+	}
+	if expected, got := EntryNoop, recovered.entries[1].Type; expected != got {
+		t.Errorf("expected type %d, got %d", expected, got)
+	}
+}
+
+func TestLogInflightResponses(t *testing.T) {
+	log := NewLog(&bytes.Buffer{}, func(cmd []byte) ([]byte, error) { return cmd, nil })
+	r1, r2, r3 := oneshot(), oneshot(), oneshot()
+	for i, r := range []chan []byte{r1, r2, r3} {
+		index := uint64(i + 1)
+		log.appendEntry(LogEntry{Index: index, Term: 1, Command: []byte(fmt.Sprint(index))})
+		log.inflight.register(index, r, time.Time{})
+	}
+
+	// committing delivers responses to the waiting clients
+	if err := log.commitTo(1); err != nil {
+		t.Fatal(err)
+	}
+	if resp, ok := <-r1; !ok || string(resp) != "1" {
+		t.Errorf("expected response 1, got %q (ok=%v)", resp, ok)
+	}
+
+	// and truncation closes the channels of clients that will never get one
+	if err := log.ensureLastIs(2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-r3; ok {
+		t.Errorf("expected truncated response chan to be closed")
+	}
+
+	// an abandoned response chan doesn't block the log
+	if err := log.commitTo(2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogResponseNonBlocking(t *testing.T) {
+	log := NewLog(&bytes.Buffer{}, func(cmd []byte) ([]byte, error) { return cmd, nil })
+	log.inflight.policy = ResponseNonBlocking
+	dropped := []uint64{}
+	log.inflight.dropped = func(index, term uint64) { dropped = append(dropped, index) }
+
+	ready, abandoned := make(chan []byte, 1), make(chan []byte)
+	for i, r := range []chan []byte{ready, abandoned} {
+		index := uint64(i + 1)
+		log.appendEntry(LogEntry{Index: index, Term: 1, Command: []byte(fmt.Sprint(index))})
+		log.inflight.register(index, r, time.Time{})
+	}
+	if err := log.commitTo(2); err != nil {
+		t.Fatal(err)
+	}
+
+	// both are handled synchronously, by the time commitTo returns
+	if resp, ok := <-ready; !ok || string(resp) != "1" {
+		t.Errorf("expected response 1, got %q (ok=%v)", resp, ok)
+	}
+	if _, ok := <-abandoned; ok {
+		t.Errorf("expected abandoned response chan to be closed without a response")
+	}
+	if expected, got := []uint64{2}, dropped; len(got) != 1 || got[0] != expected[0] {
+		t.Errorf("expected dropped %v, got %v", expected, got)
+	}
+}
+
+func TestLogResponseDeadline(t *testing.T) {
+	log := NewLog(&bytes.Buffer{}, func(cmd []byte) ([]byte, error) { return cmd, nil })
+	log.inflight.timeout = time.Hour
+	dropped := make(chan uint64, 2)
+	log.inflight.dropped = func(index, term uint64) { dropped <- index }
+
+	// an abandoned response is dropped at its client's deadline, rather than
+	// after the server's timeout
+	abandoned := make(chan []byte)
+	log.appendEntry(LogEntry{Index: 1, Term: 1, Command: []byte("1")})
+	log.inflight.register(1, abandoned, time.Now().Add(10*time.Millisecond))
+	if err := log.commitTo(1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case index := <-dropped:
+		if index != 1 {
+			t.Errorf("expected to drop 1, got %d", index)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("response not dropped at the deadline")
+	}
+	if _, ok := <-abandoned; ok {
+		t.Errorf("expected abandoned response chan to be closed without a response")
+	}
+
+	// and deadlines don't outlive their entries
+	log.appendEntry(LogEntry{Index: 2, Term: 1, Command: []byte("2")})
+	log.inflight.register(2, make(chan []byte), time.Now().Add(time.Minute))
+	if err := log.ensureLastIs(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(log.inflight.deadlines); n != 0 {
+		t.Errorf("expected no deadlines after truncation, got %d", n)
+	}
+}
+
+func TestLogGap(t *testing.T) {
+	log := NewLog(&bytes.Buffer{}, noop)
+	for i, term := range []uint64{1, 1, 2, 2, 2} {
+		log.appendEntry(LogEntry{Index: uint64(i + 1), Term: term, Command: []byte(`{}`)})
+	}
+	log.commitTo(1)
+
+	for index, expected := range map[uint64]LogGap{
+		4: {LastIndex: 5, CommitIndex: 1, ConflictTerm: 2, ConflictIndex: 3},
+		2: {LastIndex: 5, CommitIndex: 1, ConflictTerm: 1, ConflictIndex: 1},
+		7: {LastIndex: 5, CommitIndex: 1},
+		1: {LastIndex: 5, CommitIndex: 1},
+	} {
+		if got := *log.gap(index); expected != got {
+			t.Errorf("gap(%d): expected %+v, got %+v", index, expected, got)
+		}
+	}
+
+	if expected, got := uint64(5), log.lastIndexOfTerm(2); expected != got {
+		t.Errorf("lastIndexOfTerm(2): expected %d, got %d", expected, got)
+	}
+	if expected, got := uint64(0), log.lastIndexOfTerm(3); expected != got {
+		t.Errorf("lastIndexOfTerm(3): expected %d, got %d", expected, got)
+	}
+}
+
+func TestFaultyStore(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := NewFaultyStore(buf, Faults{}, 1)
+	log := NewLog(store, noop)
+
+	// a healthy disk
+	log.appendEntry(LogEntry{Index: 1, Term: 1, Command: []byte(`{}`)})
+	if err := log.commitTo(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failing disk fails the commit, and leaves a torn write behind
+	store.SetFaults(Faults{WriteErrorRate: 1, PartialWriteRate: 1})
+	before := buf.Len()
+	log.appendEntry(LogEntry{Index: 2, Term: 1, Command: []byte(`{}`)})
+	if expected, got := ErrInjectedFault, log.commitTo(2); expected != got {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	if expected, got := uint64(1), log.getCommitIndex(); expected != got {
+		t.Errorf("expected commitIndex %d, got %d", expected, got)
+	}
+	if buf.Len() <= before || bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		t.Errorf("expected a partial write, got %q", buf.Bytes()[before:])
+	}
+
+	// a slow disk is slow
+	store.SetFaults(Faults{ReadLatency: 10 * time.Millisecond, ReadErrorRate: 1})
+	began := time.Now()
+	if _, err := store.Read(make([]byte, 1)); err != ErrInjectedFault {
+		t.Errorf("expected %v, got %v", ErrInjectedFault, err)
+	}
+	if took := time.Since(began); took < 10*time.Millisecond {
+		t.Errorf("expected read to take at least 10ms, took %s", took)
+	}
+}
+
+func TestFaultyStoreCrash(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := NewFaultyStore(buf, Faults{FailWrite: 2}, 1)
+	log := NewLog(store, noop)
+
+	// the second write fails
+	log.appendEntry(LogEntry{Index: 1, Term: 1, Command: []byte(`{}`)})
+	log.appendEntry(LogEntry{Index: 2, Term: 1, Command: []byte(`{}`)})
+	if expected, got := ErrInjectedFault, log.commitTo(2); expected != got {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	persisted := buf.Len()
+
+	// unsynced writes are held back, and lost in a crash
+	store.SetFaults(Faults{LoseUnsynced: true})
+	log.syncPolicy = SyncNever
+	log.appendEntry(LogEntry{Index: 3, Term: 1, Command: []byte(`{}`)})
+	if err := log.commitTo(3); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != persisted {
+		t.Errorf("expected the unsynced entries to be held back, but the store grew by %d bytes", buf.Len()-persisted)
+	}
+	if n := store.Crash(); n == 0 {
+		t.Error("expected the crash to lose the unsynced entries")
+	}
+
+	// synced writes aren't, but syncs may be slow
+	log.syncPolicy = SyncAlways
+	store.SetFaults(Faults{LoseUnsynced: true, SyncLatency: 10 * time.Millisecond})
+	log.appendEntry(LogEntry{Index: 4, Term: 1, Command: []byte(`{}`)})
+	began := time.Now()
+	if err := log.commitTo(4); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(began); took < 10*time.Millisecond {
+		t.Errorf("expected the sync to take at least 10ms, took %s", took)
+	}
+	if n := store.Crash(); n != 0 {
+		t.Errorf("expected nothing to be lost after a sync, lost %d bytes", n)
+	}
+	if buf.Len() <= persisted {
+		t.Error("expected the synced entries in the store")
+	}
+}
+
+func TestLogRegressionRecovery(t *testing.T) {
+	for _, tc := range []struct {
+		entries  []LogEntry
+		expected error
+	}{
+		{[]LogEntry{{Index: 1, Term: 1}, {Index: 2, Term: 2}, {Index: 3, Term: 1}}, ErrTermRegression},
+		{[]LogEntry{{Index: 1, Term: 1}, {Index: 3, Term: 1}, {Index: 2, Term: 1}}, ErrIndexRegression},
+		{[]LogEntry{{Index: 1, Term: 1}, {Index: 3, Term: 1}, {Index: 2, Term: 2}}, ErrIndexRegression},
+	} {
+		buf := &bytes.Buffer{}
+		for _, e := range tc.entries {
+			e.Command = []byte(`{}`)
+			if err := e.encode(buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stored := buf.Bytes()
+		if expected, got := tc.expected, NewLog(bytes.NewBuffer(stored), noop).recovered; expected != got {
+			t.Errorf("%v: expected %v, got %v", tc.entries, expected, got)
+		}
+
+		// and a server refuses the log, without a panic
+		if s, err := NewServerErr(1, bytes.NewBuffer(stored), noop, Config{}); s != nil || err != tc.expected {
+			t.Errorf("%v: expected no server, and %v, got %v", tc.entries, tc.expected, err)
+		}
+	}
+}
+
+func TestLogReplacedRecovery(t *testing.T) {
+	// a follower persists entries 2 and 3, which conflict with the new
+	// leader's 2 and 3, from an earlier term
+	buf := &bytes.Buffer{}
+	log := NewLog(buf, noop)
+	for _, e := range []LogEntry{{Index: 1, Term: 1}, {Index: 2, Term: 3}, {Index: 3, Term: 3}} {
+		e.Command = []byte(`{}`)
+		if err := log.appendEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.persistAppended(); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.ensureLastIs(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []LogEntry{{Index: 2, Term: 2}, {Index: 3, Term: 2}} {
+		e.Command = []byte(`{}`)
+		if err := log.appendEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.persistAppended(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the store holds both, and recovers the leader's
+	recovered := NewLog(bytes.NewBuffer(buf.Bytes()), noop)
+	if recovered.recovered != nil {
+		t.Fatal(recovered.recovered)
+	}
+	if expected, got := log.entries, recovered.entries; !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestLogIndexOverflow(t *testing.T) {
+	log := NewLog(&bytes.Buffer{}, noop)
+	if err := log.appendEntry(LogEntry{Index: math.MaxUint64, Term: 1, Command: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := ErrIndexOverflow, log.appendEntry(LogEntry{Index: log.lastIndex() + 1, Term: 1, Command: []byte(`{}`)}); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestLogCompaction(t *testing.T) {
+	store := &compactingStore{}
+	log := NewLog(store, noop)
+	for i := uint64(1); i <= 10; i++ {
+		log.appendEntry(LogEntry{Index: i, Term: 1 + i/6, Command: []byte(`{}`)})
+	}
+	if err := log.commitTo(8); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := func() (func(io.Writer) error, error) { return func(io.Writer) error { return nil }, nil }
+	if index, term, _, _, err := log.capture(snapshot); err != nil || index != 8 || term != 2 {
+		t.Fatalf("expected to capture 8/2, got %d/%d (%v)", index, term, err)
+	}
+	if err := log.compact(7); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(8), store.compacted; expected != got {
+		t.Errorf("expected the store compacted before record %d, got %d", expected, got)
+	}
+
+	// the compacted entries are gone, but the last one's term is known
+	if _, _, ok := log.entriesAfter(6); ok {
+		t.Errorf("expected entries after 6 to be compacted")
+	}
+	entries, term, ok := log.entriesAfter(7)
+	if !ok || len(entries) != 3 || term != 2 {
+		t.Errorf("after 7, expected 3 entries and term 2, got %d and %d (%v)", len(entries), term, ok)
+	}
+	if expected, got := uint64(8), log.getCommitIndex(); expected != got {
+		t.Errorf("expected commit index %d, got %d", expected, got)
+	}
+
+	// and entries keep being committed, and persisted, as before
+	if err := log.commitTo(10); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(10), log.lastIndex(); expected != got {
+		t.Errorf("expected last index %d, got %d", expected, got)
+	}
+
+	// a snapshot beyond the log replaces it, and resets the store
+	if err := log.restore(20, 3, nil, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(21), store.reset; expected != got {
+		t.Errorf("expected the store reset to record %d, got %d", expected, got)
+	}
+	if expected, got := "20/3 20", fmt.Sprintf("%d/%d %d", log.lastIndex(), log.lastTerm(), log.getCommitIndex()); expected != got {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+	if err := log.ensureLastIs(20, 3); err != nil {
+		t.Errorf("expected entries to follow the snapshot, got %v", err)
+	}
+}
+
+// compactingStore is a Compactor and a Resetter, recording its last calls.
+type compactingStore struct {
+	bytes.Buffer
+	compacted, reset uint64
+}
+
+func (s *compactingStore) Compact(n uint64) error { s.compacted = n; return nil }
+func (s *compactingStore) Reset(n uint64) error   { s.reset = n; return nil }
+
+func TestLogCheck(t *testing.T) {
+	for _, tc := range []struct {
+		compacted uint64 // through index, in term 1
+		entries   []LogEntry
+		expected  string
+	}{
+		{0, []LogEntry{{Index: 1, Term: 1}, {Index: 2, Term: 2}}, ""},
+		{3, []LogEntry{{Index: 4, Term: 1}}, ""},
+		{0, []LogEntry{{Index: 2, Term: 1}}, "the log begins at index=2, with no snapshot before it"},
+		{0, []LogEntry{{Index: 1, Term: 1}, {Index: 3, Term: 1}}, "entry index=1 term=1 is followed by entry index=3"},
+		{3, []LogEntry{{Index: 5, Term: 1}}, "the snapshot through index=3 term=1 is followed by entry index=5"},
+		{3, []LogEntry{{Index: 4, Term: 1}, {Index: 5, Term: 0}}, "entry index=4 term=1 is followed by entry index=5 with older term=0"},
+	} {
+		log := NewLog(&bytes.Buffer{}, noop)
+		if tc.compacted > 0 {
+			log.compactedIndex, log.compactedTerm = tc.compacted, 1
+		}
+		log.entries = tc.entries
+		if expected, got := tc.expected, log.check(); expected != got {
+			t.Errorf("%v: expected %q, got %q", tc.entries, expected, got)
+		}
+	}
+}
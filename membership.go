@@ -0,0 +1,170 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// member is a peer as it's recorded in a configuration entry.
+type member struct {
+	Id      uint64 `json:"id"`
+	Address string `json:"address,omitempty"`
+}
+
+// membersOf returns the members recording the peers, ordered by id. Peers'
+// addresses are taken from their Addresser implementations.
+func membersOf(peers Peers) []member {
+	members := []member{}
+	for id, peer := range peers {
+		m := member{Id: id}
+		if a, ok := peer.(Addresser); ok {
+			m.Address = a.Address()
+		}
+		members = append(members, m)
+	}
+	sortMembers(members)
+	return members
+}
+
+func sortMembers(members []member) {
+	sort.Slice(members, func(i, j int) bool { return members[i].Id < members[j].Id })
+}
+
+// peersOf returns the peers of the recorded members. Members we already have
+// a peer for, as a peer or a learner, keep it; the others are dialed.
+func (s *Server) peersOf(members []member) (Peers, error) {
+	peers := Peers{}
+	for _, m := range members {
+		if peer, ok := s.peers[m.Id]; ok {
+			peers[m.Id] = peer
+			continue
+		}
+		if peer, ok := s.learners[m.Id]; ok {
+			peers[m.Id] = peer
+			continue
+		}
+		if m.Id == s.id {
+			peers[m.Id] = NewLocalPeer(s)
+			continue
+		}
+		if s.dial == nil {
+			return nil, ErrNoDialer
+		}
+		peer, err := s.dial(m.Id, m.Address)
+		if err != nil {
+			return nil, err
+		}
+		peers[m.Id] = peer
+	}
+	return peers, nil
+}
+
+// setMembers replaces the peers and learners. The loop reads them freely, as
+// the only goroutine that changes them, but others, like ReloadPeersFile,
+// read them with members.
+func (s *Server) setMembers(peers, learners Peers) {
+	s.membersMu.Lock()
+	defer s.membersMu.Unlock()
+	s.peers, s.learners = peers, learners
+}
+
+// members returns the peers and learners, from any goroutine. The sets are
+// replaced when they change, never modified, so they may be read unlocked.
+func (s *Server) members() (Peers, Peers) {
+	s.membersMu.RLock()
+	defer s.membersMu.RUnlock()
+	return s.peers, s.learners
+}
+
+// withMembership records, in the change, the peers and learners there'll be
+// once it's applied, so a server restarting with its log can recover them.
+func (s *Server) withMembership(c configurationChange) configurationChange {
+	peers, learners := s.peers, s.learners
+	switch {
+	case c.Promote != 0:
+		if peer, ok := learners[c.Promote]; ok {
+			peers = union(peers, Peers{c.Promote: peer})
+			learners = learners.Except(c.Promote)
+		}
+	case c.Remove != 0:
+		peers = peers.Except(c.Remove)
+		learners = learners.Except(c.Remove)
+	}
+	c.Members, c.Learners = membersOf(peers), membersOf(learners)
+	if c.Learn != nil {
+		c.Learners = append(c.Learners, *c.Learn)
+		sortMembers(c.Learners)
+	}
+	return c
+}
+
+// addLearner makes the member a learner, dialing it, unless it's already a
+// member, e.g. when the entry adding it is applied again after a restart.
+func (s *Server) addLearner(m member) error {
+	if _, ok := s.peers[m.Id]; ok {
+		return nil
+	}
+	if _, ok := s.learners[m.Id]; ok {
+		return nil
+	}
+	peers, err := s.peersOf([]member{m})
+	if err != nil {
+		return err
+	}
+	s.setMembers(s.peers, union(s.learners, peers))
+	s.logGeneric("learner %d added, at %q", m.Id, m.Address)
+	return nil
+}
+
+// recoverMembership restores the membership recorded by the latest
+// configuration entry in our log, as Raft servers always use the latest
+// configuration they have, or else the membership recorded with the snapshot
+// the log was restored from. It replaces any peers and learners the
+// application set, which may be stale, though their Peer values are reused.
+// If the latest entry doesn't record the membership, the application's peers
+// stand.
+func (s *Server) recoverMembership() {
+	if s.recovering {
+		return // the recovery file overrides the log
+	}
+	configuration, source := s.log.latestConfiguration(), "snapshot"
+	entries := s.log.retained()
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Type == EntryConfiguration {
+			configuration, source = entries[i].Command, fmt.Sprintf("entry %d", entries[i].Index)
+			break
+		}
+	}
+	if configuration != nil {
+		if err := s.restoreMembership(configuration); err != nil {
+			s.logGeneric("recovering membership from %s: %s", source, err)
+		}
+	}
+	s.publishStatus()
+}
+
+func (s *Server) restoreMembership(cmd []byte) error {
+	var c configurationChange
+	if err := json.Unmarshal(cmd, &c); err != nil {
+		return err
+	}
+	members, learners := c.Members, c.Learners
+	if c.Bootstrap != nil {
+		members = c.Bootstrap
+	}
+	if members == nil {
+		return nil // written before entries recorded the membership
+	}
+	peers, err := s.peersOf(members)
+	if err != nil {
+		return err
+	}
+	learnerPeers, err := s.peersOf(learners)
+	if err != nil {
+		return err
+	}
+	s.setMembers(peers, learnerPeers)
+	s.logGeneric("recovered %d peer(s) and %d learner(s) from the log", len(peers), len(learnerPeers))
+	return nil
+}
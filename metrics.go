@@ -0,0 +1,216 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The metrics a server reports to its MetricsSink. Latencies are in seconds.
+const (
+	MetricElectionsStarted      = "elections.started"       // counter
+	MetricElectionsWon          = "elections.won"           // counter
+	MetricElectionsLost         = "elections.lost"          // counter
+	MetricElectionsAbandoned    = "elections.abandoned"     // counter
+	MetricRPCs                  = "rpc.count"               // counter, by rpc, peer, and result
+	MetricRPCLatency            = "rpc.latency"             // sample, by rpc and peer
+	MetricCommitLatency         = "commit.latency"          // sample, from append to commit, leader only
+	MetricLogEntries            = "log.entries"             // gauge
+	MetricLogCommitIndex        = "log.commit_index"        // gauge
+	MetricFollowerLag           = "follower.lag"            // gauge, in entries, by peer, leader only
+	MetricAppendEntriesRejected = "append_entries.rejected" // counter, by peer and reason, leader only
+	MetricCommandBytes          = "log.command_bytes"       // counter, of commands committed
+	MetricBarriers              = "log.barriers"            // counter, of barriers committed
+	MetricStoreAppends          = "store.appends"           // counter, entries written to the log store
+	MetricStoreAppendBytes      = "store.append_bytes"      // counter
+	MetricStoreReads            = "store.reads"             // counter, entries recovered from the log store
+	MetricStoreReadBytes        = "store.read_bytes"        // counter
+	MetricStoreTruncations      = "store.truncations"       // counter, by kind: compact or reset
+	MetricStoreSyncs            = "store.syncs"             // counter
+	MetricStoreSyncLatency      = "store.sync_latency"      // sample
+	MetricCommandQueueDepth     = "command.queue_depth"     // gauge, commands waiting for the main loop
+)
+
+// The store metrics count the log's calls to its store, and the bytes of the
+// entries it writes and recovers, as it encodes them, not counting whatever
+// framing the store adds. The log only reads its store when the server's
+// created, and reports those reads when it starts. Comparing the bytes
+// written with MetricCommandBytes gives the log's write amplification.
+
+// Label qualifies a metric, e.g. the peer an RPC was sent to.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// MetricsSink receives a server's metrics, so operators can see what a running
+// cluster is doing. It's called from the server's main loop, and from the
+// goroutines making RPCs, so it must be safe for concurrent use, and it
+// shouldn't block.
+type MetricsSink interface {
+	IncrCounter(name string, delta float64, labels ...Label)
+	SetGauge(name string, value float64, labels ...Label)
+	AddSample(name string, value float64, labels ...Label)
+}
+
+// SetMetricsSink sets the sink the server reports its metrics to. It must be
+// called before Start. By default, metrics are discarded.
+func (s *Server) SetMetricsSink(sink MetricsSink) {
+	s.metrics.sink = sink
+}
+
+// metrics reports a server's metrics to its sink, if it has one.
+type metrics struct {
+	sink MetricsSink
+}
+
+func (m *metrics) incr(name string, labels ...Label) {
+	m.add(name, 1, labels...)
+}
+
+func (m *metrics) add(name string, delta float64, labels ...Label) {
+	if m != nil && m.sink != nil {
+		m.sink.IncrCounter(name, delta, labels...)
+	}
+}
+
+func (m *metrics) gauge(name string, value float64, labels ...Label) {
+	if m != nil && m.sink != nil {
+		m.sink.SetGauge(name, value, labels...)
+	}
+}
+
+func (m *metrics) since(name string, t time.Time, labels ...Label) {
+	if m != nil && m.sink != nil {
+		m.sink.AddSample(name, time.Since(t).Seconds(), labels...)
+	}
+}
+
+// rpc reports an RPC to a peer, begun at the passed time.
+func (m *metrics) rpc(rpc string, peer uint64, began time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	id := peerLabel(peer)
+	m.incr(MetricRPCs, Label{"rpc", rpc}, id, Label{"result", result})
+	m.since(MetricRPCLatency, began, Label{"rpc", rpc}, id)
+}
+
+// followerLag reports how far each peer's log is known to trail ours.
+func (m *metrics) followerLag(peers Peers, ni *nextIndex, lastIndex uint64) {
+	for id := range peers {
+		lag := uint64(0)
+		if match := ni.matchIndex(id); match < lastIndex {
+			lag = lastIndex - match
+		}
+		m.gauge(MetricFollowerLag, float64(lag), peerLabel(id))
+	}
+}
+
+func peerLabel(id uint64) Label {
+	return Label{"peer", strconv.FormatUint(id, 10)}
+}
+
+// ExpvarSink is a MetricsSink that publishes metrics as an expvar.Map, so
+// they're served with the process's other variables at /debug/vars. Each
+// metric's key is its name, followed by its labels, if any, in braces, e.g.
+// "rpc.count{rpc=append_entries,peer=2,result=ok}". Samples are published as
+// their count, sum, min, max, and last value.
+type ExpvarSink struct {
+	mu   sync.Mutex // serializes creating gauges and samples
+	vars *expvar.Map
+}
+
+// NewExpvarSink publishes a new map of metrics with the given name. Like
+// expvar.Publish, it panics if the name is already in use.
+func NewExpvarSink(name string) *ExpvarSink {
+	return &ExpvarSink{vars: expvar.NewMap(name)}
+}
+
+// NewExpvarSinkMap reports metrics to the passed map, which needn't be
+// published, e.g. so that it can be nested in another, or read by a test.
+func NewExpvarSinkMap(vars *expvar.Map) *ExpvarSink {
+	return &ExpvarSink{vars: vars}
+}
+
+func (s *ExpvarSink) IncrCounter(name string, delta float64, labels ...Label) {
+	s.vars.AddFloat(expvarKey(name, labels), delta)
+}
+
+func (s *ExpvarSink) SetGauge(name string, value float64, labels ...Label) {
+	key := expvarKey(name, labels)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.vars.Get(key).(*expvar.Float)
+	if !ok {
+		f = new(expvar.Float)
+		s.vars.Set(key, f)
+	}
+	f.Set(value)
+}
+
+func (s *ExpvarSink) AddSample(name string, value float64, labels ...Label) {
+	key := expvarKey(name, labels)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.vars.Get(key).(*expvarSample)
+	if !ok {
+		v = &expvarSample{}
+		s.vars.Set(key, v)
+	}
+	v.add(value)
+}
+
+func expvarKey(name string, labels []Label) string {
+	if len(labels) <= 0 {
+		return name
+	}
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	for i, l := range labels {
+		if i == 0 {
+			buf.WriteByte('{')
+		} else {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%s=%s", l.Name, l.Value)
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// expvarSample summarizes the values of a sample, as an expvar.Var.
+type expvarSample struct {
+	sync.Mutex
+	Count uint64  `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Last  float64 `json:"last"`
+}
+
+func (v *expvarSample) add(value float64) {
+	v.Lock()
+	defer v.Unlock()
+	if v.Count == 0 || value < v.Min {
+		v.Min = value
+	}
+	if v.Count == 0 || value > v.Max {
+		v.Max = value
+	}
+	v.Count++
+	v.Sum += value
+	v.Last = value
+}
+
+func (v *expvarSample) String() string {
+	v.Lock()
+	defer v.Unlock()
+	buf, _ := json.Marshal(v)
+	return string(buf)
+}
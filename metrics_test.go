@@ -0,0 +1,207 @@
+package raft_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/peterbourgon/raft"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	sink := &recordingSink{values: map[string]float64{}}
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	server.SetMetricsSink(sink)
+	up, down := &switchablePeer{id: 2, up: 1}, &switchablePeer{id: 3}
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), up, down))
+	server.Start()
+	defer server.Stop()
+
+	for i := 0; i < 3; {
+		response := make(chan []byte, 1)
+		if err := server.Command([]byte(`{}`), response); err != nil {
+			time.Sleep(config.MinElectionTimeout)
+			continue
+		}
+		<-response
+		i++
+	}
+	time.Sleep(2 * config.HeartbeatInterval) // another flush, at least
+
+	for _, key := range []string{
+		"elections.started",
+		"elections.won",
+		"rpc.count{rpc=request_vote,peer=2,result=ok}",
+		"rpc.count{rpc=append_entries,peer=2,result=ok}",
+		"rpc.latency{rpc=append_entries,peer=3}",
+		"commit.latency",
+		"append_entries.rejected{peer=3,reason=unknown}", // no reason from a down peer
+	} {
+		if got := sink.get(key); got < 1 {
+			t.Errorf("%s: expected at least 1, got %v", key, got)
+		}
+	}
+	// the leader appends an entry of its own, too
+	lastIndex := float64(server.Status().LastIndex)
+	if expected, got := lastIndex, sink.get("log.entries"); expected != got {
+		t.Errorf("log.entries: expected %v, got %v", expected, got)
+	}
+	if expected, got := 0., sink.get("follower.lag{peer=2}"); expected != got {
+		t.Errorf("follower.lag of the live peer: expected %v, got %v", expected, got)
+	}
+	if expected, got := lastIndex, sink.get("follower.lag{peer=3}"); expected != got {
+		t.Errorf("follower.lag of the down peer: expected %v, got %v", expected, got)
+	}
+}
+
+func TestStoreMetrics(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+
+	start := func(store io.ReadWriter) (*raft.Server, *recordingSink) {
+		sink := &recordingSink{values: map[string]float64{}}
+		server := raft.NewServer(1, store, noop, config)
+		server.SetMetricsSink(sink)
+		server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+		server.Start()
+		select {
+		case <-server.LeaderCh():
+		case <-time.After(10 * config.MaxElectionTimeout):
+			t.Fatal("never became leader")
+		}
+		return server, sink
+	}
+
+	store := &syncedBuffer{}
+	server, sink := start(store)
+	for i := 0; i < 3; i++ {
+		response := make(chan []byte, 1)
+		if err := server.Command([]byte(`{}`), response); err != nil {
+			t.Fatal(err)
+		}
+		<-response
+	}
+	server.Stop()
+
+	// every entry, and every byte, the log wrote is counted
+	entries := float64(server.Status().LastIndex)
+	for key, expected := range map[string]float64{
+		"store.appends":      entries,
+		"store.append_bytes": float64(store.Len()),
+		"log.command_bytes":  3 * 2,
+		"store.syncs":        float64(store.syncs),
+	} {
+		if got := sink.get(key); expected != got {
+			t.Errorf("%s: expected %v, got %v", key, expected, got)
+		}
+	}
+	if sink.get("store.sync_latency") < 1 {
+		t.Errorf("store.sync_latency: expected samples, got none")
+	}
+
+	// and read back, when the next server recovers them
+	written := float64(store.Len())
+	server, sink = start(store)
+	defer server.Stop()
+	if expected, got := entries, sink.get("store.reads"); expected != got {
+		t.Errorf("store.reads: expected %v, got %v", expected, got)
+	}
+	if expected, got := written, sink.get("store.read_bytes"); expected != got {
+		t.Errorf("store.read_bytes: expected %v, got %v", expected, got)
+	}
+}
+
+// syncedBuffer is a log store that counts its syncs.
+type syncedBuffer struct {
+	bytes.Buffer
+	syncs int
+}
+
+func (b *syncedBuffer) Sync() error { b.syncs++; return nil }
+
+func TestExpvarSink(t *testing.T) {
+	vars := new(expvar.Map).Init() // unpublished, so the test can run again
+	sink := raft.NewExpvarSinkMap(vars)
+	sink.IncrCounter("rpc.count", 1, raft.Label{Name: "peer", Value: "2"})
+	sink.IncrCounter("rpc.count", 2, raft.Label{Name: "peer", Value: "2"})
+	sink.SetGauge("log.entries", 5)
+	sink.SetGauge("log.entries", 7)
+	sink.AddSample("commit.latency", 0.5)
+	sink.AddSample("commit.latency", 0.25)
+
+	var published struct {
+		Count   float64 `json:"rpc.count{peer=2}"`
+		Entries float64 `json:"log.entries"`
+		Latency struct {
+			Count uint64
+			Sum   float64
+			Min   float64
+			Max   float64
+			Last  float64
+		} `json:"commit.latency"`
+	}
+	if err := json.Unmarshal([]byte(vars.String()), &published); err != nil {
+		t.Fatal(err)
+	}
+	if published.Count != 3 || published.Entries != 7 {
+		t.Errorf("expected counter 3 and gauge 7, got %+v", published)
+	}
+	if l := published.Latency; l.Count != 2 || l.Sum != 0.75 || l.Min != 0.25 || l.Max != 0.5 || l.Last != 0.25 {
+		t.Errorf("unexpected sample %+v", l)
+	}
+}
+
+// recordingSink records the latest value of each gauge, the total of each
+// counter, and the number of values of each sample.
+type recordingSink struct {
+	sync.Mutex
+	values map[string]float64
+}
+
+func (s *recordingSink) IncrCounter(name string, delta float64, labels ...raft.Label) {
+	s.Lock()
+	defer s.Unlock()
+	s.values[metricKey(name, labels)] += delta
+}
+
+func (s *recordingSink) SetGauge(name string, value float64, labels ...raft.Label) {
+	s.Lock()
+	defer s.Unlock()
+	s.values[metricKey(name, labels)] = value
+}
+
+func (s *recordingSink) AddSample(name string, value float64, labels ...raft.Label) {
+	s.Lock()
+	defer s.Unlock()
+	s.values[metricKey(name, labels)]++
+}
+
+func (s *recordingSink) get(key string) float64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.values[key]
+}
+
+func metricKey(name string, labels []raft.Label) string {
+	if len(labels) <= 0 {
+		return name
+	}
+	var buf bytes.Buffer
+	for _, l := range labels {
+		fmt.Fprintf(&buf, ",%s=%s", l.Name, l.Value)
+	}
+	return fmt.Sprintf("%s{%s}", name, buf.String()[1:])
+}
@@ -0,0 +1,164 @@
+package raft
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrMigrationInterrupted = errors.New("a snapshot was installed during the migration")
+)
+
+// Migrate moves the server's log, and its snapshots, to new stores, while it
+// runs, e.g. to move off a disk that's filling up, or onto another storage
+// engine. The snapshots are copied first, oldest first, and then the entries
+// persisted in the log store, before the server switches over to the new
+// stores, with the log locked, so nothing's lost in between. The old stores
+// are left as they were, for the caller to remove. The new stores should be
+// empty. Either may be nil, to keep the current one; the server must already
+// have a snapshot store to move its snapshots.
+//
+// If a snapshot from the leader is installed while the snapshots are copied,
+// Migrate fails with ErrMigrationInterrupted, and the server keeps its stores,
+// so it can be tried again. Snapshots in the middle of being installed when
+// the server switches over fail to install, and the leader sends them again.
+func (s *Server) Migrate(store io.ReadWriter, snapshots SnapshotStore) error {
+	var (
+		sw      *snapshotSwitch
+		covered uint64 // the newest snapshot copied covers the log up to here
+	)
+	if snapshots != nil {
+		var ok bool
+		if sw, ok = s.snapshots.(*snapshotSwitch); !ok {
+			return ErrNoSnapshotStore
+		}
+		s.snapshotMu.Lock() // no snapshots taken, or compactions, meanwhile
+		defer s.snapshotMu.Unlock()
+		newest, err := copySnapshots(sw.current(), snapshots)
+		if err != nil {
+			return err
+		}
+		covered = newest
+	}
+
+	err := s.log.migrate(store, func(compactedIndex uint64) error {
+		if sw == nil {
+			return nil
+		}
+		if compactedIndex > covered {
+			return ErrMigrationInterrupted
+		}
+		sw.swap(snapshots)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.config().logf("id=%d: migrated to new stores", s.id)
+	return nil
+}
+
+// copySnapshots copies the snapshots in the store to another, oldest first,
+// and returns the index of the newest.
+func copySnapshots(from, to SnapshotStore) (uint64, error) {
+	snapshots, err := from.List()
+	if err != nil {
+		return 0, err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		meta, data, err := from.Open(snapshots[i].Id)
+		if err != nil {
+			return 0, err
+		}
+		err = copySnapshot(meta, data, to)
+		data.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(snapshots) == 0 {
+		return 0, nil
+	}
+	return snapshots[0].Index, nil
+}
+
+func copySnapshot(meta SnapshotMeta, data io.Reader, to SnapshotStore) error {
+	sink, err := to.Create(meta)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(sink, data); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// migrate writes the entries persisted in the log's store to the new store,
+// and syncs it, if it's a Syncer, and then, unless cutover fails, switches
+// over to it. A nil store keeps the current one. Cutover is called with the
+// log locked, and its compacted index.
+func (l *Log) migrate(store io.ReadWriter, cutover func(compactedIndex uint64) error) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if store == nil {
+		return cutover(l.compactedIndex)
+	}
+	if r, ok := store.(Resetter); ok && l.compactedIndex > 0 {
+		l.metrics.incr(MetricStoreTruncations, Label{"kind", "reset"})
+		if err := r.Reset(l.compactedIndex + 1); err != nil {
+			return err
+		}
+	}
+	for pos := 0; pos <= l.persistPos; pos++ {
+		if err := l.entries[pos].encode(store); err != nil {
+			return err
+		}
+		l.metrics.incr(MetricStoreAppends)
+		l.metrics.add(MetricStoreAppendBytes, float64(l.entries[pos].encodedSize()))
+	}
+	if s, ok := store.(Syncer); ok {
+		if err := l.syncStore(s); err != nil {
+			return err
+		}
+	}
+	if err := cutover(l.compactedIndex); err != nil {
+		return err
+	}
+	l.store, l.unsynced, l.replacing = store, false, false
+	return nil
+}
+
+// snapshotSwitch is the snapshot store a server uses, which passes every call
+// to the store it's currently switched to, so Migrate can switch it while
+// the server runs.
+type snapshotSwitch struct {
+	sync.RWMutex
+	store SnapshotStore
+}
+
+func (sw *snapshotSwitch) current() SnapshotStore {
+	sw.RLock()
+	defer sw.RUnlock()
+	return sw.store
+}
+
+func (sw *snapshotSwitch) swap(store SnapshotStore) {
+	sw.Lock()
+	defer sw.Unlock()
+	sw.store = store
+}
+
+func (sw *snapshotSwitch) Create(meta SnapshotMeta) (SnapshotSink, error) {
+	return sw.current().Create(meta)
+}
+
+func (sw *snapshotSwitch) List() ([]SnapshotMeta, error) { return sw.current().List() }
+
+func (sw *snapshotSwitch) Open(id string) (SnapshotMeta, io.ReadCloser, error) {
+	return sw.current().Open(id)
+}
+
+func (sw *snapshotSwitch) Delete(id string) error { return sw.current().Delete(id) }
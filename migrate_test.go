@@ -0,0 +1,94 @@
+package raft_test
+
+import (
+	"bytes"
+	"github.com/peterbourgon/raft"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMigrate(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+
+	dir, err := ioutil.TempDir("", "raft-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotStore := func(name string) raft.SnapshotStore {
+		store, err := raft.NewFileSnapshotStore(filepath.Join(dir, name), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	start := func(store *bytes.Buffer, snapshots raft.SnapshotStore) (*raft.Server, *sumFSM) {
+		fsm := &sumFSM{}
+		server := raft.NewServer(1, store, fsm.apply, config)
+		if err := server.SetSnapshotStore(snapshots, fsm); err != nil {
+			t.Fatal(err)
+		}
+		server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+		server.Start()
+		select {
+		case <-server.LeaderCh():
+		case <-time.After(10 * config.MaxElectionTimeout):
+			t.Fatal("never became leader")
+		}
+		return server, fsm
+	}
+	command := func(server *raft.Server, n int) {
+		response := make(chan []byte, 1)
+		if err := server.Command([]byte(strconv.Itoa(n)), response); err != nil {
+			t.Fatal(err)
+		}
+		<-response
+	}
+
+	oldSnapshots := snapshotStore("old")
+	server, _ := start(&bytes.Buffer{}, oldSnapshots)
+	for n := 1; n <= 5; n++ {
+		command(server, n)
+	}
+	if _, err := server.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	command(server, 6)
+
+	// the running server moves to new stores, and carries on with them
+	store, snapshots := &bytes.Buffer{}, snapshotStore("new")
+	if err := server.Migrate(store, snapshots); err != nil {
+		t.Fatal(err)
+	}
+	command(server, 7)
+	if _, err := server.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	command(server, 8)
+	server.Stop()
+
+	if list, _ := oldSnapshots.List(); len(list) != 1 {
+		t.Errorf("expected the old store to keep its 1 snapshot, got %d", len(list))
+	}
+	if list, _ := snapshots.List(); len(list) != 2 {
+		t.Errorf("expected 2 snapshots in the new store, got %d", len(list))
+	}
+
+	// and a server started from the new stores has everything
+	server, fsm := start(store, snapshots)
+	defer server.Stop()
+	command(server, 9)
+	if expected, got := 45, fsm.get(); expected != got {
+		t.Errorf("expected sum %d, got %d", expected, got)
+	}
+}
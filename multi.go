@@ -0,0 +1,95 @@
+package raft
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrUnknownGroup = errors.New("unknown group")
+	ErrGroupExists  = errors.New("group already hosted")
+)
+
+// MultiServer hosts many independent Raft groups in one process, e.g. one per
+// shard of a sharded state machine. Each group is a Server of its own, with
+// its own log, peers, and state machine; the MultiServer finds them by group
+// id, so that a transport can serve them all on one listener (see
+// rafthttp.MultiServer), and stops them together. A server's id need only be
+// unique within its group.
+type MultiServer struct {
+	sync.RWMutex
+	groups map[uint64]*Server
+}
+
+func NewMultiServer() *MultiServer {
+	return &MultiServer{groups: map[uint64]*Server{}}
+}
+
+// Add hosts the server as the group, whose id must be greater than 0. It
+// fails with ErrGroupExists if the group is already hosted. The server may
+// be added before or after it's started, but before its peers dial it.
+func (m *MultiServer) Add(group uint64, s *Server) error {
+	if group <= 0 {
+		panic("group id must be > 0")
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.groups[group]; ok {
+		return ErrGroupExists
+	}
+	m.groups[group] = s
+	return nil
+}
+
+// Remove stops hosting the group, and returns its server, which it doesn't
+// stop. It fails with ErrUnknownGroup if the group isn't hosted.
+func (m *MultiServer) Remove(group uint64) (*Server, error) {
+	m.Lock()
+	defer m.Unlock()
+	s, ok := m.groups[group]
+	if !ok {
+		return nil, ErrUnknownGroup
+	}
+	delete(m.groups, group)
+	return s, nil
+}
+
+// Group returns the group's server, or ErrUnknownGroup if it isn't hosted.
+func (m *MultiServer) Group(group uint64) (*Server, error) {
+	m.RLock()
+	defer m.RUnlock()
+	s, ok := m.groups[group]
+	if !ok {
+		return nil, ErrUnknownGroup
+	}
+	return s, nil
+}
+
+// Groups returns the ids of the hosted groups, in order.
+func (m *MultiServer) Groups() []uint64 {
+	m.RLock()
+	defer m.RUnlock()
+	groups := make([]uint64, 0, len(m.groups))
+	for group := range m.groups {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i] < groups[j] })
+	return groups
+}
+
+// Stop stops every hosted group's server, together, and returns once they've
+// all stopped. Each must have been started. The groups stay hosted.
+func (m *MultiServer) Stop() {
+	m.RLock()
+	defer m.RUnlock()
+	var wg sync.WaitGroup
+	for _, s := range m.groups {
+		wg.Add(1)
+		go func(s *Server) {
+			defer wg.Done()
+			s.Stop()
+		}(s)
+	}
+	wg.Wait()
+}
@@ -1,13 +1,18 @@
 package raft
 
 import (
+	"context"
 	"errors"
+	"io"
 	"time"
 )
 
 var (
-	ErrTimeout        = errors.New("timeout")
-	ErrInvalidRequest = errors.New("invalid request")
+	ErrTimeout             = errors.New("timeout")
+	ErrInvalidRequest      = errors.New("invalid request")
+	ErrUnknownPeer         = errors.New("unknown peer")
+	ErrPeerExists          = errors.New("already a peer")
+	ErrAddressNotSupported = errors.New("peer doesn't support address changes")
 )
 
 // Peer is anything which provides a Raft-domain interface to a server. Peer is
@@ -22,6 +27,43 @@ type Peer interface {
 	Command([]byte, chan []byte) error
 }
 
+// ContextPeer is implemented by peers that can abandon an RPC when its context
+// is done, e.g. because the leader has given up on a flush, or the election
+// the vote was for is over. Transports can use the context's deadline as the
+// deadline of the RPC. Peers that don't implement it are called as usual, and
+// their response ignored if it arrives after the context is done.
+type ContextPeer interface {
+	AppendEntriesContext(context.Context, AppendEntries) (AppendEntriesResponse, error)
+	RequestVoteContext(context.Context, RequestVote) (RequestVoteResponse, error)
+}
+
+// Addresser is implemented by peers whose network address can be changed at
+// runtime, e.g. when a server moves to a new IP. The format of the address is
+// up to the transport.
+type Addresser interface {
+	Address() string
+	SetAddress(string) error
+}
+
+// MultiAddresser is implemented by peers that can reach their server at any
+// of several addresses, e.g. one per network it's on. The peer uses one at a
+// time, which is its Address, and moves on to the next when the server can't
+// be reached there. Host names in addresses are resolved each time they're
+// dialed, so a server that moves keeps its name.
+type MultiAddresser interface {
+	Addresser
+	Addresses() []string
+	SetAddresses([]string) error
+}
+
+// RoundTripTimer is implemented by peers whose transport measures the round-
+// trip time of their RPCs. Servers use the estimates to scale their timeouts,
+// so clusters spanning high-latency links (e.g. multiple datacenters) don't
+// suffer spurious elections, and don't need to be tuned by hand.
+type RoundTripTimer interface {
+	RoundTripTime() time.Duration
+}
+
 // LocalPeer is the simplest kind of peer, mapped to a server in the
 // same process-space. Useful for testing and demonstration; not so
 // useful for networks of independent processes.
@@ -45,20 +87,61 @@ func (p *LocalPeer) Command(cmd []byte, response chan []byte) error {
 	return p.server.Command(cmd, response)
 }
 
-// requestVoteTimeout issues the RequestVote to the given peer.
-// If no response is received before timeout, an error is returned.
-func requestVoteTimeout(p Peer, rv RequestVote, timeout time.Duration) (RequestVoteResponse, error) {
-	c := make(chan RequestVoteResponse)
+func (p *LocalPeer) AppendEntriesContext(ctx context.Context, ae AppendEntries) (AppendEntriesResponse, error) {
+	return p.server.AppendEntriesContext(ctx, ae)
+}
+
+func (p *LocalPeer) RequestVoteContext(ctx context.Context, rv RequestVote) (RequestVoteResponse, error) {
+	return p.server.RequestVoteContext(ctx, rv)
+}
+
+func (p *LocalPeer) InstallSnapshotContext(ctx context.Context, is InstallSnapshot, data io.Reader) (InstallSnapshotResponse, error) {
+	return p.server.InstallSnapshotContext(ctx, is, data)
+}
+
+// appendEntries issues the AppendEntries to the given peer. If the context is
+// done before a response is received, its error is returned.
+func appendEntries(ctx context.Context, p Peer, ae AppendEntries) (AppendEntriesResponse, error) {
+	if cp, ok := p.(ContextPeer); ok {
+		return cp.AppendEntriesContext(ctx, ae)
+	}
+	c := make(chan AppendEntriesResponse, 1)
+	go func() { c <- p.AppendEntries(ae) }()
+
+	select {
+	case resp := <-c:
+		return resp, nil
+	case <-ctx.Done():
+		return AppendEntriesResponse{}, contextError(ctx)
+	}
+}
+
+// requestVote issues the RequestVote to the given peer. If the context is
+// done before a response is received, its error is returned.
+func requestVote(ctx context.Context, p Peer, rv RequestVote) (RequestVoteResponse, error) {
+	if cp, ok := p.(ContextPeer); ok {
+		return cp.RequestVoteContext(ctx, rv)
+	}
+	c := make(chan RequestVoteResponse, 1)
 	go func() { c <- p.RequestVote(rv) }()
 
 	select {
 	case resp := <-c:
 		return resp, nil
-	case <-time.After(timeout):
-		return RequestVoteResponse{}, ErrTimeout
+	case <-ctx.Done():
+		return RequestVoteResponse{}, contextError(ctx)
 	}
 }
 
+// contextError returns the error of a done context, as ErrTimeout if its
+// deadline passed, for the benefit of callers that only know ErrTimeout.
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return ctx.Err()
+}
+
 // Peers is a collection of Peer interfaces. It provides some convenience
 // functions for actions that should apply to multiple Peers.
 type Peers map[uint64]Peer
@@ -85,6 +168,41 @@ func (p Peers) Except(id uint64) Peers {
 
 func (p Peers) Count() int { return len(p) }
 
+// SetAddress changes the network address of the peer with the given id, in
+// place, so everything holding the peer (e.g. the leader's replication) uses
+// the new address from its next RPC. The peer must implement Addresser.
+func (p Peers) SetAddress(id uint64, addr string) error {
+	peer, ok := p[id]
+	if !ok {
+		return ErrUnknownPeer
+	}
+	a, ok := peer.(Addresser)
+	if !ok {
+		return ErrAddressNotSupported
+	}
+	return a.SetAddress(addr)
+}
+
+// SetAddresses changes the network addresses of the peer with the given id,
+// in place, like SetAddress. The peer must implement MultiAddresser, unless
+// there's only one address, when Addresser will do.
+func (p Peers) SetAddresses(id uint64, addrs []string) error {
+	peer, ok := p[id]
+	if !ok {
+		return ErrUnknownPeer
+	}
+	if a, ok := peer.(MultiAddresser); ok {
+		return a.SetAddresses(addrs)
+	}
+	if len(addrs) == 1 {
+		return p.SetAddress(id, addrs[0])
+	}
+	return ErrAddressNotSupported
+}
+
+// Quorum returns how many of the peers make a majority, which must agree to
+// elect a leader, or commit an entry. With a witness, an even number of peers
+// needs as many votes, from one more voter.
 func (p Peers) Quorum() int {
 	switch n := len(p); n {
 	case 0, 1:
@@ -96,18 +214,17 @@ func (p Peers) Quorum() int {
 
 // requestVotes sends the passed RequestVote RPC to every peer in Peers. It
 // forwards responses along the returned RequestVoteResponse channel. It makes
-// the RPCs with a timeout of BroadcastInterval * 2 (chosen arbitrarily). Peers
-// that don't respond within the timeout are retried forever. The retry loop
-// stops only when all peers have responded, or a Cancel signal is sent via the
-// returned Canceler.
-func (p Peers) requestVotes(r RequestVote) (chan RequestVoteResponse, canceler) {
+// the RPCs with the passed timeout. Peers that don't respond within the
+// timeout are retried forever. The retry loop stops only when all peers have
+// responded, or the context is done, which also abandons the RPCs in flight.
+// Each RPC is reported to m, which may be nil.
+func (p Peers) requestVotes(ctx context.Context, r RequestVote, timeout time.Duration, m *metrics) chan RequestVoteResponse {
 	// "[A server entering the candidate stage] issues RequestVote RPCs in
 	// parallel to each of the other servers in the cluster. If the candidate
 	// receives no response for an RPC, it reissues the RPC repeatedly until a
 	// response arrives or the election concludes."
 
-	// construct the channels we'll return
-	abortChan := make(chan struct{})
+	// construct the channel we'll return
 	responsesChan := make(chan RequestVoteResponse)
 
 	// compact a peer.RequestVote response to a single struct
@@ -132,7 +249,11 @@ func (p Peers) requestVotes(r RequestVote) (chan RequestVoteResponse, canceler)
 			tupleChan := make(chan tuple, len(notYetResponded))
 			for id, peer := range notYetResponded {
 				go func(id0 uint64, peer0 Peer) {
-					resp, err := requestVoteTimeout(peer0, r, 2*BroadcastInterval())
+					ctx0, cancel := context.WithTimeout(ctx, timeout)
+					defer cancel()
+					began := time.Now()
+					resp, err := requestVote(ctx0, peer0, r)
+					m.rpc("request_vote", id0, began, err)
 					tupleChan <- tuple{id0, resp, err}
 				}(id, peer)
 			}
@@ -144,26 +265,36 @@ func (p Peers) requestVotes(r RequestVote) (chan RequestVoteResponse, canceler)
 					if t.Err != nil {
 						continue // will need to retry
 					}
-					respondedAlready[t.Id] = nil           // value irrelevant
-					responsesChan <- t.RequestVoteResponse // forward the vote
-				case <-abortChan:
+					respondedAlready[t.Id] = nil // value irrelevant
+					select {
+					case responsesChan <- t.RequestVoteResponse: // forward the vote
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
 					return // give up
 				}
 			}
 		}
 	}()
 
-	return responsesChan, cancel(abortChan)
+	return responsesChan
 }
 
-type canceler interface {
-	Cancel()
+// roundTripTime returns the largest round-trip time estimate among the peers
+// that implement RoundTripTimer, or zero if there are none.
+func (p Peers) roundTripTime() time.Duration {
+	max := time.Duration(0)
+	for _, peer := range p {
+		if rt, ok := peer.(RoundTripTimer); ok {
+			if d := rt.RoundTripTime(); d > max {
+				max = d
+			}
+		}
+	}
+	return max
 }
 
-type cancel chan struct{}
-
-func (c cancel) Cancel() { close(c) }
-
 func disjoint(all, except Peers) Peers {
 	d := Peers{}
 	for id, peer := range all {
@@ -174,3 +305,14 @@ func disjoint(all, except Peers) Peers {
 	}
 	return d
 }
+
+func union(a, b Peers) Peers {
+	u := Peers{}
+	for id, peer := range a {
+		u[id] = peer
+	}
+	for id, peer := range b {
+		u[id] = peer
+	}
+	return u
+}
@@ -30,5 +30,56 @@ func TestQuorum(t *testing.T) {
 		if expected, got := tuple.expected, peers.Quorum(); expected != got {
 			t.Errorf("Quorum of %d: expected %d, got %d", tuple.n, expected, got)
 		}
+		if expected, got := (tuple.n-1)/2, peers.FaultTolerance(); tuple.n > 0 && expected != got {
+			t.Errorf("FaultTolerance of %d: expected %d, got %d", tuple.n, expected, got)
+		}
+	}
+}
+
+func TestPeersSetAddress(t *testing.T) {
+	a := &addressablePeer{id: 1, addr: "old"}
+	peers := raft.MakePeers(a, nonresponsivePeer(2))
+
+	if err := peers.SetAddress(1, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "new", a.Address(); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	if expected, got := raft.ErrAddressNotSupported, peers.SetAddress(2, "new"); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if expected, got := raft.ErrUnknownPeer, peers.SetAddress(3, "new"); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
 	}
 }
+
+func TestPeersSetAddresses(t *testing.T) {
+	a := &addressablePeer{id: 1, addr: "old"}
+	peers := raft.MakePeers(a, nonresponsivePeer(2))
+
+	// a peer that takes one address can be given one
+	if err := peers.SetAddresses(1, []string{"new"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "new", a.Address(); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if expected, got := raft.ErrAddressNotSupported, peers.SetAddresses(1, []string{"a", "b"}); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if expected, got := raft.ErrUnknownPeer, peers.SetAddresses(3, []string{"new"}); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+type addressablePeer struct {
+	nonresponsivePeer
+	id   uint64
+	addr string
+}
+
+func (p *addressablePeer) Id() uint64                { return p.id }
+func (p *addressablePeer) Address() string           { return p.addr }
+func (p *addressablePeer) SetAddress(a string) error { p.addr = a; return nil }
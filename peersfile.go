@@ -0,0 +1,293 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PeerSpec is a server as it's listed in a peers file.
+type PeerSpec struct {
+	Id        uint64   `json:"id"`
+	Address   string   `json:"address"`
+	Addresses []string `json:"addresses,omitempty"` // more, tried after Address
+}
+
+// addresses returns all of the server's addresses, in order.
+func (p PeerSpec) addresses() []string {
+	return append([]string{p.Address}, p.Addresses...)
+}
+
+// ReadPeersFile reads the servers listed in a peers file, ordered by id. The
+// file is a list of PeerSpecs, in JSON, or, if its name ends in .yaml or .yml,
+// in YAML:
+//
+//	# the cluster
+//	- id: 1
+//	  address: http://10.0.0.1:8001
+//	- id: 2
+//	  address: http://10.0.0.2:8001
+//	  addresses: [http://10.1.0.2:8001]
+//
+// Only the YAML needed for that is understood: a sequence of mappings, whose
+// values are scalars, or sequences of scalars, either in brackets, or one
+// per line, each after a "- ".
+func ReadPeersFile(path string) ([]PeerSpec, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePeersFile(path, buf)
+}
+
+func parsePeersFile(path string, buf []byte) ([]PeerSpec, error) {
+	var specs []PeerSpec
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var err error
+		if specs, err = parseYAMLPeers(buf); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	default:
+		d := json.NewDecoder(bytes.NewReader(buf))
+		d.DisallowUnknownFields()
+		if err := d.Decode(&specs); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	seen := map[uint64]bool{}
+	for _, spec := range specs {
+		switch {
+		case spec.Id == 0:
+			return nil, fmt.Errorf("%s: a server has no id", path)
+		case spec.Address == "":
+			return nil, fmt.Errorf("%s: server %d has no address", path, spec.Id)
+		case seen[spec.Id]:
+			return nil, fmt.Errorf("%s: server %d is listed twice", path, spec.Id)
+		}
+		seen[spec.Id] = true
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Id < specs[j].Id })
+	return specs, nil
+}
+
+// parseYAMLPeers parses the YAML that ReadPeersFile understands.
+func parseYAMLPeers(buf []byte) ([]PeerSpec, error) {
+	var specs []PeerSpec
+	itemIndent := -1 // of the "- " that starts each server
+	listKey := ""    // whose sequence the following lines hold, one per line
+	for n, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimRight(stripYAMLComment(line), " \t\r")
+		text := strings.TrimLeft(line, " ")
+		indent := len(line) - len(text)
+		if text == "" || text == "---" {
+			continue
+		}
+		dash := text == "-" || strings.HasPrefix(text, "- ")
+		switch {
+		case dash && (itemIndent < 0 || indent == itemIndent):
+			itemIndent, listKey = indent, ""
+			specs = append(specs, PeerSpec{})
+			text = strings.TrimSpace(strings.TrimPrefix(text, "-"))
+			if text == "" {
+				continue
+			}
+		case dash && indent > itemIndent && listKey != "":
+			if err := setPeerSpec(&specs[len(specs)-1], listKey, []string{unquoteYAML(strings.TrimSpace(text[1:]))}); err != nil {
+				return nil, fmt.Errorf("line %d: %s", n+1, err)
+			}
+			continue
+		case len(specs) == 0 || indent <= itemIndent:
+			return nil, fmt.Errorf("line %d: expected a server, starting with \"- \"", n+1)
+		}
+
+		i := strings.Index(text, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected key: value", n+1)
+		}
+		key, value := strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:])
+		var values []string
+		switch {
+		case value == "":
+			listKey = key // the values follow
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			listKey = ""
+			for _, v := range strings.Split(value[1:len(value)-1], ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					values = append(values, unquoteYAML(v))
+				}
+			}
+		default:
+			listKey = ""
+			values = []string{unquoteYAML(value)}
+		}
+		if err := setPeerSpec(&specs[len(specs)-1], key, values); err != nil {
+			return nil, fmt.Errorf("line %d: %s", n+1, err)
+		}
+	}
+	return specs, nil
+}
+
+// setPeerSpec sets the field of the spec with the key to the values, or, for
+// addresses, appends them.
+func setPeerSpec(spec *PeerSpec, key string, values []string) error {
+	switch key {
+	case "id":
+		if len(values) != 1 {
+			return fmt.Errorf("id must be a number")
+		}
+		id, err := strconv.ParseUint(values[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad id %q", values[0])
+		}
+		spec.Id = id
+	case "address":
+		if len(values) != 1 {
+			return fmt.Errorf("address must be a string")
+		}
+		spec.Address = values[0]
+	case "addresses":
+		spec.Addresses = append(spec.Addresses, values...)
+	default:
+		return fmt.Errorf("unknown key %q", key)
+	}
+	return nil
+}
+
+// stripYAMLComment removes a comment, which starts with a "#" at the start of
+// the line, or after a space.
+func stripYAMLComment(line string) string {
+	if strings.HasPrefix(line, "#") {
+		return ""
+	}
+	if i := strings.Index(line, " #"); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// unquoteYAML removes the quotes around a scalar, if it has them.
+func unquoteYAML(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// LoadPeersFromFile reads a peers file, as ReadPeersFile does, and makes a
+// peer of each server it lists with the dialer, which is passed the server's
+// first address. Peers that implement MultiAddresser are given the rest. The
+// file usually lists this server too, for which the dialer should return a
+// LocalPeer, so every server can share the file.
+func LoadPeersFromFile(path string, dial Dialer) (Peers, error) {
+	specs, err := ReadPeersFile(path)
+	if err != nil {
+		return nil, err
+	}
+	peers := Peers{}
+	for _, spec := range specs {
+		peer, err := dial(spec.Id, spec.Address)
+		if err != nil {
+			return nil, err
+		}
+		if len(spec.Addresses) > 0 {
+			if a, ok := peer.(MultiAddresser); ok {
+				if err := a.SetAddresses(spec.addresses()); err != nil {
+					return nil, err
+				}
+			}
+		}
+		peers[spec.Id] = peer
+	}
+	return peers, nil
+}
+
+// ReloadPeersFile reads a peers file, and changes the addresses of the peers
+// (or learners) it lists to the ones it gives, as UpdatePeerAddresses would,
+// without a membership change. Servers it lists that aren't peers are
+// ignored, as are peers it doesn't list: members join and leave through
+// membership changes. It returns the ids of the peers it changed.
+func (s *Server) ReloadPeersFile(path string) ([]uint64, error) {
+	specs, err := ReadPeersFile(path)
+	if err != nil {
+		return nil, err
+	}
+	peers, learners := s.members()
+	changed := []uint64{}
+	for _, spec := range specs {
+		members := peers
+		if _, ok := members[spec.Id]; !ok {
+			members = learners
+		}
+		peer, ok := members[spec.Id]
+		if !ok {
+			continue
+		}
+		if reflect.DeepEqual(addressesOf(peer), spec.addresses()) {
+			continue
+		}
+		// as UpdatePeerAddresses, but with the peer we compared, which a
+		// membership change may have removed since
+		switch err := members.SetAddresses(spec.Id, spec.addresses()); err {
+		case nil:
+			changed = append(changed, spec.Id)
+		case ErrAddressNotSupported:
+			// e.g. our own LocalPeer
+		default:
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+// addressesOf returns the peer's addresses, if it has any.
+func addressesOf(peer Peer) []string {
+	switch a := peer.(type) {
+	case MultiAddresser:
+		return a.Addresses()
+	case Addresser:
+		return []string{a.Address()}
+	}
+	return nil
+}
+
+// WatchPeersFile reloads the peers file with ReloadPeersFile whenever its
+// contents change, checking it every interval, until the server stops. The
+// file is polled, rather than watched with inotify and the like, which would
+// take a dependency, and misses files that are replaced by renaming another
+// over them, as e.g. Kubernetes does with ConfigMap volumes. Failed reloads
+// are logged, and tried again when the file next changes.
+func (s *Server) WatchPeersFile(path string, interval time.Duration) {
+	last, _ := ioutil.ReadFile(path)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.stopped:
+				return
+			}
+			buf, err := ioutil.ReadFile(path)
+			if err != nil || bytes.Equal(buf, last) {
+				continue // e.g. it's being replaced
+			}
+			last = buf
+			changed, err := s.ReloadPeersFile(path)
+			if err != nil {
+				s.config().logf("id=%d: reloading peers from %s: %s", s.id, path, err)
+				continue
+			}
+			if len(changed) > 0 {
+				s.config().logf("id=%d: reloaded peers from %s: changed the addresses of %v", s.id, path, changed)
+			}
+		}
+	}()
+}
@@ -0,0 +1,257 @@
+package raft_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/peterbourgon/raft"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadPeersFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft-peersfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := map[uint64][]string{
+		1: {"http://10.0.0.1:8001"},
+		2: {"http://10.0.0.2:8001", "http://10.1.0.2:8001"},
+		3: {"http://10.0.0.3:8001", "http://10.1.0.3:8001", "http://10.2.0.3:8001"},
+	}
+	for name, file := range map[string]string{
+		"peers.json": `[
+			{"id": 2, "address": "http://10.0.0.2:8001", "addresses": ["http://10.1.0.2:8001"]},
+			{"id": 1, "address": "http://10.0.0.1:8001"},
+			{"id": 3, "address": "http://10.0.0.3:8001", "addresses": ["http://10.1.0.3:8001", "http://10.2.0.3:8001"]}
+		]`,
+		"peers.yaml": `---
+# the cluster
+- id: 1
+  address: http://10.0.0.1:8001
+- id: 2 # the second
+  address: "http://10.0.0.2:8001"
+  addresses: [http://10.1.0.2:8001]
+-
+  id: 3
+  address: http://10.0.0.3:8001
+  addresses:
+    - http://10.1.0.3:8001
+    - 'http://10.2.0.3:8001'
+`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		peers, err := raft.LoadPeersFromFile(path, func(id uint64, addr string) (raft.Peer, error) {
+			return &filePeer{id: id, addrs: []string{addr}}, nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		got := map[uint64][]string{}
+		for id, peer := range peers {
+			got[id] = peer.(*filePeer).Addresses()
+		}
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("%s: expected %v, got %v", name, expected, got)
+		}
+	}
+
+	for name, file := range map[string]string{
+		"unknown.json":   `[{"id": 1, "address": "a", "port": 1}]`,
+		"noid.json":      `[{"address": "a"}]`,
+		"noaddress.yml":  "- id: 1\n",
+		"twice.yml":      "- id: 1\n  address: a\n- id: 1\n  address: b\n",
+		"unknown.yml":    "- id: 1\n  address: a\n  port: 1\n",
+		"badid.yml":      "- id: one\n  address: a\n",
+		"mapping.yml":    "id: 1\naddress: a\n",
+		"nocolon.yml":    "- id: 1\n  address\n",
+		"notalist.json":  `{"id": 1, "address": "a"}`,
+		"multiple.yml":   "- id: [1, 2]\n  address: a\n",
+		"multiaddr.yaml": "- id: 1\n  address: [a, b]\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := raft.ReadPeersFile(path); err == nil || !strings.HasPrefix(err.Error(), path+": ") {
+			t.Errorf("%s: expected an error naming the file, got %v", name, err)
+		}
+	}
+}
+
+func TestWatchPeersFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft-peersfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers.yaml")
+	write := func(file string) {
+		// replaced by a rename, as config management does
+		if err := ioutil.WriteFile(path+".new", []byte(file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(path+".new", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("- id: 1\n  address: self\n- id: 2\n  address: a\n- id: 3\n  address: b\n")
+
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	peers, err := raft.LoadPeersFromFile(path, func(id uint64, addr string) (raft.Peer, error) {
+		if id == 1 {
+			return raft.NewLocalPeer(server), nil
+		}
+		return &filePeer{id: id, addrs: []string{addr}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetPeers(peers)
+
+	// unchanged addresses, and servers that aren't peers, are left alone
+	write("- id: 1\n  address: self\n- id: 2\n  address: c\n- id: 3\n  address: b\n- id: 4\n  address: d\n")
+	changed, err := server.ReloadPeersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []uint64{2}; !reflect.DeepEqual(expected, changed) {
+		t.Errorf("expected %v changed, got %v", expected, changed)
+	}
+	if expected, got := []string{"c"}, peers[2].(*filePeer).Addresses(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	server.Start()
+	defer server.Stop()
+	server.WatchPeersFile(path, 5*time.Millisecond)
+	write("- id: 2\n  address: c\n- id: 3\n  address: e\n  addresses: [f]\n")
+	expected := []string{"e", "f"}
+	cutoff := time.Now().Add(time.Second)
+	for {
+		got := peers[3].(*filePeer).Addresses()
+		if reflect.DeepEqual(expected, got) {
+			break
+		}
+		if time.Now().After(cutoff) {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// filePeer is a peer with several addresses, which may change while the
+// server runs.
+type filePeer struct {
+	nonresponsivePeer
+	id    uint64
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (p *filePeer) Id() uint64 { return p.id }
+
+func (p *filePeer) Address() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.addrs[0]
+}
+
+func (p *filePeer) SetAddress(a string) error { return p.SetAddresses([]string{a}) }
+
+func (p *filePeer) Addresses() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.addrs...)
+}
+
+func (p *filePeer) SetAddresses(addrs []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.addrs = append([]string{}, addrs...)
+	return nil
+}
+
+func TestReloadPeersFileDuringMembershipChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft-peersfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers.yaml")
+
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+	server.SetDialer(func(id uint64, addr string) (raft.Peer, error) {
+		return &filePeer{id: id, addrs: []string{addr}}, nil
+	})
+	server.Start()
+	defer server.Stop()
+	for i := 0; server.Status().Leader != 1; i++ {
+		if i > 100 {
+			t.Fatal("no leader")
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+
+	// the learner comes and goes, while its address is reloaded, under -race
+	stop, done := make(chan struct{}), make(chan struct{})
+	defer func() { close(stop); <-done }()
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			file := fmt.Sprintf("- id: 1\n  address: self\n- id: 2\n  address: a%d\n", i)
+			if err := ioutil.WriteFile(path, []byte(file), 0600); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := server.ReloadPeersFile(path); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	learners := func(n int) {
+		for j := 0; len(server.Status().Learners) != n; j++ {
+			if j > 100 {
+				t.Fatalf("expected %d learner(s), got %v", n, server.Status().Learners)
+			}
+			time.Sleep(config.HeartbeatInterval)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		for j := 0; ; j++ {
+			err := server.AddLearner(2, "a")
+			if err == nil {
+				break
+			} else if err != raft.ErrConfigChangeInProgress || j > 100 {
+				t.Fatal(err)
+			}
+			time.Sleep(config.HeartbeatInterval)
+		}
+		learners(1)
+		if err := server.RemovePeer(2, true); err != nil {
+			t.Fatal(err)
+		}
+		learners(0)
+	}
+}
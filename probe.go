@@ -0,0 +1,67 @@
+package raft
+
+import (
+	"context"
+)
+
+// ProbeResponse is a server's answer to a follower asking whether it's still
+// the leader.
+type ProbeResponse struct {
+	Term   uint64 `json:"term"`
+	Leader bool   `json:"leader"`
+}
+
+// Prober is implemented by peers that can be asked whether the remote server
+// is still the leader. Followers use it, if SetLeaderProbe enables it, before
+// calling an election.
+type Prober interface {
+	Probe(context.Context) (ProbeResponse, error)
+}
+
+// SetLeaderProbe determines whether a follower whose election timeout passes
+// without hearing from the leader first asks the leader whether it's still
+// the leader, if its peer implements Prober. If it is, in the follower's term,
+// the follower waits another election timeout instead of campaigning. This
+// avoids needless elections when the silence was the follower's own fault,
+// e.g. a long GC pause. The follower probes once per silence: if the leader
+// still isn't heard from, it campaigns at the next timeout.
+func (s *Server) SetLeaderProbe(enabled bool) {
+	s.probeLeader = enabled
+}
+
+// Probe answers a follower's probe. It never waits on the server.
+//
+// This is a public method only to facilitate the construction of peers
+// on arbitrary transports.
+func (s *Server) Probe(context.Context) (ProbeResponse, error) {
+	st := s.Status()
+	return ProbeResponse{Term: st.Term, Leader: st.State == Leader}, nil
+}
+
+func (p *LocalPeer) Probe(ctx context.Context) (ProbeResponse, error) {
+	return p.server.Probe(ctx)
+}
+
+// probe asks the leader, if we know it, whether it's still the leader. It
+// returns nil if it can't be asked.
+func (s *Server) probe() chan ProbeResponse {
+	if s.leader == unknownLeader || s.leader == s.id {
+		return nil
+	}
+	p, ok := s.peers[s.leader].(Prober)
+	if !ok {
+		return nil
+	}
+	c := make(chan ProbeResponse, 1)
+	timeout := s.scaleTimeout(2 * s.config().HeartbeatInterval)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		resp, err := p.Probe(ctx)
+		if err != nil {
+			resp = ProbeResponse{}
+		}
+		c <- resp
+	}()
+	return c
+}
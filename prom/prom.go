@@ -0,0 +1,156 @@
+// Package raftprom exports a Raft server's metrics to Prometheus. Sink is a
+// raft.MetricsSink, which reports each of the server's metrics to a Prometheus
+// collector, and Install serves them alongside the rafthttp endpoints.
+//
+//	sink, err := raftprom.NewSink(prometheus.DefaultRegisterer)
+//	if err != nil {
+//		return err
+//	}
+//	server.SetMetricsSink(sink)
+//	raftprom.Install(mux, prometheus.DefaultGatherer)
+//
+// It's a module of its own, which pins the Prometheus client it's built
+// with, so that the Raft package itself has no dependencies.
+package raftprom
+
+import (
+	"github.com/peterbourgon/raft"
+	"github.com/peterbourgon/raft/http"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+// MetricsPath is where Install serves the metrics.
+const MetricsPath = "/raft/metrics"
+
+// Namespace prefixes the name of every exported metric.
+const Namespace = "raft"
+
+// latencyBuckets range from half a millisecond to about eight seconds, which
+// covers both a heartbeat on a LAN and a commit stuck behind a slow disk.
+var latencyBuckets = prometheus.ExponentialBuckets(0.0005, 2, 15)
+
+// Each of the server's metrics is exported as a collector of its own kind, with
+// its own labels. Metrics the server reports that aren't listed are dropped.
+var metrics = []struct {
+	name   string // as the server reports it
+	kind   kind
+	opts   prometheus.Opts
+	labels []string
+}{
+	{raft.MetricElectionsStarted, counter, prometheus.Opts{Name: "elections_started_total", Help: "Elections this server has stood in."}, nil},
+	{raft.MetricElectionsWon, counter, prometheus.Opts{Name: "elections_won_total", Help: "Elections this server has won."}, nil},
+	{raft.MetricElectionsLost, counter, prometheus.Opts{Name: "elections_lost_total", Help: "Elections this server has lost."}, nil},
+	{raft.MetricElectionsAbandoned, counter, prometheus.Opts{Name: "elections_abandoned_total", Help: "Elections that timed out with no winner."}, nil},
+	{raft.MetricRPCs, counter, prometheus.Opts{Name: "rpcs_total", Help: "RPCs sent to peers."}, []string{"rpc", "peer", "result"}},
+	{raft.MetricRPCLatency, histogram, prometheus.Opts{Name: "rpc_latency_seconds", Help: "Time for peers to answer RPCs."}, []string{"rpc", "peer"}},
+	{raft.MetricCommitLatency, histogram, prometheus.Opts{Name: "commit_latency_seconds", Help: "Time from a leader appending an entry to committing it."}, nil},
+	{raft.MetricLogEntries, gauge, prometheus.Opts{Name: "log_entries", Help: "Entries in the log."}, nil},
+	{raft.MetricLogCommitIndex, gauge, prometheus.Opts{Name: "log_commit_index", Help: "Index of the last committed entry."}, nil},
+	{raft.MetricFollowerLag, gauge, prometheus.Opts{Name: "follower_lag_entries", Help: "Entries a follower is known to trail the leader's log by."}, []string{"peer"}},
+	{raft.MetricAppendEntriesRejected, counter, prometheus.Opts{Name: "append_entries_rejected_total", Help: "AppendEntries rejected by followers, by reason."}, []string{"peer", "reason"}},
+	{raft.MetricCommandBytes, counter, prometheus.Opts{Name: "log_command_bytes_total", Help: "Bytes of commands committed."}, nil},
+	{raft.MetricStoreAppends, counter, prometheus.Opts{Name: "store_appends_total", Help: "Entries written to the log store."}, nil},
+	{raft.MetricStoreAppendBytes, counter, prometheus.Opts{Name: "store_append_bytes_total", Help: "Bytes of entries written to the log store."}, nil},
+	{raft.MetricStoreReads, counter, prometheus.Opts{Name: "store_reads_total", Help: "Entries recovered from the log store."}, nil},
+	{raft.MetricStoreReadBytes, counter, prometheus.Opts{Name: "store_read_bytes_total", Help: "Bytes of entries recovered from the log store."}, nil},
+	{raft.MetricStoreTruncations, counter, prometheus.Opts{Name: "store_truncations_total", Help: "Log store compactions and resets."}, []string{"kind"}},
+	{raft.MetricStoreSyncs, counter, prometheus.Opts{Name: "store_syncs_total", Help: "Log store syncs."}, nil},
+	{raft.MetricStoreSyncLatency, histogram, prometheus.Opts{Name: "store_sync_latency_seconds", Help: "Time for the log store to sync."}, nil},
+}
+
+type kind int
+
+const (
+	counter kind = iota
+	gauge
+	histogram
+)
+
+// Sink is a raft.MetricsSink that reports to Prometheus collectors.
+type Sink struct {
+	counters   map[string]*prometheus.CounterVec
+	gauges     map[string]*prometheus.GaugeVec
+	histograms map[string]*prometheus.HistogramVec
+}
+
+// NewSink registers a collector for each of the server's metrics with reg,
+// and returns a sink that reports to them. It fails if any of them is already
+// registered, e.g. by another sink: to export the metrics of several servers
+// in one process, wrap reg so each server's metrics have their own labels.
+func NewSink(reg prometheus.Registerer) (*Sink, error) {
+	s := &Sink{
+		counters:   map[string]*prometheus.CounterVec{},
+		gauges:     map[string]*prometheus.GaugeVec{},
+		histograms: map[string]*prometheus.HistogramVec{},
+	}
+	for _, m := range metrics {
+		opts := m.opts
+		opts.Namespace = Namespace
+		var c prometheus.Collector
+		switch m.kind {
+		case counter:
+			v := prometheus.NewCounterVec(prometheus.CounterOpts(opts), m.labels)
+			s.counters[m.name], c = v, v
+		case gauge:
+			v := prometheus.NewGaugeVec(prometheus.GaugeOpts(opts), m.labels)
+			s.gauges[m.name], c = v, v
+		case histogram:
+			v := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Namespace: opts.Namespace,
+				Name:      opts.Name,
+				Help:      opts.Help,
+				Buckets:   latencyBuckets,
+			}, m.labels)
+			s.histograms[m.name], c = v, v
+		}
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Sink) IncrCounter(name string, delta float64, labels ...raft.Label) {
+	if v, ok := s.counters[name]; ok {
+		if c, err := v.GetMetricWith(promLabels(labels)); err == nil {
+			c.Add(delta)
+		}
+	}
+}
+
+func (s *Sink) SetGauge(name string, value float64, labels ...raft.Label) {
+	if v, ok := s.gauges[name]; ok {
+		if g, err := v.GetMetricWith(promLabels(labels)); err == nil {
+			g.Set(value)
+		}
+	}
+}
+
+func (s *Sink) AddSample(name string, value float64, labels ...raft.Label) {
+	if v, ok := s.histograms[name]; ok {
+		if h, err := v.GetMetricWith(promLabels(labels)); err == nil {
+			h.Observe(value)
+		}
+	}
+}
+
+func promLabels(labels []raft.Label) prometheus.Labels {
+	l := make(prometheus.Labels, len(labels))
+	for _, label := range labels {
+		l[label.Name] = label.Value
+	}
+	return l
+}
+
+// Handler serves the metrics gathered by g in the Prometheus exposition
+// format.
+func Handler(g prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+}
+
+// Install serves the metrics gathered by g at MetricsPath.
+func Install(mux rafthttp.Muxer, g prometheus.Gatherer) {
+	mux.HandleFunc(MetricsPath, Handler(g).ServeHTTP)
+}
@@ -0,0 +1,79 @@
+package raftprom_test
+
+import (
+	"bytes"
+	"github.com/peterbourgon/raft"
+	"github.com/peterbourgon/raft/prom"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSink(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	reg := prometheus.NewRegistry()
+	sink, err := raftprom.NewSink(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raftprom.NewSink(reg); err == nil {
+		t.Errorf("expected an error registering the metrics twice")
+	}
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	server.SetMetricsSink(sink)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+	server.Start()
+	defer server.Stop()
+	select {
+	case <-server.LeaderCh():
+	case <-time.After(10 * config.MaxElectionTimeout):
+		t.Fatal("never became leader")
+	}
+
+	// the metrics the server reports of its peers
+	peer := raft.Label{Name: "peer", Value: "2"}
+	sink.IncrCounter(raft.MetricRPCs, 1, raft.Label{Name: "rpc", Value: "append_entries"}, peer, raft.Label{Name: "result", Value: "ok"})
+	sink.AddSample(raft.MetricRPCLatency, 0.001, raft.Label{Name: "rpc", Value: "append_entries"}, peer)
+	sink.SetGauge(raft.MetricFollowerLag, 7, peer)
+	sink.IncrCounter(raft.MetricAppendEntriesRejected, 1, peer, raft.Label{Name: "reason", Value: raft.RejectLogMismatch.String()})
+	sink.SetGauge(raft.MetricFollowerLag, 1, raft.Label{Name: "bogus", Value: "label"}) // dropped
+	sink.SetGauge("unknown.metric", 1)                                                  // dropped
+
+	mux := http.NewServeMux()
+	raftprom.Install(mux, reg)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + raftprom.MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	for _, line := range []string{
+		`raft_elections_started_total 1`,
+		`raft_elections_won_total 1`,
+		`raft_rpcs_total{peer="2",result="ok",rpc="append_entries"} 1`,
+		`raft_rpc_latency_seconds_count{peer="2",rpc="append_entries"} 1`,
+		`raft_follower_lag_entries{peer="2"} 7`,
+		`raft_append_entries_rejected_total{peer="2",reason="log_mismatch"} 1`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, body)
+		}
+	}
+	if strings.Contains(string(body), "bogus") || strings.Contains(string(body), "unknown") {
+		t.Errorf("expected malformed metrics to be dropped:\n%s", body)
+	}
+}
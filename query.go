@@ -0,0 +1,190 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNoQueryFunc        = errors.New("no query function")
+	ErrInvalidConsistency = errors.New("invalid consistency level")
+	ErrQueryNotSupported  = errors.New("leader doesn't support queries")
+)
+
+// Consistency selects the guarantee a query gets about how up-to-date the
+// state it reads is.
+type Consistency int
+
+const (
+	// Linearizable queries observe every command committed before the query
+	// was issued. The leader confirms it's still the leader, by reaching a
+	// quorum of voters, before it answers.
+	Linearizable Consistency = iota
+
+	// Lease queries are answered by the leader without contacting its peers,
+	// as long as it has reached a quorum recently enough that no other leader
+	// can have been elected in the meantime. They're linearizable, provided
+	// the servers' clocks don't drift too far apart.
+	Lease
+
+	// Stale queries are answered by whichever server receives them, from its
+	// own state, which may lag arbitrarily behind the leader's.
+	Stale
+)
+
+func (c Consistency) String() string {
+	switch c {
+	case Linearizable:
+		return "linearizable"
+	case Lease:
+		return "lease"
+	case Stale:
+		return "stale"
+	default:
+		return fmt.Sprintf("Consistency(%d)", int(c))
+	}
+}
+
+// ParseConsistency returns the consistency level with the given name.
+func ParseConsistency(s string) (Consistency, error) {
+	for _, c := range []Consistency{Linearizable, Lease, Stale} {
+		if s == c.String() {
+			return c, nil
+		}
+	}
+	return 0, ErrInvalidConsistency
+}
+
+// Querier is implemented by peers that can answer read-only queries. Servers
+// that aren't the leader forward non-stale queries to the leader, if it's a
+// Querier.
+type Querier interface {
+	Query(Consistency, []byte) ([]byte, error)
+}
+
+type queryTuple struct {
+	Consistency Consistency
+	Query       []byte
+	Response    chan queryResponse
+}
+
+type queryResponse struct {
+	Response []byte
+	Err      error
+}
+
+// SetQueryFunc installs the read path of the state machine. It's called with
+// the payload of each query, once the server's state satisfies the query's
+// consistency level, and its response is returned to the client. Like the
+// apply function, it's called from the server's main loop, so it must not
+// block for long, unless entries are applied asynchronously, when it's
+// called between applying them; see SetAsyncApply.
+func (s *Server) SetQueryFunc(query func([]byte) ([]byte, error)) {
+	s.query = query
+}
+
+// Query passes the query to the query function, when the server's state
+// satisfies the given consistency level, and returns the response. Servers
+// that aren't the leader answer stale queries themselves, and forward the
+// others to the leader.
+//
+// This is a public method only to facilitate the construction of peers
+// on arbitrary transports.
+func (s *Server) Query(c Consistency, query []byte) ([]byte, error) {
+	if c != Linearizable && c != Lease && c != Stale {
+		return nil, ErrInvalidConsistency
+	}
+	t := queryTuple{c, query, make(chan queryResponse, 1)}
+	select {
+	case s.queryChan <- t:
+	case <-s.stopped:
+		return nil, ErrStopped
+	}
+	r := <-t.Response
+	return r.Response, r.Err
+}
+
+func (p *LocalPeer) Query(c Consistency, query []byte) ([]byte, error) {
+	return p.server.Query(c, query)
+}
+
+// answerQuery runs the query against our state machine, once it has applied
+// every entry committed so far.
+func (s *Server) answerQuery(t queryTuple) {
+	if s.query == nil {
+		t.Response <- queryResponse{nil, ErrNoQueryFunc}
+		return
+	}
+	s.log.whenApplied(s.log.getCommitIndex(), func(err error) {
+		if err != nil {
+			t.Response <- queryResponse{nil, err}
+			return
+		}
+		resp, err := s.query(t.Query)
+		t.Response <- queryResponse{resp, err}
+	})
+}
+
+// forwardQuery is the follower (and candidate) side of a query.
+func (s *Server) forwardQuery(t queryTuple) {
+	if t.Consistency == Stale {
+		s.answerQuery(t)
+		return
+	}
+
+	switch s.leader {
+	case unknownLeader:
+		s.logGeneric("got query, but don't know leader")
+		if s.noQuorum {
+			t.Response <- queryResponse{nil, ErrNoQuorum}
+			return
+		}
+		t.Response <- queryResponse{nil, ErrUnknownLeader}
+
+	case s.id: // I am the leader
+		panic("impossible state in forwardQuery")
+
+	default:
+		leader, ok := s.peers[s.leader].(Querier)
+		if !ok {
+			t.Response <- queryResponse{nil, ErrQueryNotSupported}
+			return
+		}
+		s.logGeneric("got %s query, forwarding to leader (%d)", t.Consistency, s.leader)
+		// As with commands, don't block our select loop while forwarding.
+		go func() {
+			resp, err := leader.Query(t.Consistency, t.Query)
+			t.Response <- queryResponse{resp, err}
+		}()
+	}
+}
+
+// pendingQueries are the linearizable queries a leader has received, which it
+// can't answer until it has confirmed its leadership with a quorum of voters.
+type pendingQueries []queryTuple
+
+// confirmed answers every pending query, once a flush that began after they
+// arrived has reached a quorum.
+func (p *pendingQueries) confirmed(s *Server) {
+	for _, t := range *p {
+		s.answerQuery(t)
+	}
+	*p = (*p)[:0]
+}
+
+// fail answers every pending query with the passed error.
+func (p *pendingQueries) fail(err error) {
+	for _, t := range *p {
+		t.Response <- queryResponse{nil, err}
+	}
+	*p = (*p)[:0]
+}
+
+// leaseDuration is how long after a flush begins that a leader, having reached
+// a quorum with it, may answer lease queries on its own. Followers won't start
+// an election until at least the minimum election timeout after they hear from
+// us; one heartbeat interval is held back, to allow for clock drift.
+func (s *Server) leaseDuration() time.Duration {
+	return s.config().MinElectionTimeout - s.config().HeartbeatInterval
+}
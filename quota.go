@@ -0,0 +1,96 @@
+package raft
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("log throughput quota exceeded")
+	ErrEntryTooLarge = errors.New("command exceeds the maximum entry size")
+)
+
+// Quota bounds what the leader admits into its log, so a runaway client can't
+// make replication slow for everyone else. Zero values mean no limit.
+//
+// The rates are enforced with token buckets, which hold one second's worth of
+// tokens, so short bursts up to the rate are admitted all at once.
+type Quota struct {
+	MaxEntrySize     int     // bytes per command
+	EntriesPerSecond float64 // commands admitted per second
+	BytesPerSecond   float64 // bytes of commands admitted per second
+}
+
+// SetQuota sets the quota the leader enforces on commands. Commands over the
+// entry size are rejected with ErrEntryTooLarge, and commands over either
+// rate with ErrQuotaExceeded; clients may retry them later. Entries the
+// leader appends itself, e.g. configuration changes, aren't subject to it.
+func (s *Server) SetQuota(q Quota) {
+	s.quota = newQuota(q)
+}
+
+// quota is the state of a Quota's token buckets.
+type quota struct {
+	Quota
+	entries, bytes bucket
+}
+
+func newQuota(q Quota) *quota {
+	now := time.Now()
+	return &quota{
+		Quota:   q,
+		entries: bucket{rate: q.EntriesPerSecond, tokens: q.EntriesPerSecond, last: now},
+		bytes:   bucket{rate: q.BytesPerSecond, tokens: q.BytesPerSecond, last: now},
+	}
+}
+
+// admit returns nil if the command may be appended, taking its share of the
+// quota, or the reason it may not be. A rejected command takes nothing.
+func (q *quota) admit(cmd []byte, now time.Time) error {
+	if q == nil {
+		return nil
+	}
+	if q.MaxEntrySize > 0 && len(cmd) > q.MaxEntrySize {
+		return ErrEntryTooLarge
+	}
+	q.entries.refill(now)
+	q.bytes.refill(now)
+	if !q.entries.has(1) || !q.bytes.has(float64(len(cmd))) {
+		return ErrQuotaExceeded
+	}
+	q.entries.take(1)
+	q.bytes.take(float64(len(cmd)))
+	return nil
+}
+
+// bucket is a token bucket, holding at most one second's worth of tokens. A
+// bucket with a zero rate is unlimited.
+type bucket struct {
+	rate   float64 // tokens per second
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(now time.Time) {
+	if b.rate <= 0 {
+		return
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// has returns true if the bucket holds n tokens, or is full, so that a single
+// command larger than a second's worth of tokens is admitted eventually. It
+// leaves the bucket in debt.
+func (b *bucket) has(n float64) bool {
+	return b.rate <= 0 || b.tokens >= n || b.tokens >= b.rate
+}
+
+func (b *bucket) take(n float64) {
+	if b.rate > 0 {
+		b.tokens -= n
+	}
+}
@@ -0,0 +1,90 @@
+package raft
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// SetSnapshotRate caps the rate at which a leader sends snapshots, in bytes
+// per second, across all the followers it's catching up at once, so that
+// sending a large snapshot doesn't starve heartbeats and replication sharing
+// the same network. It applies whatever the transport, and must be called
+// before Start. A rate of zero, the default, means no cap.
+func (s *Server) SetSnapshotRate(bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		s.snapshotRate = nil
+		return
+	}
+	s.snapshotRate = &rateLimiter{rate: bytesPerSecond}
+}
+
+// rateLimiter is shared by the readers it throttles. It hands out time at
+// its rate: each read reserves the time its bytes take to send, after those
+// reserved before it, and waits for it.
+type rateLimiter struct {
+	sync.Mutex
+	rate int64     // bytes per second
+	next time.Time // when the bytes reserved so far have been sent
+}
+
+// reserve reserves the time to send n bytes, and returns when it begins.
+func (l *rateLimiter) reserve(n int, now time.Time) time.Time {
+	l.Lock()
+	defer l.Unlock()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	begin := l.next
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	return begin
+}
+
+// rateReadChunk is the most a throttled reader reads at once, so that small
+// chunks from several readers interleave, rather than one hogging the rate.
+const rateReadChunk = 32 << 10
+
+// rateReader throttles reads from r by the limiter, until the context is
+// done.
+type rateReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+// throttle returns a reader of the data that's throttled by the limiter, if
+// any. If the data can seek, so can the reader, without being throttled, so
+// transports can skip data they've already sent.
+func (l *rateLimiter) throttle(ctx context.Context, data io.Reader) io.Reader {
+	if l == nil {
+		return data
+	}
+	rr := &rateReader{ctx: ctx, r: data, limiter: l}
+	if s, ok := data.(io.Seeker); ok {
+		return rateSeeker{rr, s}
+	}
+	return rr
+}
+
+func (rr *rateReader) Read(p []byte) (int, error) {
+	if len(p) > rateReadChunk {
+		p = p[:rateReadChunk]
+	}
+	n, err := rr.r.Read(p)
+	if n > 0 {
+		if wait := time.Until(rr.limiter.reserve(n, time.Now())); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-rr.ctx.Done():
+				return n, rr.ctx.Err()
+			}
+		}
+	}
+	return n, err
+}
+
+type rateSeeker struct {
+	*rateReader
+	io.Seeker
+}
@@ -0,0 +1,81 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+var ErrBadRecoveryFile = errors.New("recovery file must list this server, and no duplicates")
+
+// ApplyRecoveryFile recovers a cluster that has permanently lost a majority
+// of its voters, and so can never elect a leader. The operator writes the same
+// recovery file to each surviving server, listing the survivors as JSON:
+//
+//	[
+//		{"id": 1, "address": "http://10.0.0.1:8080"},
+//		{"id": 2, "address": "http://10.0.0.2:8080"}
+//	]
+//
+// and restarts them. If the file exists, the server takes the listed servers
+// as its peers, and has no learners, replacing the membership in its log and
+// any set with SetPeers. Peers the server already has are reused; the others
+// are dialed with the address, through the function passed to SetDialer. The
+// file is renamed, with the suffix ".applied", so it's used once. The first
+// survivor to be elected leader records the new membership in the log, as a
+// configuration entry, so it's replicated to the others, and outlives a
+// restart. (A survivor restarted before then reverts to the membership in its
+// log, and needs the file again.) It returns true if a file was applied.
+//
+// It must be called before Start. Recovery can lose committed entries, if
+// none of the survivors has them: it trades safety for availability, which is
+// why it's never automatic.
+func (s *Server) ApplyRecoveryFile(path string) (bool, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var members []member
+	if err := json.Unmarshal(buf, &members); err != nil {
+		return false, err
+	}
+	seen, self := map[uint64]bool{}, false
+	for _, m := range members {
+		if m.Id == 0 || seen[m.Id] {
+			return false, ErrBadRecoveryFile
+		}
+		seen[m.Id], self = true, self || m.Id == s.id
+	}
+	if !self {
+		return false, ErrBadRecoveryFile
+	}
+	peers, err := s.peersOf(members)
+	if err != nil {
+		return false, err
+	}
+	if err := os.Rename(path, path+".applied"); err != nil {
+		return false, err
+	}
+	s.setMembers(peers, Peers{})
+	s.recovering = true
+	s.logGeneric("recovered with %d peer(s) from %s", len(peers), path)
+	s.publishStatus()
+	return true, nil
+}
+
+// recordRecovery appends a configuration entry recording the membership from
+// a recovery file, when we first lead.
+func (s *Server) recordRecovery() {
+	if !s.recovering {
+		return
+	}
+	if err := s.appendConfigurationChange(configurationChange{}); err != nil {
+		s.logGeneric("recording the recovered membership: %s", err)
+		return
+	}
+	s.recovering = false
+}
@@ -0,0 +1,87 @@
+package raft_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/peterbourgon/raft"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestApplyRecoveryFile(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	dir, err := ioutil.TempDir("", "raft-recovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// servers 3, 4 and 5 are gone for good, so 1 and 2 can't elect a leader
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	servers := []*raft.Server{}
+	peers := raft.MakePeers(nonresponsivePeer(3), nonresponsivePeer(4), nonresponsivePeer(5))
+	for id := uint64(1); id <= 2; id++ {
+		server := raft.NewServer(id, &bytes.Buffer{}, noop, config)
+		servers = append(servers, server)
+		peers[id] = raft.NewLocalPeer(server)
+	}
+
+	// the operator lists the survivors
+	recovery := []byte(`[{"id": 1}, {"id": 2}]`)
+	for _, server := range servers {
+		path := filepath.Join(dir, fmt.Sprintf("recovery-%d.json", server.Id()))
+		if err := ioutil.WriteFile(path, recovery, 0644); err != nil {
+			t.Fatal(err)
+		}
+		server.SetPeers(peers)
+		if applied, err := server.ApplyRecoveryFile(path); !applied || err != nil {
+			t.Fatalf("expected the file applied, got %v (%v)", applied, err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s renamed, got %v", path, err)
+		}
+		server.Start()
+		defer server.Stop()
+	}
+
+	response := make(chan []byte, 1)
+	for {
+		err := servers[0].Command([]byte(`{}`), response)
+		if err == nil {
+			break
+		}
+		if err != raft.ErrUnknownLeader {
+			t.Fatal(err)
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+	select {
+	case <-response:
+	case <-time.After(10 * config.MaxElectionTimeout):
+		t.Fatal("the survivors didn't commit a command")
+	}
+	for _, server := range servers {
+		if expected, got := "[1 2]", fmt.Sprint(server.Status().Peers); expected != got {
+			t.Errorf("server %d: expected peers %s, got %s", server.Id(), expected, got)
+		}
+	}
+
+	// without a file, nothing changes; a file that leaves us out is refused
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	if applied, err := server.ApplyRecoveryFile(filepath.Join(dir, "missing.json")); applied || err != nil {
+		t.Errorf("missing file: expected nothing applied, got %v (%v)", applied, err)
+	}
+	path := filepath.Join(dir, "others.json")
+	ioutil.WriteFile(path, []byte(`[{"id": 2}, {"id": 3}]`), 0644)
+	if _, err := server.ApplyRecoveryFile(path); err != raft.ErrBadRecoveryFile {
+		t.Errorf("expected %v, got %v", raft.ErrBadRecoveryFile, err)
+	}
+}
@@ -0,0 +1,200 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ConfigReloaded is emitted when Reload changes the server's config. The
+// event's Data is the JSON of the changes, a list of ConfigChange.
+const ConfigReloaded = "ConfigReloaded"
+
+var (
+	ErrNotReloadable = errors.New("can't be changed while the server runs")
+)
+
+// notReloadable are the config fields fixed when the server's created.
+var notReloadable = map[string]bool{
+	"RPCQueueSize":     true, // the capacity of the RPC queues
+	"CommandQueueSize": true, // and of the command queue
+}
+
+// ConfigChange is a config field that Reload changed, with its values before
+// and after, as they're formatted by the fmt package.
+type ConfigChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// Reload replaces the server's config while it runs, e.g. to tune its
+// timeouts or snapshot thresholds, and returns the fields it changed. Zero
+// fields take their defaults, as with NewServer. The new config replaces the
+// old at once, so every use of the config sees one or the other, whole; each
+// change takes effect the next time its field is used, except for the
+// heartbeat and beacon intervals of a leader, which take effect when it's
+// next elected. If anything changed, a ConfigReloaded event is emitted.
+//
+// It fails, without changing anything, if the election timeouts are out of
+// order, or a field that's fixed when the server's created, like
+// RPCQueueSize or CommandQueueSize, would change.
+func (s *Server) Reload(config Config) ([]ConfigChange, error) {
+	config, err := config.defaults()
+	if err != nil {
+		return nil, err
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	changes := diffConfig(s.config(), config)
+	for _, c := range changes {
+		if notReloadable[c.Field] {
+			return nil, fmt.Errorf("%s %w", c.Field, ErrNotReloadable)
+		}
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	s.cfg.Store(config)
+	s.log.inflight.Lock()
+	s.log.inflight.timeout = config.CommandTimeout
+	s.log.inflight.Unlock()
+
+	s.configReloaded(changes)
+	return changes, nil
+}
+
+// configReloaded logs the changes, and emits ConfigReloaded. Like
+// responseDropped, it's called from outside the main loop.
+func (s *Server) configReloaded(changes []ConfigChange) {
+	fields := make([]string, len(changes))
+	for i, c := range changes {
+		fields[i] = fmt.Sprintf("%s=%s (was %s)", c.Field, c.New, c.Old)
+	}
+	s.config().logf("id=%d: config reloaded: %s", s.id, strings.Join(fields, ", "))
+	if s.eventHandler == nil {
+		return
+	}
+	data, _ := json.Marshal(changes)
+	s.eventHandler(Event{
+		Type: ConfigReloaded,
+		Id:   s.id,
+		Term: s.Status().Term,
+		Time: time.Now(),
+		Data: data,
+	})
+}
+
+// diffConfig returns the fields that differ between the configs, in the
+// order they're declared.
+func diffConfig(old, new Config) []ConfigChange {
+	var (
+		changes []ConfigChange
+		o, n    = reflect.ValueOf(old), reflect.ValueOf(new)
+	)
+	for i := 0; i < o.NumField(); i++ {
+		if o.Field(i).Interface() == n.Field(i).Interface() {
+			continue
+		}
+		format := "%v"
+		if o.Field(i).Kind() == reflect.Ptr {
+			format = "%p"
+		}
+		changes = append(changes, ConfigChange{
+			Field: o.Type().Field(i).Name,
+			Old:   fmt.Sprintf(format, o.Field(i).Interface()),
+			New:   fmt.Sprintf(format, n.Field(i).Interface()),
+		})
+	}
+	return changes
+}
+
+// LoadConfig reads a config from a file holding a JSON object, whose keys are
+// the names of Config fields, e.g.
+//
+//	{
+//		"MinElectionTimeout": "500ms",
+//		"SnapshotThresholdEntries": 16384,
+//		"HandoffOnStop": true
+//	}
+//
+// Durations are strings, as time.ParseDuration reads them. Fields that aren't
+// in the file are zero, and take their defaults. The Logger can't be loaded
+// from a file.
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return config, fmt.Errorf("%s: %s", path, err)
+	}
+
+	v := reflect.ValueOf(&config).Elem()
+	for name, raw := range fields {
+		f, ok := v.Type().FieldByName(name)
+		if !ok || name == "Logger" {
+			return config, fmt.Errorf("%s: unknown config field %q", path, name)
+		}
+		field := v.FieldByIndex(f.Index)
+		if field.Type() == reflect.TypeOf(time.Duration(0)) {
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return config, fmt.Errorf("%s: %s: %s", path, name, err)
+			}
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return config, fmt.Errorf("%s: %s: %s", path, name, err)
+			}
+			field.SetInt(int64(d))
+			continue
+		}
+		if err := json.Unmarshal(raw, field.Addr().Interface()); err != nil {
+			return config, fmt.Errorf("%s: %s: %s", path, name, err)
+		}
+	}
+	return config, nil
+}
+
+// ReloadFile reloads the server's config from a file, as LoadConfig reads it,
+// keeping the server's Logger. See Reload.
+func (s *Server) ReloadFile(path string) ([]ConfigChange, error) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	config.Logger = s.config().Logger
+	return s.Reload(config)
+}
+
+// ReloadOnHangup reloads the server's config from the file whenever the
+// process gets a SIGHUP, until the server stops. Failed reloads are logged,
+// and leave the config as it was.
+func (s *Server) ReloadOnHangup(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				if _, err := s.ReloadFile(path); err != nil {
+					s.config().logf("id=%d: reloading config from %s: %s", s.id, path, err)
+				}
+			case <-s.stopped:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,118 @@
+package raft_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/peterbourgon/raft"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+
+	dir, err := ioutil.TempDir("", "raft-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "raft.json")
+	reload := func(server *raft.Server, file string) ([]raft.ConfigChange, error) {
+		if err := ioutil.WriteFile(path, []byte(file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return server.ReloadFile(path)
+	}
+
+	var (
+		mu     sync.Mutex
+		events []raft.Event
+	)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	server.SetEventHandler(func(e raft.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if e.Type == raft.ConfigReloaded {
+			events = append(events, e)
+		}
+	})
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+	server.Start()
+	defer server.Stop()
+	select {
+	case <-server.LeaderCh():
+	case <-time.After(10 * config.MaxElectionTimeout):
+		t.Fatal("never became leader")
+	}
+
+	// only the changed fields are reported, and applied
+	const file = `{"MinElectionTimeout": "25ms", "MaxElectionTimeout": "50ms", "HeartbeatInterval": "5ms", "HandoffOnStop": true}`
+	changes, err := reload(server, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []raft.ConfigChange{
+		{Field: "HeartbeatInterval", Old: "2.5ms", New: "5ms"},
+		{Field: "HandoffOnStop", Old: "false", New: "true"},
+	}
+	if !reflect.DeepEqual(expected, changes) {
+		t.Errorf("expected changes %v, got %v", expected, changes)
+	}
+	if got := server.Config(); got.HeartbeatInterval != 5*time.Millisecond || !got.HandoffOnStop {
+		t.Errorf("expected the changes to be applied, got %+v", got)
+	}
+	mu.Lock()
+	if len(events) != 1 {
+		t.Errorf("expected 1 %s event, got %d", raft.ConfigReloaded, len(events))
+	} else {
+		var got []raft.ConfigChange
+		if err := json.Unmarshal(events[0].Data, &got); err != nil || !reflect.DeepEqual(expected, got) {
+			t.Errorf("expected the event to carry changes %v, got %v (%v)", expected, got, err)
+		}
+	}
+	mu.Unlock()
+
+	// reloading the same file changes nothing
+	if changes, err := reload(server, file); err != nil || len(changes) != 0 {
+		t.Errorf("reloading: expected no changes, got %v (%v)", changes, err)
+	}
+
+	// invalid configs are refused, whole
+	for file, expected := range map[string]error{
+		`{"MinElectionTimeout": "25ms", "MaxElectionTimeout": "50ms", "HeartbeatInterval": "1ms", "RPCQueueSize": 64}`: raft.ErrNotReloadable,
+		`{"MinElectionTimeout": "25ms", "MaxElectionTimeout": "10ms"}`:                                                 raft.ErrElectionTimeouts,
+	} {
+		if _, err := reload(server, file); !errors.Is(err, expected) {
+			t.Errorf("%s: expected %v, got %v", file, expected, err)
+		}
+	}
+	for _, file := range []string{
+		`{"ElectionTimeout": "25ms"}`,
+		`{"MinElectionTimeout": 25}`,
+		`{"Logger": null}`,
+	} {
+		if _, err := reload(server, file); err == nil {
+			t.Errorf("%s: expected an error", file)
+		}
+	}
+	if expected, got := 5*time.Millisecond, server.Config().HeartbeatInterval; expected != got {
+		t.Errorf("after failed reloads, expected HeartbeatInterval %s, got %s", expected, got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 {
+		t.Errorf("expected no more %s events, got %d", raft.ConfigReloaded, len(events)-1)
+	}
+}
@@ -1,13 +1,30 @@
 package raft
 
+import (
+	"fmt"
+	"time"
+)
+
 type appendEntriesTuple struct {
 	Request  AppendEntries
 	Response chan AppendEntriesResponse
+	Deadline time.Time // after which the sender has given up
 }
 
 type requestVoteTuple struct {
 	Request  RequestVote
 	Response chan RequestVoteResponse
+	Deadline time.Time
+}
+
+// expired reports whether the sender of an RPC queued for the main loop has
+// given up on it, so it can be dropped without handling it.
+func (s *Server) expired(rpc string, deadline time.Time) bool {
+	if time.Now().Before(deadline) {
+		return false
+	}
+	s.logGeneric("dropping expired %s", rpc)
+	return true
 }
 
 type AppendEntries struct {
@@ -17,12 +34,70 @@ type AppendEntries struct {
 	PrevLogTerm  uint64     `json:"prev_log_term"`
 	Entries      []LogEntry `json:"entries"`
 	CommitIndex  uint64     `json:"commit_index"`
+	StepDown     bool       `json:"step_down,omitempty"`  // the leader is stopping; campaign now
+	Version      int        `json:"version,omitempty"`    // of the protocol; see ProtocolVersion
+	ClusterId    string     `json:"cluster_id,omitempty"` // see SetClusterId
 }
 
 type AppendEntriesResponse struct {
-	Term    uint64 `json:"term"`
-	Success bool   `json:"success"`
-	reason  string
+	Term    uint64  `json:"term"`
+	Success bool    `json:"success"`
+	Gap     *LogGap `json:"gap,omitempty"` // when rejected for a mismatched log
+
+	// Rejection says why the follower rejected the entries, if it did.
+	Rejection RejectionReason `json:"rejection,omitempty"`
+
+	// State is the follower's soft state, for the leader's Status.
+	State *SoftState `json:"state,omitempty"`
+
+	reason string
+}
+
+// RejectionReason classifies why a follower rejected an AppendEntries, so the
+// leader can count rejections by cause, and operators can tell a follower
+// that's merely behind from one whose storage is failing.
+type RejectionReason uint8
+
+const (
+	RejectUnknown     RejectionReason = iota // accepted, or the follower gave no reason
+	RejectStaleTerm                          // the leader's term is older than ours
+	RejectLogMismatch                        // our log doesn't match the leader's
+	RejectStorage                            // we failed to persist our state
+	RejectVersion                            // we don't accept the leader's protocol version
+	RejectCluster                            // the leader is in another cluster
+)
+
+func (r RejectionReason) String() string {
+	switch r {
+	case RejectUnknown:
+		return "unknown"
+	case RejectStaleTerm:
+		return "stale_term"
+	case RejectLogMismatch:
+		return "log_mismatch"
+	case RejectStorage:
+		return "storage_error"
+	case RejectVersion:
+		return "protocol_version"
+	case RejectCluster:
+		return "cluster_id"
+	default:
+		return fmt.Sprintf("RejectionReason(%d)", int(r))
+	}
+}
+
+// LogGap describes how a follower's log differs from the leader's, around the
+// leader's PrevLogIndex, so the leader can jump straight to the entry where
+// their logs agree, rather than backing up one entry per AppendEntries.
+type LogGap struct {
+	LastIndex   uint64 `json:"last_index"`
+	CommitIndex uint64 `json:"commit_index"`
+
+	// If the follower has an entry at PrevLogIndex, but with another term,
+	// ConflictTerm is that term, and ConflictIndex is the index of the
+	// follower's first entry with that term.
+	ConflictTerm  uint64 `json:"conflict_term,omitempty"`
+	ConflictIndex uint64 `json:"conflict_index,omitempty"`
 }
 
 type RequestVote struct {
@@ -30,10 +105,14 @@ type RequestVote struct {
 	CandidateId  uint64 `json:"candidate_id"`
 	LastLogIndex uint64 `json:"last_log_index"`
 	LastLogTerm  uint64 `json:"last_log_term"`
+	Transfer     bool   `json:"transfer,omitempty"`   // the leader handed off to the candidate
+	Version      int    `json:"version,omitempty"`    // of the protocol; see ProtocolVersion
+	ClusterId    string `json:"cluster_id,omitempty"` // see SetClusterId
 }
 
 type RequestVoteResponse struct {
 	Term        uint64 `json:"term"`
 	VoteGranted bool   `json:"vote_granted"`
+	Version     int    `json:"version,omitempty"` // the voter speaks
 	reason      string
 }
@@ -1,12 +1,12 @@
 package raft
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math"
-	"math/rand"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -23,62 +23,29 @@ const (
 	noVote        = 0
 )
 
-var (
-	minimumElectionTimeoutMs int32 = 250
-	maximumElectionTimeoutMs       = 2 * minimumElectionTimeoutMs
+const (
+	defaultPromotionThreshold = 8
 )
 
 var (
-	ErrNotLeader             = errors.New("not the leader")
-	ErrUnknownLeader         = errors.New("unknown leader")
-	ErrDeposed               = errors.New("deposed during replication")
-	ErrAppendEntriesRejected = errors.New("AppendEntries RPC rejected")
-	ErrReplicationFailed     = errors.New("command replication failed (but will keep retrying)")
-	ErrOutOfSync             = errors.New("out of sync")
+	ErrNotLeader              = errors.New("not the leader")
+	ErrUnknownLeader          = errors.New("unknown leader")
+	ErrDeposed                = errors.New("deposed during replication")
+	ErrAppendEntriesRejected  = errors.New("AppendEntries RPC rejected")
+	ErrReplicationFailed      = errors.New("command replication failed (but will keep retrying)")
+	ErrOutOfSync              = errors.New("out of sync")
+	ErrNoQuorum               = errors.New("quorum unreachable")
+	ErrQuorumLost             = errors.New("quorum lost while waiting")
+	ErrUnsafeChange           = errors.New("configuration change would leave too few reachable voters for a quorum")
+	ErrRemoveLeader           = errors.New("the leader can't remove itself")
+	ErrStopped                = errors.New("server stopped")
+	ErrChangeConflict         = errors.New("change id already used for a different change")
+	ErrNoResponse             = errors.New("command lost, or its result unknown")
+	ErrBarrierLost            = errors.New("barrier lost")
+	ErrConfigChangeInProgress = errors.New("the previous membership change is still in progress")
+	ErrTooBusy                = errors.New("too many commands waiting for the server")
 )
 
-// ResetElectionTimeoutMs sets the minimum and maximum election timeouts to the
-// passed values, and returns the old values.
-func ResetElectionTimeoutMs(newMin, newMax int) (int, int) {
-	oldMin := atomic.LoadInt32(&minimumElectionTimeoutMs)
-	oldMax := atomic.LoadInt32(&maximumElectionTimeoutMs)
-	atomic.StoreInt32(&minimumElectionTimeoutMs, int32(newMin))
-	atomic.StoreInt32(&maximumElectionTimeoutMs, int32(newMax))
-	return int(oldMin), int(oldMax)
-}
-
-// MinimumElectionTimeout returns a constant time.Duration, which is the
-// MinimumElectionTimeMs (in milliseconds). This function exists so you can
-// set raft.MinimumElectionTimeMs in your client, and make decisions in your
-// code path without having to explicitly convert.
-func MinimumElectionTimeout() time.Duration {
-	return time.Duration(minimumElectionTimeoutMs) * time.Millisecond
-}
-
-// MaximumElectionTimeout returns a constant time.Duration, which is the
-// MaximumElectionTimeMs (in milliseconds). This function exists so you can
-// set raft.MaximumElectionTimeMs in your client, and make decisions in your
-// code path without having to explicitly convert.
-func MaximumElectionTimeout() time.Duration {
-	return time.Duration(maximumElectionTimeoutMs) * time.Millisecond
-}
-
-// ElectionTimeout returns a variable time.Duration, between
-// minimumElectionTimeoutMs and twice that value.
-func ElectionTimeout() time.Duration {
-	n := rand.Intn(int(maximumElectionTimeoutMs - minimumElectionTimeoutMs))
-	d := int(minimumElectionTimeoutMs) + n
-	return time.Duration(d) * time.Millisecond
-}
-
-// BroadcastInterval returns the interval between heartbeats (AppendEntry RPCs)
-// broadcast from the leader. It is minimumElectionTimeoutMs / 10, as dictated
-// by the spec: BroadcastInterval << ElectionTimeout << MTBF.
-func BroadcastInterval() time.Duration {
-	d := minimumElectionTimeoutMs / 10
-	return time.Duration(d) * time.Millisecond
-}
-
 // serverState is just a string protected by a mutex.
 type serverState struct {
 	sync.RWMutex
@@ -119,48 +86,141 @@ func (s *serverRunning) Set(value bool) {
 // In a typical application, each running process that wants to be part of
 // the distributed state machine will contain a server component.
 type Server struct {
-	id      uint64 // id of this server
-	state   *serverState
-	running *serverRunning
-	leader  uint64 // who we believe is the leader
-	term    uint64 // "current term number, which increases monotonically"
-	vote    uint64 // who we voted for this term, if applicable
-	log     *Log
-	peers   Peers
+	id        uint64       // id of this server
+	cfg       atomic.Value // of Config; see Reload
+	reloadMu  sync.Mutex   // serializes Reloads
+	state     *serverState
+	running   *serverRunning
+	leader    uint64       // who we believe is the leader
+	leaderRef atomic.Value // of leaderRef, mirroring leader for other goroutines
+	status    atomic.Value // of Status, published by the loop between events
+	term      uint64       // "current term number, which increases monotonically"
+	vote      uint64       // who we voted for this term, if applicable
+	termSeen  uint64       // the newest term in a response to a flush, atomically; see adoptTerm
+	log       *Log
+	peers     Peers
+
+	learners           Peers        // non-voting members, receiving replication
+	membersMu          sync.RWMutex // held by the loop to change peers or learners; see members
+	promotionThreshold uint64       // max entries a learner may lag and be promoted
+	encodeEntry        EncodeEntry
+
+	catchupLatency time.Duration // command latency above which we throttle
+	catchupEntries int           // per-flush limit for lagging followers
+
+	clusterId    string
+	elections    *electionCounters
+	lag          lagGauge
+	gossip       gossip
+	backoff      Backoff
+	metrics      *metrics
+	noQuorum     bool // believe a quorum of peers is unreachable
+	eventHandler func(Event)
+	beacons      beacons
+	watches      replicationWatches
+	leaderCh     chan bool
+	query        func([]byte) ([]byte, error)
+	validate     func([]byte) error
+	quota        *quota
+	probeLeader  bool // ask the leader before campaigning
+	transfer     bool // the leader handed off to us; our next election says so
+	stable       StableStore
+	saved        StableState // last persisted to stable
+	dial         Dialer      // for peers learned from a bootstrap entry
+	recovering   bool        // membership is from a recovery file, and not yet in the log
+	snapshots    SnapshotStore
+	fsm          FSM
+	snapshotMu   sync.Mutex // serializes snapshots
+	snapshotRate *rateLimiter
+	witness      *witnessPeer // votes when the cluster's even
+	voterCount   int          // as last checked for fault tolerance
+	lastContact  time.Time    // with the leader, while we're following
+	changedAt    time.Time    // when the last membership change was applied
+	progress     atomic.Value // of *nextIndex, while we're leading; see ReplicationStatus
 
 	appendEntriesChan chan appendEntriesTuple
 	requestVoteChan   chan requestVoteTuple
 	commandChan       chan commandTuple
+	queryChan         chan queryTuple
+	configChan        chan configTuple
+	forceChan         chan forceTuple // only sent on in the rafttest build
+	journalChan       chan journalTuple
+
+	installSnapshotChan chan installSnapshotTuple
 
 	electionTick <-chan time.Time
 	quit         chan chan struct{}
+	stopped      chan struct{} // closed when the main loop ends
 }
 
 // NewServer returns an initialized, un-started server.
 // The ID must be unique in the Raft network, and greater than 0.
 // The store will be used by the distributed log as a persistence layer.
 // The apply function will be called whenever a (user-domain) command has been
-// safely replicated to this server, and can be considered committed.
-func NewServer(id uint64, store io.ReadWriter, apply func([]byte) ([]byte, error)) *Server {
+// safely replicated to this server, and can be considered committed. It may
+// reject the command with a CommandError; any other error stops the log.
+// The config tunes the server; zero fields take their defaults.
+//
+// If the store returns entries whose terms or indexes go backwards, it panics
+// with ErrTermRegression or ErrIndexRegression: acting on such a log could
+// undo committed entries. Servers whose store is read from disk, which may be
+// corrupt, should be made with NewServerErr instead.
+func NewServer(id uint64, store io.ReadWriter, apply func([]byte) ([]byte, error), config Config) *Server {
+	s, err := NewServerErr(id, store, apply, config)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// NewServerErr is like NewServer, but returns ErrTermRegression or
+// ErrIndexRegression, and no server, if the store's entries go backwards, so
+// the caller can report the corruption, and refuse to start.
+func NewServerErr(id uint64, store io.ReadWriter, apply func([]byte) ([]byte, error), config Config) (*Server, error) {
 	if id <= 0 {
 		panic("server id must be > 0")
 	}
 
+	config = config.withDefaults()
+	m := &metrics{}
 	s := &Server{
-		id:                id,
-		state:             &serverState{value: Follower}, // "when servers start up they begin as followers"
-		running:           &serverRunning{value: false},
-		leader:            unknownLeader, // unknown at startup
-		term:              1,             // TODO is this correct?
-		log:               NewLog(store, apply),
-		peers:             nil,
-		appendEntriesChan: make(chan appendEntriesTuple),
-		requestVoteChan:   make(chan requestVoteTuple),
-		commandChan:       make(chan commandTuple),
-		electionTick:      time.NewTimer(ElectionTimeout()).C, // one-shot
-		quit:              make(chan chan struct{}),
+		id:                  id,
+		state:               &serverState{value: Follower}, // "when servers start up they begin as followers"
+		running:             &serverRunning{value: false},
+		leader:              unknownLeader, // unknown at startup
+		term:                1,             // TODO is this correct?
+		log:                 NewLog(store, apply),
+		peers:               nil,
+		learners:            Peers{},
+		promotionThreshold:  defaultPromotionThreshold,
+		appendEntriesChan:   make(chan appendEntriesTuple, config.RPCQueueSize),
+		requestVoteChan:     make(chan requestVoteTuple, config.RPCQueueSize),
+		commandChan:         make(chan commandTuple, config.CommandQueueSize),
+		queryChan:           make(chan queryTuple),
+		configChan:          make(chan configTuple),
+		forceChan:           make(chan forceTuple),
+		journalChan:         make(chan journalTuple),
+		installSnapshotChan: make(chan installSnapshotTuple),
+		quit:                make(chan chan struct{}),
+		stopped:             make(chan struct{}),
+		elections:           &electionCounters{metrics: m},
+		metrics:             m,
+		leaderCh:            make(chan bool, 1),
 	}
-	return s
+	s.cfg.Store(config)
+	switch s.log.recovered {
+	case ErrTermRegression, ErrIndexRegression:
+		return nil, s.log.recovered
+	}
+	s.electionTick = time.NewTimer(s.electionTimeout()).C // one-shot
+	s.publishStatus()
+	s.log.configure = s.applyConfiguration
+	s.log.journal = s.journaled
+	s.log.inflight.timeout = config.CommandTimeout
+	s.log.inflight.dropped = s.responseDropped
+	s.log.applyFailed = s.applyFailed
+	s.log.metrics = m
+	return s, nil
 }
 
 func (s *Server) Id() uint64 { return s.id }
@@ -168,8 +228,178 @@ func (s *Server) Id() uint64 { return s.id }
 // SetPeers injects the set of peers that this server will attempt to
 // communicate with, in its Raft network. The set peers should include a peer
 // that represents this server, so that quorum is calculated correctly.
+//
+// If the server's log records the membership, because it was bootstrapped or
+// has changed since, Start restores that instead, though it reuses these
+// peers (and learners) for the members they represent.
 func (s *Server) SetPeers(p Peers) {
-	s.peers = p
+	s.setMembers(p, s.learners)
+	s.publishStatus()
+}
+
+// SetLearners injects the set of learners in the Raft network. Learners receive
+// log entries from the leader, but don't vote, and don't count toward quorum.
+// Once a learner has caught up with the leader, the leader promotes it to a
+// full (voting) peer via a configuration entry in the log. Every server,
+// including the learners themselves, should be given the same set.
+func (s *Server) SetLearners(p Peers) {
+	s.setMembers(s.peers, p)
+	s.publishStatus()
+}
+
+// SetPromotionThreshold sets how many entries a learner may trail the leader's
+// last index and still be promoted to a voting peer.
+func (s *Server) SetPromotionThreshold(n uint64) {
+	s.promotionThreshold = n
+}
+
+// SetCatchupThrottle deprioritizes replication to lagging followers while the
+// leader is under load. When the average time for a command to commit exceeds
+// latency, followers more than maxEntries behind the leader are sent at most
+// maxEntries entries per flush, so that catching them up doesn't starve the
+// followers (and clients) that are keeping up. Lagging followers still
+// converge, just more slowly. A latency of zero disables the throttle, which
+// is the default.
+func (s *Server) SetCatchupThrottle(latency time.Duration, maxEntries int) {
+	s.catchupLatency = latency
+	s.catchupEntries = maxEntries
+}
+
+// SetEntryHooks installs functions to transform commands on their way into,
+// and out of, the Raft core. Commands are encoded once, by the leader, before
+// they're appended to its log; they're persisted and sent to peers in encoded
+// form, and decoded by each server immediately before they're applied. This
+// makes it possible to encrypt or compress commands, or evolve their schema,
+// transparently to the protocol. Every server should use compatible hooks.
+// Either function may be nil.
+func (s *Server) SetEntryHooks(encode EncodeEntry, decode DecodeEntry) {
+	s.encodeEntry = encode
+	s.log.decodeEntry = decode
+}
+
+// LeaderCh returns a chan that receives true when this server becomes the
+// leader, and false when it stops being the leader, e.g. to start and stop
+// work that only the leader should do. The chan holds only the latest change:
+// if the application hasn't received a change before the next one, it's
+// replaced, so the last value received always reflects the current state.
+func (s *Server) LeaderCh() <-chan bool {
+	return s.leaderCh
+}
+
+// notifyLeader sends the change of leadership on the leader chan, replacing
+// any change the application hasn't received. Only the main loop sends on the
+// chan, so there's always room after a receive.
+func (s *Server) notifyLeader(leader bool) {
+	select {
+	case <-s.leaderCh:
+	default:
+	}
+	select {
+	case s.leaderCh <- leader:
+	default:
+	}
+}
+
+// SetValidateFunc installs a function the leader calls with each command
+// before appending it to its log. If it returns an error, the command is
+// rejected with that error, instead of taking a slot in the log and failing
+// when it's applied on every server. It's called from the leader's main loop,
+// so it must not block for long, and since the state machine may not yet
+// reflect the commands before it, it should only check what can be checked
+// from the command itself.
+func (s *Server) SetValidateFunc(validate func(cmd []byte) error) {
+	s.validate = validate
+}
+
+// SetResponsePolicy determines what happens to the response to a command when
+// the client isn't ready to receive it. Whatever the policy, a dropped response
+// is reported as a ResponseDropped event, and the response chan is closed.
+func (s *Server) SetResponsePolicy(p ResponsePolicy) {
+	s.log.inflight.policy = p
+}
+
+// SetSyncPolicy determines when the log syncs its store, if the store is a
+// Syncer. The interval is used only by SyncInterval. The default, SyncAlways,
+// is the only policy under which a committed command is sure to survive a
+// crash.
+func (s *Server) SetSyncPolicy(p SyncPolicy, interval time.Duration) {
+	s.log.syncPolicy, s.log.syncEvery = p, interval
+}
+
+// Sync makes every entry in the log's store durable, if the store is a
+// Syncer, e.g. before a planned shutdown under a relaxed SyncPolicy.
+func (s *Server) Sync() error {
+	return s.log.Sync()
+}
+
+// UpdatePeerAddress changes the network address of the peer (or learner) with
+// the given id, without a membership change. The peer must implement
+// Addresser. Since peers are shared, the change is seen by every part of the
+// server at once: replication, elections, and command forwarding.
+func (s *Server) UpdatePeerAddress(id uint64, addr string) error {
+	peers, learners := s.members()
+	if _, ok := learners[id]; ok {
+		return learners.SetAddress(id, addr)
+	}
+	return peers.SetAddress(id, addr)
+}
+
+// UpdatePeerAddresses is like UpdatePeerAddress, but gives the peer several
+// addresses, which it tries in turn. The peer must implement MultiAddresser.
+func (s *Server) UpdatePeerAddresses(id uint64, addrs []string) error {
+	peers, learners := s.members()
+	if _, ok := learners[id]; ok {
+		return learners.SetAddresses(id, addrs)
+	}
+	return peers.SetAddresses(id, addrs)
+}
+
+// Leader returns the id of the server this server believes is the leader, and
+// its address, if its peer implements Addresser. The id is unknownLeader (0)
+// if this server doesn't know the leader. Unlike most of the server's state,
+// it's safe to call from any goroutine, e.g. a transport deciding whether to
+// redirect a client.
+func (s *Server) Leader() (uint64, string) {
+	ref, _ := s.leaderRef.Load().(leaderRef)
+	if a, ok := ref.peer.(Addresser); ok {
+		return ref.id, a.Address()
+	}
+	return ref.id, ""
+}
+
+// leaderRef is the leader, as seen from outside the server loop.
+type leaderRef struct {
+	id   uint64
+	peer Peer // nil if unknown, or if we're the leader
+}
+
+// setLeader records who we believe is the leader.
+func (s *Server) setLeader(id uint64) {
+	if id != unknownLeader {
+		s.elections.reset()
+	}
+	s.leader = id
+	ref := leaderRef{id: id}
+	if id != s.id {
+		ref.peer = s.peers[id]
+	}
+	s.leaderRef.Store(ref)
+}
+
+// responseDropped is called by the log when the response to the command at the
+// given index is dropped. It may be called from any goroutine.
+func (s *Server) responseDropped(index, term uint64) {
+	s.config().logf("id=%d: response to command %d dropped", s.id, index)
+	if s.eventHandler == nil {
+		return
+	}
+	s.eventHandler(Event{
+		Type:  ResponseDropped,
+		Id:    s.id,
+		Term:  term,
+		Index: index,
+		Time:  time.Now(),
+	})
 }
 
 // State returns the current state: follower, candidate, or leader.
@@ -177,15 +407,39 @@ func (s *Server) State() string {
 	return s.state.Get()
 }
 
-// Start triggers the server to begin communicating with its peers.
+// Start triggers the server to begin communicating with its peers. It panics
+// if the server's persistent state is inconsistent; see Check.
 func (s *Server) Start() {
+	if err := s.Check(); err != nil {
+		panic(err)
+	}
+	s.recoverMembership()
+	s.checkFaultTolerance()
+	s.metrics.add(MetricStoreReads, float64(s.log.recoveredEntries))
+	s.metrics.add(MetricStoreReadBytes, float64(s.log.recoveredBytes))
 	go s.loop()
+	if s.log.applier != nil {
+		go s.log.runApplier()
+	}
+	if s.snapshots != nil {
+		go s.snapshotLoop()
+	}
 }
 
 // Stop terminates the server. Stopped servers should not be restarted.
+//
+// Calls into the server that haven't been answered fail with ErrStopped, as do
+// any made later. Commands the server has appended, but not yet committed,
+// have their response chans closed without a response; this server can't know
+// whether they'll commit. If the config has HandoffOnStop, a leader first
+// tries to hand leadership to one of its followers.
 func (s *Server) Stop() {
 	q := make(chan struct{})
-	s.quit <- q
+	select {
+	case s.quit <- q:
+	case <-s.stopped:
+		return // already stopped
+	}
 	<-q
 	s.logGeneric("server stopped")
 }
@@ -194,20 +448,144 @@ type commandTuple struct {
 	Command         []byte
 	CommandResponse chan []byte
 	Err             chan error
+	ApplyErr        chan error // for a rejection, if the client wants it
+	Type            EntryType  // EntryCommand, or one of the session types
+	Session         uint64     // of an EntrySessionCommand
+	Seq             uint64
+	Annotations     map[string]string // from the context; see WithAnnotations
+	Deadline        time.Time         // from the context, if it has one
 }
 
 // Command appends the passed command to the leader log. If error is nil, the
 // command will eventually get replicated throughout the Raft network. When the
 // command gets committed to the local server log, it's passed to the apply
 // function, and the response from that function is provided on the
-// passed response chan.
+// passed response chan, which is then closed. If the command is lost (e.g.
+// truncated from the log by a new leader), or rejected with a CommandError,
+// the chan is closed without a response; see Apply.
+//
+// The leader never waits on the response chan: commands are acknowledged
+// asynchronously, as the commit index passes them. What happens to a response
+// the client isn't ready to receive is determined by the ResponsePolicy; by
+// default, it's dropped after the configured CommandTimeout.
 //
 // This is a public method only to facilitate the construction of peers
 // on arbitrary transports.
 func (s *Server) Command(cmd []byte, response chan []byte) error {
-	err := make(chan error)
-	s.commandChan <- commandTuple{cmd, response, err}
-	return <-err
+	return s.CommandContext(context.Background(), cmd, response)
+}
+
+// CommandContext is like Command, but gives up when the context is done,
+// returning its error. If the context is done after the server accepted the
+// command, the command may still be committed, and its response delivered,
+// until the context's deadline, if it has one, rather than the configured
+// CommandTimeout. A command still queued when its deadline passes is dropped
+// without being appended.
+func (s *Server) CommandContext(ctx context.Context, cmd []byte, response chan []byte) error {
+	return s.submit(ctx, commandTuple{Command: cmd, CommandResponse: response})
+}
+
+// Apply is like CommandContext, but waits for the command to be applied, and
+// returns the apply function's response, or the CommandError it rejected the
+// command with. Commands forwarded to the leader can only return responses,
+// as transports don't carry rejections: when a follower forwards a command
+// that's rejected, or the command is lost, Apply returns ErrNoResponse.
+func (s *Server) Apply(ctx context.Context, cmd []byte) ([]byte, error) {
+	response, rejected := make(chan []byte, 1), make(chan error, 1)
+	if err := s.submit(ctx, commandTuple{Command: cmd, CommandResponse: response, ApplyErr: rejected}); err != nil {
+		return nil, err
+	}
+	select {
+	case resp, ok := <-response:
+		if ok {
+			return resp, nil
+		}
+		select {
+		case err := <-rejected:
+			return nil, err
+		default:
+			return nil, ErrNoResponse
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Barrier appends a barrier entry to the leader log, and waits for it to be
+// applied, by which time every entry before it has been applied to the local
+// state machine, so reads of its state see every write acknowledged before
+// the barrier. It returns ErrTimeout if that takes longer than the timeout;
+// a zero timeout waits for as long as it takes. If the barrier is lost, e.g.
+// truncated by a new leader, it returns ErrBarrierLost. It must be called on
+// the leader; other servers return ErrNotLeader.
+func (s *Server) Barrier(timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Until every server knows barrier entries, barriers are no-ops.
+	typ := EntryBarrier
+	if s.protocolVersion() < barrierVersion {
+		typ = EntryNoop
+	}
+	response := make(chan []byte, 1)
+	if err := s.submit(ctx, commandTuple{Type: typ, CommandResponse: response}); err != nil {
+		if err == context.DeadlineExceeded {
+			return ErrTimeout
+		}
+		return err
+	}
+	select {
+	case _, ok := <-response:
+		if !ok {
+			return ErrBarrierLost
+		}
+		return nil
+	case <-ctx.Done():
+		return contextError(ctx)
+	}
+}
+
+// submit queues the command for the main loop, and returns its error. If the
+// queue's full, it fails with ErrTooBusy.
+func (s *Server) submit(ctx context.Context, t commandTuple) error {
+	t.Annotations = AnnotationsFrom(ctx)
+	t.Deadline, _ = ctx.Deadline()
+	if err := checkAnnotations(t.Annotations); err != nil {
+		return err
+	}
+	err := make(chan error, 1)
+	t.Err = err
+	select {
+	case <-s.stopped:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	select {
+	case s.commandChan <- t:
+	default:
+		return ErrTooBusy
+	}
+	select {
+	case e := <-err:
+		return e
+	case <-s.stopped:
+		// The command may have been handled just before the server
+		// stopped; otherwise, it never will be.
+		select {
+		case e := <-err:
+			return e
+		default:
+			return ErrStopped
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // AppendEntries processes the given RPC and returns the response.
@@ -215,12 +593,47 @@ func (s *Server) Command(cmd []byte, response chan []byte) error {
 // This is a public method only to facilitate the construction of peers
 // on arbitrary transports.
 func (s *Server) AppendEntries(ae AppendEntries) AppendEntriesResponse {
+	resp, _ := s.AppendEntriesContext(context.Background(), ae)
+	return resp
+}
+
+// AppendEntriesContext is like AppendEntries, but gives up when the context
+// is done, returning its error. Transports should use it to stop processing
+// RPCs whose clients have gone away. It also gives up after the configured
+// RPCTimeout.
+func (s *Server) AppendEntriesContext(ctx context.Context, ae AppendEntries) (AppendEntriesResponse, error) {
+	if !acceptsVersion(ae.Version) {
+		// Term zero, so the leader doesn't take it for a newer term.
+		return AppendEntriesResponse{Rejection: RejectVersion, State: s.softState()}, nil
+	}
+	if !s.acceptsCluster(ae.ClusterId) {
+		s.logGeneric("rejecting AppendEntries from %d, of cluster %q", ae.LeaderId, ae.ClusterId)
+		return AppendEntriesResponse{Rejection: RejectCluster}, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.config().RPCTimeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
 	t := appendEntriesTuple{
 		Request:  ae,
-		Response: make(chan AppendEntriesResponse),
+		Response: make(chan AppendEntriesResponse, 1),
+		Deadline: deadline,
+	}
+	select {
+	case s.appendEntriesChan <- t:
+	case <-s.stopped:
+		return AppendEntriesResponse{}, ErrStopped
+	case <-ctx.Done():
+		return AppendEntriesResponse{}, ctx.Err()
+	}
+	select {
+	case resp := <-t.Response:
+		resp.State = s.softState()
+		return resp, nil
+	case <-s.stopped:
+		return AppendEntriesResponse{}, ErrStopped
+	case <-ctx.Done():
+		return AppendEntriesResponse{}, ctx.Err()
 	}
-	s.appendEntriesChan <- t
-	return <-t.Response
 }
 
 // RequestVote processes the given RPC and returns the response.
@@ -228,12 +641,44 @@ func (s *Server) AppendEntries(ae AppendEntries) AppendEntriesResponse {
 // This is a public method only to facilitate the construction of Peers
 // on arbitrary transports.
 func (s *Server) RequestVote(rv RequestVote) RequestVoteResponse {
+	resp, _ := s.RequestVoteContext(context.Background(), rv)
+	return resp
+}
+
+// RequestVoteContext is like RequestVote, but gives up when the context is
+// done, returning its error, or after the configured RPCTimeout.
+func (s *Server) RequestVoteContext(ctx context.Context, rv RequestVote) (RequestVoteResponse, error) {
+	if !acceptsVersion(rv.Version) {
+		return RequestVoteResponse{Version: s.protocolVersion()}, nil
+	}
+	if !s.acceptsCluster(rv.ClusterId) {
+		s.logGeneric("rejecting RequestVote from %d, of cluster %q", rv.CandidateId, rv.ClusterId)
+		return RequestVoteResponse{Version: s.protocolVersion()}, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.config().RPCTimeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
 	t := requestVoteTuple{
 		Request:  rv,
-		Response: make(chan RequestVoteResponse),
+		Response: make(chan RequestVoteResponse, 1),
+		Deadline: deadline,
+	}
+	select {
+	case s.requestVoteChan <- t:
+	case <-s.stopped:
+		return RequestVoteResponse{}, ErrStopped
+	case <-ctx.Done():
+		return RequestVoteResponse{}, ctx.Err()
+	}
+	select {
+	case resp := <-t.Response:
+		resp.Version = s.protocolVersion()
+		return resp, nil
+	case <-s.stopped:
+		return RequestVoteResponse{}, ErrStopped
+	case <-ctx.Done():
+		return RequestVoteResponse{}, ctx.Err()
 	}
-	s.requestVoteChan <- t
-	return <-t.Response
 }
 
 //                                  times out,
@@ -270,13 +715,93 @@ func (s *Server) loop() {
 	}
 }
 
+// stop ends the main loop, in answer to Stop. Clients waiting for the response
+// to a command are released, as after a truncation.
+func (s *Server) stop(q chan struct{}) {
+	s.logGeneric("got quit signal")
+	s.running.Set(false)
+	s.log.inflight.truncate(0)
+	close(s.stopped)
+	s.log.stopApplier()
+	close(q)
+}
+
+// campaign ends our time as a follower.
+func (s *Server) campaign() {
+	// 5.2 Leader election: "A follower increments its current term and
+	// transitions to candidate state."
+	term, err := nextTerm(s.term)
+	if err != nil {
+		s.logGeneric("election timeout, but can't become candidate: %s", err)
+		s.resetElectionTimeout()
+		return
+	}
+	s.logGeneric("election timeout, becoming candidate")
+	s.term = term
+	s.vote = noVote
+	s.setLeader(unknownLeader)
+	s.state.Set(Candidate)
+	s.resetElectionTimeout()
+}
+
+// leaderHealthy returns true if we're the leader, and reaching a quorum, or
+// we've heard from the leader within the minimum election timeout.
+func (s *Server) leaderHealthy() bool {
+	switch {
+	case s.leader == unknownLeader:
+		return false
+	case s.leader == s.id:
+		return !s.noQuorum
+	default:
+		return time.Since(s.lastContact) < s.scaleTimeout(s.config().MinElectionTimeout)
+	}
+}
+
+// isLearner returns true if this server is a non-voting member.
+func (s *Server) isLearner() bool {
+	_, ok := s.learners[s.id]
+	return ok
+}
+
 func (s *Server) resetElectionTimeout() {
-	s.electionTick = time.NewTimer(ElectionTimeout()).C
+	s.electionTick = time.NewTimer(s.scaleTimeout(s.backoffElection(s.electionTimeout()))).C
+}
+
+// backoffElection doubles the election timeout for each election we've failed
+// in a row, after the first, while it stays within the MaxElectionBackoff.
+// The timeout's random, so servers backing off together still spread out.
+func (s *Server) backoffElection(d time.Duration) time.Duration {
+	max := s.config().MaxElectionBackoff
+	for i := uint64(1); i < s.elections.failing() && 2*d <= max; i++ {
+		d *= 2
+	}
+	return d
+}
+
+// rttTimeoutFactor is the minimum ratio between the minimum election timeout
+// and the round-trip time to the slowest peer. It keeps the RPC timeouts, which
+// are derived from the heartbeat interval, above the round-trip time.
+const rttTimeoutFactor = 10
+
+// scaleTimeout stretches the passed timeout in proportion to the round-trip
+// times measured by the transport, if the peers are so far away that the
+// configured election timeouts would be too short for them. On a LAN, the
+// timeout is returned unchanged.
+func (s *Server) scaleTimeout(d time.Duration) time.Duration {
+	rtt := s.peers.roundTripTime()
+	if l := s.learners.roundTripTime(); l > rtt {
+		rtt = l
+	}
+	floor := rttTimeoutFactor * rtt
+	if floor <= s.config().MinElectionTimeout {
+		return d
+	}
+	return time.Duration(float64(d) * float64(floor) / float64(s.config().MinElectionTimeout))
 }
 
 func (s *Server) logGeneric(format string, args ...interface{}) {
 	prefix := fmt.Sprintf("id=%d term=%d state=%s: ", s.id, s.term, s.State())
-	log.Printf(prefix+format, args...)
+	s.config().logf(prefix+format, args...)
 }
 
 func (s *Server) logAppendEntriesResponse(req AppendEntries, resp AppendEntriesResponse, stepDown bool) {
@@ -306,6 +831,10 @@ func (s *Server) forwardCommand(t commandTuple) {
 	switch s.leader {
 	case unknownLeader:
 		s.logGeneric("got command, but don't know leader")
+		if s.noQuorum {
+			t.Err <- ErrNoQuorum
+			return
+		}
 		t.Err <- ErrUnknownLeader
 
 	case s.id: // I am the leader
@@ -316,55 +845,132 @@ func (s *Server) forwardCommand(t commandTuple) {
 		if !ok {
 			panic("invalid state in peers")
 		}
+		if t.Type != EntryCommand {
+			s.logGeneric("got session command, but the leader is %d", s.leader)
+			t.Err <- ErrNotLeader
+			return
+		}
 		s.logGeneric("got command, forwarding to leader (%d)", s.leader)
 		// We're blocking our {follower,candidate}Select function in the
 		// receive-command branch. If we continue to block while forwarding
 		// the command, the leader won't be able to get a response from us!
-		go func() { t.Err <- leader.Command(t.Command, t.CommandResponse) }()
+		go func() {
+			if a, ok := leader.(AnnotatingPeer); ok && len(t.Annotations) > 0 {
+				t.Err <- a.CommandAnnotated(t.Command, t.Annotations, t.CommandResponse)
+				return
+			}
+			t.Err <- leader.Command(t.Command, t.CommandResponse)
+		}()
 	}
 }
 
 func (s *Server) followerSelect() {
+	// If we probe the leader before campaigning, the answer arrives on probe,
+	// and we only probe once until we hear from the leader again.
+	var probe chan ProbeResponse
+	probed := false
+
 	for {
+		s.publishStatus()
 		select {
 		case q := <-s.quit:
-			s.logGeneric("got quit signal")
-			s.running.Set(false)
-			close(q)
+			s.stop(q)
 			return
 
+		case t := <-s.forceChan:
+			err := s.force(t.State, t.Term)
+			t.Err <- err
+			if err == nil {
+				return // to enter the forced state
+			}
+
 		case t := <-s.commandChan:
 			s.forwardCommand(t)
 
+		case t := <-s.queryChan:
+			s.forwardQuery(t)
+
+		case t := <-s.configChan:
+			t.Err <- ErrNotLeader
+
+		case t := <-s.journalChan:
+			t.Response <- journalResponse{0, ErrNotLeader}
+
 		case <-s.electionTick:
-			// 5.2 Leader election: "A follower increments its current term and
-			// transitions to candidate state."
-			s.logGeneric("election timeout, becoming candidate")
-			s.term++
-			s.vote = noVote
-			s.leader = unknownLeader
-			s.state.Set(Candidate)
-			s.resetElectionTimeout()
+			// Learners wait to be promoted, and servers without peers to be
+			// bootstrapped; they never stand for election.
+			if s.isLearner() || len(s.peers) == 0 {
+				s.resetElectionTimeout()
+				continue
+			}
+
+			if s.probeLeader && !probed {
+				if probe = s.probe(); probe != nil {
+					s.logGeneric("election timeout, probing leader %d", s.leader)
+					probed = true
+					s.electionTick = time.NewTimer(s.scaleTimeout(2 * s.config().HeartbeatInterval)).C
+					continue
+				}
+			}
+			s.campaign()
+			return
+
+		case r := <-probe:
+			probe = nil
+			if r.Leader && r.Term == s.term {
+				s.logGeneric("leader %d answered probe; waiting for it", s.leader)
+				s.resetElectionTimeout()
+				continue
+			}
+			s.logGeneric("leader %d didn't answer probe as leader", s.leader)
+			s.campaign()
 			return
 
 		case t := <-s.appendEntriesChan:
+			if s.expired("AppendEntries", t.Deadline) {
+				continue
+			}
+			probe, probed = nil, false // we've heard from a leader
 			if s.leader == unknownLeader {
-				s.leader = t.Request.LeaderId
+				s.setLeader(t.Request.LeaderId)
 				s.logGeneric("discovered Leader %d", s.leader)
 			}
 			resp, stepDown := s.handleAppendEntries(t.Request)
 			s.logAppendEntriesResponse(t.Request, resp, stepDown)
 			t.Response <- resp
+			if resp.Success {
+				s.setQuorum(true)
+			}
 			if stepDown {
 				// stepDown as a Follower means just to reset the leader
 				if s.leader != unknownLeader {
 					s.logGeneric("abandoning old leader=%d", s.leader)
 				}
 				s.logGeneric("following new leader=%d", t.Request.LeaderId)
-				s.leader = t.Request.LeaderId
+				s.setLeader(t.Request.LeaderId)
+			}
+			if resp.Success && t.Request.StepDown && !s.isLearner() {
+				// the leader is stopping, and we're up to date: don't wait
+				// for our election timeout to replace it
+				s.logGeneric("leader %d is stepping down", t.Request.LeaderId)
+				s.transfer = true
+				s.campaign()
+				return
+			}
+
+		case t := <-s.installSnapshotChan:
+			probe, probed = nil, false // we've heard from a leader
+			resp, stepDown := s.handleInstallSnapshot(t.Request, t.Id)
+			s.logInstallSnapshotResponse(t.Request, resp, stepDown)
+			t.Response <- resp
+			if stepDown || s.leader == unknownLeader {
+				s.setLeader(t.Request.LeaderId)
 			}
 
 		case t := <-s.requestVoteChan:
+			if s.expired("RequestVote", t.Deadline) {
+				continue
+			}
 			resp, stepDown := s.handleRequestVote(t.Request)
 			s.logRequestVoteResponse(t.Request, resp, stepDown)
 			t.Response <- resp
@@ -374,7 +980,7 @@ func (s *Server) followerSelect() {
 					s.logGeneric("abandoning old leader=%d", s.leader)
 				}
 				s.logGeneric("new leader unknown")
-				s.leader = unknownLeader
+				s.setLeader(unknownLeader)
 			}
 		}
 	}
@@ -392,22 +998,37 @@ func (s *Server) candidateSelect() {
 	// parallel to each of the other servers in the cluster. If the candidate
 	// receives no response for an RPC, it reissues the RPC repeatedly until a
 	// response arrives or the election concludes."
-	responses, canceler := s.peers.Except(s.id).requestVotes(RequestVote{
+	s.elections.started()
+	s.vote = s.id // vote for myself
+	if err := s.saveStable(); err != nil {
+		s.logGeneric("can't persist our vote; abandoning election")
+		s.vote = noVote
+		s.elections.abandoned()
+		s.state.Set(Follower)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // abandons the election's outstanding vote requests
+	voters := s.voters()
+	transfer := s.transfer
+	s.transfer = false // only for this election
+	votes := voters.requestVotes(ctx, RequestVote{
 		Term:         s.term,
 		CandidateId:  s.id,
 		LastLogIndex: s.log.lastIndex(),
 		LastLogTerm:  s.log.lastTerm(),
-	})
-	defer canceler.Cancel()
-	s.vote = s.id      // vote for myself
-	votesReceived := 1 // already have a vote from myself
-	votesRequired := s.peers.Quorum()
-	s.logGeneric("term=%d election started, %d vote(s) required", s.term, votesRequired)
+		Transfer:     transfer,
+		Version:      s.protocolVersion(),
+		ClusterId:    s.clusterId,
+	}, s.scaleTimeout(2*s.config().HeartbeatInterval), s.metrics)
+	tally := newElectionTally(1+len(voters), s.peers.Quorum())
+	s.logGeneric("term=%d election started, %d vote(s) required", s.term, tally.required)
 
 	// catch a bad state
-	if votesReceived >= votesRequired {
+	if tally.won() {
 		s.logGeneric("%d-node cluster; I win", s.peers.Count())
-		s.leader = s.id
+		s.elections.won()
+		s.setLeader(s.id)
 		s.state.Set(Leader)
 		s.vote = noVote
 		return
@@ -417,44 +1038,93 @@ func (s *Server) candidateSelect() {
 	// (a) it wins the election, (b) another server establishes itself as
 	// leader, or (c) a period of time goes by with no winner."
 	for {
+		s.publishStatus()
 		select {
 		case q := <-s.quit:
-			s.logGeneric("got quit signal")
-			s.running.Set(false)
-			close(q)
+			s.stop(q)
 			return
 
+		case t := <-s.forceChan:
+			err := s.force(t.State, t.Term)
+			t.Err <- err
+			if err == nil {
+				return // to enter the forced state
+			}
+
 		case t := <-s.commandChan:
 			s.forwardCommand(t)
 
-		case r := <-responses:
-			s.logGeneric("got vote: term=%d granted=%v", r.Term, r.VoteGranted)
-			// "A candidate wins the election if it receives votes from a
-			// majority of servers in the full cluster for the same term."
-			if r.Term > s.term {
-				s.logGeneric("got future term (%d>%d); abandoning election", r.Term, s.term)
-				s.leader = unknownLeader
-				s.state.Set(Follower)
-				s.vote = noVote
-				return // lose
+		case t := <-s.queryChan:
+			s.forwardQuery(t)
+
+		case t := <-s.configChan:
+			t.Err <- ErrNotLeader
+
+		case t := <-s.journalChan:
+			t.Response <- journalResponse{0, ErrNotLeader}
+
+		case r := <-votes:
+			// Count every vote that's already arrived before deciding.
+			batch := []RequestVoteResponse{r}
+		drain:
+			for {
+				select {
+				case r := <-votes:
+					batch = append(batch, r)
+				default:
+					break drain
+				}
 			}
-			if r.Term < s.term {
-				s.logGeneric("got vote from past term (%d<%d); ignoring", r.Term, s.term)
-				break
+
+			for _, r := range batch {
+				s.logGeneric("got vote: term=%d granted=%v", r.Term, r.VoteGranted)
+				// "A candidate wins the election if it receives votes from a
+				// majority of servers in the full cluster for the same term."
+				if r.Term > s.term {
+					s.logGeneric("got future term (%d>%d); abandoning election", r.Term, s.term)
+					s.elections.lost()
+					s.setLeader(unknownLeader)
+					s.state.Set(Follower)
+					s.adoptTerm(r.Term)
+					return // lose
+				}
+				if r.Term < s.term {
+					s.logGeneric("got vote from past term (%d<%d); ignoring", r.Term, s.term)
+					continue
+				}
+				tally.add(r.VoteGranted)
 			}
-			if r.VoteGranted {
-				votesReceived++
+			if tally.responses() >= tally.required {
+				s.setQuorum(true)
 			}
+
 			// "Once a candidate wins an election, it becomes leader."
-			if votesReceived >= votesRequired {
-				s.logGeneric("%d >= %d: win", votesReceived, votesRequired)
-				s.leader = s.id
+			if tally.won() {
+				s.logGeneric("%d >= %d: win", tally.granted, tally.required)
+				s.elections.won()
+				s.setLeader(s.id)
 				s.state.Set(Leader)
 				s.vote = noVote
 				return // win
 			}
 
+			// If enough peers have denied us that we can't possibly win,
+			// there's no point waiting for the election to time out. Back
+			// off as a follower (keeping our vote for this term) and give
+			// another candidate a chance.
+			if tally.lost() {
+				s.logGeneric("%d vote(s) denied, can't reach %d: lose", tally.denied, tally.required)
+				s.elections.lost()
+				s.setLeader(unknownLeader)
+				s.state.Set(Follower)
+				s.resetElectionTimeout()
+				return // lose
+			}
+
 		case t := <-s.appendEntriesChan:
+			if s.expired("AppendEntries", t.Deadline) {
+				continue
+			}
 			// "While waiting for votes, a candidate may receive an
 			// AppendEntries RPC from another server claiming to be leader.
 			// If the leader's term (included in its RPC) is at least as
@@ -466,19 +1136,36 @@ func (s *Server) candidateSelect() {
 			t.Response <- resp
 			if stepDown {
 				s.logGeneric("after an AppendEntries, stepping down to Follower (leader=%d)", t.Request.LeaderId)
-				s.leader = t.Request.LeaderId
+				s.elections.lost()
+				s.setLeader(t.Request.LeaderId)
+				s.state.Set(Follower)
+				return // lose
+			}
+
+		case t := <-s.installSnapshotChan:
+			resp, stepDown := s.handleInstallSnapshot(t.Request, t.Id)
+			s.logInstallSnapshotResponse(t.Request, resp, stepDown)
+			t.Response <- resp
+			if stepDown {
+				s.logGeneric("after an InstallSnapshot, stepping down to Follower (leader=%d)", t.Request.LeaderId)
+				s.elections.lost()
+				s.setLeader(t.Request.LeaderId)
 				s.state.Set(Follower)
 				return // lose
 			}
 
 		case t := <-s.requestVoteChan:
+			if s.expired("RequestVote", t.Deadline) {
+				continue
+			}
 			// We can also be defeated by a more recent candidate
 			resp, stepDown := s.handleRequestVote(t.Request)
 			s.logRequestVoteResponse(t.Request, resp, stepDown)
 			t.Response <- resp
 			if stepDown {
 				s.logGeneric("after a RequestVote, stepping down to Follower (leader unknown)")
-				s.leader = unknownLeader
+				s.elections.lost()
+				s.setLeader(unknownLeader)
 				s.state.Set(Follower)
 				return // lose
 			}
@@ -491,50 +1178,297 @@ func (s *Server) candidateSelect() {
 			// election by incrementing its term and initiating another round of
 			// RequestVote RPCs."
 			s.logGeneric("election ended with no winner; incrementing term and trying again")
+			s.elections.abandoned()
+			if tally.responses() < tally.required {
+				s.setQuorum(false)
+			}
 			s.resetElectionTimeout()
-			s.term++
+			term, err := nextTerm(s.term)
+			if err != nil {
+				s.logGeneric("can't try again: %s", err)
+				s.state.Set(Follower)
+				return // draw
+			}
+			s.term = term
 			s.vote = noVote
 			return // draw
 		}
 	}
 }
 
+// electionTally counts the votes in a single election.
+type electionTally struct {
+	voters   int // in the full cluster, including the candidate
+	required int // to win
+	granted  int
+	denied   int
+}
+
+func newElectionTally(voters, required int) *electionTally {
+	return &electionTally{
+		voters:   voters,
+		required: required,
+		granted:  1, // the candidate votes for itself
+	}
+}
+
+func (t *electionTally) add(granted bool) {
+	if granted {
+		t.granted++
+	} else {
+		t.denied++
+	}
+}
+
+func (t *electionTally) responses() int { return t.granted + t.denied }
+func (t *electionTally) won() bool      { return t.granted >= t.required }
+func (t *electionTally) lost() bool     { return t.voters-t.denied < t.required }
+
+// ElectionCounts describes the outcomes of the elections a server has stood in.
+// Elections are lost when enough peers deny their vote, or another server
+// establishes itself as leader; they're abandoned when they time out with no
+// winner. Failing is how many it's lost or abandoned in a row, since it last
+// won, or heard from a leader; see Config.MaxElectionBackoff.
+type ElectionCounts struct {
+	Won       uint64 `json:"won"`
+	Lost      uint64 `json:"lost"`
+	Abandoned uint64 `json:"abandoned"`
+	Failing   uint64 `json:"failing"`
+}
+
+type electionCounters struct {
+	nWon, nLost, nAbandoned, nFailing uint64
+	metrics                           *metrics
+}
+
+func (c *electionCounters) started() {
+	c.metrics.incr(MetricElectionsStarted)
+}
+
+func (c *electionCounters) won() {
+	atomic.AddUint64(&c.nWon, 1)
+	c.metrics.incr(MetricElectionsWon)
+	c.reset()
+}
+
+func (c *electionCounters) lost() {
+	atomic.AddUint64(&c.nLost, 1)
+	atomic.AddUint64(&c.nFailing, 1)
+	c.metrics.incr(MetricElectionsLost)
+}
+
+func (c *electionCounters) abandoned() {
+	atomic.AddUint64(&c.nAbandoned, 1)
+	atomic.AddUint64(&c.nFailing, 1)
+	c.metrics.incr(MetricElectionsAbandoned)
+}
+
+// reset ends a run of failed elections. It's safe to call on a nil
+// *electionCounters, which never has a run to end.
+func (c *electionCounters) reset() {
+	if c == nil {
+		return
+	}
+	atomic.StoreUint64(&c.nFailing, 0)
+}
+
+func (c *electionCounters) failing() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.nFailing)
+}
+
+func (c *electionCounters) get() ElectionCounts {
+	return ElectionCounts{
+		Won:       atomic.LoadUint64(&c.nWon),
+		Lost:      atomic.LoadUint64(&c.nLost),
+		Abandoned: atomic.LoadUint64(&c.nAbandoned),
+		Failing:   atomic.LoadUint64(&c.nFailing),
+	}
+}
+
+// ElectionCounts returns the number of elections this server has won, lost,
+// and abandoned as a candidate. It's safe to call at any time.
+func (s *Server) ElectionCounts() ElectionCounts {
+	return s.elections.get()
+}
+
+// Lag describes how many entries a server's log trailed the leader's, when it
+// was last contacted by a leader, and the most it's ever trailed by.
+type Lag struct {
+	Last uint64 `json:"last"`
+	Max  uint64 `json:"max"`
+}
+
+type lagGauge struct {
+	last, max uint64
+}
+
+func (g *lagGauge) observe(leaderIndex, ourIndex uint64) {
+	lag := uint64(0)
+	if leaderIndex > ourIndex {
+		lag = leaderIndex - ourIndex
+	}
+	atomic.StoreUint64(&g.last, lag)
+	for {
+		max := atomic.LoadUint64(&g.max)
+		if lag <= max || atomic.CompareAndSwapUint64(&g.max, max, lag) {
+			return
+		}
+	}
+}
+
+func (g *lagGauge) get() Lag {
+	return Lag{
+		Last: atomic.LoadUint64(&g.last),
+		Max:  atomic.LoadUint64(&g.max),
+	}
+}
+
+// Lag returns how far this server's log trailed the leader's, as of the last
+// AppendEntries it received. It's safe to call at any time.
+func (s *Server) Lag() Lag {
+	return s.lag.get()
+}
+
 //
 //
 //
 
 type nextIndex struct {
 	sync.RWMutex
-	m map[uint64]uint64 // followerId: nextIndex
+	m       map[uint64]uint64    // followerId: nextIndex
+	match   map[uint64]uint64    // followerId: highest index known to be replicated
+	contact map[uint64]time.Time // followerId: last successful response from the follower
+	applied map[uint64]uint64    // followerId: highest index the follower's known to have applied
+	sending map[uint64]bool      // followerId: we're sending it a snapshot
 }
 
 func newNextIndex(peers Peers, defaultNextIndex uint64) *nextIndex {
 	ni := &nextIndex{
-		m: map[uint64]uint64{},
+		m:       map[uint64]uint64{},
+		match:   map[uint64]uint64{},
+		contact: map[uint64]time.Time{},
+		applied: map[uint64]uint64{},
+		sending: map[uint64]bool{},
 	}
 	for id, _ := range peers {
 		ni.m[id] = defaultNextIndex
+		ni.match[id] = 0
 	}
 	return ni
 }
 
-func (ni *nextIndex) bestIndex() uint64 {
+// track starts tracking the peers that joined since we became leader, with
+// the given nextIndex.
+func (ni *nextIndex) track(peers Peers, defaultNextIndex uint64) {
+	ni.Lock()
+	defer ni.Unlock()
+	for id := range peers {
+		if _, ok := ni.m[id]; !ok {
+			ni.m[id] = defaultNextIndex
+			ni.match[id] = 0
+		}
+	}
+}
+
+// matchIndex returns the highest index known to be replicated to the peer.
+func (ni *nextIndex) matchIndex(id uint64) uint64 {
+	ni.RLock()
+	defer ni.RUnlock()
+	i, ok := ni.match[id]
+	if !ok {
+		panic(fmt.Sprintf("peer %d not found", id))
+	}
+	return i
+}
+
+// matched records that the peer's log is known to contain everything up to
+// and including index. matchIndex never decreases.
+func (ni *nextIndex) matched(id, index uint64) {
+	ni.Lock()
+	defer ni.Unlock()
+	i, ok := ni.match[id]
+	if !ok {
+		panic(fmt.Sprintf("peer %d not found", id))
+	}
+	if index > i {
+		ni.match[id] = index
+	}
+}
+
+// quorumMatchIndex returns the highest index that's replicated on a quorum of
+// the passed voters, plus the leader itself, whose log is replicated up to
+// leaderIndex.
+func (ni *nextIndex) quorumMatchIndex(voters Peers, quorum int, leaderIndex uint64) uint64 {
 	ni.RLock()
 	defer ni.RUnlock()
 
-	if len(ni.m) <= 0 {
+	indexes := []uint64{leaderIndex}
+	for id := range voters {
+		i, ok := ni.match[id]
+		if !ok {
+			panic(fmt.Sprintf("peer %d not found", id))
+		}
+		indexes = append(indexes, i)
+	}
+	if quorum > len(indexes) {
 		return 0
 	}
 
-	var i uint64 = math.MaxUint64
-	for _, nextIndex := range ni.m {
-		if nextIndex < i {
-			i = nextIndex
+	// Descending order; the quorum-th highest index is on a quorum.
+	sort.Sort(sort.Reverse(uint64Slice(indexes)))
+	return indexes[quorum-1]
+}
+
+// contacted records that the peer accepted our entries, or snapshot, just now,
+// and so has applied everything up to and including applied.
+func (ni *nextIndex) contacted(id, applied uint64) {
+	ni.Lock()
+	defer ni.Unlock()
+	ni.contact[id] = time.Now()
+	if applied > ni.applied[id] {
+		ni.applied[id] = applied
+	}
+}
+
+// appliedIndex returns the highest index the peer's known to have applied.
+func (ni *nextIndex) appliedIndex(id uint64) uint64 {
+	ni.RLock()
+	defer ni.RUnlock()
+	return ni.applied[id]
+}
+
+// sendingSnapshot records whether we're sending the peer a snapshot.
+func (ni *nextIndex) sendingSnapshot(id uint64, sending bool) {
+	ni.Lock()
+	defer ni.Unlock()
+	ni.sending[id] = sending
+}
+
+// progress returns the replication progress of every peer.
+func (ni *nextIndex) progress() map[uint64]PeerProgress {
+	ni.RLock()
+	defer ni.RUnlock()
+	m := make(map[uint64]PeerProgress, len(ni.m))
+	for id, prevLogIndex := range ni.m {
+		m[id] = PeerProgress{
+			NextIndex:    prevLogIndex + 1,
+			MatchIndex:   ni.match[id],
+			LastContact:  ni.contact[id],
+			Snapshotting: ni.sending[id],
 		}
 	}
-	return i
+	return m
 }
 
+type uint64Slice []uint64
+
+func (a uint64Slice) Len() int           { return len(a) }
+func (a uint64Slice) Less(i, j int) bool { return a[i] < a[j] }
+func (a uint64Slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
 func (ni *nextIndex) prevLogIndex(id uint64) uint64 {
 	ni.RLock()
 	defer ni.RUnlock()
@@ -587,38 +1521,103 @@ func (ni *nextIndex) set(id, index, prev uint64) (uint64, error) {
 // between our log and the follower's log. The passed nextIndex structure
 // manages that state.
 //
-// flush is synchronous and can block forever if the peer is nonresponsive.
-func (s *Server) flush(peer Peer, ni *nextIndex) error {
+// If maxEntries is greater than zero, at most that many entries are sent, and
+// never more than the configured MaxAppendEntries, or MaxAppendBytes.
+//
+// If handoff is true, and the flush brings the follower up to date, it's asked
+// to call an election at once; see Server.handoff.
+//
+// flush is synchronous, and returns the context's error if it's done before
+// the peer responds.
+func (s *Server) flush(ctx context.Context, peer Peer, ni *nextIndex, maxEntries int, handoff bool) error {
 	peerId := peer.Id()
 	currentTerm := s.term
 	prevLogIndex := ni.prevLogIndex(peerId)
-	entries, prevLogTerm := s.log.entriesAfter(prevLogIndex)
+	entries, prevLogTerm, ok := s.log.entriesAfter(prevLogIndex)
+	if !ok {
+		return s.sendSnapshot(ctx, peer, ni, prevLogIndex)
+	}
+	if limit := s.config().MaxAppendEntries; limit > 0 && (maxEntries <= 0 || maxEntries > limit) {
+		maxEntries = limit
+	}
+	if maxEntries > 0 && len(entries) > maxEntries {
+		entries = entries[:maxEntries]
+	}
+	if limit := s.config().MaxAppendBytes; limit > 0 {
+		entries = limitBytes(entries, limit)
+	}
 	commitIndex := s.log.getCommitIndex()
 	s.logGeneric("flush to %d: term=%d leaderId=%d prevLogIndex/Term=%d/%d sz=%d commitIndex=%d", peerId, currentTerm, s.id, prevLogIndex, prevLogTerm, len(entries), commitIndex)
-	resp := peer.AppendEntries(AppendEntries{
+	began := time.Now()
+	resp, err := appendEntries(ctx, peer, AppendEntries{
 		Term:         currentTerm,
 		LeaderId:     s.id,
 		PrevLogIndex: prevLogIndex,
 		PrevLogTerm:  prevLogTerm,
 		Entries:      entries,
 		CommitIndex:  commitIndex,
+		StepDown:     handoff && prevLogIndex+uint64(len(entries)) == s.log.lastIndex(),
+		Version:      s.protocolVersion(),
+		ClusterId:    s.clusterId,
 	})
+	s.metrics.rpc("append_entries", peerId, began, err)
+	if err != nil {
+		return err
+	}
+	if resp.State != nil {
+		s.gossip.observe(peerId, *resp.State)
+	}
+	if !resp.Success {
+		s.metrics.incr(MetricAppendEntriesRejected, peerLabel(peerId), Label{"reason", resp.Rejection.String()})
+	}
 
+	if resp.Rejection == RejectVersion {
+		theirs := 0
+		if resp.State != nil {
+			theirs = resp.State.Version
+		}
+		s.logGeneric("flush to %d: rejected protocol version %d; it speaks %d", peerId, s.protocolVersion(), theirs)
+		return ErrVersionMismatch
+	}
+	if resp.Rejection == RejectCluster {
+		s.logGeneric("flush to %d: rejected cluster ID %q", peerId, s.clusterId)
+		return ErrClusterMismatch
+	}
 	if resp.Term > currentTerm {
 		s.logGeneric("flush to %d: responseTerm=%d > currentTerm=%d: deposed", peerId, resp.Term, currentTerm)
+		s.observeTerm(resp.Term)
 		return ErrDeposed
 	}
+	if resp.Success {
+		// The follower's commit index is now ours, or its last new entry, if
+		// that's lower; it applies entries as they commit.
+		applied := prevLogIndex + uint64(len(entries))
+		if commitIndex < applied {
+			applied = commitIndex
+		}
+		ni.contacted(peerId, applied)
+	}
 
 	// It's possible the leader has timed out waiting for us, and moved on.
 	// So we should be careful, here, to make only valid state changes to `ni`.
 
+	if !resp.Success && resp.Gap != nil {
+		newPrevLogIndex, err := ni.set(peerId, s.skipGap(prevLogIndex, *resp.Gap), prevLogIndex)
+		if err != nil {
+			s.logGeneric("flush to %d: while skipping gap: %s", peerId, err)
+			return err
+		}
+		s.logGeneric("flush to %d: rejected (%+v); prevLogIndex(%d) becomes %d", peerId, *resp.Gap, peerId, newPrevLogIndex)
+		return ErrAppendEntriesRejected
+	}
+
 	if !resp.Success {
 		newPrevLogIndex, err := ni.decrement(peerId, prevLogIndex)
 		if err != nil {
 			s.logGeneric("flush to %d: while decrementing prevLogIndex: %s", peerId, err)
 			return err
 		}
-		s.logGeneric("flush to %d: rejected; prevLogIndex(%d) becomes %d", peerId, peerId, newPrevLogIndex)
+		s.logGeneric("flush to %d: rejected (%s); prevLogIndex(%d) becomes %d", peerId, resp.Rejection, peerId, newPrevLogIndex)
 		return ErrAppendEntriesRejected
 	}
 
@@ -628,38 +1627,125 @@ func (s *Server) flush(peer Peer, ni *nextIndex) error {
 			s.logGeneric("flush to %d: while moving prevLogIndex forward: %s", peerId, err)
 			return err
 		}
+		ni.matched(peerId, newPrevLogIndex)
 		s.logGeneric("flush to %d: accepted; prevLogIndex(%d) becomes %d", peerId, peerId, newPrevLogIndex)
 		return nil
 	}
 
+	// Even a heartbeat tells us the follower's log matches ours up to the
+	// prevLogIndex we sent.
+	ni.matched(peerId, prevLogIndex)
 	s.logGeneric("flush to %d: accepted; prevLogIndex(%d) remains %d", peerId, peerId, ni.prevLogIndex(peerId))
 	return nil
 }
 
+// limitBytes returns the longest prefix of the entries whose encoded size is
+// within the limit, but at least the first entry, so an entry larger than the
+// limit is still sent.
+func limitBytes(entries []LogEntry, limit int64) []LogEntry {
+	var size int64
+	for i := range entries {
+		if size += entries[i].encodedSize(); size > limit && i > 0 {
+			return entries[:i]
+		}
+	}
+	return entries
+}
+
+// handoff tries to hand leadership to the voting follower with the most of
+// our log, before we stop. It catches the follower up, and then asks it to
+// call an election at once, rather than leaving the cluster without a leader
+// until an election timeout. It gives up after the minimum election timeout,
+// when the followers would soon be calling elections anyway.
+func (s *Server) handoff(ni *nextIndex) {
+	var target Peer
+	for id, peer := range s.peers.Except(s.id) {
+		if target == nil || ni.matchIndex(id) > ni.matchIndex(target.Id()) {
+			target = peer
+		}
+	}
+	if target == nil {
+		return // nobody to hand off to
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.config().MinElectionTimeout)
+	defer cancel()
+	for ctx.Err() == nil {
+		lastIndex := s.log.lastIndex()
+		switch err := s.flush(ctx, target, ni, 0, true); err {
+		case nil:
+			if ni.matchIndex(target.Id()) >= lastIndex {
+				s.logGeneric("handed off leadership to %d", target.Id())
+				return
+			}
+		case ErrAppendEntriesRejected:
+			// try again, further back
+		default:
+			s.logGeneric("handoff to %d: %s", target.Id(), err)
+			return
+		}
+	}
+}
+
+// skipGap returns the prevLogIndex to send next to a follower that rejected
+// prevLogIndex, and described the gap between our logs. It's never less than
+// the follower's commit index, since committed entries are in our log, too.
+func (s *Server) skipGap(prevLogIndex uint64, g LogGap) uint64 {
+	next := prevLogIndex
+	switch {
+	case g.ConflictTerm > 0:
+		// If we have entries from the conflicting term, the follower's log
+		// may match ours up to our last one. Otherwise, none of its entries
+		// from that term can match.
+		if i := s.log.lastIndexOfTerm(g.ConflictTerm); i > 0 && i < prevLogIndex {
+			next = i
+		} else if g.ConflictIndex > 0 {
+			next = g.ConflictIndex - 1
+		}
+	case g.LastIndex < prevLogIndex:
+		next = g.LastIndex
+	case next > 0:
+		next--
+	}
+	if next < g.CommitIndex {
+		next = g.CommitIndex
+	}
+	return next
+}
+
 // concurrentFlush triggers a concurrent flush to each of the peers. All peers
 // must respond (or timeout) before concurrentFlush will return. timeout is per
-// peer.
-func (s *Server) concurrentFlush(peers Peers, ni *nextIndex, timeout time.Duration) (int, bool) {
+// peer; flushes still in flight when it passes are canceled. maxEntries
+// optionally limits the size of each peer's flush. Peers the retrier says
+// are backing off, after failing too often, are skipped. The peers that
+// accepted their flush are returned.
+func (s *Server) concurrentFlush(peers Peers, ni *nextIndex, maxEntries map[uint64]int, timeout time.Duration, retry *retrier) (Peers, bool) {
 	type tuple struct {
 		id  uint64
 		err error
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 	responses := make(chan tuple, len(peers))
+	flushed := 0
 	for _, peer := range peers {
+		if !retry.due(peer.Id(), time.Now()) {
+			s.logGeneric("concurrentFlush: peer %d: backing off", peer.Id())
+			continue
+		}
+		flushed++
 		go func(peer0 Peer) {
-			err0 := make(chan error, 1)
-			go func() { err0 <- s.flush(peer0, ni) }()
-			go func() { time.Sleep(timeout); err0 <- ErrTimeout }()
-			responses <- tuple{peer0.Id(), <-err0} // first responder wins
+			responses <- tuple{peer0.Id(), s.flush(ctx, peer0, ni, maxEntries[peer0.Id()], false)}
 		}(peer)
 	}
 
-	successes, stepDown := 0, false
-	for i := 0; i < cap(responses); i++ {
-		switch t := <-responses; t.err {
+	accepted, stepDown := Peers{}, false
+	for i := 0; i < flushed; i++ {
+		t := <-responses
+		retry.observe(t.id, t.err, time.Now())
+		switch t.err {
 		case nil:
 			s.logGeneric("concurrentFlush: peer %d: OK (prevLogIndex(%d)=%d)", t.id, t.id, ni.prevLogIndex(t.id))
-			successes++
+			accepted[t.id] = peers[t.id]
 		case ErrDeposed:
 			s.logGeneric("concurrentFlush: peer %d: deposed!", t.id)
 			stepDown = true
@@ -668,7 +1754,7 @@ func (s *Server) concurrentFlush(peers Peers, ni *nextIndex, timeout time.Durati
 			// nothing to do but log and continue
 		}
 	}
-	return successes, stepDown
+	return accepted, stepDown
 }
 
 func (s *Server) leaderSelect() {
@@ -676,8 +1762,10 @@ func (s *Server) leaderSelect() {
 		panic(fmt.Sprintf("leader (%d) not me (%d) when entering leaderSelect", s.leader, s.id))
 	}
 	if s.vote != 0 {
-		panic(fmt.Sprintf("vote (%d) not zero when entering leaderSelect", s.leader, s.id))
+		panic(fmt.Sprintf("vote (%d) not zero when entering leaderSelect", s.vote))
 	}
+	s.notifyLeader(true)
+	defer s.notifyLeader(false)
 
 	// 5.3 Log replication: "The leader maintains a nextIndex for each follower,
 	// which is the index of the next log entry the leader will send to that
@@ -689,10 +1777,39 @@ func (s *Server) leaderSelect() {
 	// doing the decrement. This was just annoying, except if you manage to
 	// sneak in a command before the first heartbeat. Then, it will never get
 	// properly replicated (it seemed).
-	ni := newNextIndex(s.peers.Except(s.id), s.log.lastIndex()) // +1)
+	followers := union(s.peers.Except(s.id), s.learners)
+	if s.witness != nil {
+		followers = union(followers, Peers{s.witness.id: s.witness}) // in case it's needed
+	}
+	ni := newNextIndex(followers, s.log.lastIndex()) // +1)
+	s.progress.Store(ni)
+	defer s.progress.Store((*nextIndex)(nil))
+	s.gossip.reset()
+
+	// Followers we keep failing to reach, which we back off from.
+	retry := s.newRetrier()
+
+	// Learners we've appended a promotion for, which hasn't yet committed.
+	promoting := map[uint64]bool{}
+
+	// The peers that accepted our last flush.
+	reachable := Peers{}
+
+	// The last time a flush reached a quorum of voters.
+	lastQuorum := time.Now()
+
+	// How long our commands take to commit.
+	latency := newCommandLatency()
+	latency.metrics = s.metrics
+
+	// Linearizable queries waiting for us to confirm our leadership, and
+	// until when we may answer lease queries without confirming it.
+	pending := pendingQueries{}
+	defer pending.fail(ErrDeposed)
+	lease := time.Time{}
 
 	flush := make(chan struct{})
-	heartbeat := time.NewTicker(BroadcastInterval())
+	heartbeat := time.NewTicker(s.config().HeartbeatInterval)
 	defer heartbeat.Stop()
 	go func() {
 		for _ = range heartbeat.C {
@@ -700,28 +1817,119 @@ func (s *Server) leaderSelect() {
 		}
 	}()
 
+	// 5.4.2 Committing entries from previous terms: a leader can't consider
+	// an entry from a previous term committed just because it's stored on a
+	// majority of servers. Only entries from the leader's current term are
+	// committed by counting replicas. So, we append a no-op entry in our
+	// term, and replicate it straight away, to commit everything before it.
+	if err := s.log.appendEntry(LogEntry{
+		Index: s.log.lastIndex() + 1,
+		Term:  s.term,
+		Type:  EntryNoop,
+	}); err != nil {
+		s.logGeneric("appending no-op: %s", err)
+	}
+	s.recordRecovery()
+	go func() { flush <- struct{}{} }()
+
+	// Beacons tell clients we're still the leader, while our lease says so.
+	var beacon <-chan time.Time
+	if s.config().BeaconInterval > 0 {
+		ticker := time.NewTicker(s.config().BeaconInterval)
+		defer ticker.Stop()
+		beacon = ticker.C
+	}
+
 	for {
+		s.publishStatus()
 		select {
 		case q := <-s.quit:
-			s.logGeneric("got quit signal")
-			s.running.Set(false)
-			close(q)
+			if s.config().HandoffOnStop {
+				s.handoff(ni)
+			}
+			pending.fail(ErrStopped)
+			s.stop(q)
 			return
 
+		case t := <-s.forceChan:
+			err := s.force(t.State, t.Term)
+			t.Err <- err
+			if err == nil {
+				return // to enter the forced state
+			}
+
 		case t := <-s.commandChan:
+			// The client has given up on a command that waited too long in
+			// the queue; don't append it.
+			if !t.Deadline.IsZero() && s.expired("command", t.Deadline) {
+				t.Err <- context.DeadlineExceeded
+				continue
+			}
+
+			// Without a quorum, the command can't commit; fail fast.
+			if s.noQuorum {
+				s.logGeneric("got command, but have no quorum")
+				t.Err <- ErrNoQuorum
+				continue
+			}
+
+			if t.Type == EntrySessionCommand && !s.log.hasSession(t.Session) {
+				s.logGeneric("got command, but session %d is unknown", t.Session)
+				t.Err <- ErrUnknownSession
+				continue
+			}
+			command := t.Type == EntryCommand || t.Type == EntrySessionCommand
+			if s.validate != nil && command {
+				if err := s.validate(t.Command); err != nil {
+					s.logGeneric("got command, but it's invalid: %s", err)
+					t.Err <- err
+					continue
+				}
+			}
+			if command {
+				if err := s.quota.admit(t.Command, time.Now()); err != nil {
+					s.logGeneric("got command, but it's over quota: %s", err)
+					t.Err <- err
+					continue
+				}
+				if s.log.applyBacklogFull() {
+					s.logGeneric("got command, but the state machine is too far behind")
+					t.Err <- ErrApplyBacklog
+					continue
+				}
+			}
+
 			// Append the command to our (leader) log
 			s.logGeneric("got command, appending")
 			currentTerm := s.term
 			entry := LogEntry{
-				Index:           s.log.lastIndex() + 1,
-				Term:            currentTerm,
-				Command:         t.Command,
-				commandResponse: t.CommandResponse,
+				Index:       s.log.lastIndex() + 1,
+				Term:        currentTerm,
+				Type:        t.Type,
+				Command:     t.Command,
+				Annotations: t.Annotations,
+			}
+			if s.encodeEntry != nil && command {
+				cmd, err := s.encodeEntry(entry)
+				if err != nil {
+					t.Err <- err
+					continue
+				}
+				entry.Command = cmd
+			}
+			if t.Type == EntrySessionCommand {
+				entry.Command = tagSessionCommand(t.Session, t.Seq, entry.Command)
 			}
 			if err := s.log.appendEntry(entry); err != nil {
 				t.Err <- err
 				continue
 			}
+			s.log.inflight.register(entry.Index, t.CommandResponse, t.Deadline)
+			if t.ApplyErr != nil {
+				s.log.inflight.registerErr(entry.Index, t.ApplyErr)
+			}
+			latency.appended(entry.Index)
+
 			s.logGeneric("after append, commitIndex=%d lastIndex=%d lastTerm=%d", s.log.getCommitIndex(), s.log.lastIndex(), s.log.lastTerm())
 
 			// Now that the entry is in the log, we can fall back to the
@@ -731,13 +1939,94 @@ func (s *Server) leaderSelect() {
 			go func() { flush <- struct{}{} }()
 			t.Err <- nil
 
+		case t := <-s.journalChan:
+			index, err := s.appendJournal(t.Data)
+			t.Response <- journalResponse{index, err}
+			if err == nil {
+				go func() { flush <- struct{}{} }()
+			}
+
+		case t := <-s.configChan:
+			if prior, ok := s.findChange(t.Change.ChangeId); ok {
+				if prior.Remove != t.Change.Remove || prior.learnId() != t.Change.learnId() {
+					t.Err <- ErrChangeConflict
+					continue
+				}
+				s.logGeneric("change %q is already in the log", t.Change.ChangeId)
+				t.Err <- nil
+				continue
+			}
+			verb, id := "remove", t.Change.Remove
+			if t.Change.Learn != nil {
+				verb, id = "add learner", t.Change.Learn.Id
+			}
+			_, isPeer := s.peers[id]
+			_, isLearner := s.learners[id]
+			switch {
+			case t.Change.Learn != nil && (isPeer || isLearner):
+				t.Err <- ErrPeerExists
+				continue
+			case t.Change.Learn != nil && s.dial == nil:
+				t.Err <- ErrNoDialer
+				continue
+			case t.Change.Learn != nil:
+			case id == s.id:
+				t.Err <- ErrRemoveLeader
+				continue
+			case !isPeer && !isLearner:
+				t.Err <- ErrUnknownPeer
+				continue
+			}
+			err := s.changeInProgress(ni, reachable)
+			if err == nil && t.Change.Learn == nil { // learners don't vote
+				err = s.checkConfigurationChange(t.Change, reachable)
+			}
+			if err != nil {
+				if !t.Force {
+					s.logGeneric("refusing to %s %d: %s", verb, id, err)
+					t.Err <- err
+					continue
+				}
+				s.logGeneric("going to %s %d, despite: %s", verb, id, err)
+			}
+			if err := s.appendConfigurationChange(t.Change); err != nil {
+				t.Err <- err
+				continue
+			}
+			go func() { flush <- struct{}{} }()
+			t.Err <- nil
+
+		case t := <-s.queryChan:
+			// Until an entry from our term has committed, we may not know
+			// the latest commit index, so we can't answer anything but
+			// stale queries.
+			current := s.log.termAt(s.log.getCommitIndex()) == s.term
+			switch {
+			case t.Consistency == Stale:
+				s.answerQuery(t)
+			case s.noQuorum:
+				s.logGeneric("got %s query, but have no quorum", t.Consistency)
+				t.Response <- queryResponse{nil, ErrNoQuorum}
+			case t.Consistency == Lease && current && time.Now().Before(lease):
+				s.answerQuery(t)
+			default:
+				pending = append(pending, t)
+				go func() { flush <- struct{}{} }()
+			}
+
+		case <-beacon:
+			if time.Now().Before(lease) {
+				s.beacon()
+			}
+
 		case <-flush:
 			// Flushes attempt to sync the follower log with ours.
 			// That requires per-follower state in the form of nextIndex.
 			// After every flush, we check if we can advance our commitIndex.
 			// If so, we do it, and trigger another flush ASAP.
 			// A flush can cause us to be deposed.
-			recipients := s.peers.Except(s.id)
+			voters := s.voters()
+			recipients := union(voters, s.learners)
 
 			// Special case: network of 1
 			if len(recipients) <= 0 {
@@ -748,65 +2037,132 @@ func (s *Server) leaderSelect() {
 						continue
 					}
 					s.logGeneric("after commitTo(%d), commitIndex=%d", ourLastIndex, s.log.getCommitIndex())
+					latency.committed(s.log.getCommitIndex())
 				}
+				lease = time.Now().Add(s.leaseDuration()) // we're our own quorum
+				pending.confirmed(s)
 				continue
 			}
 
 			// Normal case: network of at-least-2
-			successes, stepDown := s.concurrentFlush(recipients, ni, 2*BroadcastInterval())
+			ni.track(recipients, s.log.lastIndex()) // e.g. an added learner
+			limits := s.catchupLimits(recipients, ni, latency.average)
+			began := time.Now()
+			accepted, stepDown := s.concurrentFlush(recipients, ni, limits, s.scaleTimeout(2*s.config().HeartbeatInterval), retry)
+			reachable = accepted
+			s.metrics.followerLag(recipients, ni, s.log.lastIndex())
+			s.notifyReplicated(ni)
 			if stepDown {
 				s.logGeneric("deposed during flush")
 				s.state.Set(Follower)
-				s.leader = unknownLeader
+				s.setLeader(unknownLeader)
+				s.adoptTerm(0)
 				return
 			}
 
-			// Only when we know all followers accepted the flush can we
-			// consider incrementing commitIndex and pushing out another
-			// round of flushes.
-			if successes == len(recipients) {
-				peersBestIndex := ni.bestIndex()
-				ourLastIndex := s.log.lastIndex()
-				ourCommitIndex := s.log.getCommitIndex()
-				if peersBestIndex > ourLastIndex {
-					// safety check: we've probably been deposed
-					s.logGeneric("peers' best index %d > our lastIndex %d", peersBestIndex, ourLastIndex)
-					s.logGeneric("this is crazy, I'm gonna become a follower")
-					s.leader = unknownLeader
-					s.vote = noVote
+			// Followers sent as many entries as the config allows, and
+			// still behind, are sent more straight away, rather than at
+			// the next heartbeat. Throttled followers wait their turn.
+			for id := range accepted {
+				if limits[id] == 0 && ni.prevLogIndex(id) < s.log.lastIndex() {
+					s.logGeneric("peer %d is still behind -- queueing another flush", id)
+					go func() { flush <- struct{}{} }()
+					break
+				}
+			}
+
+			// If we haven't reached a quorum for a while, we've lost it.
+			// The witness counts towards a quorum, but not a lease: it
+			// may vote for another candidate straight away.
+			reached := 1 + len(voters) - len(disjoint(voters, accepted))
+			if reached >= s.peers.Quorum() {
+				lastQuorum = time.Now()
+				if s.witness == nil || accepted[s.witness.id] == nil || reached > s.peers.Quorum() {
+					lease = began.Add(s.leaseDuration())
+				}
+				s.setQuorum(true)
+			} else if time.Since(lastQuorum) > s.scaleTimeout(s.config().MinElectionTimeout) {
+				s.setQuorum(false)
+				pending.fail(ErrQuorumLost) // not ErrNoQuorum, which is only for refusals
+				if s.config().CheckQuorum {
+					s.logGeneric("no quorum since %s, stepping down", lastQuorum.Format(time.StampMicro))
 					s.state.Set(Follower)
+					s.setLeader(unknownLeader)
 					return
 				}
-				if peersBestIndex > ourCommitIndex {
-					if err := s.log.commitTo(peersBestIndex); err != nil {
-						s.logGeneric("commitTo(%d): %s", peersBestIndex, err)
-						continue // oh well, next time?
-					}
-					if s.log.getCommitIndex() > ourCommitIndex {
-						s.logGeneric("after commitTo(%d), commitIndex=%d -- queueing another flush", peersBestIndex, s.log.getCommitIndex())
-						go func() { flush <- struct{}{} }()
-					}
+			}
+
+			// Learners that are close enough to our log get promoted.
+			s.promoteLearners(ni, promoting, reachable)
+
+			// 5.3, 5.4.2: "If there exists an N such that N > commitIndex, a
+			// majority of matchIndex[i] >= N, and log[N].term == currentTerm:
+			// set commitIndex = N." Learners don't count.
+			ourLastIndex := s.log.lastIndex()
+			ourCommitIndex := s.log.getCommitIndex()
+			quorumIndex := ni.quorumMatchIndex(voters, s.peers.Quorum(), ourLastIndex)
+			if quorumIndex > ourLastIndex {
+				// safety check: we've probably been deposed
+				s.logGeneric("quorum match index %d > our lastIndex %d", quorumIndex, ourLastIndex)
+				s.logGeneric("this is crazy, I'm gonna become a follower")
+				s.setLeader(unknownLeader)
+				s.vote = noVote
+				s.state.Set(Follower)
+				return
+			}
+			if quorumIndex > ourCommitIndex && s.log.termAt(quorumIndex) == s.term {
+				if err := s.log.commitTo(quorumIndex); err != nil {
+					s.logGeneric("commitTo(%d): %s", quorumIndex, err)
+					continue // oh well, next time?
 				}
+				if s.log.getCommitIndex() > ourCommitIndex {
+					latency.committed(s.log.getCommitIndex())
+					s.logGeneric("after commitTo(%d), commitIndex=%d -- queueing another flush", quorumIndex, s.log.getCommitIndex())
+					go func() { flush <- struct{}{} }()
+				}
+			}
+
+			// Every pending query arrived before this flush began, so if it
+			// reached a quorum, we were still the leader when they arrived.
+			if reached >= s.peers.Quorum() && s.log.termAt(s.log.getCommitIndex()) == s.term {
+				pending.confirmed(s)
 			}
 
 		case t := <-s.appendEntriesChan:
+			if s.expired("AppendEntries", t.Deadline) {
+				continue
+			}
 			resp, stepDown := s.handleAppendEntries(t.Request)
 			s.logAppendEntriesResponse(t.Request, resp, stepDown)
 			t.Response <- resp
 			if stepDown {
 				s.logGeneric("after an AppendEntries, deposed to Follower (leader=%d)", s.leader)
-				s.leader = t.Request.LeaderId
+				s.setLeader(t.Request.LeaderId)
+				s.state.Set(Follower)
+				return // deposed
+			}
+
+		case t := <-s.installSnapshotChan:
+			resp, stepDown := s.handleInstallSnapshot(t.Request, t.Id)
+			s.logInstallSnapshotResponse(t.Request, resp, stepDown)
+			t.Response <- resp
+			if stepDown {
+				s.logGeneric("after an InstallSnapshot, deposed to Follower (leader=%d)", t.Request.LeaderId)
+				s.setLeader(t.Request.LeaderId)
 				s.state.Set(Follower)
 				return // deposed
 			}
 
 		case t := <-s.requestVoteChan:
+			if s.expired("RequestVote", t.Deadline) {
+				continue
+			}
 			resp, stepDown := s.handleRequestVote(t.Request)
 			s.logRequestVoteResponse(t.Request, resp, stepDown)
 			t.Response <- resp
 			if stepDown {
 				s.logGeneric("after a RequestVote, deposed to Follower (leader unknown)")
-				s.leader = unknownLeader
+				s.setLeader(unknownLeader)
 				s.state.Set(Follower)
 				return // deposed
 			}
@@ -814,6 +2170,286 @@ func (s *Server) leaderSelect() {
 	}
 }
 
+// catchupLimits returns the per-flush entry limit for each of the passed peers,
+// given the current average command latency. Peers without a limit are absent.
+func (s *Server) catchupLimits(peers Peers, ni *nextIndex, latency time.Duration) map[uint64]int {
+	limits := map[uint64]int{}
+	if s.catchupLatency <= 0 || s.catchupEntries <= 0 || latency <= s.catchupLatency {
+		return limits
+	}
+	lastIndex := s.log.lastIndex()
+	for id := range peers {
+		if matchIndex := ni.matchIndex(id); matchIndex+uint64(s.catchupEntries) < lastIndex {
+			limits[id] = s.catchupEntries
+		}
+	}
+	if len(limits) > 0 {
+		s.logGeneric("average command latency %s > %s: throttling %d lagging peer(s)", latency, s.catchupLatency, len(limits))
+	}
+	return limits
+}
+
+// commandLatency tracks a moving average of the time it takes for commands
+// appended to the leader log to be committed.
+type commandLatency struct {
+	pending map[uint64]time.Time // index: when it was appended
+	average time.Duration
+	metrics *metrics
+}
+
+func newCommandLatency() *commandLatency {
+	return &commandLatency{pending: map[uint64]time.Time{}}
+}
+
+func (c *commandLatency) appended(index uint64) {
+	c.pending[index] = time.Now()
+}
+
+func (c *commandLatency) committed(commitIndex uint64) {
+	for index, t := range c.pending {
+		if index > commitIndex {
+			continue
+		}
+		c.average += (time.Since(t) - c.average) / 8
+		c.metrics.since(MetricCommitLatency, t)
+		delete(c.pending, index)
+	}
+}
+
+// promoteLearners appends a configuration entry promoting each learner whose
+// matchIndex is within promotionThreshold entries of our last index. promoting
+// tracks promotions that haven't yet committed, so we only append one per
+// learner.
+func (s *Server) promoteLearners(ni *nextIndex, promoting map[uint64]bool, reachable Peers) {
+	for id := range s.learners {
+		if promoting[id] {
+			continue
+		}
+		matchIndex, lastIndex := ni.matchIndex(id), s.log.lastIndex()
+		if matchIndex+s.promotionThreshold < lastIndex {
+			continue
+		}
+		if err := s.changeInProgress(ni, reachable); err != nil {
+			return // try again after the next flush
+		}
+		c := configurationChange{Promote: id}
+		if err := s.checkConfigurationChange(c, reachable); err != nil {
+			s.logGeneric("learner %d at %d/%d: not promoting: %s", id, matchIndex, lastIndex, err)
+			continue
+		}
+		if err := s.appendConfigurationChange(c); err != nil {
+			s.logGeneric("promoting learner %d: %s", id, err)
+			continue
+		}
+		s.logGeneric("learner %d at %d/%d: promoting", id, matchIndex, lastIndex)
+		promoting[id] = true
+	}
+}
+
+type configTuple struct {
+	Change configurationChange
+	Force  bool
+	Err    chan error
+}
+
+// AddLearner adds the server with the given id, at the given address, to the
+// Raft network as a learner, via a configuration entry in the leader's log.
+// It must be called on the leader. As the entry commits on each server, the
+// server dials the learner with the function passed to SetDialer, so every
+// server needs one, including the learner, which should be started without
+// peers, and learns the membership from the leader's log. The leader promotes
+// the learner to a voting peer once it's caught up; see
+// SetPromotionThreshold.
+//
+// It fails with ErrPeerExists if the server is already a peer or learner, and
+// with ErrConfigChangeInProgress under the same conditions as RemovePeer.
+func (s *Server) AddLearner(id uint64, addr string) error {
+	return s.AddLearnerOnce("", id, addr)
+}
+
+// AddLearnerOnce is AddLearner, with a change id, as with RemovePeerOnce.
+func (s *Server) AddLearnerOnce(changeId string, id uint64, addr string) error {
+	if id <= 0 {
+		panic("server id must be > 0")
+	}
+	err := make(chan error)
+	select {
+	case s.configChan <- configTuple{configurationChange{Learn: &member{Id: id, Address: addr}, ChangeId: changeId}, false, err}:
+	case <-s.stopped:
+		return ErrStopped
+	}
+	return <-err
+}
+
+// RemovePeer removes the peer (or learner) with the given id from the Raft
+// network, via a configuration entry in the leader's log. It must be called on
+// the leader; the change takes effect on each server as the entry commits
+// there. The removed server should then be stopped.
+//
+// The leader refuses to remove a voting peer if the voters it can currently
+// reach would then fall short of a quorum, which would make the network
+// unavailable the moment the change is applied. It refuses any change, with
+// ErrConfigChangeInProgress, until the last has committed, and been applied
+// by every member it can reach, and until the config's
+// MembershipChangeInterval has passed since. Force overrides those checks.
+func (s *Server) RemovePeer(id uint64, force bool) error {
+	return s.RemovePeerOnce("", id, force)
+}
+
+// RemovePeerOnce is RemovePeer, with a change id chosen by the caller, which
+// is recorded in the configuration entry. If an entry with the same id is
+// already in the leader's log, the change isn't made again, and nil is
+// returned, so an operator can safely retry a request whose outcome they
+// didn't learn, e.g. after a timeout, even if the leader has since changed.
+// Reusing an id for a different change fails with ErrChangeConflict. An empty
+// id is never deduplicated.
+func (s *Server) RemovePeerOnce(changeId string, id uint64, force bool) error {
+	err := make(chan error)
+	select {
+	case s.configChan <- configTuple{configurationChange{Remove: id, ChangeId: changeId}, force, err}:
+	case <-s.stopped:
+		return ErrStopped
+	}
+	return <-err
+}
+
+// checkConfigurationChange returns ErrUnsafeChange if, after the change, the
+// voting peers we can reach (including ourselves) won't make up a quorum.
+func (s *Server) checkConfigurationChange(c configurationChange, reachable Peers) error {
+	voters := s.peers
+	switch {
+	case c.Promote != 0:
+		voters = union(voters, Peers{c.Promote: s.learners[c.Promote]})
+	case c.Remove != 0:
+		voters = voters.Except(c.Remove)
+	}
+	n := 0
+	for id := range voters {
+		if _, ok := reachable[id]; ok || id == s.id {
+			n++
+		}
+	}
+	if n < voters.Quorum() {
+		return ErrUnsafeChange
+	}
+	return nil
+}
+
+// changeInProgress returns ErrConfigChangeInProgress unless the last
+// membership change in our log has committed, and been applied by every
+// member we can reach, and took effect here at least MembershipChangeInterval
+// ago. Members we can't reach will apply it as they catch up, and mustn't
+// block changes, e.g. to remove them.
+func (s *Server) changeInProgress(ni *nextIndex, reachable Peers) error {
+	// Zero if the last change has been compacted, and so long since applied.
+	index := s.log.lastOfType(EntryConfiguration)
+	if s.log.getCommitIndex() < index {
+		return ErrConfigChangeInProgress
+	}
+	for id := range union(s.peers.Except(s.id), s.learners) {
+		if _, ok := reachable[id]; ok && ni.appliedIndex(id) < index {
+			return ErrConfigChangeInProgress
+		}
+	}
+	if time.Since(s.changedAt) < s.config().MembershipChangeInterval {
+		return ErrConfigChangeInProgress
+	}
+	return nil
+}
+
+// findChange returns the configuration change in our log with the given change
+// id, if there is one.
+func (s *Server) findChange(changeId string) (configurationChange, bool) {
+	if changeId == "" {
+		return configurationChange{}, false
+	}
+	entries := s.log.retained()
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Type != EntryConfiguration {
+			continue
+		}
+		var c configurationChange
+		if err := json.Unmarshal(entries[i].Command, &c); err == nil && c.ChangeId == changeId {
+			return c, true
+		}
+	}
+	return configurationChange{}, false
+}
+
+// appendConfigurationChange appends a configuration entry to our log. Entries
+// other than the bootstrap entry record the membership after the change.
+func (s *Server) appendConfigurationChange(c configurationChange) error {
+	if c.Bootstrap == nil {
+		c = s.withMembership(c)
+	}
+	cmd, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return s.log.appendEntry(LogEntry{
+		Index:   s.log.lastIndex() + 1,
+		Term:    s.term,
+		Type:    EntryConfiguration,
+		Command: cmd,
+	})
+}
+
+// configurationChange is the command of an EntryConfiguration log entry.
+type configurationChange struct {
+	Promote   uint64   `json:"promote,omitempty"`   // learner to make a voting peer
+	Remove    uint64   `json:"remove,omitempty"`    // peer or learner to remove
+	Bootstrap []member `json:"bootstrap,omitempty"` // the initial peers
+	Learn     *member  `json:"learn,omitempty"`     // server to add as a learner
+	ChangeId  string   `json:"change_id,omitempty"` // chosen by the operator
+
+	// The membership after a promotion or removal, for recovery.
+	Members  []member `json:"members,omitempty"`
+	Learners []member `json:"learners,omitempty"`
+}
+
+// learnId returns the id of the server the change adds as a learner, if any.
+func (c configurationChange) learnId() uint64 {
+	if c.Learn == nil {
+		return 0
+	}
+	return c.Learn.Id
+}
+
+// applyConfiguration is called by the log when a configuration entry is
+// committed. It never modifies the passed peer maps, which may be shared.
+func (s *Server) applyConfiguration(cmd []byte) error {
+	var c configurationChange
+	if err := json.Unmarshal(cmd, &c); err != nil {
+		return err
+	}
+	if len(c.Bootstrap) > 0 {
+		if err := s.bootstrap(c.Bootstrap); err != nil {
+			return err
+		}
+	}
+	if c.Promote != 0 {
+		peer, ok := s.learners[c.Promote]
+		if !ok {
+			s.logGeneric("promotion of unknown learner %d; ignoring", c.Promote)
+			return nil
+		}
+		s.setMembers(union(s.peers, Peers{c.Promote: peer}), s.learners.Except(c.Promote))
+		s.logGeneric("learner %d promoted to voting peer", c.Promote)
+	}
+	if c.Remove != 0 {
+		s.setMembers(s.peers.Except(c.Remove), s.learners.Except(c.Remove))
+		s.logGeneric("peer %d removed", c.Remove)
+	}
+	if c.Learn != nil {
+		if err := s.addLearner(*c.Learn); err != nil {
+			return err
+		}
+	}
+	s.changedAt = time.Now()
+	s.checkFaultTolerance()
+	return nil
+}
+
 // handleRequestVote will modify s.term and s.vote, but nothing else.
 // stepDown means you need to: s.leader=unknownLeader, s.state.Set(Follower).
 func (s *Server) handleRequestVote(rv RequestVote) (RequestVoteResponse, bool) {
@@ -828,14 +2464,28 @@ func (s *Server) handleRequestVote(rv RequestVote) (RequestVoteResponse, bool) {
 		}, false
 	}
 
+	// 4.2.3 Disruptive servers: "if a server receives a RequestVote request
+	// within the minimum election timeout of hearing from a current leader,
+	// it does not update its term or grant its vote." A server that's been
+	// partitioned away can't depose a healthy leader when it returns, then.
+	// A candidate the leader handed off to is the exception.
+	if s.config().CheckQuorum && !rv.Transfer && s.leaderHealthy() {
+		return RequestVoteResponse{
+			Term:        s.term,
+			VoteGranted: false,
+			reason:      fmt.Sprintf("leader %d is healthy", s.leader),
+		}, false
+	}
+
 	// If the request is from a newer term, reset our state
 	stepDown := false
 	if rv.Term > s.term {
 		s.logGeneric("RequestVote from newer term (%d): we defer", rv.Term)
 		s.term = rv.Term
 		s.vote = noVote
-		s.leader = unknownLeader
+		s.setLeader(unknownLeader)
 		stepDown = true
+		s.saveStable() // if it fails, we'll try again before voting
 	}
 
 	// Special case: if we're the leader, and we haven't been deposed by a more
@@ -875,8 +2525,16 @@ func (s *Server) handleRequestVote(rv RequestVote) (RequestVoteResponse, bool) {
 		}, stepDown
 	}
 
-	// We passed all the tests: cast vote in favor
+	// We passed all the tests: cast vote in favor, once it's persisted
 	s.vote = rv.CandidateId
+	if err := s.saveStable(); err != nil {
+		s.vote = noVote
+		return RequestVoteResponse{
+			Term:        s.term,
+			VoteGranted: false,
+			reason:      fmt.Sprintf("persisting vote: %s", err),
+		}, stepDown
+	}
 	s.resetElectionTimeout() // TODO why?
 	return RequestVoteResponse{
 		Term:        s.term,
@@ -884,6 +2542,34 @@ func (s *Server) handleRequestVote(rv RequestVote) (RequestVoteResponse, bool) {
 	}, stepDown
 }
 
+// observeTerm records a term newer than ours, seen in the response to an RPC
+// sent outside the main loop, e.g. by a flush, for the main loop to adopt.
+func (s *Server) observeTerm(term uint64) {
+	for {
+		seen := atomic.LoadUint64(&s.termSeen)
+		if term <= seen || atomic.CompareAndSwapUint64(&s.termSeen, seen, term) {
+			return
+		}
+	}
+}
+
+// adoptTerm moves us to the passed term, or the newest observed since the
+// last call, if either is newer than ours, and clears our vote, as we step
+// down: "If RPC request or response contains term T > currentTerm: set
+// currentTerm = T, convert to follower" (§5.1). If persisting the term
+// fails, we'll try again before we next vote, or acknowledge a leader.
+func (s *Server) adoptTerm(term uint64) {
+	if seen := atomic.SwapUint64(&s.termSeen, 0); seen > term {
+		term = seen
+	}
+	if term <= s.term {
+		return
+	}
+	s.logGeneric("adopting term %d", term)
+	s.term, s.vote = term, noVote
+	s.saveStable()
+}
+
 // handleAppendEntries will modify s.term and s.vote, but nothing else.
 // stepDown means you need to: s.leader=r.LeaderId, s.state.Set(Follower).
 func (s *Server) handleAppendEntries(r AppendEntries) (AppendEntriesResponse, bool) {
@@ -896,9 +2582,10 @@ func (s *Server) handleAppendEntries(r AppendEntries) (AppendEntriesResponse, bo
 	// If the request is from an old term, reject
 	if r.Term < s.term {
 		return AppendEntriesResponse{
-			Term:    s.term,
-			Success: false,
-			reason:  fmt.Sprintf("Term %d < %d", r.Term, s.term),
+			Term:      s.term,
+			Success:   false,
+			Rejection: RejectStaleTerm,
+			reason:    fmt.Sprintf("Term %d < %d", r.Term, s.term),
 		}, false
 	}
 
@@ -921,14 +2608,30 @@ func (s *Server) handleAppendEntries(r AppendEntries) (AppendEntriesResponse, bo
 		stepDown = true
 	}
 
+	// We mustn't forget the term before acknowledging the leader
+	if err := s.saveStable(); err != nil {
+		return AppendEntriesResponse{
+			Term:      s.term,
+			Success:   false,
+			Rejection: RejectStorage,
+			reason:    fmt.Sprintf("persisting term: %s", err),
+		}, stepDown
+	}
+
 	// In any case, reset our election timeout
 	s.resetElectionTimeout()
+	s.lastContact = time.Now()
+
+	// Note how far behind the leader we were
+	s.lag.observe(r.PrevLogIndex+uint64(len(r.Entries)), s.log.lastIndex())
 
 	// Reject if log doesn't contain a matching previous entry
 	if err := s.log.ensureLastIs(r.PrevLogIndex, r.PrevLogTerm); err != nil {
 		return AppendEntriesResponse{
-			Term:    s.term,
-			Success: false,
+			Term:      s.term,
+			Success:   false,
+			Gap:       s.log.gap(r.PrevLogIndex),
+			Rejection: RejectLogMismatch,
 			reason: fmt.Sprintf(
 				"while ensuring last log entry had index=%d term=%d: error: %s",
 				r.PrevLogIndex,
@@ -942,8 +2645,9 @@ func (s *Server) handleAppendEntries(r AppendEntries) (AppendEntriesResponse, bo
 	for i, entry := range r.Entries {
 		if err := s.log.appendEntry(entry); err != nil {
 			return AppendEntriesResponse{
-				Term:    s.term,
-				Success: false,
+				Term:      s.term,
+				Success:   false,
+				Rejection: RejectLogMismatch,
 				reason: fmt.Sprintf(
 					"AppendEntry %d/%d failed: %s",
 					i+1,
@@ -954,6 +2658,17 @@ func (s *Server) handleAppendEntries(r AppendEntries) (AppendEntriesResponse, bo
 		}
 	}
 
+	// The leader counts our acknowledgement toward committing the entries,
+	// so they must survive our crash first.
+	if err := s.log.persistAppended(); err != nil {
+		return AppendEntriesResponse{
+			Term:      s.term,
+			Success:   false,
+			Rejection: RejectStorage,
+			reason:    fmt.Sprintf("persisting entries failed: %s", err),
+		}, stepDown
+	}
+
 	// Commit up to the commit index
 	// < ptrb> ongardie: if the new leader sends a 0-entry AppendEntries
 	// with lastIndex=5 commitIndex=4, to a follower that has lastIndex=5
@@ -964,12 +2679,21 @@ func (s *Server) handleAppendEntries(r AppendEntries) (AppendEntriesResponse, bo
 	// network drops packet (2) caller has stale term (3) would leave gap in the
 	// recipient's log (4) term of entry preceding the new entries doesn't match
 	// the term at the same index on the recipient
-	if r.CommitIndex > 0 && r.CommitIndex > s.log.getCommitIndex() {
-		if err := s.log.commitTo(r.CommitIndex); err != nil {
+	//
+	// "If leaderCommit > commitIndex, set commitIndex = min(leaderCommit,
+	// index of last new entry)." The leader may not have sent us everything
+	// it has committed, yet.
+	commitIndex := r.CommitIndex
+	if lastIndex := s.log.lastIndex(); commitIndex > lastIndex {
+		commitIndex = lastIndex
+	}
+	if commitIndex > 0 && commitIndex > s.log.getCommitIndex() {
+		if err := s.log.commitTo(commitIndex); err != nil {
 			return AppendEntriesResponse{
-				Term:    s.term,
-				Success: false,
-				reason:  fmt.Sprintf("CommitTo(%d) failed: %s", r.CommitIndex, err),
+				Term:      s.term,
+				Success:   false,
+				Rejection: RejectStorage,
+				reason:    fmt.Sprintf("CommitTo(%d) failed: %s", commitIndex, err),
 			}, stepDown
 		}
 	}
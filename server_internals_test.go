@@ -2,7 +2,14 @@ package raft
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestFollowerAllegiance(t *testing.T) {
@@ -57,6 +64,40 @@ func TestStrongLeader(t *testing.T) {
 	}
 }
 
+func TestStickyLeader(t *testing.T) {
+	// a follower in term=5, which has just heard from leader=2
+	s := Server{
+		id:          1,
+		term:        5,
+		state:       &serverState{value: Follower},
+		leader:      2,
+		lastContact: time.Now(),
+		log:         NewLog(&bytes.Buffer{}, noop),
+	}
+	s.cfg.Store(Config{MinElectionTimeout: 100 * time.Millisecond, CheckQuorum: true}.withDefaults())
+
+	// ignores a RequestVote from a future term
+	resp, stepDown := s.handleRequestVote(RequestVote{Term: 6, CandidateId: 3})
+	if resp.VoteGranted || stepDown {
+		t.Errorf("healthy leader: expected no vote, and no step down, got %+v, %v", resp, stepDown)
+	}
+	if expected, got := uint64(5), s.term; expected != got {
+		t.Errorf("healthy leader: expected term=%d, got %d", expected, got)
+	}
+
+	// unless the leader handed off to the candidate
+	if resp, _ := s.handleRequestVote(RequestVote{Term: 6, CandidateId: 3, Transfer: true}); !resp.VoteGranted {
+		t.Errorf("transfer: expected a vote, got %+v", resp)
+	}
+
+	// or it hasn't heard from the leader for the minimum election timeout
+	s.term, s.vote, s.leader = 5, noVote, 2
+	s.lastContact = time.Now().Add(-100 * time.Millisecond)
+	if resp, _ := s.handleRequestVote(RequestVote{Term: 6, CandidateId: 3}); !resp.VoteGranted {
+		t.Errorf("silent leader: expected a vote, got %+v", resp)
+	}
+}
+
 func TestLimitedClientPatience(t *testing.T) {
 	// a client issues a command
 
@@ -79,7 +120,8 @@ func TestLenientCommit(t *testing.T) {
 			LogEntry{Index: 4, Term: 2},
 			LogEntry{Index: 5, Term: 2},
 		},
-		commitPos: 4,
+		commitPos:  4,
+		persistPos: 4, // and so in the store
 	}
 
 	// belongs to a follower
@@ -108,3 +150,761 @@ func TestLenientCommit(t *testing.T) {
 		t.Errorf("shouldn't step down")
 	}
 }
+
+func TestLearnerPromotion(t *testing.T) {
+	// a follower with a learner=3 among its peers
+	s := Server{
+		id:       1,
+		term:     2,
+		state:    &serverState{value: Follower},
+		leader:   2,
+		log:      NewLog(&bytes.Buffer{}, noop),
+		peers:    Peers{1: nil, 2: nil},
+		learners: Peers{3: nil},
+	}
+	s.log.configure = s.applyConfiguration
+
+	// receives a committed promotion for the learner
+	resp, _ := s.handleAppendEntries(AppendEntries{
+		Term:     2,
+		LeaderId: 2,
+		Entries: []LogEntry{
+			LogEntry{Index: 1, Term: 2, Type: EntryConfiguration, Command: []byte(`{"promote":3}`)},
+		},
+		CommitIndex: 1,
+	})
+	if !resp.Success {
+		t.Fatalf("failed (%s)", resp.reason)
+	}
+
+	// and should now count the learner as a voting peer
+	if _, ok := s.peers[3]; !ok {
+		t.Errorf("learner wasn't promoted")
+	}
+	if _, ok := s.learners[3]; ok {
+		t.Errorf("learner is still a learner")
+	}
+	if expected, got := 2, s.peers.Quorum(); expected != got {
+		t.Errorf("expected quorum %d, got %d", expected, got)
+	}
+}
+
+func TestLearnerPromotionThreshold(t *testing.T) {
+	// a leader with 10 entries, and a learner=3 that has 5 of them
+	s := Server{
+		id:                 1,
+		term:               1,
+		state:              &serverState{value: Leader},
+		leader:             1,
+		log:                NewLog(&bytes.Buffer{}, noop),
+		peers:              Peers{1: nil, 2: nil},
+		learners:           Peers{3: nil},
+		promotionThreshold: 4,
+	}
+	for i := uint64(1); i <= 10; i++ {
+		s.log.appendEntry(LogEntry{Index: i, Term: 1, Command: []byte(`{}`)})
+	}
+	ni := newNextIndex(Peers{2: nil, 3: nil}, 10)
+	ni.matched(3, 5)
+	promoting := map[uint64]bool{}
+	reachable := Peers{2: nil, 3: nil}
+
+	// is too far behind to be promoted
+	s.promoteLearners(ni, promoting, reachable)
+	if promoting[3] || s.log.lastIndex() != 10 {
+		t.Fatalf("promoted a learner that was too far behind")
+	}
+
+	// until it catches up to within the threshold
+	ni.matched(3, 6)
+	s.promoteLearners(ni, promoting, reachable)
+	if !promoting[3] || s.log.lastIndex() != 11 {
+		t.Fatalf("didn't promote a learner that caught up")
+	}
+
+	// and the promotion is only appended once
+	s.promoteLearners(ni, promoting, reachable)
+	if expected, got := uint64(11), s.log.lastIndex(); expected != got {
+		t.Errorf("expected lastIndex %d, got %d", expected, got)
+	}
+}
+
+func TestQuorumMatchIndex(t *testing.T) {
+	// a leader with lastIndex=10, and four followers at various positions
+	ni := newNextIndex(Peers{2: nil, 3: nil, 4: nil, 5: nil}, 10)
+	ni.matched(2, 10)
+	ni.matched(3, 7)
+	ni.matched(4, 3)
+	voters := Peers{2: nil, 3: nil, 4: nil, 5: nil}
+
+	// with follower 5 down, index 7 is on a majority (1, 2, 3)
+	if expected, got := uint64(7), ni.quorumMatchIndex(voters, 3, 10); expected != got {
+		t.Errorf("expected %d, got %d", expected, got)
+	}
+
+	// matchIndex never decreases
+	ni.matched(3, 2)
+	if expected, got := uint64(7), ni.matchIndex(3); expected != got {
+		t.Errorf("expected %d, got %d", expected, got)
+	}
+
+	// and the leader alone is a quorum of one
+	if expected, got := uint64(10), ni.quorumMatchIndex(Peers{}, 1, 10); expected != got {
+		t.Errorf("expected %d, got %d", expected, got)
+	}
+}
+
+func TestCatchupThrottle(t *testing.T) {
+	// a leader with 100 entries, one follower keeping up and one lagging
+	s := Server{
+		id:             1,
+		term:           1,
+		state:          &serverState{value: Leader},
+		leader:         1,
+		log:            NewLog(&bytes.Buffer{}, noop),
+		catchupLatency: 50 * time.Millisecond,
+		catchupEntries: 10,
+	}
+	for i := uint64(1); i <= 100; i++ {
+		s.log.appendEntry(LogEntry{Index: i, Term: 1, Command: []byte(`{}`)})
+	}
+	peers := Peers{2: nil, 3: nil}
+	ni := newNextIndex(peers, 100)
+	ni.matched(2, 98)
+	ni.matched(3, 20)
+
+	// while commands are fast, nobody is throttled
+	if limits := s.catchupLimits(peers, ni, 10*time.Millisecond); len(limits) != 0 {
+		t.Errorf("expected no limits, got %v", limits)
+	}
+
+	// when commands are slow, only the lagging follower is throttled
+	limits := s.catchupLimits(peers, ni, 100*time.Millisecond)
+	if expected, got := 1, len(limits); expected != got {
+		t.Fatalf("expected %d limit(s), got %d", expected, got)
+	}
+	if expected, got := 10, limits[3]; expected != got {
+		t.Errorf("expected limit %d, got %d", expected, got)
+	}
+}
+
+func TestCommandLatency(t *testing.T) {
+	c := newCommandLatency()
+	c.appended(1)
+	c.appended(2)
+	time.Sleep(10 * time.Millisecond)
+
+	c.committed(1)
+	if c.average <= 0 {
+		t.Errorf("expected positive average, got %s", c.average)
+	}
+	if expected, got := 1, len(c.pending); expected != got {
+		t.Errorf("expected %d pending, got %d", expected, got)
+	}
+}
+
+func TestElectionTally(t *testing.T) {
+	// a candidate in a 5-node cluster needs 3 votes
+	tally := newElectionTally(5, 3)
+	if tally.won() || tally.lost() {
+		t.Fatalf("decided before any votes")
+	}
+
+	tally.add(false)
+	tally.add(false)
+	if tally.won() || tally.lost() {
+		t.Fatalf("decided with 2 denials; could still win")
+	}
+
+	tally.add(false)
+	if !tally.lost() {
+		t.Fatalf("3 denials of 5 should be a loss")
+	}
+	if expected, got := 4, tally.responses(); expected != got {
+		t.Errorf("expected %d responses, got %d", expected, got)
+	}
+}
+
+func TestScaleTimeout(t *testing.T) {
+	near, far := &timedPeer{rtt: time.Millisecond}, &timedPeer{rtt: time.Millisecond}
+	s := Server{
+		id:       1,
+		peers:    Peers{1: nil, 2: near},
+		learners: Peers{3: far},
+	}
+	s.cfg.Store(Config{MinElectionTimeout: 100 * time.Millisecond}.withDefaults())
+
+	// on a LAN, timeouts are unchanged
+	if expected, got := 150*time.Millisecond, s.scaleTimeout(150*time.Millisecond); expected != got {
+		t.Errorf("LAN: expected %s, got %s", expected, got)
+	}
+
+	// a distant peer stretches them, so that the minimum election timeout is
+	// rttTimeoutFactor round trips
+	far.rtt = 50 * time.Millisecond
+	if expected, got := 500*time.Millisecond, s.scaleTimeout(s.config().MinElectionTimeout); expected != got {
+		t.Errorf("WAN: expected %s, got %s", expected, got)
+	}
+	if expected, got := 750*time.Millisecond, s.scaleTimeout(150*time.Millisecond); expected != got {
+		t.Errorf("WAN: expected %s, got %s", expected, got)
+	}
+}
+
+func TestElectionBackoff(t *testing.T) {
+	s := Server{elections: &electionCounters{}}
+	s.cfg.Store(Config{MinElectionTimeout: 100 * time.Millisecond}.withDefaults())
+
+	// the first failure doesn't back off, each after it doubles the timeout,
+	// up to the MaxElectionBackoff of 800ms
+	for failing, expected := range []time.Duration{
+		150 * time.Millisecond,
+		150 * time.Millisecond,
+		300 * time.Millisecond,
+		600 * time.Millisecond,
+		600 * time.Millisecond,
+	} {
+		s.elections.nFailing = uint64(failing)
+		if got := s.backoffElection(150 * time.Millisecond); expected != got {
+			t.Errorf("%d failing: expected %s, got %s", failing, expected, got)
+		}
+	}
+
+	// hearing from a leader ends the run
+	s.setLeader(2)
+	if expected, got := uint64(0), s.elections.failing(); expected != got {
+		t.Errorf("expected %d failing, got %d", expected, got)
+	}
+}
+
+type timedPeer struct {
+	rtt time.Duration
+}
+
+func (p *timedPeer) Id() uint64 { return 0 }
+func (p *timedPeer) AppendEntries(AppendEntries) AppendEntriesResponse {
+	return AppendEntriesResponse{}
+}
+func (p *timedPeer) RequestVote(RequestVote) RequestVoteResponse { return RequestVoteResponse{} }
+func (p *timedPeer) Command([]byte, chan []byte) error           { return ErrTimeout }
+func (p *timedPeer) RoundTripTime() time.Duration                { return p.rtt }
+
+func TestSkipGap(t *testing.T) {
+	// a leader whose log has entries from terms 1, 4, 5 and 6
+	s := Server{id: 1, term: 6, log: NewLog(&bytes.Buffer{}, noop)}
+	for i, term := range []uint64{1, 1, 1, 4, 4, 5, 5, 6, 6, 6} {
+		s.log.appendEntry(LogEntry{Index: uint64(i + 1), Term: term, Command: []byte(`{}`)})
+	}
+
+	for _, c := range []struct {
+		prevLogIndex uint64
+		gap          LogGap
+		expected     uint64
+	}{
+		// follower is missing entries: jump back to its last one
+		{10, LogGap{LastIndex: 4, CommitIndex: 1}, 4},
+		// follower has entries from a term we don't: skip all of them
+		{10, LogGap{LastIndex: 11, CommitIndex: 3, ConflictTerm: 3, ConflictIndex: 4}, 3},
+		// follower has extra entries from a term we do: back to our last one
+		{9, LogGap{LastIndex: 9, CommitIndex: 3, ConflictTerm: 5, ConflictIndex: 6}, 7},
+		// but never behind the follower's commit index
+		{10, LogGap{LastIndex: 11, CommitIndex: 5, ConflictTerm: 3, ConflictIndex: 4}, 5},
+		// a follower that's committed past prevLogIndex moves us forward
+		{2, LogGap{LastIndex: 8, CommitIndex: 6}, 6},
+	} {
+		if got := s.skipGap(c.prevLogIndex, c.gap); c.expected != got {
+			t.Errorf("prevLogIndex=%d %+v: expected %d, got %d", c.prevLogIndex, c.gap, c.expected, got)
+		}
+	}
+}
+
+func TestFollowerLag(t *testing.T) {
+	s := Server{
+		id:     1,
+		term:   1,
+		state:  &serverState{value: Follower},
+		leader: 2,
+		log:    NewLog(&bytes.Buffer{}, noop),
+	}
+
+	// a leader 10 entries ahead of us reveals the gap
+	resp, _ := s.handleAppendEntries(AppendEntries{Term: 1, LeaderId: 2, PrevLogIndex: 10, PrevLogTerm: 1})
+	if resp.Success || resp.Gap == nil {
+		t.Fatalf("expected rejection with a gap, got %+v", resp)
+	}
+	if expected, got := (LogGap{}), *resp.Gap; expected != got {
+		t.Errorf("expected gap %+v, got %+v", expected, got)
+	}
+	if expected, got := (Lag{Last: 10, Max: 10}), s.Lag(); expected != got {
+		t.Errorf("expected lag %+v, got %+v", expected, got)
+	}
+
+	// once it sends us everything, we're caught up
+	entries := []LogEntry{}
+	for i := uint64(1); i <= 10; i++ {
+		entries = append(entries, LogEntry{Index: i, Term: 1, Command: []byte(`{}`)})
+	}
+	s.handleAppendEntries(AppendEntries{Term: 1, LeaderId: 2, Entries: entries})
+	s.handleAppendEntries(AppendEntries{Term: 1, LeaderId: 2, PrevLogIndex: 10, PrevLogTerm: 1})
+	if expected, got := (Lag{Last: 0, Max: 10}), s.Lag(); expected != got {
+		t.Errorf("expected lag %+v, got %+v", expected, got)
+	}
+}
+
+// failingStore reads as empty, and fails every write.
+type failingStore struct{ bytes.Buffer }
+
+func (*failingStore) Write([]byte) (int, error) { return 0, fmt.Errorf("disk on fire") }
+
+func TestRejectionReason(t *testing.T) {
+	s := Server{
+		id:     1,
+		term:   2,
+		state:  &serverState{value: Follower},
+		leader: 2,
+		log:    NewLog(&failingStore{}, noop),
+	}
+
+	for _, c := range []struct {
+		name     string
+		request  AppendEntries
+		expected RejectionReason
+	}{
+		{"stale term", AppendEntries{Term: 1, LeaderId: 2}, RejectStaleTerm},
+		{"log mismatch", AppendEntries{Term: 2, LeaderId: 2, PrevLogIndex: 3, PrevLogTerm: 2}, RejectLogMismatch},
+		{"storage error", AppendEntries{
+			Term:        2,
+			LeaderId:    2,
+			Entries:     []LogEntry{LogEntry{Index: 1, Term: 2, Command: []byte(`{}`)}},
+			CommitIndex: 1,
+		}, RejectStorage},
+	} {
+		resp, _ := s.handleAppendEntries(c.request)
+		if resp.Success {
+			t.Errorf("%s: expected rejection", c.name)
+			continue
+		}
+		if resp.Rejection != c.expected {
+			t.Errorf("%s: expected %s, got %s (%s)", c.name, c.expected, resp.Rejection, resp.reason)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	// a log restored from a snapshot that's since gone missing
+	s := NewServer(1, &bytes.Buffer{}, noop, Config{})
+	s.log.compactedIndex, s.log.compactedTerm = 5, 1
+	err := s.Check()
+	if _, ok := err.(*ConsistencyError); !ok {
+		t.Fatalf("expected a *ConsistencyError, got %v", err)
+	}
+
+	// won't start
+	defer func() {
+		if expected, got := err.Error(), fmt.Sprint(recover()); expected != got {
+			t.Errorf("expected Start to panic with %v, got %v", expected, got)
+		}
+	}()
+	s.Start()
+	s.Stop()
+}
+
+func TestConfigurationChangeSafety(t *testing.T) {
+	// a leader of 5 voters, of which it can reach 2, and 1 learner
+	s := Server{
+		id:       1,
+		peers:    Peers{1: nil, 2: nil, 3: nil, 4: nil, 5: nil},
+		learners: Peers{6: nil},
+	}
+	reachable := Peers{2: nil, 3: nil, 6: nil}
+
+	for _, c := range []struct {
+		change   configurationChange
+		expected error
+	}{
+		// 3 of 4 voters are reachable
+		{configurationChange{Remove: 5}, nil},
+		// 2 of 4 aren't a quorum
+		{configurationChange{Remove: 3}, ErrUnsafeChange},
+		// learners don't vote, so removing one is always safe
+		{configurationChange{Remove: 6}, nil},
+		// 4 of 6 voters are reachable
+		{configurationChange{Promote: 6}, nil},
+	} {
+		if got := s.checkConfigurationChange(c.change, reachable); c.expected != got {
+			t.Errorf("%+v: expected %v, got %v", c.change, c.expected, got)
+		}
+	}
+
+	// a learner we can't reach would make 3 of 6 voters reachable
+	delete(reachable, 6)
+	if expected, got := ErrUnsafeChange, s.checkConfigurationChange(configurationChange{Promote: 6}, reachable); expected != got {
+		t.Errorf("promoting unreachable learner: expected %v, got %v", expected, got)
+	}
+}
+
+func TestPeerContext(t *testing.T) {
+	hung := &hungPeer{id: 2, release: make(chan struct{})}
+	defer close(hung.release)
+
+	// an RPC to a peer that ignores contexts is still abandoned
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := appendEntries(ctx, hung, AppendEntries{}); err != ErrTimeout {
+		t.Errorf("expected %s, got %v", ErrTimeout, err)
+	}
+
+	// canceling an election stops its vote requests
+	ctx, cancel = context.WithCancel(context.Background())
+	votes := Peers{2: hung, 3: &timedPeer{}}.requestVotes(ctx, RequestVote{Term: 1}, 10*time.Millisecond, nil)
+	select {
+	case <-votes:
+	case <-time.After(time.Second):
+		t.Fatal("no vote from the responsive peer")
+	}
+	cancel()
+	hung.release <- struct{}{} // the hung peer finally responds
+	select {
+	case v := <-votes:
+		t.Errorf("got vote %+v after the election was canceled", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// hungPeer doesn't respond to RPCs until it's released.
+type hungPeer struct {
+	id      uint64
+	release chan struct{}
+}
+
+func (p *hungPeer) Id() uint64 { return p.id }
+func (p *hungPeer) AppendEntries(AppendEntries) AppendEntriesResponse {
+	<-p.release
+	return AppendEntriesResponse{}
+}
+func (p *hungPeer) RequestVote(RequestVote) RequestVoteResponse {
+	<-p.release
+	return RequestVoteResponse{}
+}
+func (p *hungPeer) Command([]byte, chan []byte) error { return ErrTimeout }
+
+func TestQuota(t *testing.T) {
+	for name, c := range map[string]struct {
+		quota Quota
+		steps []quotaStep
+	}{
+		"size": {Quota{MaxEntrySize: 100}, []quotaStep{
+			{100, 0, nil},
+			{101, 0, ErrEntryTooLarge},
+		}},
+		"entries": {Quota{EntriesPerSecond: 2}, []quotaStep{
+			{10, 0, nil},
+			{10, 0, nil},
+			{10, 0, ErrQuotaExceeded},
+			{10, 500 * time.Millisecond, nil},
+			{10, 0, ErrQuotaExceeded},
+		}},
+		"bytes": {Quota{BytesPerSecond: 50}, []quotaStep{
+			{30, 0, nil},
+			{30, 0, ErrQuotaExceeded}, // a rejected command takes nothing
+			{30, 200 * time.Millisecond, nil},
+			{80, 2 * time.Second, nil},                    // larger than the rate, but the bucket is full
+			{1, 100 * time.Millisecond, ErrQuotaExceeded}, // the bucket is in debt
+		}},
+	} {
+		now := time.Now()
+		q := newQuota(c.quota)
+		q.entries.last, q.bytes.last = now, now
+		for i, step := range c.steps {
+			now = now.Add(step.after)
+			if got := q.admit(make([]byte, step.size), now); step.expected != got {
+				t.Errorf("%s %d: %d bytes: expected %v, got %v", name, i, step.size, step.expected, got)
+			}
+		}
+	}
+
+	var unlimited *quota
+	if err := unlimited.admit(make([]byte, 1<<20), time.Now()); err != nil {
+		t.Errorf("no quota: expected no error, got %v", err)
+	}
+}
+
+type quotaStep struct {
+	size     int
+	after    time.Duration
+	expected error
+}
+
+func TestTermOverflow(t *testing.T) {
+	s := NewServer(1, &bytes.Buffer{}, noop, Config{})
+	s.term = math.MaxUint64
+
+	// a follower at the last term can't campaign
+	s.campaign()
+	if expected, got := Follower, s.State(); expected != got {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+	if expected, got := uint64(math.MaxUint64), s.term; expected != got {
+		t.Errorf("expected term %d, got %d", expected, got)
+	}
+
+	// nor can a stable store be made to go back
+	s.stable, s.saved = &memoryStableStore{}, StableState{Term: 5}
+	s.term = 4
+	if expected, got := ErrTermRegression, s.saveStable(); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+type memoryStableStore struct{ state StableState }
+
+func (m *memoryStableStore) LoadState() (StableState, error) { return m.state, nil }
+func (m *memoryStableStore) StoreState(s StableState) error  { m.state = s; return nil }
+
+func TestForce(t *testing.T) {
+	hung := make(chan struct{})
+	defer close(hung)
+	s := NewServer(1, &bytes.Buffer{}, noop, Config{MinElectionTimeout: time.Hour, HeartbeatInterval: time.Millisecond})
+	s.SetPeers(MakePeers(NewLocalPeer(s), &hungPeer{id: 2, release: hung}, &hungPeer{id: 3, release: hung}))
+	s.Start()
+	defer s.Stop()
+
+	force := func(state string, term uint64) error {
+		err := make(chan error)
+		s.forceChan <- forceTuple{state, term, err}
+		return <-err
+	}
+	awaitStatus := func(state string, term uint64) {
+		for i := 0; i < 100; i++ {
+			if status := s.Status(); status.State == state && status.Term == term {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("never became %s in term %d, got %+v", state, term, s.Status())
+	}
+
+	// a leader without an election
+	if err := force(Leader, 3); err != nil {
+		t.Fatal(err)
+	}
+	awaitStatus(Leader, 3)
+	if expected, got := uint64(1), s.Status().Leader; expected != got {
+		t.Errorf("expected leader %d, got %d", expected, got)
+	}
+
+	// and back to a follower, in a later term
+	if err := force(Follower, 4); err != nil {
+		t.Fatal(err)
+	}
+	awaitStatus(Follower, 4)
+
+	// but never an earlier term, or an unknown state
+	if expected, got := ErrTermRegression, force(Candidate, 2); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if err := force("Emperor", 5); err == nil {
+		t.Error("expected an error forcing an unknown state")
+	}
+	awaitStatus(Follower, 4)
+}
+
+func TestMembershipRecovery(t *testing.T) {
+	hung := make(chan struct{})
+	defer close(hung)
+	store := &bytes.Buffer{}
+	s := NewServer(1, store, noop, Config{})
+	peer2, peer3, peer4 := &hungPeer{id: 2, release: hung}, &hungPeer{id: 3, release: hung}, &hungPeer{id: 4, release: hung}
+	s.SetPeers(MakePeers(NewLocalPeer(s), peer2, peer3))
+	s.SetLearners(MakePeers(peer4))
+
+	// each change records the membership after it
+	for _, c := range []configurationChange{{Promote: 4}, {Remove: 2}} {
+		if err := s.appendConfigurationChange(c); err != nil {
+			t.Fatal(err)
+		}
+		entries, _, _ := s.log.entriesAfter(s.log.lastIndex() - 1)
+		if err := s.applyConfiguration(entries[0].Command); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.log.commitTo(s.log.lastIndex()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted server restores it, over the stale peers it's given
+	r := NewServer(1, bytes.NewBuffer(store.Bytes()), noop, Config{})
+	r.SetPeers(MakePeers(NewLocalPeer(r), peer2, peer3))
+	r.SetLearners(MakePeers(peer4))
+	r.recoverMembership()
+	if expected, got := "[1 3 4] []", fmt.Sprint(r.Status().Peers, " ", r.Status().Learners); expected != got {
+		t.Errorf("expected members %s, got %s", expected, got)
+	}
+	if r.peers[3] != peer3 || r.peers[4] != peer4 {
+		t.Error("expected the peers passed to SetPeers and SetLearners to be reused")
+	}
+
+	// members it has no peer for are dialed
+	r = NewServer(1, bytes.NewBuffer(store.Bytes()), noop, Config{})
+	dialed := []uint64{}
+	r.SetDialer(func(id uint64, addr string) (Peer, error) {
+		dialed = append(dialed, id)
+		return &hungPeer{id: id, release: hung}, nil
+	})
+	r.recoverMembership()
+	if expected, got := "[3 4]", fmt.Sprint(dialed); expected != got {
+		t.Errorf("expected to dial %s, got %s", expected, got)
+	}
+}
+
+func TestExpiredRPC(t *testing.T) {
+	s := NewServer(1, &bytes.Buffer{}, noop, Config{RPCTimeout: 20 * time.Millisecond})
+
+	// with the main loop stalled (here, not yet started), an RPC is queued,
+	// and fails once its time is up
+	begin := time.Now()
+	_, err := s.RequestVoteContext(context.Background(), RequestVote{Term: 5, CandidateId: 2})
+	if expected, got := context.DeadlineExceeded, err; expected != got {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("took %s to fail", elapsed)
+	}
+
+	// and once the loop is running, it's dropped, rather than handled
+	s.Start()
+	defer s.Stop()
+	resp, err := s.RequestVoteContext(context.Background(), RequestVote{Term: 1, CandidateId: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(1), resp.Term; expected != got {
+		t.Errorf("expected term %d, got %d", expected, got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := ExponentialBackoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	for i, expected := range []time.Duration{10, 20, 40, 50, 50} {
+		if got := b.Delay(i+1, ErrorNetwork); expected*time.Millisecond != got {
+			t.Errorf("retry %d: expected %s, got %s", i+1, expected*time.Millisecond, got)
+		}
+	}
+
+	// jitter keeps delays within the fraction either way
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := b.Delay(2, ErrorTimeout); d < 10*time.Millisecond || d > 30*time.Millisecond {
+			t.Fatalf("with jitter, expected 10ms..30ms, got %s", d)
+		}
+	}
+
+	// the leader stops flushing to a follower it can't reach, for no longer
+	// than half the election timeout, and resumes once it answers
+	s := NewServer(1, &bytes.Buffer{}, noop, Config{MinElectionTimeout: 60 * time.Millisecond})
+	s.SetBackoff(ExponentialBackoff{Min: 20 * time.Millisecond, Max: time.Minute})
+	r := s.newRetrier()
+	now := time.Now()
+	r.observe(2, context.DeadlineExceeded, now)
+	if r.due(2, now.Add(10*time.Millisecond)) {
+		t.Errorf("after a failure, expected peer 2 not to be due")
+	}
+	if !r.due(3, now) {
+		t.Errorf("expected peer 3 to be due")
+	}
+	for i := 0; i < 10; i++ {
+		r.observe(2, ErrTimeout, now)
+	}
+	if !r.due(2, now.Add(30*time.Millisecond)) {
+		t.Errorf("after many failures, expected peer 2 to be due after half the election timeout")
+	}
+	r.observe(2, ErrAppendEntriesRejected, now)
+	if !r.due(2, now) {
+		t.Errorf("after it answered, expected peer 2 to be due")
+	}
+}
+
+func TestSnapshotRate(t *testing.T) {
+	s := NewServer(1, &bytes.Buffer{}, noop, Config{})
+	s.SetSnapshotRate(100 << 10)
+
+	// two snapshots sent at once share the rate
+	began := time.Now()
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			r := s.snapshotRate.throttle(context.Background(), bytes.NewReader(make([]byte, 20<<10)))
+			_, err := io.CopyBuffer(ioutil.Discard, r, make([]byte, 10<<10))
+			done <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(began); elapsed < 250*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("expected 40KB at 100KB/s to take about 300ms, took %s", elapsed)
+	}
+
+	// seekable data stays seekable, and a done context stops the reader
+	ctx, cancel := context.WithCancel(context.Background())
+	r := s.snapshotRate.throttle(ctx, bytes.NewReader(make([]byte, 200<<10)))
+	if _, ok := r.(io.Seeker); !ok {
+		t.Errorf("expected a throttled bytes.Reader to be an io.Seeker")
+	}
+	cancel()
+	if _, err := io.Copy(ioutil.Discard, r); err != context.Canceled {
+		t.Errorf("with the context canceled, expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestCommandQueueFull(t *testing.T) {
+	s := NewServer(1, &bytes.Buffer{}, noop, Config{CommandQueueSize: 2})
+	sink := &gaugeSink{gauges: map[string]float64{}}
+	s.SetMetricsSink(sink)
+
+	// with nothing draining the queue, two commands wait in it until they
+	// time out, and a third is refused at once
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := s.CommandContext(ctx, []byte("cmd"), nil)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("command %d: expected %v, got %v", i, context.DeadlineExceeded, err)
+		}
+	}
+	if err := s.CommandContext(context.Background(), []byte("cmd"), nil); err != ErrTooBusy {
+		t.Fatalf("expected %v, got %v", ErrTooBusy, err)
+	}
+
+	// and the queue's depth is published with the status
+	s.publishStatus()
+	if depth := sink.gauge(MetricCommandQueueDepth); depth != 2 {
+		t.Errorf("expected a queue depth of 2, got %v", depth)
+	}
+}
+
+// gaugeSink is a MetricsSink that records the latest value of each unlabeled
+// gauge, and ignores everything else.
+type gaugeSink struct {
+	sync.Mutex
+	gauges map[string]float64
+}
+
+func (s *gaugeSink) IncrCounter(string, float64, ...Label) {}
+func (s *gaugeSink) AddSample(string, float64, ...Label)   {}
+
+func (s *gaugeSink) SetGauge(name string, value float64, labels ...Label) {
+	if len(labels) > 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.gauges[name] = value
+}
+
+func (s *gaugeSink) gauge(name string) float64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.gauges[name]
+}
@@ -3,6 +3,8 @@ package raft_test
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/peterbourgon/raft"
@@ -10,6 +12,8 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -24,11 +28,10 @@ func init() {
 func TestFollowerToCandidate(t *testing.T) {
 	log.SetOutput(&bytes.Buffer{})
 	defer log.SetOutput(os.Stdout)
-	oldMin, oldMax := raft.ResetElectionTimeoutMs(25, 50)
-	defer raft.ResetElectionTimeoutMs(oldMin, oldMax)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
 
 	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
-	server := raft.NewServer(1, &bytes.Buffer{}, noop)
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
 	server.SetPeers(raft.MakePeers(nonresponsivePeer(2), nonresponsivePeer(3)))
 	if server.State() != raft.Follower {
 		t.Fatalf("didn't start as Follower")
@@ -37,10 +40,10 @@ func TestFollowerToCandidate(t *testing.T) {
 	server.Start()
 	defer func() { server.Stop(); t.Logf("server stopped") }()
 
-	time.Sleep(raft.MaximumElectionTimeout())
+	time.Sleep(config.MaxElectionTimeout)
 
-	cutoff := time.Now().Add(2 * raft.MinimumElectionTimeout())
-	backoff := raft.BroadcastInterval()
+	cutoff := time.Now().Add(2 * config.MinElectionTimeout)
+	backoff := config.HeartbeatInterval
 	for {
 		if time.Now().After(cutoff) {
 			t.Fatal("failed to become Candidate")
@@ -58,19 +61,18 @@ func TestFollowerToCandidate(t *testing.T) {
 func TestCandidateToLeader(t *testing.T) {
 	log.SetOutput(&bytes.Buffer{})
 	defer log.SetOutput(os.Stdout)
-	oldMin, oldMax := raft.ResetElectionTimeoutMs(25, 50)
-	defer raft.ResetElectionTimeoutMs(oldMin, oldMax)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
 
 	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
-	server := raft.NewServer(1, &bytes.Buffer{}, noop)
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
 	server.SetPeers(raft.MakePeers(nonresponsivePeer(1), approvingPeer(2), nonresponsivePeer(3)))
 	server.Start()
 	defer func() { server.Stop(); t.Logf("server stopped") }()
 
-	time.Sleep(raft.MaximumElectionTimeout())
+	time.Sleep(config.MaxElectionTimeout)
 
-	cutoff := time.Now().Add(2 * raft.MaximumElectionTimeout())
-	backoff := raft.BroadcastInterval()
+	cutoff := time.Now().Add(2 * config.MaxElectionTimeout)
+	backoff := config.HeartbeatInterval
 	for {
 		if time.Now().After(cutoff) {
 			t.Fatal("failed to become Leader")
@@ -88,116 +90,1708 @@ func TestCandidateToLeader(t *testing.T) {
 func TestFailedElection(t *testing.T) {
 	log.SetOutput(&bytes.Buffer{})
 	defer log.SetOutput(os.Stdout)
-	oldMin, oldMax := raft.ResetElectionTimeoutMs(25, 50)
-	defer raft.ResetElectionTimeoutMs(oldMin, oldMax)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
 
 	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
-	server := raft.NewServer(1, &bytes.Buffer{}, noop)
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
 	server.SetPeers(raft.MakePeers(disapprovingPeer(2), nonresponsivePeer(3)))
 	server.Start()
 	defer func() { server.Stop(); t.Logf("server stopped") }()
 
-	time.Sleep(2 * raft.ElectionTimeout())
+	time.Sleep(2 * config.MaxElectionTimeout)
 	if server.State() == raft.Leader {
 		t.Fatalf("erroneously became Leader")
 	}
 	t.Logf("remained %s", server.State())
 }
 
+func TestEarlyElectionDefeat(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), disapprovingPeer(2), disapprovingPeer(3)))
+	server.Start()
+	defer server.Stop()
+
+	time.Sleep(2 * config.MaxElectionTimeout)
+	counts := server.ElectionCounts()
+	if counts.Lost <= 0 {
+		t.Errorf("expected lost elections, got %+v", counts)
+	}
+	if counts.Won > 0 || counts.Abandoned > 0 {
+		t.Errorf("expected only lost elections, got %+v", counts)
+	}
+}
+
 func TestSimpleConsensus(t *testing.T) {
+
 	logBuffer := &bytes.Buffer{}
 	log.SetOutput(logBuffer)
 	defer log.SetOutput(os.Stdout)
-	defer printOnFailure(t, logBuffer)
-	oldMin, oldMax := raft.ResetElectionTimeoutMs(25, 50)
-	defer raft.ResetElectionTimeoutMs(oldMin, oldMax)
+	defer printOnFailure(t, logBuffer)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	type SetValue struct {
+		Value int32 `json:"value"`
+	}
+
+	var i1, i2, i3 int32
+
+	applyValue := func(id uint64, i *int32) func([]byte) ([]byte, error) {
+		return func(cmd []byte) ([]byte, error) {
+			var sv SetValue
+			if err := json.Unmarshal(cmd, &sv); err != nil {
+				return []byte{}, err
+			}
+			atomic.StoreInt32(i, sv.Value)
+			return json.Marshal(map[string]interface{}{"applied_to_server": id, "applied_value": sv.Value})
+		}
+	}
+
+	s1 := raft.NewServer(1, &bytes.Buffer{}, applyValue(1, &i1), config)
+	s2 := raft.NewServer(2, &bytes.Buffer{}, applyValue(2, &i2), config)
+	s3 := raft.NewServer(3, &bytes.Buffer{}, applyValue(3, &i3), config)
+
+	s1Responses := &synchronizedBuffer{}
+	s2Responses := &synchronizedBuffer{}
+	s3Responses := &synchronizedBuffer{}
+	defer func(sb *synchronizedBuffer) { t.Logf("s1 responses: %s", sb.String()) }(s1Responses)
+	defer func(sb *synchronizedBuffer) { t.Logf("s2 responses: %s", sb.String()) }(s2Responses)
+	defer func(sb *synchronizedBuffer) { t.Logf("s3 responses: %s", sb.String()) }(s3Responses)
+
+	peers := raft.MakePeers(
+		raft.NewLocalPeer(s1),
+		raft.NewLocalPeer(s2),
+		raft.NewLocalPeer(s3),
+	)
+
+	s1.SetPeers(peers)
+	s2.SetPeers(peers)
+	s3.SetPeers(peers)
+
+	s1.Start()
+	s2.Start()
+	s3.Start()
+	defer s1.Stop()
+	defer s2.Stop()
+	defer s3.Stop()
+
+	var v int32 = 42
+	cmd, _ := json.Marshal(SetValue{v})
+
+	response := make(chan []byte, 1)
+	func() {
+		for {
+			switch err := s1.Command(cmd, response); err {
+			case nil:
+				return
+			case raft.ErrUnknownLeader:
+				time.Sleep(config.MinElectionTimeout)
+			default:
+				t.Fatal(err)
+			}
+		}
+	}()
+
+	r, ok := <-response
+	if ok {
+		s1Responses.Write(r)
+	} else {
+		t.Logf("didn't receive command response")
+	}
+
+	ticker := time.Tick(config.HeartbeatInterval)
+	timeout := time.After(1 * time.Second)
+	for {
+		select {
+		case <-ticker:
+			i1l := atomic.LoadInt32(&i1)
+			i2l := atomic.LoadInt32(&i2)
+			i3l := atomic.LoadInt32(&i3)
+			t.Logf("i1=%02d i2=%02d i3=%02d", i1l, i2l, i3l)
+			if i1l == v && i2l == v && i3l == v {
+				t.Logf("success!")
+				return
+			}
+
+		case <-timeout:
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestEntryHooks(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	applied := &synchronizedBuffer{}
+	apply := func(cmd []byte) ([]byte, error) { applied.Write(cmd); return cmd, nil }
+	encode := func(e raft.LogEntry) ([]byte, error) { return []byte(hex.EncodeToString(e.Command)), nil }
+	decode := func(e raft.LogEntry) ([]byte, error) { return hex.DecodeString(string(e.Command)) }
+
+	storage := &synchronizedBuffer{}
+	server := raft.NewServer(1, storage, apply, config)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+	server.SetEntryHooks(encode, decode)
+	server.Start()
+	defer server.Stop()
+
+	cmd := []byte(`{"secret":true}`)
+	response := make(chan []byte, 1)
+	for {
+		err := server.Command(cmd, response)
+		if err == nil {
+			break
+		}
+		if err != raft.ErrUnknownLeader {
+			t.Fatal(err)
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+	select {
+	case <-response:
+	case <-time.After(config.MaxElectionTimeout):
+		t.Fatal("timeout waiting for response")
+	}
+
+	if expected, got := string(cmd), applied.String(); expected != got {
+		t.Errorf("applied: expected %q, got %q", expected, got)
+	}
+	if strings.Contains(storage.String(), string(cmd)) {
+		t.Errorf("storage contains plaintext command: %q", storage.String())
+	}
+	if !strings.Contains(storage.String(), hex.EncodeToString(cmd)) {
+		t.Errorf("storage doesn't contain encoded command: %q", storage.String())
+	}
+}
+
+func TestQuorumLossAndRestoration(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	peer := &switchablePeer{id: 2}
+	peer.Set(true)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), peer, nonresponsivePeer(3)))
+	events := make(chan raft.Event, 100)
+	server.SetEventHandler(func(e raft.Event) { events <- e })
+	server.Start()
+	defer server.Stop()
+
+	awaitEvent := func(typ string) {
+		timeout := time.After(4 * config.MaxElectionTimeout)
+		for {
+			select {
+			case e := <-events:
+				if e.Type == typ {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timeout waiting for %s", typ)
+			}
+		}
+	}
+
+	cutoff := time.Now().Add(4 * config.MaxElectionTimeout)
+	for server.State() != raft.Leader {
+		if time.Now().After(cutoff) {
+			t.Fatal("failed to become Leader")
+		}
+		time.Sleep(config.HeartbeatInterval)
+	}
+
+	peer.Set(false)
+	awaitEvent(raft.QuorumLost)
+	if expected, got := raft.ErrNoQuorum, server.Command([]byte(`{}`), make(chan []byte, 1)); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	peer.Set(true)
+	awaitEvent(raft.QuorumRestored)
+}
+
+func TestCommitWithFollowerDown(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	applied := make(chan []byte, 1)
+	apply := func(cmd []byte) ([]byte, error) { applied <- cmd; return cmd, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, apply, config)
+	peer := &switchablePeer{id: 2}
+	peer.Set(true)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), peer, nonresponsivePeer(3)))
+	server.Start()
+	defer server.Stop()
+
+	response := make(chan []byte, 1)
+	for {
+		err := server.Command([]byte(`{}`), response)
+		if err == nil {
+			break
+		}
+		if err != raft.ErrUnknownLeader {
+			t.Fatal(err)
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+
+	// 2 of 3 servers have the entry, so it should commit
+	select {
+	case <-applied:
+	case <-time.After(2 * config.MaxElectionTimeout):
+		t.Fatal("command never committed")
+	}
+}
+
+func TestCommitAfterQuorumRestored(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	applied := make(chan []byte, 1)
+	apply := func(cmd []byte) ([]byte, error) { applied <- cmd; return cmd, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, apply, config)
+	peer := &switchablePeer{id: 2}
+	peer.Set(true)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), peer, nonresponsivePeer(3)))
+	server.Start()
+	defer server.Stop()
+	select {
+	case <-server.LeaderCh():
+	case <-time.After(4 * config.MaxElectionTimeout):
+		t.Fatal("never became leader")
+	}
+
+	// a command accepted just as the quorum's lost can't commit
+	peer.Set(false)
+	if err := server.Command([]byte("cmd"), make(chan []byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-applied:
+		t.Fatal("command committed without a quorum")
+	case <-time.After(2 * config.MaxElectionTimeout):
+	}
+
+	// but it commits on the heartbeats that find the quorum again, without
+	// waiting for another command
+	peer.Set(true)
+	select {
+	case <-applied:
+	case <-time.After(4 * config.MaxElectionTimeout):
+		t.Fatal("command never committed after the quorum returned")
+	}
+}
+
+func TestCheckQuorum(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond, CheckQuorum: true}
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	peer := &switchablePeer{id: 2}
+	peer.Set(true)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), peer, nonresponsivePeer(3)))
+	server.Start()
+	defer server.Stop()
+	select {
+	case <-server.LeaderCh():
+	case <-time.After(4 * config.MaxElectionTimeout):
+		t.Fatal("never became leader")
+	}
+
+	// a leader that loses its quorum steps down, and refuses commands
+	peer.Set(false)
+	deadline := time.Now().Add(10 * config.MaxElectionTimeout)
+	for server.State() == raft.Leader {
+		if time.Now().After(deadline) {
+			t.Fatal("leader never stepped down")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := server.Command([]byte("cmd"), nil); err != raft.ErrNoQuorum {
+		t.Errorf("expected %v, got %v", raft.ErrNoQuorum, err)
+	}
+
+	// and is elected again once the quorum returns
+	peer.Set(true)
+	deadline = time.Now().Add(10 * config.MaxElectionTimeout)
+	for server.State() != raft.Leader {
+		if time.Now().After(deadline) {
+			t.Fatal("never became leader again")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMaxAppendBytes(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 250 * time.Millisecond, MaxElectionTimeout: 500 * time.Millisecond, HeartbeatInterval: 25 * time.Millisecond, MaxAppendBytes: 200}
+
+	// server 3 starts far behind the others
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	var applied int32
+	count := func([]byte) ([]byte, error) { atomic.AddInt32(&applied, 1); return []byte{}, nil }
+	servers := []*raft.Server{
+		raft.NewServer(1, &bytes.Buffer{}, noop, config),
+		raft.NewServer(2, &bytes.Buffer{}, noop, config),
+		raft.NewServer(3, &bytes.Buffer{}, count, config),
+	}
+	third := &batchingPeer{Peer: raft.NewLocalPeer(servers[2])}
+	peers := raft.MakePeers(raft.NewLocalPeer(servers[0]), raft.NewLocalPeer(servers[1]), third)
+	for _, server := range servers {
+		server.SetPeers(peers)
+		defer server.Stop()
+	}
+	servers[0].Start()
+	servers[1].Start()
+	cmd := bytes.Repeat([]byte("x"), 64)
+	for n := 0; n < 40; {
+		for _, server := range servers[:2] {
+			response := make(chan []byte, 1)
+			if server.Command(cmd, response) == nil {
+				if _, ok := <-response; ok {
+					n++
+				}
+			}
+		}
+	}
+
+	// it's caught up in batches of at most 200 bytes, each sent as soon as
+	// the one before is accepted, not a heartbeat later
+	servers[2].Start()
+	third.up()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&applied) < 40 {
+		if time.Now().After(deadline) {
+			t.Fatalf("server 3 applied %d of 40", atomic.LoadInt32(&applied))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	batches, took := third.stats()
+	if len(batches) < 20 {
+		t.Errorf("expected at least 20 batches, got %v", batches)
+	}
+	for _, n := range batches {
+		if n > 200 {
+			t.Fatalf("expected batches of at most 200 bytes, got %v", batches)
+		}
+	}
+	if heartbeats := 10 * config.HeartbeatInterval; took > heartbeats {
+		t.Errorf("expected to catch up within %s, took %s", heartbeats, took)
+	}
+}
+
+// batchingPeer records the bytes of the commands in each AppendEntries that
+// carries any, once it's up; until then, it doesn't respond.
+type batchingPeer struct {
+	raft.Peer
+	sync.Mutex
+	isUp    bool
+	batches []int
+	first   time.Time
+	last    time.Time
+}
+
+func (p *batchingPeer) up() {
+	p.Lock()
+	defer p.Unlock()
+	p.isUp = true
+}
+
+func (p *batchingPeer) stats() ([]int, time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	return append([]int{}, p.batches...), p.last.Sub(p.first)
+}
+
+func (p *batchingPeer) AppendEntries(ae raft.AppendEntries) raft.AppendEntriesResponse {
+	p.Lock()
+	if !p.isUp {
+		p.Unlock()
+		return raft.AppendEntriesResponse{}
+	}
+	if len(ae.Entries) > 0 {
+		if p.first.IsZero() {
+			p.first = time.Now()
+		}
+		p.last = time.Now()
+		n := 0
+		for _, entry := range ae.Entries {
+			n += len(entry.Command)
+		}
+		p.batches = append(p.batches, n)
+	}
+	p.Unlock()
+	return p.Peer.AppendEntries(ae)
+}
+
+func (p *batchingPeer) RequestVote(rv raft.RequestVote) raft.RequestVoteResponse {
+	p.Lock()
+	up := p.isUp
+	p.Unlock()
+	if !up {
+		return raft.RequestVoteResponse{}
+	}
+	return p.Peer.RequestVote(rv)
+}
+
+func TestQuery(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	// apply and query are both called from the server's main loop
+	state := []byte{}
+	apply := func(cmd []byte) ([]byte, error) { state = cmd; return cmd, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, apply, config)
+	server.SetQueryFunc(func([]byte) ([]byte, error) { return state, nil })
+	peer := &switchablePeer{id: 2}
+	peer.Set(true)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), peer, nonresponsivePeer(3)))
+	server.Start()
+	defer server.Stop()
+
+	response := make(chan []byte, 1)
+	for {
+		err := server.Command([]byte(`{"x":1}`), response)
+		if err == nil {
+			break
+		}
+		if err != raft.ErrUnknownLeader {
+			t.Fatal(err)
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+	<-response
+
+	for _, c := range []raft.Consistency{raft.Linearizable, raft.Lease, raft.Stale} {
+		resp, err := server.Query(c, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		if expected, got := `{"x":1}`, string(resp); expected != got {
+			t.Errorf("%s: expected %s, got %s", c, expected, got)
+		}
+	}
+
+	// without a quorum, only stale queries can be answered
+	peer.Set(false)
+	cutoff := time.Now().Add(10 * config.MaxElectionTimeout)
+	for {
+		_, err := server.Query(raft.Linearizable, nil)
+		if err == raft.ErrNoQuorum {
+			break
+		}
+		if time.Now().After(cutoff) {
+			t.Fatalf("expected %s, got %v", raft.ErrNoQuorum, err)
+		}
+		time.Sleep(config.HeartbeatInterval)
+	}
+	if _, err := server.Query(raft.Stale, nil); err != nil {
+		t.Errorf("stale: %s", err)
+	}
+}
+
+func TestRemovePeer(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	peer := &switchablePeer{id: 2}
+	peer.Set(true)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), peer, nonresponsivePeer(3)))
+	server.Start()
+	defer server.Stop()
+
+	// wait until we're the leader, and have heard from peer 2
+	response := make(chan []byte, 1)
+	for {
+		err := server.Command([]byte(`{}`), response)
+		if err == nil {
+			break
+		}
+		if err != raft.ErrUnknownLeader {
+			t.Fatal(err)
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+	<-response
+
+	for _, c := range []struct {
+		id       uint64
+		force    bool
+		expected error
+	}{
+		{1, false, raft.ErrRemoveLeader},
+		{9, false, raft.ErrUnknownPeer},
+		{2, false, raft.ErrUnsafeChange}, // only 1 of 2 remaining voters is reachable
+		{2, true, nil},
+	} {
+		if got := server.RemovePeer(c.id, c.force); c.expected != got {
+			t.Errorf("RemovePeer(%d, %v): expected %v, got %v", c.id, c.force, c.expected, got)
+		}
+	}
+
+	// a retried change is made only once
+	// (the status is published before each request is handled, so it's only
+	// sure to show the first one's entry once the next has been handled)
+	for i := 0; i < 2; i++ {
+		if err := server.RemovePeerOnce("remove-3", 3, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lastIndex := server.Status().LastIndex
+	if err := server.RemovePeerOnce("remove-3", 3, true); err != nil {
+		t.Errorf("retry: expected no error, got %v", err)
+	}
+	if got := server.Status().LastIndex; got != lastIndex {
+		t.Errorf("retry: expected last index to stay %d, got %d", lastIndex, got)
+	}
+	if expected, got := raft.ErrChangeConflict, server.RemovePeerOnce("remove-3", 2, true); expected != got {
+		t.Errorf("reused id: expected %v, got %v", expected, got)
+	}
+}
+
+func TestMembershipChangeInProgress(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond, MembershipChangeInterval: 100 * time.Millisecond}
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	peers := raft.MakePeers(raft.NewLocalPeer(server))
+	for id := uint64(2); id <= 5; id++ {
+		peer := &switchablePeer{id: id}
+		peer.Set(true)
+		peers[id] = peer
+	}
+	server.SetPeers(peers)
+	server.Start()
+	defer server.Stop()
+	select {
+	case <-server.LeaderCh():
+	case <-time.After(10 * config.MaxElectionTimeout):
+		t.Fatal("never became leader")
+	}
+	response := make(chan []byte, 1)
+	if err := server.Command([]byte(`{}`), response); err != nil {
+		t.Fatal(err)
+	}
+	<-response // so we've heard from the peers
+
+	if err := server.RemovePeer(5, false); err != nil {
+		t.Fatal(err)
+	}
+	removed := time.Now()
+
+	// the next change waits for the last to be applied, and the interval
+	if expected, got := raft.ErrConfigChangeInProgress, server.RemovePeer(4, false); expected != got {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for {
+		err := server.RemovePeer(4, false)
+		if err == nil {
+			break
+		}
+		if err != raft.ErrConfigChangeInProgress {
+			t.Fatal(err)
+		}
+		time.Sleep(config.HeartbeatInterval)
+	}
+	if elapsed := time.Since(removed); elapsed < config.MembershipChangeInterval {
+		t.Errorf("expected the next change to wait %s, but it was accepted after %s", config.MembershipChangeInterval, elapsed)
+	}
+
+	// unless it's forced
+	if err := server.RemovePeer(3, true); err != nil {
+		t.Errorf("forced: expected no error, got %v", err)
+	}
+}
+
+func TestLeader(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(2, &bytes.Buffer{}, noop, raft.Config{})
+	leader := &addressablePeer{id: 1, addr: "leader:1"}
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), leader, nonresponsivePeer(3)))
+	if id, addr := server.Leader(); id != 0 || addr != "" {
+		t.Errorf("before start, expected no leader, got %d (%q)", id, addr)
+	}
+	server.Start()
+	defer server.Stop()
+
+	server.AppendEntries(raft.AppendEntries{Term: 2, LeaderId: 1})
+	if id, addr := server.Leader(); id != 1 || addr != "leader:1" {
+		t.Errorf("expected leader 1 (%q), got %d (%q)", "leader:1", id, addr)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(2, &bytes.Buffer{}, noop, raft.Config{})
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), nonresponsivePeer(1), nonresponsivePeer(3)))
+	server.SetLearners(raft.MakePeers(nonresponsivePeer(4)))
+	server.Start()
+	defer server.Stop()
+
+	server.AppendEntries(raft.AppendEntries{
+		Term:     5,
+		LeaderId: 1,
+		Entries: []raft.LogEntry{
+			{Index: 1, Term: 4, Command: []byte(`{}`)},
+			{Index: 2, Term: 5, Command: []byte(`{}`)},
+		},
+		CommitIndex: 1,
+	})
+
+	// the snapshot is published once the server has finished with the RPC
+	var status raft.Status
+	for i := 0; i < 100; i++ {
+		if status = server.Status(); status.Term == 5 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if status.Id != 2 || status.State != raft.Follower || status.Term != 5 || status.Leader != 1 {
+		t.Errorf("expected follower 2 of leader 1 in term 5, got %+v", status)
+	}
+	if status.CommitIndex != 1 || status.LastIndex != 2 || status.LastTerm != 5 {
+		t.Errorf("expected commit index 1, last index 2 in term 5, got %+v", status)
+	}
+	if expected, got := "[1 2 3] [4]", fmt.Sprint(status.Peers, " ", status.Learners); expected != got {
+		t.Errorf("expected members %s, got %s", expected, got)
+	}
+	if status.LastContact.IsZero() {
+		t.Errorf("expected the follower to have heard from the leader")
+	}
+
+	// stats are the same, flattened
+	stats := server.Stats()
+	for key, expected := range map[string]string{
+		"state":          raft.Follower,
+		"term":           "5",
+		"leader":         "1",
+		"commit_index":   "1",
+		"applied_index":  "1",
+		"last_log_index": "2",
+		"snapshot_index": "0",
+		"num_peers":      "3",
+		"num_learners":   "1",
+	} {
+		if got := stats[key]; expected != got {
+			t.Errorf("stats: %s: expected %q, got %q", key, expected, got)
+		}
+	}
+	if got := stats["last_contact"]; got == "" || got == "never" {
+		t.Errorf("stats: expected a last contact, got %q", got)
+	}
+}
+
+func TestSoftState(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	servers := []*raft.Server{}
+	peers := raft.Peers{}
+	for id := uint64(1); id <= 3; id++ {
+		server := raft.NewServer(id, &bytes.Buffer{}, noop, config)
+		server.SetHealth("disk", id != 3)
+		servers = append(servers, server)
+		peers[id] = raft.NewLocalPeer(server)
+	}
+	for _, server := range servers {
+		server.SetPeers(peers)
+		server.Start()
+		defer server.Stop()
+	}
+
+	// the leader sees every server's applied index, and health
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var leader *raft.Server
+		for _, server := range servers {
+			if server.Status().State == raft.Leader {
+				leader = server
+			}
+		}
+		if leader != nil {
+			st := leader.Status()
+			if len(st.Cluster) == 3 && st.AppliedSpread == 0 && st.Cluster[1].Applied > 0 {
+				if !st.Cluster[1].Health["disk"] || st.Cluster[3].Health["disk"] {
+					t.Errorf("expected server 3 alone to have an unhealthy disk, got %+v", st.Cluster)
+				}
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("leader never saw the whole cluster converge")
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+
+	// followers don't know
+	for _, server := range servers {
+		if st := server.Status(); st.State != raft.Leader && st.Cluster != nil {
+			t.Errorf("follower %d: expected no cluster state, got %+v", st.Id, st.Cluster)
+		}
+	}
+}
+
+func TestReplicationStatus(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	up, down := &switchablePeer{id: 2}, &switchablePeer{id: 3}
+	up.Set(true)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), up, down))
+	if progress := server.ReplicationStatus(); progress != nil {
+		t.Errorf("before starting, expected no progress, got %+v", progress)
+	}
+	server.Start()
+	defer server.Stop()
+	select {
+	case <-server.LeaderCh():
+	case <-time.After(10 * config.MaxElectionTimeout):
+		t.Fatal("never became leader")
+	}
+	response := make(chan []byte, 1)
+	if err := server.Command([]byte("cmd"), response); err != nil {
+		t.Fatal(err)
+	}
+	<-response
+
+	// the follower that's up has every entry, the one that's down none
+	lastIndex := server.Status().LastIndex
+	var progress map[uint64]raft.PeerProgress
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if progress = server.ReplicationStatus(); progress[2].MatchIndex >= lastIndex {
+			break
+		}
+	}
+	if len(progress) != 2 {
+		t.Fatalf("expected the progress of 2 followers, got %+v", progress)
+	}
+	if p := progress[2]; p.MatchIndex != lastIndex || p.NextIndex != lastIndex+1 || p.LastContact.IsZero() || p.Snapshotting {
+		t.Errorf("follower 2: expected to have index %d, got %+v", lastIndex, p)
+	}
+	if p := progress[3]; p.MatchIndex != 0 || !p.LastContact.IsZero() || p.Snapshotting {
+		t.Errorf("follower 3: expected to have nothing, got %+v", p)
+	}
+}
+
+func TestWatchReplication(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	up, down := &switchablePeer{id: 2}, &switchablePeer{id: 3}
+	up.Set(true)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), up, down))
+
+	// watches can be registered before the entries exist
+	replicated, _ := server.WatchReplication(2, 4)
+	never, cancel := server.WatchReplication(3, 1)
+	defer cancel()
+
+	server.Start()
+	defer server.Stop()
+	select {
+	case <-server.LeaderCh():
+	case <-time.After(10 * config.MaxElectionTimeout):
+		t.Fatal("never became leader")
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := server.Apply(context.Background(), []byte("cmd")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case e := <-replicated:
+		if e.Type != raft.Replicated || e.Index < 4 || string(e.Data) != "2" {
+			t.Errorf("expected follower 2 to have replicated index 4, got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("follower 2 never replicated index 4")
+	}
+	select {
+	case e := <-never:
+		t.Errorf("follower 3 is down, but got %+v", e)
+	default:
+	}
+
+	// and after
+	replicated, _ = server.WatchReplication(2, 1)
+	select {
+	case <-replicated:
+	case <-time.After(time.Second):
+		t.Fatal("follower 2 never replicated index 1")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+
+	// zero fields take their defaults
+	config := raft.NewServer(1, &bytes.Buffer{}, noop, raft.Config{}).Config()
+	if expected, got := (raft.Config{
+		MinElectionTimeout:       250 * time.Millisecond,
+		MaxElectionTimeout:       500 * time.Millisecond,
+		MaxElectionBackoff:       2 * time.Second,
+		HeartbeatInterval:        25 * time.Millisecond,
+		CommandTimeout:           500 * time.Millisecond,
+		RPCQueueSize:             16,
+		CommandQueueSize:         256,
+		RPCTimeout:               250 * time.Millisecond,
+		SnapshotThresholdEntries: 8192,
+		SnapshotTrailingEntries:  1024,
+		ProtocolVersion:          raft.ProtocolVersion,
+	}), config; expected != got {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+
+	// servers in the same process are tuned independently
+	config = raft.NewServer(2, &bytes.Buffer{}, noop, raft.Config{MinElectionTimeout: time.Second, MaxAppendEntries: 64}).Config()
+	if expected, got := (raft.Config{
+		MinElectionTimeout:       time.Second,
+		MaxElectionTimeout:       2 * time.Second,
+		MaxElectionBackoff:       8 * time.Second,
+		HeartbeatInterval:        100 * time.Millisecond,
+		MaxAppendEntries:         64,
+		CommandTimeout:           2 * time.Second,
+		RPCQueueSize:             16,
+		CommandQueueSize:         256,
+		RPCTimeout:               time.Second,
+		SnapshotThresholdEntries: 8192,
+		SnapshotTrailingEntries:  1024,
+		ProtocolVersion:          raft.ProtocolVersion,
+	}), config; expected != got {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	// servers accept each other if each accepts the version the other speaks
+	var (
+		v1Old = raft.Handshake{Version: 1} // predates versions
+		v1    = raft.Handshake{Version: 1, MinVersion: 1, MaxVersion: 2}
+		v2    = raft.Handshake{Version: 2, MinVersion: 1, MaxVersion: 2}
+		v3at2 = raft.Handshake{Version: 2, MinVersion: 2, MaxVersion: 3} // yet to be told everyone's upgraded
+		v3    = raft.Handshake{Version: 3, MinVersion: 2, MaxVersion: 3}
+	)
+	for _, c := range []struct {
+		local, remote raft.Handshake
+		compatible    bool
+	}{
+		{v1, v1Old, true},
+		{v2, v1Old, false},
+		{v1, v2, true},
+		{v2, v3at2, true},
+		{v1, v3at2, false},
+		{v2, v3, false},
+	} {
+		for _, pair := range [][2]raft.Handshake{{c.local, c.remote}, {c.remote, c.local}} {
+			err := raft.CheckHandshake(pair[0], pair[1])
+			if herr, ok := err.(*raft.HandshakeError); (err == nil) != c.compatible || (err != nil && (!ok || herr.Err != raft.ErrVersionMismatch)) {
+				t.Errorf("%+v, %+v: expected compatible=%v, got %v", pair[0], pair[1], c.compatible, err)
+			}
+		}
+	}
+
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+
+	// server 1 is yet to be told everyone's upgraded
+	servers := []*raft.Server{}
+	peers := raft.Peers{}
+	for id := uint64(1); id <= 3; id++ {
+		c := config
+		if id == 1 {
+			c.ProtocolVersion = 1
+		}
+		server := raft.NewServer(id, &bytes.Buffer{}, noop, c)
+		servers = append(servers, server)
+		peers[id] = raft.NewLocalPeer(server)
+	}
+	if _, err := servers[0].Reload(raft.Config{ProtocolVersion: raft.ProtocolVersion + 1}); err != raft.ErrProtocolVersion {
+		t.Errorf("expected %v, got %v", raft.ErrProtocolVersion, err)
+	}
+	if local, err := servers[0].Handshake(v2); err != nil || local.Version != 1 || local.MinVersion != raft.MinProtocolVersion || local.MaxVersion != raft.ProtocolVersion {
+		t.Errorf("expected to speak 1, and accept %d-%d, got %+v (%v)", raft.MinProtocolVersion, raft.ProtocolVersion, local, err)
+	}
+
+	// RPCs of versions a server doesn't know are refused, without their
+	// terms being taken
+	resp := servers[2].AppendEntries(raft.AppendEntries{Term: 9, LeaderId: 1, Version: raft.ProtocolVersion + 1})
+	if resp.Success || resp.Rejection != raft.RejectVersion || resp.Term != 0 || resp.State == nil || resp.State.Version != raft.ProtocolVersion {
+		t.Errorf("AppendEntries: expected a version rejection, got %+v", resp)
+	}
+	vote := servers[2].RequestVote(raft.RequestVote{Term: 9, CandidateId: 1, Version: raft.ProtocolVersion + 1})
+	if vote.VoteGranted || vote.Term != 0 || vote.Version != raft.ProtocolVersion {
+		t.Errorf("RequestVote: expected a refusal, got %+v", vote)
+	}
+
+	// the others accept both versions, and the leader sees who speaks which
+	for _, server := range servers {
+		server.SetPeers(peers)
+		server.Start()
+		defer server.Stop()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, server := range servers {
+			if st := server.Status(); st.State == raft.Leader && len(st.Cluster) == 3 {
+				versions := map[uint64]int{}
+				for id, state := range st.Cluster {
+					versions[id] = state.Version
+				}
+				if expected, got := fmt.Sprintf("map[1:1 2:%d 3:%d]", raft.ProtocolVersion, raft.ProtocolVersion), fmt.Sprint(versions); expected != got {
+					t.Fatalf("expected versions %s, got %s", expected, got)
+				}
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("leader never saw the whole cluster")
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+}
+
+func TestClusterId(t *testing.T) {
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	server.SetClusterId("alpha")
+
+	// RPCs from another cluster are refused, without their terms being
+	// taken, whether or not the sender exchanged handshakes
+	resp := server.AppendEntries(raft.AppendEntries{Term: 9, LeaderId: 2, Version: raft.ProtocolVersion, ClusterId: "beta"})
+	if resp.Success || resp.Rejection != raft.RejectCluster || resp.Term != 0 {
+		t.Errorf("AppendEntries: expected a cluster rejection, got %+v", resp)
+	}
+	vote := server.RequestVote(raft.RequestVote{Term: 9, CandidateId: 2, Version: raft.ProtocolVersion, ClusterId: "beta"})
+	if vote.VoteGranted || vote.Term != 0 {
+		t.Errorf("RequestVote: expected a refusal, got %+v", vote)
+	}
+	if _, err := server.InstallSnapshotContext(context.Background(), raft.InstallSnapshot{Term: 9, LeaderId: 2, ClusterId: "beta"}, &bytes.Buffer{}); err != raft.ErrClusterMismatch {
+		t.Errorf("InstallSnapshot: expected %v, got %v", raft.ErrClusterMismatch, err)
+	}
+	if term := server.Status().Term; term != 1 {
+		t.Errorf("expected the initial term 1, got %d", term)
+	}
+
+	// servers in the same cluster, or without one, elect a leader
+	servers := []*raft.Server{server}
+	for id := uint64(2); id <= 3; id++ {
+		servers = append(servers, raft.NewServer(id, &bytes.Buffer{}, noop, config))
+	}
+	servers[1].SetClusterId("alpha")
+	peers := raft.Peers{}
+	for _, server := range servers {
+		peers[server.Id()] = raft.NewLocalPeer(server)
+	}
+	for _, server := range servers {
+		server.SetPeers(peers)
+		server.Start()
+		defer server.Stop()
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(config.MinElectionTimeout) {
+		if server.Status().Leader != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no leader elected")
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	errInvalid := fmt.Errorf("invalid command")
+	applied := int32(0)
+	apply := func([]byte) ([]byte, error) { atomic.AddInt32(&applied, 1); return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, apply, config)
+	server.SetValidateFunc(func(cmd []byte) error {
+		if !json.Valid(cmd) {
+			return errInvalid
+		}
+		return nil
+	})
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+	server.Start()
+	defer server.Stop()
+
+	response := make(chan []byte, 1)
+	for {
+		err := server.Command([]byte(`{}`), response)
+		if err == nil {
+			break
+		}
+		if err != raft.ErrUnknownLeader {
+			t.Fatal(err)
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+	<-response
+
+	if err := server.Command([]byte(`{`), make(chan []byte, 1)); err != errInvalid {
+		t.Errorf("expected %s, got %v", errInvalid, err)
+	}
+	response = make(chan []byte, 1)
+	if err := server.Command([]byte(`{"x":1}`), response); err != nil {
+		t.Fatal(err)
+	}
+	<-response
+
+	// had the invalid command taken a slot in the log, it would be applied
+	if expected, got := int32(2), atomic.LoadInt32(&applied); expected != got {
+		t.Errorf("expected %d commands applied, got %d", expected, got)
+	}
+}
+
+func TestApply(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	errOverdrawn := fmt.Errorf("overdrawn")
+	balance := 0
+	apply := func(cmd []byte) ([]byte, error) {
+		n, err := strconv.Atoi(string(cmd))
+		if err != nil {
+			return nil, err
+		}
+		if balance+n < 0 {
+			return nil, &raft.CommandError{Err: errOverdrawn}
+		}
+		balance += n
+		return []byte(strconv.Itoa(balance)), nil
+	}
+	server := raft.NewServer(1, &bytes.Buffer{}, apply, config)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+	server.Start()
+	defer server.Stop()
+	select {
+	case <-server.LeaderCh():
+	case <-time.After(10 * config.MaxElectionTimeout):
+		t.Fatal("never became leader")
+	}
+	ctx := context.Background()
+
+	// the apply function's response is the command's
+	if resp, err := server.Apply(ctx, []byte("10")); err != nil || string(resp) != "10" {
+		t.Errorf("expected response %q, got %q (%v)", "10", resp, err)
+	}
+
+	// a rejection is the command's result, and the log carries on past it
+	_, err := server.Apply(ctx, []byte("-20"))
+	if ce, ok := err.(*raft.CommandError); !ok || ce.Err != errOverdrawn {
+		t.Errorf("expected a CommandError of %v, got %v", errOverdrawn, err)
+	}
+	response := make(chan []byte, 1)
+	if err := server.Command([]byte("-20"), response); err != nil {
+		t.Fatal(err)
+	}
+	if resp, ok := <-response; ok {
+		t.Errorf("expected a rejected command to have no response, got %q", resp)
+	}
+	if resp, err := server.Apply(ctx, []byte("-5")); err != nil || string(resp) != "5" {
+		t.Errorf("after rejections, expected response %q, got %q (%v)", "5", resp, err)
+	}
+}
+
+func TestApplyPolicy(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	// start runs a server whose apply function panics on "boom" the first
+	// failures times, with the policy, and returns it with its ApplyFailed
+	// events.
+	start := func(policy raft.ApplyPolicy, async bool, failures int) (*raft.Server, chan raft.Event) {
+		var mu sync.Mutex
+		apply := func(cmd []byte) ([]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if string(cmd) == "boom" && failures > 0 {
+				failures--
+				panic("boom")
+			}
+			return cmd, nil
+		}
+		events := make(chan raft.Event, 16)
+		server := raft.NewServer(1, &bytes.Buffer{}, apply, config)
+		server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+		server.SetApplyPolicy(policy)
+		if async {
+			server.SetAsyncApply(16)
+		}
+		server.SetEventHandler(func(e raft.Event) {
+			if e.Type == raft.ApplyFailed {
+				events <- e
+			}
+		})
+		server.Start()
+		select {
+		case <-server.LeaderCh():
+		case <-time.After(10 * config.MaxElectionTimeout):
+			t.Fatal("never became leader")
+		}
+		return server, events
+	}
+	expectEvent := func(policy raft.ApplyPolicy, events chan raft.Event) {
+		select {
+		case e := <-events:
+			if e.Index == 0 || !strings.Contains(string(e.Data), "apply function panicked: boom") {
+				t.Errorf("%s: unexpected event %+v (%s)", policy, e, e.Data)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: expected an ApplyFailed event", policy)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a skipped command is rejected with the panic, and the log carries on
+	server, events := start(raft.ApplySkip, false, 1)
+	_, err := server.Apply(ctx, []byte("boom"))
+	if ce, ok := err.(*raft.CommandError); !ok {
+		t.Errorf("skip: expected a CommandError, got %v", err)
+	} else if p, ok := ce.Err.(*raft.ApplyPanic); !ok || p.Value != "boom" || len(p.Stack) == 0 {
+		t.Errorf("skip: expected an ApplyPanic, got %v", ce.Err)
+	}
+	expectEvent(raft.ApplySkip, events)
+	if resp, err := server.Apply(ctx, []byte("a")); err != nil || string(resp) != "a" {
+		t.Errorf("skip: expected response %q, got %q (%v)", "a", resp, err)
+	}
+	server.Stop()
+
+	// a retried command is applied once the panics stop, after a backoff
+	server, events = start(raft.ApplyRetry, true, 2)
+	if resp, err := server.Apply(ctx, []byte("boom")); err != nil || string(resp) != "boom" {
+		t.Errorf("retry: expected response %q, got %q (%v)", "boom", resp, err)
+	}
+	expectEvent(raft.ApplyRetry, events)
+	expectEvent(raft.ApplyRetry, events)
+	server.Stop()
+
+	// a halt stops the server, and the command's result is unknown
+	server, events = start(raft.ApplyHalt, false, 1)
+	if _, err := server.Apply(ctx, []byte("boom")); err != raft.ErrNoResponse {
+		t.Errorf("halt: expected %v, got %v", raft.ErrNoResponse, err)
+	}
+	expectEvent(raft.ApplyHalt, events)
+	if err := server.Command([]byte("a"), make(chan []byte, 1)); err != raft.ErrStopped {
+		t.Errorf("halt: expected %v, got %v", raft.ErrStopped, err)
+	}
+}
+
+func TestAsyncApply(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	// every state machine is stuck until the gate opens
+	gate := make(chan struct{})
+	var (
+		mu      sync.Mutex
+		applied = map[uint64]int{}
+	)
+	servers := []*raft.Server{}
+	peers := raft.Peers{}
+	for id := uint64(1); id <= 3; id++ {
+		id := id
+		apply := func(cmd []byte) ([]byte, error) {
+			<-gate
+			mu.Lock()
+			defer mu.Unlock()
+			applied[id]++
+			return cmd, nil
+		}
+		server := raft.NewServer(id, &bytes.Buffer{}, apply, config)
+		server.SetAsyncApply(2)
+		server.SetQueryFunc(func([]byte) ([]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return []byte(strconv.Itoa(applied[id])), nil
+		})
+		servers = append(servers, server)
+		peers[id] = raft.NewLocalPeer(server)
+	}
+	for _, server := range servers {
+		server.SetPeers(peers)
+		server.Start()
+		defer server.Stop()
+	}
+	var leader *raft.Server
+	for deadline := time.Now().Add(5 * time.Second); leader == nil; time.Sleep(config.HeartbeatInterval) {
+		for _, server := range servers {
+			if server.State() == raft.Leader {
+				leader = server
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no leader")
+		}
+	}
+	term := leader.Status().Term
+
+	// commands commit, though none can be applied
+	responses := []chan []byte{}
+	for _, cmd := range []string{"a", "b"} {
+		response := make(chan []byte, 1)
+		if err := leader.Command([]byte(cmd), response); err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, response)
+	}
+	awaitBacklog := func() error {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(config.HeartbeatInterval) {
+			if st := leader.Status(); st.CommitIndex >= leader.AppliedIndex()+2 {
+				return nil
+			}
+		}
+		return fmt.Errorf("commit index %d, applied index %d", leader.Status().CommitIndex, leader.AppliedIndex())
+	}
+	if err := awaitBacklog(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the leader keeps its followers, while refusing more commands
+	if err := leader.Command([]byte("c"), make(chan []byte, 1)); err != raft.ErrApplyBacklog {
+		t.Errorf("expected %v, got %v", raft.ErrApplyBacklog, err)
+	}
+	time.Sleep(4 * config.MaxElectionTimeout)
+	if st := leader.Status(); st.State != raft.Leader || st.Term != term {
+		t.Errorf("expected to stay leader in term %d, got %s in term %d", term, st.State, st.Term)
+	}
+
+	// queries wait for the commands to be applied
+	query := make(chan []byte, 1)
+	go func() {
+		resp, err := leader.Query(raft.Lease, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		query <- resp
+	}()
+	select {
+	case resp := <-query:
+		t.Fatalf("expected the query to wait, got %q", resp)
+	case <-time.After(config.MaxElectionTimeout):
+	}
+
+	close(gate)
+	if resp := <-query; string(resp) != "2" {
+		t.Errorf("expected the query to see 2 commands applied, got %q", resp)
+	}
+	for i, cmd := range []string{"a", "b"} {
+		select {
+		case resp := <-responses[i]:
+			if string(resp) != cmd {
+				t.Errorf("expected response %q, got %q", cmd, resp)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("no response to %q", cmd)
+		}
+	}
+	for deadline := time.Now().Add(time.Second); leader.Status().AppliedIndex != leader.Status().CommitIndex; time.Sleep(config.HeartbeatInterval) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the applied index to catch up, got %+v", leader.Status())
+		}
+	}
+}
+
+func TestCommitStream(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
 
-	type SetValue struct {
-		Value int32 `json:"value"`
+	server := raft.NewServer(1, &bytes.Buffer{}, nil, config)
+	if server.CommitCh() != nil {
+		t.Errorf("expected no commit chan without a stream")
+	}
+	if err := server.Acknowledge(1); err != raft.ErrNoCommitStream {
+		t.Errorf("expected %v, got %v", raft.ErrNoCommitStream, err)
+	}
+	if err := server.SetCommitStream(16); err != nil {
+		t.Fatal(err)
+	}
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+	server.Start()
+	defer server.Stop()
+	select {
+	case <-server.LeaderCh():
+	case <-time.After(10 * config.MaxElectionTimeout):
+		t.Fatal("never became leader")
 	}
 
-	var i1, i2, i3 int32
-
-	applyValue := func(id uint64, i *int32) func([]byte) ([]byte, error) {
-		return func(cmd []byte) ([]byte, error) {
-			var sv SetValue
-			if err := json.Unmarshal(cmd, &sv); err != nil {
-				return []byte{}, err
+	// commands are delivered as they commit, before they're acknowledged
+	responses := []chan []byte{}
+	for _, cmd := range []string{"a", "b", "c"} {
+		response := make(chan []byte, 1)
+		if err := server.Command([]byte(cmd), response); err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, response)
+	}
+	entries := []raft.CommittedEntry{}
+	for _, cmd := range []string{"a", "b", "c"} {
+		select {
+		case entry := <-server.CommitCh():
+			if string(entry.Command) != cmd || entry.Term != server.Status().Term {
+				t.Errorf("expected command %q in term %d, got %+v", cmd, server.Status().Term, entry)
 			}
-			atomic.StoreInt32(i, sv.Value)
-			return json.Marshal(map[string]interface{}{"applied_to_server": id, "applied_value": sv.Value})
+			entries = append(entries, entry)
+		case <-time.After(time.Second):
+			t.Fatalf("command %q never delivered", cmd)
 		}
 	}
+	if applied := server.AppliedIndex(); applied >= entries[0].Index {
+		t.Errorf("expected nothing applied before it's acknowledged, got applied index %d", applied)
+	}
+	select {
+	case <-responses[0]:
+		t.Errorf("expected no response before the command's acknowledged")
+	default:
+	}
 
-	s1 := raft.NewServer(1, &bytes.Buffer{}, applyValue(1, &i1))
-	s2 := raft.NewServer(2, &bytes.Buffer{}, applyValue(2, &i2))
-	s3 := raft.NewServer(3, &bytes.Buffer{}, applyValue(3, &i3))
+	// acknowledging one applies those before it too
+	if err := server.Acknowledge(entries[1].Index); err != nil {
+		t.Fatal(err)
+	}
+	for _, response := range responses[:2] {
+		select {
+		case <-response:
+		case <-time.After(time.Second):
+			t.Fatal("no response after the command was acknowledged")
+		}
+	}
+	if expected, got := entries[1].Index, server.AppliedIndex(); expected != got {
+		t.Errorf("expected applied index %d, got %d", expected, got)
+	}
+	if err := server.Acknowledge(entries[2].Index + 1); err != raft.ErrNotDelivered {
+		t.Errorf("expected %v, got %v", raft.ErrNotDelivered, err)
+	}
+	if err := server.Acknowledge(entries[2].Index); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*config.MaxElectionTimeout)
+	defer cancel()
+	if _, err := server.Apply(ctx, []byte("d")); err != context.DeadlineExceeded {
+		t.Errorf("expected an unacknowledged Apply to time out, got %v", err)
+	}
 
-	s1Responses := &synchronizedBuffer{}
-	s2Responses := &synchronizedBuffer{}
-	s3Responses := &synchronizedBuffer{}
-	defer func(sb *synchronizedBuffer) { t.Logf("s1 responses: %s", sb.String()) }(s1Responses)
-	defer func(sb *synchronizedBuffer) { t.Logf("s2 responses: %s", sb.String()) }(s2Responses)
-	defer func(sb *synchronizedBuffer) { t.Logf("s3 responses: %s", sb.String()) }(s3Responses)
+	// the chan's closed when the server stops
+	server.Stop()
+	for range server.CommitCh() {
+	}
 
-	peers := raft.MakePeers(
-		raft.NewLocalPeer(s1),
-		raft.NewLocalPeer(s2),
-		raft.NewLocalPeer(s3),
-	)
+	// sessions are applied by the server, so they can't be streamed
+	server = raft.NewServer(1, &bytes.Buffer{}, nil, config)
+	server.SetSessions(10)
+	if err := server.SetCommitStream(16); err != raft.ErrStreamSessions {
+		t.Errorf("with sessions: expected %v, got %v", raft.ErrStreamSessions, err)
+	}
+}
 
-	s1.SetPeers(peers)
-	s2.SetPeers(peers)
-	s3.SetPeers(peers)
+func TestBarrier(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
 
-	s1.Start()
-	s2.Start()
-	s3.Start()
-	defer s1.Stop()
-	defer s2.Stop()
-	defer s3.Stop()
+	var applied int32
+	apply := func([]byte) ([]byte, error) {
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&applied, 1)
+		return []byte{}, nil
+	}
+	server := raft.NewServer(1, &bytes.Buffer{}, apply, config)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
 
-	var v int32 = 42
-	cmd, _ := json.Marshal(SetValue{v})
+	// before the server runs, nothing's applied
+	if err := server.Barrier(10 * time.Millisecond); err != raft.ErrTimeout {
+		t.Errorf("before Start: expected %v, got %v", raft.ErrTimeout, err)
+	}
 
-	response := make(chan []byte, 1)
-	func() {
-		for {
-			switch err := s1.Command(cmd, response); err {
-			case nil:
-				return
-			case raft.ErrUnknownLeader:
-				time.Sleep(raft.MinimumElectionTimeout())
+	server.Start()
+	defer server.Stop()
+	select {
+	case <-server.LeaderCh():
+	case <-time.After(10 * config.MaxElectionTimeout):
+		t.Fatal("never became leader")
+	}
+
+	// commands accepted before the barrier are applied by the time it returns
+	const n = 5
+	for i := 0; i < n; i++ {
+		if err := server.Command([]byte("x"), make(chan []byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := server.Barrier(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&applied); got != n {
+		t.Errorf("expected %d commands applied, got %d", n, got)
+	}
+
+	// barriers are entries of their own, except for servers speaking a
+	// version that predates them, which append no-ops
+	for version, expected := range map[int]float64{2: 0, raft.ProtocolVersion: 1} {
+		c := config
+		c.ProtocolVersion = version
+		sink := &recordingSink{values: map[string]float64{}}
+		server := raft.NewServer(1, &bytes.Buffer{}, apply, c)
+		server.SetMetricsSink(sink)
+		server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+		server.Start()
+		defer server.Stop()
+		select {
+		case <-server.LeaderCh():
+		case <-time.After(10 * config.MaxElectionTimeout):
+			t.Fatal("never became leader")
+		}
+		if err := server.Barrier(time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if got := sink.get(raft.MetricBarriers); expected != got {
+			t.Errorf("speaking version %d: expected %v barrier entries, got %v", version, expected, got)
+		}
+	}
+}
+
+func TestLeaderCh(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+	server.Start()
+
+	for _, expected := range []bool{true, false} {
+		select {
+		case got := <-server.LeaderCh():
+			if expected != got {
+				t.Fatalf("expected %v, got %v", expected, got)
+			}
+		case <-time.After(10 * config.MaxElectionTimeout):
+			t.Fatalf("timed out waiting for %v", expected)
+		}
+		if expected {
+			server.Stop() // no longer the leader
+		}
+	}
+}
+
+func TestBeacons(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond, BeaconInterval: 5 * time.Millisecond}
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	handled := make(chan raft.Event, 100)
+	server.SetEventHandler(func(e raft.Event) {
+		if e.Type == raft.LeaderBeacon {
+			select {
+			case handled <- e:
 			default:
-				t.Fatal(err)
 			}
 		}
-	}()
+	})
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+	beacons, unsubscribe := server.Beacons()
+	defer unsubscribe()
+	server.Start()
+	defer server.Stop()
 
-	r, ok := <-response
-	if ok {
-		s1Responses.Write(r)
-	} else {
-		t.Logf("didn't receive command response")
+	for _, c := range []<-chan raft.Event{beacons, handled} {
+		select {
+		case e := <-c:
+			if e.Id != 1 || e.Term != server.Status().Term || e.Index < 1 {
+				t.Errorf("expected a beacon from leader 1 of its term, after committing its no-op, got %+v", e)
+			}
+		case <-time.After(10 * config.MaxElectionTimeout):
+			t.Fatal("timed out waiting for a beacon")
+		}
 	}
+}
 
-	ticker := time.Tick(raft.BroadcastInterval())
-	timeout := time.After(1 * time.Second)
+func TestJournal(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	journaled := make(chan raft.Event, 10)
+	var applied int32
+	apply := func([]byte) ([]byte, error) { atomic.AddInt32(&applied, 1); return []byte{}, nil }
+	servers := []*raft.Server{}
+	peers := raft.Peers{}
+	for id := uint64(1); id <= 3; id++ {
+		server := raft.NewServer(id, &bytes.Buffer{}, apply, config)
+		server.SetEventHandler(func(e raft.Event) {
+			if e.Type == raft.Journaled {
+				journaled <- e
+			}
+		})
+		servers = append(servers, server)
+		peers[id] = raft.NewLocalPeer(server)
+	}
+	for _, server := range servers {
+		server.SetPeers(peers)
+		server.Start()
+		defer server.Stop()
+	}
+
+	// only the leader journals
+	var index uint64
 	for {
+		var err error
+		notLeader := 0
+		for _, server := range servers {
+			if index, err = server.Journal([]byte("audit")); err == nil {
+				break
+			} else if err == raft.ErrNotLeader {
+				notLeader++
+			} else {
+				t.Fatal(err)
+			}
+		}
+		if err == nil {
+			break
+		}
+		if notLeader != len(servers) {
+			t.Fatalf("expected %v from every server without a leader, got it from %d", raft.ErrNotLeader, notLeader)
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+
+	// every server sees the entry commit, but not its state machine
+	seen := map[uint64]bool{}
+	for len(seen) < len(servers) {
 		select {
-		case <-ticker:
-			i1l := atomic.LoadInt32(&i1)
-			i2l := atomic.LoadInt32(&i2)
-			i3l := atomic.LoadInt32(&i3)
-			t.Logf("i1=%02d i2=%02d i3=%02d", i1l, i2l, i3l)
-			if i1l == v && i2l == v && i3l == v {
-				t.Logf("success!")
-				return
+		case e := <-journaled:
+			if e.Index != index || string(e.Data) != "audit" {
+				t.Errorf("expected journal entry %d (%q), got %+v", index, "audit", e)
 			}
+			seen[e.Id] = true
+		case <-time.After(10 * config.MaxElectionTimeout):
+			t.Fatalf("timed out; only %d server(s) saw the entry", len(seen))
+		}
+	}
+	if n := atomic.LoadInt32(&applied); n != 0 {
+		t.Errorf("expected nothing applied to the state machine, got %d", n)
+	}
+}
 
-		case <-timeout:
-			t.Fatal("timeout")
+func TestLeaderProbe(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(2, &bytes.Buffer{}, noop, config)
+	leader := &probedPeer{nonresponsivePeer: 1, term: 3}
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), leader, nonresponsivePeer(3)))
+	server.SetLeaderProbe(true)
+	server.Start()
+	defer server.Stop()
+	server.AppendEntries(raft.AppendEntries{Term: 3, LeaderId: 1})
+
+	// the leader answers the probe, so we keep following it
+	cutoff := time.Now().Add(10 * config.MaxElectionTimeout)
+	for atomic.LoadInt32(&leader.probes) == 0 {
+		if time.Now().After(cutoff) {
+			t.Fatal("leader never probed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if state := server.State(); state != raft.Follower {
+		t.Fatalf("expected to remain %s after the probe, got %s", raft.Follower, state)
+	}
+
+	// but without hearing from it, we campaign at the next timeout
+	for server.State() == raft.Follower {
+		if time.Now().After(cutoff) {
+			t.Fatal("never campaigned")
 		}
+		time.Sleep(time.Millisecond)
+	}
+	if expected, got := int32(1), atomic.LoadInt32(&leader.probes); expected != got {
+		t.Errorf("expected %d probe, got %d", expected, got)
+	}
+}
+
+type probedPeer struct {
+	nonresponsivePeer
+	term   uint64
+	probes int32
+}
+
+func (p *probedPeer) Probe(context.Context) (raft.ProbeResponse, error) {
+	atomic.AddInt32(&p.probes, 1)
+	return raft.ProbeResponse{Term: p.term, Leader: true}, nil
+}
+
+func TestContext(t *testing.T) {
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, raft.Config{}) // never started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := server.CommandContext(ctx, []byte(`{}`), make(chan []byte, 1)); err != context.DeadlineExceeded {
+		t.Errorf("Command: expected %s, got %v", context.DeadlineExceeded, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := server.AppendEntriesContext(ctx, raft.AppendEntries{}); err != context.Canceled {
+		t.Errorf("AppendEntries: expected %s, got %v", context.Canceled, err)
+	}
+	if _, err := raft.NewLocalPeer(server).RequestVoteContext(ctx, raft.RequestVote{}); err != context.Canceled {
+		t.Errorf("RequestVote: expected %s, got %v", context.Canceled, err)
 	}
 }
 
@@ -230,8 +1824,6 @@ func testOrderTimeout(t *testing.T, nServers int, timeout time.Duration) {
 	log.SetOutput(logBuffer)
 	defer log.SetOutput(os.Stdout)
 	defer printOnFailure(t, logBuffer)
-	oldMin, oldMax := raft.ResetElectionTimeoutMs(50, 100)
-	defer raft.ResetElectionTimeoutMs(oldMin, oldMax)
 
 	done := make(chan struct{})
 	go func() { testOrder(t, nServers); close(done) }()
@@ -244,6 +1836,7 @@ func testOrderTimeout(t *testing.T, nServers int, timeout time.Duration) {
 }
 
 func testOrder(t *testing.T, nServers int) {
+	config := raft.Config{MinElectionTimeout: 50 * time.Millisecond, MaxElectionTimeout: 100 * time.Millisecond, HeartbeatInterval: 5 * time.Millisecond}
 	values := rand.Perm(8 + rand.Intn(16))
 
 	// command and response
@@ -269,7 +1862,7 @@ func testOrder(t *testing.T, nServers int) {
 	for i := 0; i < nServers; i++ {
 		buffers = append(buffers, &synchronizedBuffer{})
 		storage = append(storage, &bytes.Buffer{})
-		servers = append(servers, raft.NewServer(uint64(i+1), storage[i], do(buffers[i])))
+		servers = append(servers, raft.NewServer(uint64(i+1), storage[i], do(buffers[i]), config))
 	}
 	peers := raft.Peers{}
 	for _, server := range servers {
@@ -316,7 +1909,7 @@ func testOrder(t *testing.T, nServers int) {
 				break retry
 			case raft.ErrUnknownLeader, raft.ErrDeposed:
 				log.Printf("command=%d/%d peer=%d: failed (%s) -- will retry", i+1, len(cmds), id, err)
-				time.Sleep(raft.ElectionTimeout())
+				time.Sleep(config.MaxElectionTimeout)
 				continue
 			case raft.ErrTimeout:
 				log.Printf("command=%d/%d peer=%d: timed out -- assume it went through", i+1, len(cmds), id)
@@ -343,7 +1936,7 @@ func testOrder(t *testing.T, nServers int) {
 			expected, got := expectedBuffer.String(), sb.String()
 			if len(got) < len(expected) {
 				t.Logf("server %d: not yet fully replicated, will check again", i+1)
-				time.Sleep(raft.BroadcastInterval())
+				time.Sleep(config.HeartbeatInterval)
 				continue // retry
 			}
 			if expected != got {
@@ -385,6 +1978,12 @@ func (b *synchronizedBuffer) Write(p []byte) (int, error) {
 	return b.buf.Write(p)
 }
 
+func (b *synchronizedBuffer) Read(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Read(p)
+}
+
 func (b *synchronizedBuffer) String() string {
 	b.RLock()
 	defer b.RUnlock()
@@ -435,3 +2034,157 @@ func (p disapprovingPeer) RequestVote(rv raft.RequestVote) raft.RequestVoteRespo
 func (p disapprovingPeer) Command([]byte, chan []byte) error {
 	return fmt.Errorf("not implemented")
 }
+
+// switchablePeer grants every vote, and accepts every AppendEntries, but only
+// while it's up.
+type switchablePeer struct {
+	id uint64
+	up int32
+}
+
+func (p *switchablePeer) Set(up bool) {
+	if up {
+		atomic.StoreInt32(&p.up, 1)
+	} else {
+		atomic.StoreInt32(&p.up, 0)
+	}
+}
+
+func (p *switchablePeer) Id() uint64 { return p.id }
+func (p *switchablePeer) AppendEntries(ae raft.AppendEntries) raft.AppendEntriesResponse {
+	if atomic.LoadInt32(&p.up) == 0 {
+		return raft.AppendEntriesResponse{}
+	}
+	return raft.AppendEntriesResponse{
+		Term:    ae.Term,
+		Success: true,
+	}
+}
+func (p *switchablePeer) RequestVote(rv raft.RequestVote) raft.RequestVoteResponse {
+	if atomic.LoadInt32(&p.up) == 0 {
+		return raft.RequestVoteResponse{}
+	}
+	return raft.RequestVoteResponse{
+		Term:        rv.Term,
+		VoteGranted: true,
+	}
+}
+func (p *switchablePeer) Command([]byte, chan []byte) error {
+	return fmt.Errorf("not implemented")
+}
+
+func TestStop(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond, HandoffOnStop: true}
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	servers := []*raft.Server{}
+	peers := raft.Peers{}
+	for id := uint64(1); id <= 3; id++ {
+		server := raft.NewServer(id, &bytes.Buffer{}, noop, config)
+		servers = append(servers, server)
+		peers[id] = raft.NewLocalPeer(server)
+	}
+	var leader *raft.Server
+	for _, server := range servers {
+		server.SetPeers(peers)
+		server.Start()
+		defer server.Stop()
+	}
+	for leader == nil {
+		time.Sleep(config.MinElectionTimeout)
+		for _, server := range servers {
+			if server.State() == raft.Leader {
+				leader = server
+			}
+		}
+	}
+
+	// the followers stop, so the leader can't commit a command
+	for _, server := range servers {
+		if server != leader {
+			server.Stop()
+		}
+	}
+	response := make(chan []byte, 1)
+	if err := leader.Command([]byte(`{}`), response); err != nil {
+		t.Fatal(err)
+	}
+
+	// stopping the leader releases the command, and fails everything after
+	leader.Stop()
+	select {
+	case r, ok := <-response:
+		if ok {
+			t.Errorf("expected the response chan to be closed, got %q", r)
+		}
+	default:
+		t.Error("response chan still open after stop")
+	}
+	if err := leader.Command([]byte(`{}`), make(chan []byte, 1)); err != raft.ErrStopped {
+		t.Errorf("Command: expected %v, got %v", raft.ErrStopped, err)
+	}
+	if _, err := leader.AppendEntriesContext(context.Background(), raft.AppendEntries{}); err != raft.ErrStopped {
+		t.Errorf("AppendEntries: expected %v, got %v", raft.ErrStopped, err)
+	}
+	leader.Stop() // again, harmlessly
+}
+
+func TestHandoffOnStop(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+	// election timeouts long enough that a handoff is clearly quicker
+	config := raft.Config{MinElectionTimeout: 400 * time.Millisecond, MaxElectionTimeout: 800 * time.Millisecond, HeartbeatInterval: 5 * time.Millisecond, HandoffOnStop: true}
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	servers := []*raft.Server{}
+	peers := raft.Peers{}
+	for id := uint64(1); id <= 3; id++ {
+		server := raft.NewServer(id, &bytes.Buffer{}, noop, config)
+		servers = append(servers, server)
+		peers[id] = raft.NewLocalPeer(server)
+	}
+	for _, server := range servers {
+		server.SetPeers(peers)
+		server.Start()
+		defer server.Stop()
+	}
+	leaderOf := func(servers []*raft.Server) *raft.Server {
+		for _, server := range servers {
+			if server.State() == raft.Leader {
+				return server
+			}
+		}
+		return nil
+	}
+	var leader *raft.Server
+	for leader = leaderOf(servers); leader == nil; leader = leaderOf(servers) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	response := make(chan []byte, 1)
+	if err := leader.Command([]byte(`{}`), response); err != nil {
+		t.Fatal(err)
+	}
+	<-response
+
+	rest := []*raft.Server{}
+	for _, server := range servers {
+		if server != leader {
+			rest = append(rest, server)
+		}
+	}
+	began := time.Now()
+	leader.Stop()
+	for leaderOf(rest) == nil {
+		if time.Since(began) > config.MinElectionTimeout {
+			t.Fatal("no new leader within the election timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Logf("new leader after %s", time.Since(began))
+}
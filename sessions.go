@@ -0,0 +1,231 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+var (
+	ErrSessionsDisabled = errors.New("sessions aren't enabled")
+	ErrUnknownSession   = errors.New("unknown or expired session")
+	ErrRegistrationLost = errors.New("session registration lost")
+)
+
+// SetSessions enables client sessions, which make commands apply exactly
+// once, even when clients retry them: see RegisterSession and SessionCommand.
+// Each server keeps the max most recently used sessions, and forgets the
+// rest. It must be called before SetSnapshotStore, as sessions are kept in
+// snapshots, and before Start. Every server should keep the same number of
+// sessions. A max of zero, the default, disables sessions.
+func (s *Server) SetSessions(max int) {
+	if max <= 0 {
+		s.log.sessions = nil
+		return
+	}
+	s.log.sessions = &sessions{max: max, m: map[uint64]*session{}}
+}
+
+// RegisterSession registers a new client session, and returns its id, once
+// the registration has committed. It must be called on the leader; other
+// servers return ErrNotLeader.
+func (s *Server) RegisterSession(ctx context.Context) (uint64, error) {
+	if s.log.sessions == nil {
+		return 0, ErrSessionsDisabled
+	}
+	response := make(chan []byte, 1)
+	if err := s.submit(ctx, commandTuple{Type: EntrySession, CommandResponse: response}); err != nil {
+		return 0, err
+	}
+	select {
+	case resp, ok := <-response:
+		if !ok {
+			return 0, ErrRegistrationLost
+		}
+		return strconv.ParseUint(string(resp), 10, 64)
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// SessionCommand is like CommandContext, but the command is tagged with the
+// session, and its sequence number in it, which the client increments with
+// every new command, and reuses when it retries one, e.g. after ErrTimeout.
+// Each server applies a sequence number once: a retry gets the response to
+// the command as it was first applied, without applying it again.
+//
+// A session has one command outstanding at a time; only the response to its
+// latest is kept. The response chan of a command that isn't applied, because
+// the session has expired, or a later command has been applied, is closed
+// without a response. If the session has expired, a retry returns
+// ErrUnknownSession. SessionCommand must be called on the leader; other
+// servers return ErrNotLeader.
+func (s *Server) SessionCommand(ctx context.Context, session, seq uint64, cmd []byte, response chan []byte) error {
+	if s.log.sessions == nil {
+		return ErrSessionsDisabled
+	}
+	return s.submit(ctx, commandTuple{
+		Command:         cmd,
+		CommandResponse: response,
+		Type:            EntrySessionCommand,
+		Session:         session,
+		Seq:             seq,
+	})
+}
+
+// tagSessionCommand tags the command with its session and sequence number.
+func tagSessionCommand(session, seq uint64, cmd []byte) []byte {
+	return append([]byte(fmt.Sprintf("%016x %016x ", session, seq)), cmd...)
+}
+
+// untagSessionCommand returns the command entry, without its tag, and the
+// session and sequence number it was tagged with.
+func untagSessionCommand(entry LogEntry) (LogEntry, uint64, uint64, error) {
+	var session, seq uint64
+	if len(entry.Command) < 34 {
+		return entry, 0, 0, fmt.Errorf("session command at index %d isn't tagged", entry.Index)
+	}
+	if _, err := fmt.Sscanf(string(entry.Command[:34]), "%016x %016x ", &session, &seq); err != nil {
+		return entry, 0, 0, err
+	}
+	entry.Command = entry.Command[34:]
+	return entry, session, seq, nil
+}
+
+// session is what a server remembers about a client session.
+type session struct {
+	Seq      uint64 `json:"seq"`                // of the latest command applied
+	Response []byte `json:"response"`           // to it
+	Rejected string `json:"rejected,omitempty"` // or why it was rejected
+	Used     uint64 `json:"used"`               // index of the latest entry of the session
+}
+
+// rejection returns the CommandError the latest command was rejected with,
+// if it was.
+func (s *session) rejection() *CommandError {
+	if s.Rejected == "" {
+		return nil
+	}
+	return &CommandError{errors.New(s.Rejected)}
+}
+
+// sessions is the session table. It's only changed as entries are applied,
+// so it's the same on every server, as of the same index, and it's guarded
+// by the log's lock. A nil table is disabled.
+type sessions struct {
+	max int
+	m   map[uint64]*session
+}
+
+// register registers the session whose id is the index, forgetting the least
+// recently used session if there are too many, and returns its id as its
+// response.
+func (t *sessions) register(index uint64) []byte {
+	if t == nil {
+		return nil
+	}
+	t.m[index] = &session{Used: index}
+	if len(t.m) > t.max {
+		lru := index
+		for id, s := range t.m {
+			if s.Used < t.m[lru].Used {
+				lru = id
+			}
+		}
+		delete(t.m, lru)
+	}
+	return []byte(strconv.FormatUint(index, 10))
+}
+
+// lookup returns the session, if the command with the sequence number in it
+// is a duplicate, or nil, if it's new. If the session's unknown, or the
+// sequence number older than its latest, it's not ok.
+func (t *sessions) lookup(id, seq uint64) (cached *session, ok bool) {
+	if t == nil {
+		return nil, false
+	}
+	s, known := t.m[id]
+	switch {
+	case !known || seq < s.Seq:
+		return nil, false
+	case seq == s.Seq:
+		return s, true
+	default:
+		return nil, true
+	}
+}
+
+// applied records the response to the command with the sequence number in
+// the session, which was applied at the index, or its rejection.
+func (t *sessions) applied(id, seq, index uint64, resp []byte, rejected *CommandError) {
+	s := &session{Seq: seq, Response: resp, Used: index}
+	if rejected != nil {
+		s.Rejected = rejected.Error()
+	}
+	t.m[id] = s
+}
+
+// hasSession returns whether the session is known, as of the last entry
+// applied.
+func (l *Log) hasSession(id uint64) bool {
+	l.RLock()
+	defer l.RUnlock()
+	if l.sessions == nil {
+		return false
+	}
+	_, ok := l.sessions.m[id]
+	return ok
+}
+
+// sessionsFSM keeps the session table in the snapshots of the state machine,
+// ahead of its data, as a JSON object, preceded by its length.
+type sessionsFSM struct {
+	FSM
+	sessions *sessions
+}
+
+// Snapshot is called with the log locked, as of the last entry applied.
+func (f sessionsFSM) Snapshot() (func(io.Writer) error, error) {
+	table, err := json.Marshal(f.sessions.m)
+	if err != nil {
+		return nil, err
+	}
+	write, err := f.FSM.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return func(w io.Writer) error {
+		if _, err := fmt.Fprintf(w, "%016x\n%s", len(table), table); err != nil {
+			return err
+		}
+		return write(w)
+	}, nil
+}
+
+// Restore is called with the log locked.
+func (f sessionsFSM) Restore(r io.Reader) error {
+	header := make([]byte, 17)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	n, err := strconv.ParseUint(string(header[:16]), 16, 32)
+	if err != nil {
+		return err
+	}
+	table := make([]byte, n)
+	if _, err := io.ReadFull(r, table); err != nil {
+		return err
+	}
+	m := map[uint64]*session{}
+	if err := json.Unmarshal(table, &m); err != nil {
+		return err
+	}
+	if err := f.FSM.Restore(r); err != nil {
+		return err
+	}
+	f.sessions.m = m
+	return nil
+}
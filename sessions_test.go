@@ -0,0 +1,105 @@
+package raft_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/peterbourgon/raft"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+
+	dir, err := ioutil.TempDir("", "raft-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshots, err := raft.NewFileSnapshotStore(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	ctx := context.Background()
+
+	start := func() (*raft.Server, *sumFSM) {
+		fsm := &sumFSM{}
+		server := raft.NewServer(1, &bytes.Buffer{}, fsm.apply, config)
+		server.SetSessions(2)
+		if err := server.SetSnapshotStore(snapshots, fsm); err != nil {
+			t.Fatal(err)
+		}
+		server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+		server.Start()
+		select {
+		case <-server.LeaderCh():
+		case <-time.After(10 * config.MaxElectionTimeout):
+			t.Fatal("never became leader")
+		}
+		return server, fsm
+	}
+	command := func(server *raft.Server, session, seq uint64, cmd string) (string, bool) {
+		response := make(chan []byte, 1)
+		if err := server.SessionCommand(ctx, session, seq, []byte(cmd), response); err != nil {
+			t.Fatal(err)
+		}
+		resp, ok := <-response
+		return string(resp), ok
+	}
+
+	server, fsm := start()
+	if err := server.SessionCommand(ctx, 1, 1, []byte("1"), nil); err != raft.ErrUnknownSession {
+		t.Errorf("before registering: expected %v, got %v", raft.ErrUnknownSession, err)
+	}
+	a, err := server.RegisterSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a retried command is applied once, and answered as it was
+	for i := 0; i < 2; i++ {
+		if resp, ok := command(server, a, 1, "5"); !ok || resp != "5" {
+			t.Errorf("attempt %d: expected response %q, got %q (%v)", i+1, "5", resp, ok)
+		}
+	}
+	command(server, a, 2, "3")
+	if expected, got := 8, fsm.get(); expected != got {
+		t.Errorf("expected sum %d, got %d", expected, got)
+	}
+
+	// a command older than the latest isn't applied, or answered
+	if resp, ok := command(server, a, 1, "5"); ok {
+		t.Errorf("with a stale sequence number, expected no response, got %q", resp)
+	}
+
+	// sessions survive in snapshots
+	if _, err := server.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	server.Stop()
+	server, fsm = start()
+	defer server.Stop()
+	if resp, ok := command(server, a, 2, "3"); !ok || resp != "3" {
+		t.Errorf("after restoring: expected response %q, got %q (%v)", "3", resp, ok)
+	}
+	if expected, got := 8, fsm.get(); expected != got {
+		t.Errorf("after restoring: expected sum %d, got %d", expected, got)
+	}
+
+	// the least recently used session is forgotten
+	for i := 0; i < 2; i++ {
+		if _, err := server.RegisterSession(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := server.SessionCommand(ctx, a, 3, []byte("1"), nil); err != raft.ErrUnknownSession {
+		t.Errorf("once forgotten: expected %v, got %v", raft.ErrUnknownSession, err)
+	}
+}
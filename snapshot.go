@@ -0,0 +1,335 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownSnapshot = errors.New("unknown snapshot")
+	ErrCorruptSnapshot = errors.New("snapshot is corrupt")
+	ErrSnapshotClosed  = errors.New("snapshot already closed")
+)
+
+// SnapshotMeta describes a snapshot of the state machine: the last log entry
+// it includes, and the cluster's membership as of that entry, which a server
+// restored from the snapshot can't otherwise learn from its log.
+type SnapshotMeta struct {
+	Id       string            `json:"id"`    // assigned by the store
+	Index    uint64            `json:"index"` // of the last entry included
+	Term     uint64            `json:"term"`  // of the last entry included
+	Peers    map[uint64]string `json:"peers"` // id: address, if any
+	Learners map[uint64]string `json:"learners,omitempty"`
+	Size     int64             `json:"size"` // of the data, set by the store
+	CRC      uint32            `json:"crc"`  // of the data, set by the store
+}
+
+// SnapshotStore stores snapshots of the state machine. A snapshot is written
+// to the sink returned by Create, and only becomes visible to List and Open
+// once the sink is closed; a snapshot that's canceled, or interrupted by a
+// crash, is never seen.
+type SnapshotStore interface {
+	// Create starts a snapshot with the given metadata.
+	Create(SnapshotMeta) (SnapshotSink, error)
+
+	// List returns the metadata of the complete snapshots, newest first.
+	List() ([]SnapshotMeta, error)
+
+	// Open returns the snapshot with the given id, and its data. The data
+	// has been checked against the snapshot's checksum.
+	Open(id string) (SnapshotMeta, io.ReadCloser, error)
+
+	// Delete deletes the snapshot with the given id.
+	Delete(id string) error
+}
+
+// SnapshotSink receives the data of a snapshot. Close completes the snapshot;
+// Cancel abandons it.
+type SnapshotSink interface {
+	io.WriteCloser
+	Meta() SnapshotMeta
+	Cancel() error
+}
+
+const (
+	snapshotMetaFile = "meta.json"
+	snapshotDataFile = "state.bin"
+	snapshotTmp      = ".tmp"
+)
+
+// FileSnapshotStore is a SnapshotStore keeping each snapshot in its own
+// directory, under a root directory. A snapshot is written to a temporary
+// directory, which is synced and renamed into place when it's complete, so
+// a snapshot is either entirely there or not there at all. Only the newest
+// snapshots are retained; older ones are deleted as new ones are completed.
+type FileSnapshotStore struct {
+	sync.Mutex
+	dir    string
+	retain int
+}
+
+// NewFileSnapshotStore opens (or creates) the snapshot store in the given
+// directory, which retains the given number of snapshots, at least one. The
+// leftovers of snapshots interrupted by a crash are deleted.
+func NewFileSnapshotStore(dir string, retain int) (*FileSnapshotStore, error) {
+	if retain < 1 {
+		retain = 1
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range infos {
+		if fi.IsDir() && strings.HasSuffix(fi.Name(), snapshotTmp) {
+			if err := os.RemoveAll(filepath.Join(dir, fi.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &FileSnapshotStore{dir: dir, retain: retain}, nil
+}
+
+func (s *FileSnapshotStore) Create(meta SnapshotMeta) (SnapshotSink, error) {
+	meta.Id = fmt.Sprintf("%d-%d-%d", meta.Term, meta.Index, time.Now().UnixNano())
+	meta.Size, meta.CRC = 0, 0
+	tmp := filepath.Join(s.dir, meta.Id+snapshotTmp)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(tmp, snapshotDataFile))
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	return &fileSnapshotSink{store: s, meta: meta, dir: tmp, f: f, crc: crc32.NewIEEE()}, nil
+}
+
+func (s *FileSnapshotStore) List() ([]SnapshotMeta, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.list()
+}
+
+// list returns the complete snapshots, newest first. Snapshots whose metadata
+// can't be read are skipped.
+func (s *FileSnapshotStore) list() ([]SnapshotMeta, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []SnapshotMeta{}
+	for _, fi := range infos {
+		if !fi.IsDir() || strings.HasSuffix(fi.Name(), snapshotTmp) {
+			continue
+		}
+		meta, err := s.readMeta(fi.Name())
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, meta)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		a, b := snapshots[i], snapshots[j]
+		if a.Index != b.Index {
+			return a.Index > b.Index
+		}
+		if a.Term != b.Term {
+			return a.Term > b.Term
+		}
+		return a.Id > b.Id
+	})
+	return snapshots, nil
+}
+
+func (s *FileSnapshotStore) readMeta(id string) (SnapshotMeta, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(s.dir, id, snapshotMetaFile))
+	if os.IsNotExist(err) {
+		return SnapshotMeta{}, ErrUnknownSnapshot
+	}
+	if err != nil {
+		return SnapshotMeta{}, err
+	}
+	var meta SnapshotMeta
+	if err := json.Unmarshal(buf, &meta); err != nil || meta.Id != id {
+		return SnapshotMeta{}, ErrCorruptSnapshot
+	}
+	return meta, nil
+}
+
+// Open reads the snapshot's data once, to check its size and checksum, and
+// then returns it from the beginning.
+func (s *FileSnapshotStore) Open(id string) (SnapshotMeta, io.ReadCloser, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if !validSnapshotId(id) {
+		return SnapshotMeta{}, nil, ErrUnknownSnapshot
+	}
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return SnapshotMeta{}, nil, err
+	}
+	f, err := os.Open(filepath.Join(s.dir, id, snapshotDataFile))
+	if err != nil {
+		return SnapshotMeta{}, nil, err
+	}
+	crc := crc32.NewIEEE()
+	n, err := io.Copy(crc, f)
+	if err != nil {
+		f.Close()
+		return SnapshotMeta{}, nil, err
+	}
+	if n != meta.Size || crc.Sum32() != meta.CRC {
+		f.Close()
+		return SnapshotMeta{}, nil, ErrCorruptSnapshot
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return SnapshotMeta{}, nil, err
+	}
+	return meta, f, nil
+}
+
+func (s *FileSnapshotStore) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.delete(id)
+}
+
+func (s *FileSnapshotStore) delete(id string) error {
+	if !validSnapshotId(id) {
+		return ErrUnknownSnapshot
+	}
+	path := filepath.Join(s.dir, id)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ErrUnknownSnapshot
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// validSnapshotId reports whether the id could name a snapshot in the store,
+// and not, say, a path outside it.
+func validSnapshotId(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`) && !strings.HasSuffix(id, snapshotTmp)
+}
+
+// complete renames a finished snapshot into place, and deletes the snapshots
+// beyond the number retained.
+func (s *FileSnapshotStore) complete(tmp string, meta SnapshotMeta) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := os.Rename(tmp, filepath.Join(s.dir, meta.Id)); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	snapshots, err := s.list()
+	if err != nil {
+		return err
+	}
+	for i := s.retain; i < len(snapshots); i++ {
+		if err := s.delete(snapshots[i].Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileSnapshotSink writes a snapshot to its temporary directory.
+type fileSnapshotSink struct {
+	store  *FileSnapshotStore
+	meta   SnapshotMeta
+	dir    string
+	f      *os.File
+	crc    hash.Hash32
+	closed bool
+}
+
+func (k *fileSnapshotSink) Meta() SnapshotMeta { return k.meta }
+
+func (k *fileSnapshotSink) Write(p []byte) (int, error) {
+	if k.closed {
+		return 0, ErrSnapshotClosed
+	}
+	n, err := k.f.Write(p)
+	k.crc.Write(p[:n])
+	k.meta.Size += int64(n)
+	return n, err
+}
+
+// Close syncs the data, and writes the metadata, with the data's size and
+// checksum, before moving the snapshot into place. If any of it fails, the
+// snapshot is abandoned.
+func (k *fileSnapshotSink) Close() error {
+	if k.closed {
+		return ErrSnapshotClosed
+	}
+	k.closed = true
+	k.meta.CRC = k.crc.Sum32()
+	if err := k.finish(); err != nil {
+		os.RemoveAll(k.dir)
+		return err
+	}
+	return nil
+}
+
+func (k *fileSnapshotSink) finish() error {
+	if err := k.f.Sync(); err != nil {
+		k.f.Close()
+		return err
+	}
+	if err := k.f.Close(); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(k.meta)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(k.dir, snapshotMetaFile))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := syncDir(k.dir); err != nil {
+		return err
+	}
+	return k.store.complete(k.dir, k.meta)
+}
+
+func (k *fileSnapshotSink) Cancel() error {
+	if k.closed {
+		return ErrSnapshotClosed
+	}
+	k.closed = true
+	k.f.Close()
+	return os.RemoveAll(k.dir)
+}
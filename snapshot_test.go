@@ -0,0 +1,362 @@
+package raft_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/peterbourgon/raft"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileSnapshotStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := raft.NewFileSnapshotStore(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(index uint64, data string) string {
+		sink, err := store.Create(raft.SnapshotMeta{Index: index, Term: 1, Peers: map[uint64]string{1: "a", 2: "b"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sink.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return sink.Meta().Id
+	}
+	create(10, "ten")
+	create(20, "twenty")
+	newest := create(30, "thirty")
+
+	// a canceled snapshot is never seen
+	sink, err := store.Create(raft.SnapshotMeta{Index: 40, Term: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Write([]byte("forty"))
+	if err := sink.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the newest two are retained
+	snapshots, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2, len(snapshots); expected != got {
+		t.Fatalf("expected %d snapshots, got %d", expected, got)
+	}
+	if expected, got := uint64(30), snapshots[0].Index; expected != got {
+		t.Errorf("expected newest index %d, got %d", expected, got)
+	}
+	if expected, got := "b", snapshots[0].Peers[2]; expected != got {
+		t.Errorf("expected peer 2 at %q, got %q", expected, got)
+	}
+
+	meta, r, err := store.Open(newest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if expected, got := "thirty", string(data); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if expected, got := int64(6), meta.Size; expected != got {
+		t.Errorf("expected size %d, got %d", expected, got)
+	}
+
+	// damage is found on open
+	if err := ioutil.WriteFile(filepath.Join(dir, newest, "state.bin"), []byte("thirsty"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Open(newest); err != raft.ErrCorruptSnapshot {
+		t.Errorf("expected %v, got %v", raft.ErrCorruptSnapshot, err)
+	}
+
+	if err := store.Delete(newest); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Open(newest); err != raft.ErrUnknownSnapshot {
+		t.Errorf("expected %v, got %v", raft.ErrUnknownSnapshot, err)
+	}
+	if _, _, err := store.Open("../" + filepath.Base(dir)); err != raft.ErrUnknownSnapshot {
+		t.Errorf("expected %v, got %v", raft.ErrUnknownSnapshot, err)
+	}
+}
+
+func TestSnapshotting(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+
+	dir, err := ioutil.TempDir("", "raft-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := raft.Config{
+		MinElectionTimeout:       25 * time.Millisecond,
+		MaxElectionTimeout:       50 * time.Millisecond,
+		HeartbeatInterval:        2500 * time.Microsecond,
+		SnapshotThresholdEntries: 5,
+		SnapshotTrailingEntries:  1,
+	}
+
+	// server 3 starts late, after the entries it needs have been compacted
+	servers, fsms, stores, snapshots := []*raft.Server{}, []*sumFSM{}, []*bytes.Buffer{}, []*raft.FileSnapshotStore{}
+	peers := raft.Peers{}
+	for id := uint64(1); id <= 3; id++ {
+		fsm, store := &sumFSM{}, &bytes.Buffer{}
+		server := raft.NewServer(id, store, fsm.apply, config)
+		snapshotStore, err := raft.NewFileSnapshotStore(filepath.Join(dir, fmt.Sprint(id)), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.SetSnapshotStore(snapshotStore, fsm); err != nil {
+			t.Fatal(err)
+		}
+		servers, fsms, stores, snapshots = append(servers, server), append(fsms, fsm), append(stores, store), append(snapshots, snapshotStore)
+		peers[id] = raft.NewLocalPeer(server)
+	}
+	for _, server := range servers {
+		server.SetPeers(peers)
+	}
+	servers[0].Start()
+	servers[1].Start()
+
+	// commit 1 + 2 + ... + 20, waiting for a snapshot, and its compaction,
+	// half way
+	command := func(n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			for _, server := range servers[:2] {
+				response := make(chan []byte, 1)
+				if server.Command([]byte(strconv.Itoa(n)), response) != nil {
+					continue
+				}
+				if _, ok := <-response; ok {
+					return
+				}
+			}
+			time.Sleep(config.MinElectionTimeout)
+		}
+		t.Fatalf("command %d never committed", n)
+	}
+	for n := 1; n <= 10; n++ {
+		command(n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if metas, _ := snapshots[0].List(); len(metas) > 0 {
+			if metas, _ := snapshots[1].List(); len(metas) > 0 {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no snapshot taken")
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+	for n := 11; n <= 20; n++ {
+		command(n)
+	}
+
+	// server 3 is sent a snapshot, and caught up from there
+	servers[2].Start()
+	deadline = time.Now().Add(5 * time.Second)
+	for fsms[2].get() != 210 {
+		if time.Now().After(deadline) {
+			t.Fatalf("server 3 has %d, expected 210", fsms[2].get())
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+	for _, server := range servers {
+		server.Stop()
+	}
+	// the leader may give up on the snapshot's response, and not log it, so
+	// look for server 3 restoring it
+	installed := false
+	for _, line := range strings.Split(logBuffer.String(), "\n") {
+		if strings.Contains(line, "id=3 ") && strings.Contains(line, "restored snapshot") {
+			installed = true
+		}
+	}
+	if !installed {
+		t.Errorf("server 3 wasn't sent a snapshot")
+	}
+
+	// a restarted server restores its latest snapshot, rather than applying
+	// the entries before it
+	metas, err := snapshots[0].List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsm := &sumFSM{}
+	server := raft.NewServer(1, bytes.NewBuffer(stores[0].Bytes()), fsm.apply, config)
+	if err := server.SetSnapshotStore(snapshots[0], fsm); err != nil {
+		t.Fatal(err)
+	}
+	if got := fsm.get(); got == 0 || got > 210 {
+		t.Errorf("after restoring snapshot through index %d, got %d", metas[0].Index, got)
+	}
+	if expected, got := metas[0].Index, server.Status().CommitIndex; expected != got {
+		t.Errorf("expected commit index %d, got %d", expected, got)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+
+	dir, err := ioutil.TempDir("", "raft-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	fsm, store := &sumFSM{}, &bytes.Buffer{}
+	server := raft.NewServer(1, store, fsm.apply, config)
+	if _, err := server.Snapshot(); err != raft.ErrNoSnapshotStore {
+		t.Errorf("without a snapshot store: expected %v, got %v", raft.ErrNoSnapshotStore, err)
+	}
+	snapshots, err := raft.NewFileSnapshotStore(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetSnapshotStore(snapshots, fsm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Snapshot(); err != raft.ErrNothingCommitted {
+		t.Errorf("before committing: expected %v, got %v", raft.ErrNothingCommitted, err)
+	}
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+	server.Start()
+	select {
+	case <-server.LeaderCh():
+	case <-time.After(10 * config.MaxElectionTimeout):
+		t.Fatal("never became leader")
+	}
+	command := func(n int) {
+		response := make(chan []byte, 1)
+		if err := server.Command([]byte(strconv.Itoa(n)), response); err != nil {
+			t.Fatal(err)
+		}
+		<-response
+	}
+	for n := 1; n <= 5; n++ {
+		command(n)
+	}
+
+	// a snapshot's taken on demand, and taken again only once more has
+	// been committed
+	meta, err := server.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := server.Status().CommitIndex, meta.Index; expected != got {
+		t.Errorf("expected snapshot through index %d, got %d", expected, got)
+	}
+	if again, err := server.Snapshot(); err != nil || again.Id != meta.Id {
+		t.Errorf("expected snapshot %s again, got %s (%v)", meta.Id, again.Id, err)
+	}
+
+	// restored data replaces the state machine's, and commands apply on top
+	if err := server.Restore(strings.NewReader("100")); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 100, fsm.get(); expected != got {
+		t.Errorf("after restoring: expected %d, got %d", expected, got)
+	}
+	command(1)
+	if expected, got := 101, fsm.get(); expected != got {
+		t.Errorf("after restoring and committing: expected %d, got %d", expected, got)
+	}
+	if err := server.Restore(strings.NewReader("bogus")); err == nil {
+		t.Errorf("restoring bogus data: expected error")
+	}
+	server.Stop()
+
+	// and survive a restart
+	fsm = &sumFSM{}
+	server = raft.NewServer(1, bytes.NewBuffer(store.Bytes()), fsm.apply, config)
+	if err := server.SetSnapshotStore(snapshots, fsm); err != nil {
+		t.Fatal(err)
+	}
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+	server.Start()
+	defer server.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for fsm.get() != 101 {
+		if time.Now().After(deadline) {
+			t.Fatalf("after restarting: expected 101, got %d", fsm.get())
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+}
+
+// sumFSM adds up the integers it's sent.
+type sumFSM struct {
+	sync.Mutex
+	sum int
+}
+
+func (f *sumFSM) apply(cmd []byte) ([]byte, error) {
+	n, err := strconv.Atoi(string(cmd))
+	if err != nil {
+		return nil, err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.sum += n
+	return cmd, nil
+}
+
+func (f *sumFSM) get() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.sum
+}
+
+func (f *sumFSM) Snapshot() (func(io.Writer) error, error) {
+	sum := f.get()
+	return func(w io.Writer) error {
+		_, err := fmt.Fprint(w, sum)
+		return err
+	}, nil
+}
+
+func (f *sumFSM) Restore(r io.Reader) error {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	sum, err := strconv.Atoi(string(buf))
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.sum = sum
+	return nil
+}
@@ -0,0 +1,317 @@
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	ErrCorruptState = errors.New("stable state is corrupt")
+	ErrFenced       = errors.New("stable store is in use by another server")
+)
+
+// StableState is the state a server must never forget, even across a crash:
+// "currentTerm" and "votedFor". Forgetting either could let a server vote
+// twice in the same term, and so elect two leaders.
+type StableState struct {
+	Term uint64
+	Vote uint64
+}
+
+// StableStore persists a server's stable state. StoreState must not return
+// until the state is durable, and LoadState must return either the last state
+// stored, or the one before it, but never a mixture of the two.
+type StableStore interface {
+	LoadState() (StableState, error)
+	StoreState(StableState) error
+}
+
+// Fencer is implemented by stable stores that can make sure only one server
+// uses them at a time, e.g. with a lock on a file, or a lease. Two processes
+// started with the same identity and the same data directory, by mistake,
+// could otherwise both vote in the same term, each believing it hadn't yet.
+// Fence acquires exclusive use of the store, for as long as it's open, or
+// until Unfence releases it, and fails with ErrFenced if another server has
+// it.
+type Fencer interface {
+	Fence() error
+	Unfence() error
+}
+
+// SetStableStore restores the server's term and vote from the store, and
+// persists them there before the server acts on them, e.g. by granting a vote.
+// It must be called before Start. Without a stable store, a restarted server
+// begins again at term 1. It fails with ErrTermRegression if the stored term
+// is older than the last entry in the log, which the server can only have
+// received after seeing that entry's term. If the store is a Fencer, it's
+// fenced first, and SetStableStore fails with ErrFenced if another server is
+// using it, so that server's votes can't be repeated. If it fails otherwise,
+// the fence is released, so the store can be used again once it's repaired.
+func (s *Server) SetStableStore(store StableStore) error {
+	state, err := loadStable(store)
+	if err == nil && state.Term > 0 && state.Term < s.log.lastTerm() {
+		err = ErrTermRegression
+	}
+	if err != nil {
+		if f, ok := store.(Fencer); ok && err != ErrFenced {
+			f.Unfence()
+		}
+		return err
+	}
+	if state.Term > 0 {
+		s.term, s.vote = state.Term, state.Vote
+	}
+	s.stable, s.saved = store, state
+	s.publishStatus()
+	return nil
+}
+
+// loadStable fences the store, if it's a Fencer, and loads its state.
+func loadStable(store StableStore) (StableState, error) {
+	if f, ok := store.(Fencer); ok {
+		if err := f.Fence(); err != nil {
+			return StableState{}, err
+		}
+	}
+	return store.LoadState()
+}
+
+// saveStable persists the term and vote, if they've changed since they were
+// last persisted. It refuses to persist a term older than the last one.
+func (s *Server) saveStable() error {
+	state := StableState{Term: s.term, Vote: s.vote}
+	if s.stable == nil || state == s.saved {
+		return nil
+	}
+	if state.Term < s.saved.Term {
+		s.logGeneric("persisting term=%d: %s from %d", state.Term, ErrTermRegression, s.saved.Term)
+		return ErrTermRegression
+	}
+	if err := s.stable.StoreState(state); err != nil {
+		s.logGeneric("persisting term=%d vote=%d: %s", state.Term, state.Vote, err)
+		return err
+	}
+	s.saved = state
+	return nil
+}
+
+// journalLimit is the number of records a FileStableStore appends to its
+// journal, before compacting them into its state file.
+const journalLimit = 64
+
+// recordSize is the size of a record: the term, the vote, and a checksum of
+// both.
+const recordSize = 8 + 8 + 4
+
+// FileStableStore is a StableStore backed by two files. Each state is appended
+// to a journal, and synced, which costs a single small write. When the
+// journal grows long, the latest state is written to a temporary file, which
+// is synced and renamed over the state file, and the journal is emptied.
+//
+// Every record is checksummed, so a write torn by a crash is recognized, and
+// ignored, leaving the previous state; the rename means the state file is
+// always either the old one or the new one.
+//
+// A FileStableStore is a Fencer: it locks path + ".lock", with an advisory
+// lock that the operating system releases when the store is closed, or the
+// process exits, so a crashed server never leaves a stale lock behind. Where
+// the platform has no such locks, fencing does nothing.
+type FileStableStore struct {
+	sync.Mutex
+	path    string // of the state file; the journal is path + ".journal"
+	journal *os.File
+	lock    *os.File // held while fenced
+	records int      // in the journal
+	state   StableState
+}
+
+// NewFileStableStore opens (or creates) the stable store at the given path.
+// A torn record at the end of the journal is discarded.
+func NewFileStableStore(path string) (*FileStableStore, error) {
+	s := &FileStableStore{path: path}
+
+	buf, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		state, ok := decodeRecord(buf)
+		if !ok || len(buf) != recordSize {
+			return nil, ErrCorruptState
+		}
+		s.state = state
+	}
+
+	s.journal, err = os.OpenFile(path+".journal", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	buf, err = ioutil.ReadAll(s.journal)
+	if err != nil {
+		s.journal.Close()
+		return nil, err
+	}
+	for len(buf) >= recordSize {
+		state, ok := decodeRecord(buf[:recordSize])
+		if !ok {
+			break
+		}
+		s.state = state
+		s.records++
+		buf = buf[recordSize:]
+	}
+	// Drop whatever follows the valid records, so new ones follow them.
+	if err := s.journal.Truncate(int64(s.records * recordSize)); err != nil {
+		s.journal.Close()
+		return nil, err
+	}
+	if _, err := s.journal.Seek(int64(s.records*recordSize), io.SeekStart); err != nil {
+		s.journal.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileStableStore) LoadState() (StableState, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.state, nil
+}
+
+func (s *FileStableStore) StoreState(state StableState) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, err := s.journal.Write(encodeRecord(state)); err != nil {
+		return err
+	}
+	if err := s.journal.Sync(); err != nil {
+		return err
+	}
+	s.state = state
+	s.records++
+
+	if s.records < journalLimit {
+		return nil
+	}
+	return s.compact()
+}
+
+// compact writes the current state to the state file, and empties the journal.
+// If it fails part way, the journal still ends with the current state.
+func (s *FileStableStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(encodeRecord(s.state)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+
+	if err := s.journal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.records = 0
+	return s.journal.Sync()
+}
+
+// Fence locks the store's lock file, failing with ErrFenced if it's locked by
+// another store, in this process or another.
+func (s *FileStableStore) Fence() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.lock != nil {
+		return nil // we already have it
+	}
+	f, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	s.lock = f
+	return nil
+}
+
+// Unfence releases the store's lock file, if it's locked.
+func (s *FileStableStore) Unfence() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.unfence()
+}
+
+func (s *FileStableStore) unfence() error {
+	if s.lock == nil {
+		return nil
+	}
+	err := s.lock.Close()
+	s.lock = nil
+	return err
+}
+
+// Close closes the journal, and releases the fence, if it's held.
+func (s *FileStableStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.unfence()
+	return s.journal.Close()
+}
+
+// syncDir makes a rename in the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func encodeRecord(state StableState) []byte {
+	buf := make([]byte, recordSize)
+	binary.BigEndian.PutUint64(buf[0:], state.Term)
+	binary.BigEndian.PutUint64(buf[8:], state.Vote)
+	binary.BigEndian.PutUint32(buf[16:], crc32.ChecksumIEEE(buf[:16]))
+	return buf
+}
+
+func decodeRecord(buf []byte) (StableState, bool) {
+	if len(buf) < recordSize {
+		return StableState{}, false
+	}
+	if crc32.ChecksumIEEE(buf[:16]) != binary.BigEndian.Uint32(buf[16:]) {
+		return StableState{}, false
+	}
+	return StableState{
+		Term: binary.BigEndian.Uint64(buf[0:]),
+		Vote: binary.BigEndian.Uint64(buf[8:]),
+	}, true
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package raft
+
+import (
+	"os"
+)
+
+// lockFile does nothing where there's no flock.
+func lockFile(f *os.File) error {
+	return nil
+}
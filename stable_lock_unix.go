@@ -0,0 +1,19 @@
+//go:build unix
+
+package raft
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on the file, without waiting for it.
+// Locks belong to the open file, so a second open of the same file, even in
+// the same process, can't take it too.
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrFenced
+	}
+	return err
+}
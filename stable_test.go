@@ -0,0 +1,286 @@
+package raft_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/peterbourgon/raft"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFileStableStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft-stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+
+	store, err := raft.NewFileStableStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := store.LoadState(); state != (raft.StableState{}) {
+		t.Errorf("expected empty state, got %+v", state)
+	}
+
+	// enough states to compact the journal a few times
+	last := raft.StableState{}
+	for term := uint64(1); term <= 200; term++ {
+		last = raft.StableState{Term: term, Vote: term % 3}
+		if err := store.StoreState(last); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	reopen := func() raft.StableState {
+		store, err := raft.NewFileStableStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		state, _ := store.LoadState()
+		return state
+	}
+	if got := reopen(); got != last {
+		t.Errorf("after reopening, expected %+v, got %+v", last, got)
+	}
+
+	// a write torn by a crash leaves the previous state
+	f, err := os.OpenFile(path+".journal", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0xff, 0, 0})
+	f.Close()
+	if got := reopen(); got != last {
+		t.Errorf("after a torn write, expected %+v, got %+v", last, got)
+	}
+
+	// a corrupt state file isn't mistaken for a valid one
+	if err := ioutil.WriteFile(path, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raft.NewFileStableStore(path); err != raft.ErrCorruptState {
+		t.Errorf("expected %s, got %v", raft.ErrCorruptState, err)
+	}
+}
+
+func TestServerStableStore(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+
+	dir, err := ioutil.TempDir("", "raft-stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := raft.NewFileStableStore(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, raft.Config{})
+	if err := server.SetStableStore(store); err != nil {
+		t.Fatal(err)
+	}
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), nonresponsivePeer(2), nonresponsivePeer(3)))
+	server.Start()
+	rvr := server.RequestVote(raft.RequestVote{Term: 7, CandidateId: 2})
+	server.Stop()
+	if !rvr.VoteGranted {
+		t.Fatalf("expected vote to be granted")
+	}
+	if expected, got := (raft.StableState{Term: 7, Vote: 2}), mustLoad(t, store); expected != got {
+		t.Errorf("expected %+v persisted, got %+v", expected, got)
+	}
+
+	// a restarted server remembers its vote
+	server = raft.NewServer(1, &bytes.Buffer{}, noop, raft.Config{})
+	if err := server.SetStableStore(store); err != nil {
+		t.Fatal(err)
+	}
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), nonresponsivePeer(2), nonresponsivePeer(3)))
+	if expected, got := uint64(7), server.Status().Term; expected != got {
+		t.Errorf("expected term %d, got %d", expected, got)
+	}
+	server.Start()
+	defer server.Stop()
+	if rvr := server.RequestVote(raft.RequestVote{Term: 7, CandidateId: 3}); rvr.VoteGranted {
+		t.Errorf("voted twice in term 7")
+	}
+}
+
+func TestStableStoreRegression(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+
+	dir, err := ioutil.TempDir("", "raft-stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := raft.NewFileStableStore(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.StoreState(raft.StableState{Term: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a log with entries from term 3 must have seen term 3
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	entries := bytes.NewBufferString("0a8312d4 0000000000000001 0000000000000003 00 {}\n")
+	server := raft.NewServer(1, entries, noop, raft.Config{})
+	if err := server.SetStableStore(store); err != raft.ErrTermRegression {
+		t.Errorf("expected %v, got %v", raft.ErrTermRegression, err)
+	}
+
+	// which leaves the store unfenced, for another attempt
+	other, err := raft.NewFileStableStore(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := other.Fence(); err != nil {
+		t.Errorf("after the failure, expected the store unfenced, got %v", err)
+	}
+	if err := raft.NewServer(1, &bytes.Buffer{}, noop, raft.Config{}).SetStableStore(store); err != raft.ErrFenced {
+		t.Errorf("fenced by another store, expected %v, got %v", raft.ErrFenced, err)
+	}
+}
+
+func TestStableStoreFence(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+
+	dir, err := ioutil.TempDir("", "raft-stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+
+	first, err := raft.NewFileStableStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := raft.NewServer(1, &bytes.Buffer{}, noop, raft.Config{}).SetStableStore(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second instance, sharing the data directory by mistake, is refused
+	second, err := raft.NewFileStableStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if expected, got := raft.ErrFenced, raft.NewServer(1, &bytes.Buffer{}, noop, raft.Config{}).SetStableStore(second); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// until the first is closed
+	first.Close()
+	if err := raft.NewServer(1, &bytes.Buffer{}, noop, raft.Config{}).SetStableStore(second); err != nil {
+		t.Errorf("after close, expected no error, got %v", err)
+	}
+}
+
+func TestTermDiscovery(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+
+	dir, err := ioutil.TempDir("", "raft-stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := raft.NewFileStableStore(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	if err := server.SetStableStore(store); err != nil {
+		t.Fatal(err)
+	}
+	peer := &termPeer{id: 2}
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), peer, nonresponsivePeer(3)))
+	server.Start()
+	defer server.Stop()
+	select {
+	case <-server.LeaderCh():
+	case <-time.After(4 * config.MaxElectionTimeout):
+		t.Fatal("never became leader")
+	}
+
+	// a newer term in a response to the leader, and then to a candidate,
+	// is adopted, and persisted
+	for _, state := range []string{raft.Leader, raft.Candidate} {
+		deadline := time.Now().Add(10 * config.MaxElectionTimeout)
+		for server.State() != state {
+			if time.Now().After(deadline) {
+				t.Fatalf("never became %s", state)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		term := server.Status().Term + 1000
+		peer.setTerm(term)
+		for server.Status().Term < term {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: never adopted term %d, still in %d", state, term, server.Status().Term)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if got := mustLoad(t, store).Term; got < term {
+			t.Errorf("%s: expected term %d persisted, got %d", state, term, got)
+		}
+	}
+}
+
+// termPeer votes for every candidate, and accepts every AppendEntries, until
+// it's given a term, which it then answers everything with.
+type termPeer struct {
+	id   uint64
+	term uint64
+}
+
+func (p *termPeer) setTerm(term uint64) { atomic.StoreUint64(&p.term, term) }
+
+func (p *termPeer) Id() uint64 { return p.id }
+func (p *termPeer) AppendEntries(ae raft.AppendEntries) raft.AppendEntriesResponse {
+	if term := atomic.LoadUint64(&p.term); term != 0 {
+		return raft.AppendEntriesResponse{Term: term}
+	}
+	return raft.AppendEntriesResponse{Term: ae.Term, Success: true}
+}
+func (p *termPeer) RequestVote(rv raft.RequestVote) raft.RequestVoteResponse {
+	if term := atomic.LoadUint64(&p.term); term != 0 {
+		return raft.RequestVoteResponse{Term: term}
+	}
+	return raft.RequestVoteResponse{Term: rv.Term, VoteGranted: true}
+}
+func (p *termPeer) Command([]byte, chan []byte) error {
+	return fmt.Errorf("not implemented")
+}
+
+func mustLoad(t *testing.T, store raft.StableStore) raft.StableState {
+	state, err := store.LoadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
@@ -0,0 +1,157 @@
+package raft
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Status is a snapshot of a server's view of the cluster, for operators.
+// Everything but Lag, Elections, and Cluster, which are updated as they
+// change, is taken at the same moment, between two events in the server's
+// main loop, so e.g. the state and term are always consistent with one
+// another.
+type Status struct {
+	Id             uint64         `json:"id"`
+	State          string         `json:"state"`
+	Term           uint64         `json:"term"`
+	Leader         uint64         `json:"leader"` // 0 if unknown
+	CommitIndex    uint64         `json:"commit_index"`
+	AppliedIndex   uint64         `json:"applied_index"` // may trail CommitIndex; see SetAsyncApply
+	LastIndex      uint64         `json:"last_index"`
+	LastTerm       uint64         `json:"last_term"`
+	Snapshot       uint64         `json:"snapshot"`        // index of the latest snapshot, if any
+	CompactedIndex uint64         `json:"compacted_index"` // of the last entry discarded after a snapshot
+	LastContact    time.Time      `json:"last_contact"`    // with the leader, followers only
+	Peers          []uint64       `json:"peers"`           // voting members, including this server
+	Learners       []uint64       `json:"learners"`
+	Witness        bool           `json:"witness,omitempty"` // votes, as the peers are even
+	Quorum         int            `json:"quorum"`            // votes needed to elect, or commit
+	FaultTolerance int            `json:"fault_tolerance"`   // voters that can fail, leaving a quorum
+	Lag            Lag            `json:"lag"`
+	Elections      ElectionCounts `json:"elections"`
+
+	// Cluster is the soft state of each server, as last reported to the
+	// leader, including its own, and AppliedSpread is how far the server
+	// that's applied the most is ahead of the one that's applied the least.
+	// Only the leader knows them.
+	Cluster       map[uint64]PeerState `json:"cluster,omitempty"`
+	AppliedSpread uint64               `json:"applied_spread,omitempty"`
+}
+
+// Status returns a snapshot of the server's state. It's safe to call at any
+// time, and never waits on the server.
+func (s *Server) Status() Status {
+	st, _ := s.status.Load().(Status)
+	st.Lag = s.Lag()
+	st.Elections = s.ElectionCounts()
+	if st.State == Leader {
+		st.Cluster, st.AppliedSpread = s.cluster(append(append([]uint64{}, st.Peers...), st.Learners...))
+	}
+	return st
+}
+
+// publishStatus takes a snapshot of the server's state, for Status, and
+// reports the size of the log, and of the command queue, to the metrics sink.
+// It must only be called from the main loop, or before the server is started.
+func (s *Server) publishStatus() {
+	snapshot, compacted := s.log.snapshotted()
+	lastContact := time.Time{}
+	if s.State() == Follower {
+		lastContact = s.lastContact
+	}
+	s.status.Store(Status{
+		Id:             s.id,
+		State:          s.State(),
+		Term:           s.term,
+		Leader:         s.leader,
+		CommitIndex:    s.log.getCommitIndex(),
+		AppliedIndex:   s.log.appliedIndex(),
+		LastIndex:      s.log.lastIndex(),
+		LastTerm:       s.log.lastTerm(),
+		Snapshot:       snapshot,
+		CompactedIndex: compacted,
+		LastContact:    lastContact,
+		Peers:          sortedIds(s.peers),
+		Learners:       sortedIds(s.learners),
+		Witness:        s.witness != nil && len(s.peers)%2 == 0,
+		Quorum:         s.peers.Quorum(),
+		FaultTolerance: union(s.voters(), Peers{s.id: nil}).FaultTolerance(),
+	})
+	s.metrics.gauge(MetricLogEntries, float64(s.log.size()))
+	s.metrics.gauge(MetricLogCommitIndex, float64(s.log.getCommitIndex()))
+	s.metrics.gauge(MetricCommandQueueDepth, float64(len(s.commandChan)))
+}
+
+// Stats returns the server's Status, flattened into strings, for dashboards
+// and monitoring systems that expect a flat set of values. Times since the
+// last contact, with the leader on a follower, and with each follower on the
+// leader, are durations, or "never".
+func (s *Server) Stats() map[string]string {
+	st := s.Status()
+	u := func(n uint64) string { return strconv.FormatUint(n, 10) }
+	since := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).String()
+	}
+	stats := map[string]string{
+		"id":               u(st.Id),
+		"state":            st.State,
+		"term":             u(st.Term),
+		"leader":           u(st.Leader),
+		"commit_index":     u(st.CommitIndex),
+		"applied_index":    u(st.AppliedIndex),
+		"last_log_index":   u(st.LastIndex),
+		"last_log_term":    u(st.LastTerm),
+		"snapshot_index":   u(st.Snapshot),
+		"compacted_index":  u(st.CompactedIndex),
+		"num_peers":        strconv.Itoa(len(st.Peers)),
+		"num_learners":     strconv.Itoa(len(st.Learners)),
+		"quorum":           strconv.Itoa(st.Quorum),
+		"fault_tolerance":  strconv.Itoa(st.FaultTolerance),
+		"lag":              u(st.Lag.Last),
+		"failed_elections": u(st.Elections.Failing),
+	}
+	switch st.State {
+	case Follower:
+		stats["last_contact"] = since(st.LastContact)
+	case Leader:
+		for _, id := range append(append([]uint64{}, st.Peers...), st.Learners...) {
+			if id != st.Id {
+				stats["last_contact."+u(id)] = since(st.Cluster[id].Updated)
+			}
+		}
+	}
+	return stats
+}
+
+// PeerProgress is how far the leader has replicated its log to a follower.
+type PeerProgress struct {
+	NextIndex    uint64    `json:"next_index"`   // of the next entry the leader will send
+	MatchIndex   uint64    `json:"match_index"`  // highest index known to be replicated
+	LastContact  time.Time `json:"last_contact"` // last response from the follower; zero if none
+	Snapshotting bool      `json:"snapshotting"` // the leader's sending it a snapshot
+}
+
+// ReplicationStatus returns the replication progress of each follower,
+// including learners, by id, so operators can see which is lagging, and by
+// how much. Only the leader knows it; other servers return nil. It's safe to
+// call at any time, and never waits on the server.
+func (s *Server) ReplicationStatus() map[uint64]PeerProgress {
+	ni, _ := s.progress.Load().(*nextIndex)
+	if ni == nil {
+		return nil
+	}
+	return ni.progress()
+}
+
+func sortedIds(p Peers) []uint64 {
+	ids := make([]uint64, 0, len(p))
+	for id := range p {
+		ids = append(ids, id)
+	}
+	sort.Sort(uint64Slice(ids))
+	return ids
+}
@@ -0,0 +1,408 @@
+package rafttcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/peterbourgon/raft"
+	"io"
+	"sort"
+)
+
+// Every message is a frame: a 4-byte big-endian length, a 1-byte message type,
+// and a payload of that length. Payloads are sequences of uvarints, and
+// uvarint-length-prefixed byte strings.
+
+const (
+	msgId byte = iota + 1
+	msgAppendEntries
+	msgRequestVote
+	msgCommand
+	msgHandshake
+)
+
+// responses have the same type as their request, with the high bit set
+const msgResponse byte = 0x80
+
+// maxFrameSize guards against allocating absurd buffers for corrupt frames.
+const maxFrameSize = 64 << 20
+
+var (
+	errShortFrame = errors.New("short frame")
+	errLongFrame  = errors.New("frame too long")
+)
+
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	buf := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	buf[4] = typ
+	_, err := w.Write(append(buf, payload...))
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n > maxFrameSize {
+		return 0, nil, errLongFrame
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[4], payload, nil
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint(v uint64) { e.buf = binary.AppendUvarint(e.buf, v) }
+
+func (e *encoder) bool(b bool) {
+	if b {
+		e.uint(1)
+	} else {
+		e.uint(0)
+	}
+}
+
+func (e *encoder) bytes(p []byte) {
+	e.uint(uint64(len(p)))
+	e.buf = append(e.buf, p...)
+}
+
+type decoder struct {
+	buf []byte
+	err error // the first error encountered, after which decoding stops
+}
+
+func (d *decoder) uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errShortFrame
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) bool() bool { return d.uint() != 0 }
+
+func (d *decoder) bytes() []byte {
+	n := d.uint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = errShortFrame
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	p := make([]byte, n)
+	copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return p
+}
+
+func encodeAppendEntries(ae raft.AppendEntries) []byte {
+	e := &encoder{}
+	e.uint(ae.Term)
+	e.uint(ae.LeaderId)
+	e.uint(ae.PrevLogIndex)
+	e.uint(ae.PrevLogTerm)
+	e.uint(ae.CommitIndex)
+	e.uint(uint64(len(ae.Entries)))
+	for _, entry := range ae.Entries {
+		e.uint(entry.Index)
+		e.uint(entry.Term)
+		e.uint(uint64(entry.Type))
+		e.bytes(entry.Command)
+	}
+	e.bool(ae.StepDown)
+	versioned := ae.Version != 0 || ae.ClusterId != ""
+	annotated := versioned // the version follows the annotations
+	for _, entry := range ae.Entries {
+		annotated = annotated || len(entry.Annotations) > 0
+	}
+	if annotated { // each entry's annotations, as count, then keys and values
+		for _, entry := range ae.Entries {
+			e.uint(uint64(len(entry.Annotations)))
+			for k, v := range entry.Annotations {
+				e.bytes([]byte(k))
+				e.bytes([]byte(v))
+			}
+		}
+	}
+	if versioned {
+		e.uint(uint64(ae.Version))
+	}
+	if ae.ClusterId != "" {
+		e.bytes([]byte(ae.ClusterId))
+	}
+	return e.buf
+}
+
+func decodeAppendEntries(p []byte) (raft.AppendEntries, error) {
+	d := &decoder{buf: p}
+	ae := raft.AppendEntries{
+		Term:         d.uint(),
+		LeaderId:     d.uint(),
+		PrevLogIndex: d.uint(),
+		PrevLogTerm:  d.uint(),
+		CommitIndex:  d.uint(),
+	}
+	n := d.uint()
+	if n > uint64(len(d.buf)) {
+		return ae, errShortFrame // each entry takes at least one byte
+	}
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		ae.Entries = append(ae.Entries, raft.LogEntry{
+			Index:   d.uint(),
+			Term:    d.uint(),
+			Type:    raft.EntryType(d.uint()),
+			Command: d.bytes(),
+		})
+	}
+	if len(d.buf) > 0 { // absent from older peers' frames
+		ae.StepDown = d.bool()
+	}
+	if len(d.buf) > 0 { // absent unless an entry's annotated
+		for i := range ae.Entries {
+			n := d.uint()
+			if n > uint64(len(d.buf)) {
+				return ae, errShortFrame
+			}
+			for j := uint64(0); j < n && d.err == nil; j++ {
+				if ae.Entries[i].Annotations == nil {
+					ae.Entries[i].Annotations = map[string]string{}
+				}
+				k, v := string(d.bytes()), string(d.bytes())
+				ae.Entries[i].Annotations[k] = v
+			}
+		}
+	}
+	if len(d.buf) > 0 { // absent from older peers' frames
+		ae.Version = int(d.uint())
+	}
+	if len(d.buf) > 0 { // absent unless the leader has a cluster ID
+		ae.ClusterId = string(d.bytes())
+	}
+	return ae, d.err
+}
+
+func encodeAppendEntriesResponse(aer raft.AppendEntriesResponse) []byte {
+	e := &encoder{}
+	e.uint(aer.Term)
+	e.bool(aer.Success)
+	e.bool(aer.Gap != nil)
+	if aer.Gap != nil {
+		e.uint(aer.Gap.LastIndex)
+		e.uint(aer.Gap.CommitIndex)
+		e.uint(aer.Gap.ConflictTerm)
+		e.uint(aer.Gap.ConflictIndex)
+	}
+	e.uint(uint64(aer.Rejection))
+	e.bool(aer.State != nil)
+	if aer.State != nil {
+		e.uint(aer.State.Applied)
+		names := make([]string, 0, len(aer.State.Health))
+		for name := range aer.State.Health {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		e.uint(uint64(len(names)))
+		for _, name := range names {
+			e.bytes([]byte(name))
+			e.bool(aer.State.Health[name])
+		}
+		e.uint(uint64(aer.State.Version))
+	}
+	return e.buf
+}
+
+func decodeAppendEntriesResponse(p []byte) (raft.AppendEntriesResponse, error) {
+	d := &decoder{buf: p}
+	aer := raft.AppendEntriesResponse{
+		Term:    d.uint(),
+		Success: d.bool(),
+	}
+	if d.bool() {
+		aer.Gap = &raft.LogGap{
+			LastIndex:     d.uint(),
+			CommitIndex:   d.uint(),
+			ConflictTerm:  d.uint(),
+			ConflictIndex: d.uint(),
+		}
+	}
+	if len(d.buf) > 0 { // absent from older peers' frames
+		aer.Rejection = raft.RejectionReason(d.uint())
+	}
+	if len(d.buf) > 0 && d.bool() {
+		aer.State = &raft.SoftState{Applied: d.uint()}
+		n := d.uint()
+		if n > uint64(len(d.buf)) {
+			return aer, errShortFrame // each flag takes at least one byte
+		}
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			if aer.State.Health == nil {
+				aer.State.Health = map[string]bool{}
+			}
+			name := string(d.bytes())
+			aer.State.Health[name] = d.bool()
+		}
+		if len(d.buf) > 0 { // absent from older peers' frames
+			aer.State.Version = int(d.uint())
+		}
+	}
+	return aer, d.err
+}
+
+func encodeRequestVote(rv raft.RequestVote) []byte {
+	e := &encoder{}
+	e.uint(rv.Term)
+	e.uint(rv.CandidateId)
+	e.uint(rv.LastLogIndex)
+	e.uint(rv.LastLogTerm)
+	e.bool(rv.Transfer)
+	e.uint(uint64(rv.Version))
+	if rv.ClusterId != "" {
+		e.bytes([]byte(rv.ClusterId))
+	}
+	return e.buf
+}
+
+func decodeRequestVote(p []byte) (raft.RequestVote, error) {
+	d := &decoder{buf: p}
+	rv := raft.RequestVote{
+		Term:         d.uint(),
+		CandidateId:  d.uint(),
+		LastLogIndex: d.uint(),
+		LastLogTerm:  d.uint(),
+	}
+	if len(d.buf) > 0 { // absent from older peers' frames
+		rv.Transfer = d.bool()
+	}
+	if len(d.buf) > 0 {
+		rv.Version = int(d.uint())
+	}
+	if len(d.buf) > 0 { // absent unless the candidate has a cluster ID
+		rv.ClusterId = string(d.bytes())
+	}
+	return rv, d.err
+}
+
+func encodeRequestVoteResponse(rvr raft.RequestVoteResponse) []byte {
+	e := &encoder{}
+	e.uint(rvr.Term)
+	e.bool(rvr.VoteGranted)
+	e.uint(uint64(rvr.Version))
+	return e.buf
+}
+
+func decodeRequestVoteResponse(p []byte) (raft.RequestVoteResponse, error) {
+	d := &decoder{buf: p}
+	rvr := raft.RequestVoteResponse{
+		Term:        d.uint(),
+		VoteGranted: d.bool(),
+	}
+	if len(d.buf) > 0 { // absent from older peers' frames
+		rvr.Version = int(d.uint())
+	}
+	return rvr, d.err
+}
+
+func encodeHandshake(h raft.Handshake) []byte {
+	e := &encoder{}
+	e.uint(h.Id)
+	e.bytes([]byte(h.ClusterId))
+	e.uint(uint64(h.Version))
+	e.uint(uint64(h.MinVersion))
+	e.uint(uint64(h.MaxVersion))
+	return e.buf
+}
+
+func decodeHandshake(d *decoder) raft.Handshake {
+	return raft.Handshake{
+		Id:         d.uint(),
+		ClusterId:  string(d.bytes()),
+		Version:    int(d.uint()),
+		MinVersion: int(d.uint()),
+		MaxVersion: int(d.uint()),
+	}
+}
+
+// A handshake response carries the server's handshake, and the reason it
+// rejected the client's, if it did.
+func encodeHandshakeResponse(h raft.Handshake, err error) []byte {
+	e := &encoder{buf: encodeHandshake(h)}
+	if err != nil {
+		e.bytes([]byte(err.Error()))
+	}
+	return e.buf
+}
+
+func decodeHandshakeResponse(p []byte) (raft.Handshake, string, error) {
+	d := &decoder{buf: p}
+	h := decodeHandshake(d)
+	var rejection string
+	if len(d.buf) > 0 {
+		rejection = string(d.bytes())
+	}
+	return h, rejection, d.err
+}
+
+// A command response carries either the response from the remote server's
+// apply function, or the error that prevented it.
+func encodeCommandResponse(resp []byte, err error) []byte {
+	e := &encoder{}
+	if err != nil {
+		e.bytes([]byte(err.Error()))
+	} else {
+		e.bytes(nil)
+	}
+	e.bytes(resp)
+	return e.buf
+}
+
+func decodeCommandResponse(p []byte) ([]byte, error) {
+	d := &decoder{buf: p}
+	msg, resp := d.bytes(), d.bytes()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(msg) > 0 {
+		return nil, remoteError(string(msg))
+	}
+	return resp, nil
+}
+
+// remoteErrors are the errors a remote server may report, which we recognize
+// by their text, so callers can compare them as usual.
+var remoteErrors = []error{
+	raft.ErrUnknownLeader,
+	raft.ErrNotLeader,
+	raft.ErrNoQuorum,
+	raft.ErrQuorumLost,
+	raft.ErrDeposed,
+	raft.ErrTimeout,
+	raft.ErrQuotaExceeded,
+	raft.ErrEntryTooLarge,
+	raft.ErrTooBusy,
+}
+
+func remoteError(msg string) error {
+	for _, err := range remoteErrors {
+		if msg == err.Error() {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,130 @@
+package rafttcp
+
+import (
+	"bytes"
+	"github.com/peterbourgon/raft"
+	"reflect"
+	"testing"
+)
+
+func TestFrames(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writeFrame(buf, msgCommand, []byte("hello"))
+	writeFrame(buf, msgId|msgResponse, nil)
+
+	for _, expected := range []struct {
+		typ     byte
+		payload string
+	}{
+		{msgCommand, "hello"},
+		{msgId | msgResponse, ""},
+	} {
+		typ, payload, err := readFrame(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != expected.typ || string(payload) != expected.payload {
+			t.Errorf("expected %#x %q, got %#x %q", expected.typ, expected.payload, typ, payload)
+		}
+	}
+
+	if _, _, err := readFrame(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 1})); err != errLongFrame {
+		t.Errorf("expected %s, got %v", errLongFrame, err)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	ae := raft.AppendEntries{
+		Term:         3,
+		LeaderId:     2,
+		PrevLogIndex: 40,
+		PrevLogTerm:  2,
+		CommitIndex:  39,
+		StepDown:     true,
+		Entries: []raft.LogEntry{
+			{Index: 41, Term: 3, Type: raft.EntryNoop},
+			{Index: 42, Term: 3, Command: []byte(`{"x":1}`)},
+		},
+	}
+	if got, err := decodeAppendEntries(encodeAppendEntries(ae)); err != nil || !reflect.DeepEqual(ae, got) {
+		t.Errorf("AppendEntries: expected %+v, got %+v (%v)", ae, got, err)
+	}
+	annotated := ae
+	annotated.Entries = []raft.LogEntry{
+		ae.Entries[0],
+		{Index: 42, Term: 3, Command: []byte(`{"x":1}`), Annotations: map[string]string{"auth/principal": "alice", "app/schema": "2"}},
+	}
+	if got, err := decodeAppendEntries(encodeAppendEntries(annotated)); err != nil || !reflect.DeepEqual(annotated, got) {
+		t.Errorf("annotated AppendEntries: expected %+v, got %+v (%v)", annotated, got, err)
+	}
+	for _, versioned := range []raft.AppendEntries{ae, annotated, {Term: 3, LeaderId: 2}} {
+		versioned.Version = raft.ProtocolVersion
+		if got, err := decodeAppendEntries(encodeAppendEntries(versioned)); err != nil || !reflect.DeepEqual(versioned, got) {
+			t.Errorf("versioned AppendEntries: expected %+v, got %+v (%v)", versioned, got, err)
+		}
+	}
+	for _, clustered := range []raft.AppendEntries{ae, annotated, {Term: 3, LeaderId: 2, Version: raft.ProtocolVersion}} {
+		clustered.ClusterId = "alpha"
+		if got, err := decodeAppendEntries(encodeAppendEntries(clustered)); err != nil || !reflect.DeepEqual(clustered, got) {
+			t.Errorf("AppendEntries with a cluster ID: expected %+v, got %+v (%v)", clustered, got, err)
+		}
+	}
+
+	for _, aer := range []raft.AppendEntriesResponse{
+		{Term: 3, Success: true},
+		{Term: 3, Gap: &raft.LogGap{LastIndex: 9, CommitIndex: 4, ConflictTerm: 2, ConflictIndex: 7}, Rejection: raft.RejectLogMismatch},
+		{Term: 3, Rejection: raft.RejectStorage},
+		{Term: 3, Success: true, State: &raft.SoftState{Applied: 12}},
+		{Term: 3, Success: true, State: &raft.SoftState{Applied: 12, Health: map[string]bool{"disk": false, "cpu": true}}},
+		{Rejection: raft.RejectVersion, State: &raft.SoftState{Applied: 12, Version: raft.ProtocolVersion}},
+	} {
+		if got, err := decodeAppendEntriesResponse(encodeAppendEntriesResponse(aer)); err != nil || !reflect.DeepEqual(aer, got) {
+			t.Errorf("AppendEntriesResponse: expected %+v, got %+v (%v)", aer, got, err)
+		}
+	}
+
+	for _, rv := range []raft.RequestVote{
+		{Term: 4, CandidateId: 1, LastLogIndex: 42, LastLogTerm: 3},
+		{Term: 4, CandidateId: 1, LastLogIndex: 42, LastLogTerm: 3, Transfer: true},
+		{Term: 4, CandidateId: 1, LastLogIndex: 42, LastLogTerm: 3, Version: raft.ProtocolVersion},
+		{Term: 4, CandidateId: 1, LastLogIndex: 42, LastLogTerm: 3, Version: raft.ProtocolVersion, ClusterId: "alpha"},
+	} {
+		if got, err := decodeRequestVote(encodeRequestVote(rv)); err != nil || rv != got {
+			t.Errorf("RequestVote: expected %+v, got %+v (%v)", rv, got, err)
+		}
+	}
+
+	for _, rvr := range []raft.RequestVoteResponse{
+		{Term: 4, VoteGranted: true},
+		{Term: 4, VoteGranted: true, Version: raft.ProtocolVersion},
+	} {
+		if got, err := decodeRequestVoteResponse(encodeRequestVoteResponse(rvr)); err != nil || rvr != got {
+			t.Errorf("RequestVoteResponse: expected %+v, got %+v (%v)", rvr, got, err)
+		}
+	}
+	// frames from peers that predate versions
+	if got, err := decodeRequestVoteResponse([]byte{4, 1}); err != nil || got.Version != 0 {
+		t.Errorf("unversioned RequestVoteResponse: got %+v (%v)", got, err)
+	}
+
+	h := raft.Handshake{Id: 3, ClusterId: "alpha", Version: 2, MinVersion: 1, MaxVersion: 2}
+	if got, rejection, err := decodeHandshakeResponse(encodeHandshakeResponse(h, nil)); err != nil || got != h || rejection != "" {
+		t.Errorf("handshake response: expected %+v, got %+v %q (%v)", h, got, rejection, err)
+	}
+	if _, rejection, err := decodeHandshakeResponse(encodeHandshakeResponse(h, raft.ErrClusterMismatch)); err != nil || rejection != raft.ErrClusterMismatch.Error() {
+		t.Errorf("rejected handshake response: got %q (%v)", rejection, err)
+	}
+
+	if _, err := decodeCommandResponse(encodeCommandResponse(nil, raft.ErrUnknownLeader)); err != raft.ErrUnknownLeader {
+		t.Errorf("command response: expected %s, got %v", raft.ErrUnknownLeader, err)
+	}
+
+	// truncated payloads are errors, not panics; the trailing step down flag
+	// is optional, since older peers don't send it
+	p := encodeAppendEntries(ae)
+	for i := 0; i < len(p)-1; i++ {
+		if _, err := decodeAppendEntries(p[:i]); err == nil {
+			t.Errorf("AppendEntries truncated to %d byte(s): expected error", i)
+		}
+	}
+}
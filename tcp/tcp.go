@@ -0,0 +1,439 @@
+// Package rafttcp is a Raft transport over persistent TCP connections, with a
+// compact binary encoding. Compared to the HTTP transport, it saves a
+// connection setup and a round of HTTP headers per heartbeat, which adds up
+// when a leader has many followers.
+package rafttcp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/peterbourgon/raft"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBackoff     = errors.New("not reconnecting yet, after a failure")
+	errCommandLost = errors.New("command lost")
+	errNoHandshake = errors.New("handshake not supported")
+)
+
+const (
+	// DialTimeout is how long a peer waits for a connection to be established.
+	DialTimeout = 1 * time.Second
+
+	// RPCTimeout is how long a peer waits for the response to an RPC, before
+	// giving up on the connection. Command responses, which wait for the
+	// command to commit, aren't subject to it.
+	RPCTimeout = 5 * time.Second
+
+	// maxIdle is the number of idle connections a peer keeps open.
+	maxIdle = 4
+)
+
+// Peer is a raft.Peer reached over TCP. It keeps a few connections to the
+// remote server open between RPCs, and dials more as required. After a dial
+// fails, it moves on to the server's next address, if it has several; once
+// it's tried them all, it refuses to dial again until its backoff says, and
+// RPCs made until then fail straight away.
+type Peer struct {
+	sync.Mutex
+	id       uint64
+	addr     string   // the one of addrs in use
+	addrs    []string // of the remote server, tried in turn
+	gen      int      // incremented when addr changes
+	idle     []*conn
+	backoff  raft.Backoff
+	failures int
+	retry    time.Time // no dials before then
+}
+
+// NewPeer connects to the server at the passed address, and asks for its ID.
+// More addresses of the same server, e.g. on other networks, are tried in
+// turn if it can't be reached at the first.
+func NewPeer(addr string, more ...string) (*Peer, error) {
+	p, payload, err := connect(msgId, nil, addr, more)
+	if err != nil {
+		return nil, err
+	}
+	d := &decoder{buf: payload}
+	id := d.uint()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if id <= 0 {
+		return nil, fmt.Errorf("invalid peer ID %d", id)
+	}
+	p.id = id
+	return p, nil
+}
+
+// NewVerifiedPeer is like NewPeer, but instead of simply asking for the remote
+// server's ID, it exchanges handshakes with it. If either side finds the other
+// incompatible, e.g. because they're in different clusters, an error
+// describing the mismatch is returned, and no peer is created.
+func NewVerifiedPeer(local raft.Handshake, addr string, more ...string) (*Peer, error) {
+	p, payload, err := connect(msgHandshake, encodeHandshake(local), addr, more)
+	if err != nil {
+		return nil, err
+	}
+	remote, rejection, err := decodeHandshakeResponse(payload)
+	if err != nil {
+		return nil, err
+	}
+	if rejection != "" {
+		return nil, fmt.Errorf("handshake rejected by %s: %s", p.addr, rejection)
+	}
+	if err := raft.CheckHandshake(local, remote); err != nil {
+		return nil, err
+	}
+	if remote.Id <= 0 {
+		return nil, fmt.Errorf("invalid peer ID %d", remote.Id)
+	}
+	p.id = remote.Id
+	return p, nil
+}
+
+// connect makes a peer for the server at the addresses, and sends it the
+// request, trying each address in turn until one answers. It returns the
+// payload of the response.
+func connect(typ byte, payload []byte, addr string, more []string) (*Peer, []byte, error) {
+	p := &Peer{addr: addr, addrs: append([]string{addr}, more...)}
+	var rtyp byte
+	var rpayload []byte
+	var err error
+	for range p.addrs {
+		if rtyp, rpayload, err = p.roundTrip(typ, payload); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if rtyp != typ|msgResponse {
+		return nil, nil, fmt.Errorf("unexpected response type %#x", rtyp)
+	}
+	return p, rpayload, nil
+}
+
+func (p *Peer) Id() uint64 { return p.id }
+
+// Address returns the address of the remote server.
+func (p *Peer) Address() string {
+	p.Lock()
+	defer p.Unlock()
+	return p.addr
+}
+
+// SetBackoff sets how long the peer waits to dial again after dials fail. The
+// default is raft.DefaultBackoff.
+func (p *Peer) SetBackoff(b raft.Backoff) {
+	p.Lock()
+	defer p.Unlock()
+	p.backoff = b
+}
+
+// SetAddress changes the address of the remote server. Idle connections to
+// the old address are closed; RPCs in flight complete against it.
+func (p *Peer) SetAddress(addr string) error {
+	return p.SetAddresses([]string{addr})
+}
+
+// Addresses returns the addresses of the remote server, in the order they're
+// tried.
+func (p *Peer) Addresses() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string{}, p.addrs...)
+}
+
+// SetAddresses changes the addresses of the remote server, which are tried
+// in turn, starting with the first, like SetAddress. After a dial fails, the
+// peer dials the next address straight away, and only waits as its backoff
+// says once it's tried them all.
+func (p *Peer) SetAddresses(addrs []string) error {
+	if len(addrs) == 0 {
+		return errors.New("no peer addresses")
+	}
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return err
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.addr, p.addrs = addrs[0], append([]string{}, addrs...)
+	p.gen++
+	for _, conn := range p.idle {
+		conn.Close()
+	}
+	p.idle = nil
+	p.failures, p.retry = 0, time.Time{}
+	return nil
+}
+
+func (p *Peer) AppendEntries(ae raft.AppendEntries) raft.AppendEntriesResponse {
+	typ, payload, err := p.roundTrip(msgAppendEntries, encodeAppendEntries(ae))
+	if err != nil || typ != msgAppendEntries|msgResponse {
+		return raft.AppendEntriesResponse{}
+	}
+	aer, _ := decodeAppendEntriesResponse(payload)
+	return aer
+}
+
+func (p *Peer) RequestVote(rv raft.RequestVote) raft.RequestVoteResponse {
+	typ, payload, err := p.roundTrip(msgRequestVote, encodeRequestVote(rv))
+	if err != nil || typ != msgRequestVote|msgResponse {
+		return raft.RequestVoteResponse{}
+	}
+	rvr, _ := decodeRequestVoteResponse(payload)
+	return rvr
+}
+
+// Command forwards the command to the remote server, and returns the error it
+// returns. If it accepts the command, the response is delivered on the passed
+// chan when it arrives, and the chan is closed; if the command is lost, the
+// chan is closed without a response.
+func (p *Peer) Command(cmd []byte, response chan []byte) error {
+	// The first frame tells us if the command was accepted.
+	c, typ, payload, err := p.exchange(msgCommand, cmd)
+	if err != nil {
+		return err
+	}
+	if typ != msgCommand|msgResponse {
+		c.Close()
+		return fmt.Errorf("unexpected response type %#x", typ)
+	}
+	if _, err := decodeCommandResponse(payload); err != nil {
+		p.put(c)
+		return err
+	}
+
+	// The second carries the response, once the command commits.
+	go func() {
+		defer close(response)
+		c.SetDeadline(time.Time{})
+		typ, payload, err := readFrame(c)
+		if err != nil || typ != msgCommand|msgResponse {
+			c.Close()
+			return
+		}
+		p.put(c)
+		if resp, err := decodeCommandResponse(payload); err == nil {
+			response <- resp
+		}
+	}()
+	return nil
+}
+
+// roundTrip sends a request and returns the response.
+func (p *Peer) roundTrip(typ byte, payload []byte) (byte, []byte, error) {
+	c, rtyp, rpayload, err := p.exchange(typ, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	p.put(c)
+	return rtyp, rpayload, nil
+}
+
+// exchange sends a request on a pooled connection, and reads the first frame
+// of the response. An idle connection may have been closed by the remote
+// server since it was last used, so if the exchange fails on one, it's retried
+// on a fresh connection. On success, the caller owns the connection.
+func (p *Peer) exchange(typ byte, payload []byte) (*conn, byte, []byte, error) {
+	for {
+		c, pooled, err := p.get()
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		c.SetDeadline(time.Now().Add(RPCTimeout))
+		if err = writeFrame(c, typ, payload); err == nil {
+			var rtyp byte
+			var rpayload []byte
+			if rtyp, rpayload, err = readFrame(c); err == nil {
+				return c, rtyp, rpayload, nil
+			}
+		}
+		c.Close()
+		if !pooled {
+			return nil, 0, nil, err
+		}
+	}
+}
+
+// conn is a connection to the address a peer had in a given generation.
+type conn struct {
+	net.Conn
+	gen int
+}
+
+// get returns an idle connection, or dials a new one.
+func (p *Peer) get() (c *conn, pooled bool, err error) {
+	p.Lock()
+	if n := len(p.idle); n > 0 {
+		c = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.Unlock()
+		return c, true, nil
+	}
+	if time.Now().Before(p.retry) {
+		p.Unlock()
+		return nil, false, ErrBackoff
+	}
+	addr, gen := p.addr, p.gen
+	p.Unlock()
+
+	nc, err := net.DialTimeout("tcp", addr, DialTimeout)
+
+	p.Lock()
+	defer p.Unlock()
+	if err != nil {
+		p.failures++
+		n := len(p.addrs)
+		if n > 1 && gen == p.gen {
+			p.failover()
+		}
+		if n <= 1 || p.failures%n == 0 { // we've tried every address
+			b := p.backoff
+			if b == nil {
+				b = raft.DefaultBackoff
+			}
+			rounds := p.failures
+			if n > 1 {
+				rounds /= n
+			}
+			p.retry = time.Now().Add(b.Delay(rounds, raft.ErrorClassOf(err)))
+		}
+		return nil, false, err
+	}
+	p.failures, p.retry = 0, time.Time{}
+	return &conn{nc, gen}, false, nil
+}
+
+// failover moves on to the next of the remote server's addresses. The caller
+// must hold the lock.
+func (p *Peer) failover() {
+	for i, addr := range p.addrs {
+		if addr == p.addr {
+			p.addr = p.addrs[(i+1)%len(p.addrs)]
+			p.gen++
+			return
+		}
+	}
+}
+
+// put returns a healthy connection to the pool.
+func (p *Peer) put(c *conn) {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.idle) >= maxIdle || c.gen != p.gen {
+		c.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+// Server answers the RPCs of Peers on behalf of a Raft server.
+type Server struct {
+	server raft.Peer
+	logger *log.Logger // of errors that end connections, if any
+}
+
+func NewServer(server raft.Peer) *Server {
+	return &Server{
+		server: server,
+	}
+}
+
+// SetLogger sets the logger that errors ending connections, e.g. frames that
+// can't be decoded, are reported to. By default, they aren't reported. It must
+// be called before Serve.
+func (s *Server) SetLogger(logger *log.Logger) {
+	s.logger = logger
+}
+
+// Serve accepts connections on the listener, and answers the RPCs sent on
+// them, until the listener is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		typ, payload, err := readFrame(conn)
+		if err != nil {
+			return // includes the client hanging up
+		}
+		if err := s.handle(conn, typ, payload); err != nil {
+			if s.logger != nil {
+				s.logger.Printf("rafttcp: %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+func (s *Server) handle(conn net.Conn, typ byte, payload []byte) error {
+	switch typ {
+	case msgId:
+		e := &encoder{}
+		e.uint(s.server.Id())
+		return writeFrame(conn, msgId|msgResponse, e.buf)
+
+	case msgHandshake:
+		d := &decoder{buf: payload}
+		remote := decodeHandshake(d)
+		if d.err != nil {
+			return d.err
+		}
+		h, ok := s.server.(raft.Handshaker)
+		if !ok {
+			return writeFrame(conn, msgHandshake|msgResponse, encodeHandshakeResponse(raft.Handshake{}, errNoHandshake))
+		}
+		local, err := h.Handshake(remote)
+		return writeFrame(conn, msgHandshake|msgResponse, encodeHandshakeResponse(local, err))
+
+	case msgAppendEntries:
+		ae, err := decodeAppendEntries(payload)
+		if err != nil {
+			return err
+		}
+		aer := s.server.AppendEntries(ae)
+		return writeFrame(conn, msgAppendEntries|msgResponse, encodeAppendEntriesResponse(aer))
+
+	case msgRequestVote:
+		rv, err := decodeRequestVote(payload)
+		if err != nil {
+			return err
+		}
+		rvr := s.server.RequestVote(rv)
+		return writeFrame(conn, msgRequestVote|msgResponse, encodeRequestVoteResponse(rvr))
+
+	case msgCommand:
+		response := make(chan []byte, 1)
+		if err := s.server.Command(payload, response); err != nil {
+			return writeFrame(conn, msgCommand|msgResponse, encodeCommandResponse(nil, err))
+		}
+		if err := writeFrame(conn, msgCommand|msgResponse, encodeCommandResponse(nil, nil)); err != nil {
+			return err
+		}
+		resp, ok := <-response
+		if !ok {
+			return writeFrame(conn, msgCommand|msgResponse, encodeCommandResponse(nil, errCommandLost))
+		}
+		return writeFrame(conn, msgCommand|msgResponse, encodeCommandResponse(resp, nil))
+
+	default:
+		return fmt.Errorf("unknown message type %#x", typ)
+	}
+}
@@ -0,0 +1,312 @@
+package rafttcp_test
+
+import (
+	"bytes"
+	"github.com/peterbourgon/raft"
+	"github.com/peterbourgon/raft/tcp"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func noop([]byte) ([]byte, error) { return []byte{}, nil }
+
+func serve(t *testing.T, server raft.Peer, addr string) net.Listener {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := &trackingListener{Listener: ln}
+	go rafttcp.NewServer(server).Serve(tl)
+	return tl
+}
+
+// trackingListener closes the connections it accepted when it's closed, so
+// that closing it simulates the server going away.
+type trackingListener struct {
+	net.Listener
+	sync.Mutex
+	conns []net.Conn
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.Lock()
+		l.conns = append(l.conns, conn)
+		l.Unlock()
+	}
+	return conn, err
+}
+
+func (l *trackingListener) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	return l.Listener.Close()
+}
+
+func TestPeer(t *testing.T) {
+	ln := serve(t, &echoServer{
+		id:  7,
+		aer: raft.AppendEntriesResponse{Term: 3, Success: true},
+		rvr: raft.RequestVoteResponse{Term: 5, VoteGranted: true},
+	}, "127.0.0.1:0")
+	defer ln.Close()
+
+	peer, err := rafttcp.NewPeer(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(7), peer.Id(); expected != got {
+		t.Errorf("expected ID %d, got %d", expected, got)
+	}
+
+	for i := 0; i < 3; i++ { // reusing connections
+		if aer := peer.AppendEntries(raft.AppendEntries{}); aer.Term != 3 || !aer.Success {
+			t.Errorf("AppendEntries: got %+v", aer)
+		}
+		if rvr := peer.RequestVote(raft.RequestVote{}); rvr.Term != 5 || !rvr.VoteGranted {
+			t.Errorf("RequestVote: got %+v", rvr)
+		}
+	}
+
+	response := make(chan []byte, 1)
+	if err := peer.Command([]byte(`{"foo":123}`), response); err != nil {
+		t.Fatal(err)
+	}
+	if resp, ok := <-response; !ok || string(resp) != `{"foo":123}` {
+		t.Errorf("Command: got %q (ok=%v)", resp, ok)
+	}
+}
+
+func TestPeerAddresses(t *testing.T) {
+	dead := serve(t, &echoServer{id: 1}, "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+	live := serve(t, &echoServer{id: 1, aer: raft.AppendEntriesResponse{Term: 4}}, "127.0.0.1:0")
+	defer live.Close()
+
+	// a server unreachable at its first address is reached at the next
+	peer, err := rafttcp.NewPeer(deadAddr, live.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := live.Addr().String(), peer.Address(); expected != got {
+		t.Errorf("expected address %s, got %s", expected, got)
+	}
+
+	// and again, after its addresses change
+	if err := peer.SetAddresses([]string{deadAddr, live.Addr().String()}); err != nil {
+		t.Fatal(err)
+	}
+	if aer := peer.AppendEntries(raft.AppendEntries{}); aer.Term != 0 {
+		t.Errorf("at the dead address, expected an empty response, got %+v", aer)
+	}
+	if aer := peer.AppendEntries(raft.AppendEntries{}); aer.Term != 4 {
+		t.Errorf("at the next address, expected term 4 straight away, got %+v", aer)
+	}
+	if err := peer.SetAddresses(nil); err == nil {
+		t.Errorf("expected an error for no addresses")
+	}
+}
+
+func TestVerifiedPeer(t *testing.T) {
+	config := raft.Config{MinElectionTimeout: 50 * time.Millisecond, MaxElectionTimeout: 100 * time.Millisecond, HeartbeatInterval: 5 * time.Millisecond}
+	server := raft.NewServer(7, &bytes.Buffer{}, noop, config)
+	server.SetClusterId("alpha")
+	ln := serve(t, server, "127.0.0.1:0")
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	peer, err := rafttcp.NewVerifiedPeer(raft.Handshake{ClusterId: "alpha", Version: raft.ProtocolVersion}, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(7), peer.Id(); expected != got {
+		t.Errorf("expected ID %d, got %d", expected, got)
+	}
+
+	for _, local := range []raft.Handshake{
+		{ClusterId: "beta", Version: raft.ProtocolVersion},
+		{ClusterId: "alpha", Version: raft.ProtocolVersion + 1, MinVersion: raft.ProtocolVersion + 1},
+	} {
+		if _, err := rafttcp.NewVerifiedPeer(local, addr); err == nil {
+			t.Errorf("%+v: expected the handshake to fail", local)
+		} else {
+			t.Logf("%+v: %s", local, err)
+		}
+	}
+
+	// a peer made without a handshake still can't reach the server from
+	// another cluster
+	unverified, err := rafttcp.NewPeer(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aer := unverified.AppendEntries(raft.AppendEntries{Term: 1, LeaderId: 2, ClusterId: "beta"}); aer.Rejection != raft.RejectCluster {
+		t.Errorf("AppendEntries from another cluster: expected %s, got %+v", raft.RejectCluster, aer)
+	}
+	if rvr := unverified.RequestVote(raft.RequestVote{Term: 1, CandidateId: 2, ClusterId: "beta"}); rvr.VoteGranted {
+		t.Errorf("RequestVote from another cluster: expected no vote, got %+v", rvr)
+	}
+
+	// and servers that can't handshake say so
+	echo := serve(t, &echoServer{id: 1}, "127.0.0.1:0")
+	defer echo.Close()
+	if _, err := rafttcp.NewVerifiedPeer(raft.Handshake{Version: raft.ProtocolVersion}, echo.Addr().String()); err == nil {
+		t.Errorf("expected the handshake to fail with a server that doesn't support it")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	echo := &echoServer{id: 1, aer: raft.AppendEntriesResponse{Term: 1}}
+	ln := serve(t, echo, "127.0.0.1:0")
+	addr := ln.Addr().String()
+
+	peer, err := rafttcp.NewPeer(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// while the server is down, RPCs fail, and the peer backs off
+	ln.Close()
+	if aer := peer.AppendEntries(raft.AppendEntries{}); aer.Term != 0 {
+		t.Errorf("with the server down, expected an empty response, got %+v", aer)
+	}
+	if err := peer.Command([]byte(`{}`), make(chan []byte, 1)); err == nil {
+		t.Errorf("with the server down, expected an error")
+	} else {
+		t.Logf("with the server down: %s", err) // probably ErrBackoff
+	}
+
+	// when it comes back, so does the peer
+	ln = serve(t, echo, addr)
+	defer ln.Close()
+	cutoff := time.Now().Add(5 * time.Second)
+	for peer.AppendEntries(raft.AppendEntries{}).Term != 1 {
+		if time.Now().After(cutoff) {
+			t.Fatal("peer never reconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerLogger(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	logBuffer := &syncBuffer{}
+	server := rafttcp.NewServer(&echoServer{id: 1})
+	server.SetLogger(log.New(logBuffer, "", 0))
+	go server.Serve(ln)
+
+	// a message the server doesn't know ends the connection, and is logged
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{0, 0, 0, 0, 0x7f}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected the server to hang up")
+	}
+	if expected, got := "unknown message type 0x7f", logBuffer.String(); !strings.Contains(got, expected) {
+		t.Errorf("expected %q logged, got %q", expected, got)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	config := raft.Config{MinElectionTimeout: 50 * time.Millisecond, MaxElectionTimeout: 100 * time.Millisecond, HeartbeatInterval: 5 * time.Millisecond}
+
+	n := 3
+	servers := make([]*raft.Server, n)
+	applied := make(chan []byte, n)
+	peers := raft.Peers{}
+	for i := 0; i < n; i++ {
+		apply := func(cmd []byte) ([]byte, error) { applied <- cmd; return cmd, nil }
+		servers[i] = raft.NewServer(uint64(i+1), &bytes.Buffer{}, apply, config)
+		ln := serve(t, servers[i], "127.0.0.1:0")
+		defer ln.Close()
+		peer, err := rafttcp.NewPeer(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers[peer.Id()] = peer
+	}
+	for _, server := range servers {
+		server.SetPeers(peers)
+		server.Start()
+		defer server.Stop()
+	}
+
+	// a command sent to any server, via its peer, is applied everywhere
+	response := make(chan []byte, 1)
+	cutoff := time.Now().Add(5 * time.Second)
+	for {
+		err := peers[1].Command([]byte(`{"x":1}`), response)
+		if err == nil {
+			break
+		}
+		if err != raft.ErrUnknownLeader || time.Now().After(cutoff) {
+			t.Fatal(err)
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case cmd := <-applied:
+			if expected, got := `{"x":1}`, string(cmd); expected != got {
+				t.Errorf("expected %s, got %s", expected, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("command applied on only %d server(s)", i)
+		}
+	}
+}
+
+type echoServer struct {
+	id  uint64
+	aer raft.AppendEntriesResponse
+	rvr raft.RequestVoteResponse
+}
+
+func (p *echoServer) Id() uint64 { return p.id }
+func (p *echoServer) AppendEntries(raft.AppendEntries) raft.AppendEntriesResponse {
+	return p.aer
+}
+func (p *echoServer) RequestVote(raft.RequestVote) raft.RequestVoteResponse {
+	return p.rvr
+}
+func (p *echoServer) Command(cmd []byte, response chan []byte) error {
+	go func() { response <- cmd; close(response) }()
+	return nil
+}
+
+// syncBuffer is a bytes.Buffer that's safe to log to from other goroutines.
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,284 @@
+// Package rafttest runs Raft clusters in a single process, over an in-memory
+// network that can be partitioned, and made slow and lossy, so protocol edge
+// cases can be written down as scenarios, and run as ordinary, table-driven
+// tests:
+//
+//	err := rafttest.Scenario{
+//		Servers: 3,
+//		Steps: []rafttest.Step{
+//			rafttest.AwaitLeader{},
+//			rafttest.IsolateLeader{},
+//			rafttest.Submit{N: 10},
+//			rafttest.Heal{},
+//			rafttest.ExpectConvergence{},
+//		},
+//	}.Run()
+//
+// Steps wait for what they expect, up to a deadline, rather than sleeping for
+// a fixed time, so scenarios don't depend on how fast the machine is.
+//
+// Runs aren't deterministic. Each server runs its loop, timers and flushes on
+// goroutines of its own, on real time, so a seeded Network makes the same
+// random choices from run to run, but the servers' interleaving still varies,
+// and a failing run may not fail again. A rare race is hunted by running a
+// scenario many times, e.g. with go test -count, and -race.
+package rafttest
+
+import (
+	"context"
+	"fmt"
+	"github.com/peterbourgon/raft"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Cluster is a set of servers, with ids from 1, connected by a Network. Each
+// server's state machine records the commands it applies, in order. Each
+// server's log is kept in memory, by a raft.FaultyStore, and its term and
+// vote in a stable store that survives a Crash.
+type Cluster struct {
+	Servers []*raft.Server
+	Network *Network
+
+	config raft.Config
+	fsm    FSMFactory
+	disks  map[uint64]*disk
+	stores map[uint64]*raft.FaultyStore
+	stable map[uint64]*stableStore
+
+	mu      sync.Mutex
+	applied map[uint64][]string
+	faults  map[uint64]applyFault
+}
+
+// FSMFactory returns the apply function of the state machine of the server
+// with the given id; see raft.NewServer. Each server must get a state
+// machine of its own, and a server restarted after a Crash gets a new one.
+type FSMFactory func(id uint64) func(cmd []byte) ([]byte, error)
+
+// NewCluster returns a cluster of n servers with the given config, ready to
+// Start. Their state machines respond to each command with the command. If
+// the config has no Logger, the servers' logs are discarded.
+func NewCluster(n int, config raft.Config) *Cluster {
+	return NewClusterWithFSM(n, config, nil)
+}
+
+// NewClusterWithFSM is like NewCluster, but each server applies commands to
+// a state machine from the factory, so applications can test their own. The
+// cluster still records the commands each server applies.
+func NewClusterWithFSM(n int, config raft.Config, fsm FSMFactory) *Cluster {
+	if config.Logger == nil {
+		config.Logger = log.New(ioutil.Discard, "", 0)
+	}
+	c := &Cluster{
+		Network: newNetwork(),
+		config:  config,
+		fsm:     fsm,
+		disks:   map[uint64]*disk{},
+		stores:  map[uint64]*raft.FaultyStore{},
+		stable:  map[uint64]*stableStore{},
+		applied: map[uint64][]string{},
+		faults:  map[uint64]applyFault{},
+	}
+	for id := uint64(1); id <= uint64(n); id++ {
+		c.disks[id] = &disk{}
+		c.stores[id] = raft.NewFaultyStore(c.disks[id], raft.Faults{}, int64(id))
+		c.stable[id] = &stableStore{}
+	}
+	for id := uint64(1); id <= uint64(n); id++ {
+		c.Servers = append(c.Servers, c.newServer(id))
+	}
+	return c
+}
+
+// newServer returns a server with the given id, on its store, and with its
+// peers, ready to Start.
+func (c *Cluster) newServer(id uint64) *raft.Server {
+	next := func(cmd []byte) ([]byte, error) { return cmd, nil }
+	if c.fsm != nil {
+		next = c.fsm(id)
+	}
+	apply := func(cmd []byte) ([]byte, error) {
+		c.mu.Lock()
+		c.applied[id] = append(c.applied[id], string(cmd))
+		fault := c.faults[id]
+		err := fault.next()
+		c.faults[id] = fault
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return next(cmd)
+	}
+	s := raft.NewServer(id, c.stores[id], apply, c.config)
+	if err := s.SetStableStore(c.stable[id]); err != nil {
+		panic(err) // the store's in memory
+	}
+	peers := raft.Peers{id: raft.NewLocalPeer(s)}
+	for i := 1; i <= len(c.disks); i++ {
+		if other := uint64(i); other != id {
+			peers[other] = &peer{from: id, to: other, cluster: c, network: c.Network}
+		}
+	}
+	s.SetPeers(peers)
+	return s
+}
+
+// Start starts every server.
+func (c *Cluster) Start() {
+	for _, s := range c.Servers {
+		s.Start()
+	}
+}
+
+// Stop stops every server.
+func (c *Cluster) Stop() {
+	for _, s := range c.Servers {
+		s.Stop()
+	}
+}
+
+// Partition cuts the network between the groups of servers, e.g.
+// Partition([]uint64{1, 2}, []uint64{3}). Servers that aren't in any group
+// are cut off from every other server.
+func (c *Cluster) Partition(groups ...[]uint64) {
+	group := map[uint64]int{}
+	for i, ids := range groups {
+		for _, id := range ids {
+			group[id] = i + 1
+		}
+	}
+	for _, a := range c.Servers {
+		for _, b := range c.Servers {
+			ga, gb := group[a.Id()], group[b.Id()]
+			if a != b && (ga == 0 || gb == 0 || ga != gb) {
+				c.Network.Cut(a.Id(), b.Id())
+			}
+		}
+	}
+}
+
+// Heal restores every connection in the network, and makes every link
+// perfect again.
+func (c *Cluster) Heal() {
+	c.Network.Heal()
+}
+
+// Server returns the server with the given id, or nil.
+func (c *Cluster) Server(id uint64) *raft.Server {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id < 1 || id > uint64(len(c.Servers)) {
+		return nil
+	}
+	return c.Servers[id-1]
+}
+
+// Leader returns the leader of the latest term, or nil if no server thinks
+// it's the leader. A leader cut off from the rest of the cluster may not know
+// it's been replaced, so there may be more than one server in the Leader
+// state, but only the one in the latest term can commit.
+func (c *Cluster) Leader() *raft.Server {
+	var leader *raft.Server
+	var term uint64
+	for _, s := range c.Servers {
+		st := s.Status()
+		if st.State == raft.Leader && st.Term >= term {
+			leader, term = s, st.Term
+		}
+	}
+	return leader
+}
+
+// WaitForLeader waits for a leader to be elected, and returns it, or
+// ErrNoLeader if none is before the timeout.
+func (c *Cluster) WaitForLeader(timeout time.Duration) (*raft.Server, error) {
+	var leader *raft.Server
+	err := await(timeout, func() error {
+		if leader = c.Leader(); leader == nil {
+			return ErrNoLeader
+		}
+		return nil
+	})
+	return leader, err
+}
+
+// Followers returns the servers that are following a leader, in order of id.
+func (c *Cluster) Followers() []*raft.Server {
+	var followers []*raft.Server
+	for _, s := range c.Servers {
+		if st := s.Status(); st.State == raft.Follower && st.Leader != 0 {
+			followers = append(followers, s)
+		}
+	}
+	return followers
+}
+
+// ApplyAndWait submits the command to the leader, and waits for it to be
+// applied there, and returns its response. If there's no leader, or the
+// command isn't committed, e.g. because its leader was deposed, it's
+// submitted again, to the new leader, so it may be applied more than once.
+// It gives up after the timeout, with the last error.
+func (c *Cluster) ApplyAndWait(cmd []byte, timeout time.Duration) ([]byte, error) {
+	var resp []byte
+	err := await(timeout, func() error {
+		leader := c.Leader()
+		if leader == nil {
+			return ErrNoLeader
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 4*leader.Config().MaxElectionTimeout)
+		defer cancel()
+		var err error
+		resp, err = leader.Apply(ctx, cmd)
+		if _, rejected := err.(*raft.CommandError); rejected {
+			return nil
+		}
+		return err
+	})
+	return resp, err
+}
+
+// EnsureSame waits for every server to have applied the same commands, in
+// the same order, and returns ErrNotConverged if they haven't before the
+// timeout.
+func (c *Cluster) EnsureSame(timeout time.Duration) error {
+	return await(timeout, c.same)
+}
+
+// same returns ErrNotConverged unless every server has applied the same
+// commands, in the same order.
+func (c *Cluster) same() error {
+	first := c.Applied(1)
+	for _, s := range c.Servers[1:] {
+		if applied := c.Applied(s.Id()); !reflect.DeepEqual(first, applied) {
+			return fmt.Errorf("%s: server 1 applied %d commands, server %d applied %d", ErrNotConverged, len(first), s.Id(), len(applied))
+		}
+	}
+	return nil
+}
+
+// Applied returns the commands the server has applied, in order.
+func (c *Cluster) Applied(id uint64) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.applied[id]...)
+}
+
+// await calls f until it returns nil, or the timeout expires, when it returns
+// the last error.
+func await(timeout time.Duration, f func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
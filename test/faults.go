@@ -0,0 +1,122 @@
+package rafttest
+
+import (
+	"github.com/peterbourgon/raft"
+	"io"
+	"sync"
+)
+
+// Store returns the store of the server's log, so its faults can be set,
+// e.g. to fail the server's next write to its log, with
+//
+//	c.Store(1).SetFaults(raft.Faults{FailWrite: 1})
+//
+// or to hold its writes back until they're synced, so a Crash loses them.
+func (c *Cluster) Store(id uint64) *raft.FaultyStore {
+	return c.stores[id]
+}
+
+// FailApply makes the nth command the server applies from now, e.g. 1 for
+// the next, fail with the error, instead of being passed to its state
+// machine. A raft.CommandError rejects the command; any other error stops
+// the server's log, as a state machine that fails to apply a command must.
+func (c *Cluster) FailApply(id uint64, n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults[id] = applyFault{n: n, err: err}
+}
+
+// applyFault is the failure FailApply injects into a server's apply path.
+type applyFault struct {
+	n   int
+	err error
+}
+
+// next counts a command applied, and returns the error it should fail with,
+// if any. It's called with the cluster locked.
+func (f *applyFault) next() error {
+	if f.n <= 0 {
+		return nil
+	}
+	f.n--
+	if f.n > 0 {
+		return nil
+	}
+	return f.err
+}
+
+// Crash crashes the server, and restarts it. It's stopped, loses the writes
+// its store held back since its last sync (see raft.Faults.LoseUnsynced),
+// and a new server, with a new state machine, replaces it, recovering from
+// what's left of its log, and from its term and vote. The commands it had
+// applied are forgotten, as it applies its log again.
+func (c *Cluster) Crash(id uint64) {
+	old := c.Server(id)
+	if old == nil {
+		return
+	}
+	old.Stop()
+	c.stores[id].Crash()
+	c.disks[id].rewind()
+
+	c.mu.Lock()
+	delete(c.applied, id)
+	c.mu.Unlock()
+	s := c.newServer(id)
+	c.mu.Lock()
+	c.Servers[id-1] = s
+	c.mu.Unlock()
+	s.Start()
+}
+
+// disk is an in-memory log store, which can be read again from the start,
+// as a restarted server does.
+type disk struct {
+	sync.Mutex
+	data []byte
+	pos  int // of the next read
+}
+
+func (d *disk) Read(p []byte) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.pos >= len(d.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.data[d.pos:])
+	d.pos += n
+	return n, nil
+}
+
+func (d *disk) Write(p []byte) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.data = append(d.data, p...)
+	return len(p), nil
+}
+
+// rewind makes the next read start from the beginning.
+func (d *disk) rewind() {
+	d.Lock()
+	defer d.Unlock()
+	d.pos = 0
+}
+
+// stableStore keeps a server's term and vote in memory.
+type stableStore struct {
+	sync.Mutex
+	state raft.StableState
+}
+
+func (s *stableStore) LoadState() (raft.StableState, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.state, nil
+}
+
+func (s *stableStore) StoreState(state raft.StableState) error {
+	s.Lock()
+	defer s.Unlock()
+	s.state = state
+	return nil
+}
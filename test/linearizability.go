@@ -0,0 +1,321 @@
+package rafttest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/peterbourgon/raft"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotLinearizable = errors.New("history isn't linearizable")
+)
+
+// Operation is an operation a client made, recorded in a History: its input
+// and output, and when it was called and returned. An operation whose
+// outcome is unknown, e.g. because it timed out, has a nil Output and a zero
+// Return: it may have taken effect at any time after its call, or never.
+type Operation struct {
+	Client int
+	Input  interface{}
+	Output interface{}
+	Call   time.Time
+	Return time.Time
+}
+
+// completed returns whether the operation's outcome is known.
+func (op Operation) completed() bool { return !op.Return.IsZero() }
+
+// History records the operations made by concurrent clients, for
+// CheckLinearizable.
+type History struct {
+	mu     sync.Mutex
+	ops    []Operation
+	failed map[int]bool
+}
+
+// Invoke records the call of an operation, and returns its index, with
+// which Return records its output.
+func (h *History) Invoke(client int, input interface{}) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ops = append(h.ops, Operation{Client: client, Input: input, Call: time.Now()})
+	return len(h.ops) - 1
+}
+
+// Return records the output of the operation with the index. Operations
+// that never return have unknown outcomes.
+func (h *History) Return(i int, output interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ops[i].Output, h.ops[i].Return = output, time.Now()
+}
+
+// Fail records that the operation with the index failed without taking
+// effect, e.g. because the server refused it, so it's left out of the
+// history.
+func (h *History) Fail(i int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.failed == nil {
+		h.failed = map[int]bool{}
+	}
+	h.failed[i] = true
+}
+
+// Operations returns the operations recorded so far, except those that
+// failed.
+func (h *History) Operations() []Operation {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var ops []Operation
+	for i, op := range h.ops {
+		if !h.failed[i] {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// Model is the sequential specification a history is checked against. Step
+// returns whether the operation, applied to the state, could have had its
+// output, and the state after it; an operation whose outcome is unknown may
+// have had any output. States must be comparable, as with ==. Partition, if
+// set, splits a history into histories that can be checked independently,
+// e.g. the operations on each key of a KV store, which makes checking much
+// faster.
+type Model struct {
+	Init      func() interface{}
+	Step      func(state interface{}, op Operation) (bool, interface{})
+	Partition func([]Operation) [][]Operation
+}
+
+// KVInput is the input of an operation on a KV store: a get or put of the
+// key. The output of a get is the value read, or "" if the key isn't set;
+// a put has no output.
+type KVInput struct {
+	Op    string // "get" or "put"
+	Key   string
+	Value string
+}
+
+// KVModel is the model of a KV store, whose operations are KVInputs. Each
+// key is a register, checked independently. Operations whose outcome is
+// unknown are left out if they can't matter: gets, and puts of values that
+// no get returned, which might as well never have taken effect. That keeps
+// the search from trying every subset of them.
+var KVModel = Model{
+	Init: func() interface{} { return "" },
+	Step: func(state interface{}, op Operation) (bool, interface{}) {
+		input := op.Input.(KVInput)
+		if input.Op == "put" {
+			return true, input.Value
+		}
+		return op.Output == nil || op.Output == state, state
+	},
+	Partition: func(ops []Operation) [][]Operation {
+		var (
+			keys []string
+			m    = map[string][]Operation{}
+			read = map[KVInput]bool{} // values returned, as puts of them
+		)
+		for _, op := range ops {
+			input := op.Input.(KVInput)
+			if input.Op == "get" && op.completed() {
+				read[KVInput{Op: "put", Key: input.Key, Value: op.Output.(string)}] = true
+			}
+		}
+		for _, op := range ops {
+			input := op.Input.(KVInput)
+			if !op.completed() && !read[input] {
+				continue
+			}
+			key := input.Key
+			if _, ok := m[key]; !ok {
+				keys = append(keys, key)
+			}
+			m[key] = append(m[key], op)
+		}
+		parts := make([][]Operation, len(keys))
+		for i, key := range keys {
+			parts[i] = m[key]
+		}
+		return parts
+	},
+}
+
+// CheckLinearizable checks that the history is linearizable with respect to
+// the model: that each operation could have taken effect at some instant
+// between its call and return, in an order the model allows. Operations whose
+// outcome is unknown may have taken effect at any time after their call, or
+// not at all. It returns ErrNotLinearizable if not.
+//
+// It searches the orders the history allows, after Wing and Gong, as Knossos
+// and porcupine do, skipping orders that lead to states it's already seen.
+// The search is exponential in the worst case, so histories should be short,
+// or partitioned.
+func CheckLinearizable(model Model, history []Operation) error {
+	parts := [][]Operation{history}
+	if model.Partition != nil {
+		parts = model.Partition(history)
+	}
+	for _, part := range parts {
+		if !linearizable(model, part) {
+			return fmt.Errorf("%w: %d operations, from %s", ErrNotLinearizable, len(part), describe(part))
+		}
+	}
+	return nil
+}
+
+// linearizable searches for an order of the operations the model allows.
+func linearizable(model Model, history []Operation) bool {
+	ops := append([]Operation{}, history...)
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].Call.Before(ops[j].Call) })
+	left := 0 // completed operations not yet linearized
+	for _, op := range ops {
+		if op.completed() {
+			left++
+		}
+	}
+
+	type visit struct {
+		linearized string
+		state      interface{}
+	}
+	var (
+		done = new(big.Int) // the operations linearized
+		seen = map[visit]bool{}
+	)
+	var search func(state interface{}, left int) bool
+	search = func(state interface{}, left int) bool {
+		if left == 0 {
+			return true
+		}
+		// The next operation must have been called before every operation
+		// not yet linearized returned.
+		var first time.Time
+		for i, op := range ops {
+			if done.Bit(i) == 0 && op.completed() && (first.IsZero() || op.Return.Before(first)) {
+				first = op.Return
+			}
+		}
+		for i, op := range ops {
+			if !op.Call.Before(first) {
+				break
+			}
+			if done.Bit(i) == 1 {
+				continue
+			}
+			ok, next := model.Step(state, op)
+			if !ok {
+				continue
+			}
+			done.SetBit(done, i, 1)
+			v := visit{done.Text(16), next}
+			if !seen[v] {
+				seen[v] = true
+				n := left
+				if op.completed() {
+					n--
+				}
+				if search(next, n) {
+					return true
+				}
+			}
+			done.SetBit(done, i, 0)
+		}
+		return false
+	}
+	return search(model.Init(), left)
+}
+
+// describe summarizes the operations, for an error.
+func describe(ops []Operation) string {
+	var s []string
+	for i, op := range ops {
+		if i == 3 {
+			s = append(s, "...")
+			break
+		}
+		s = append(s, fmt.Sprintf("client %d: %v -> %v", op.Client, op.Input, op.Output))
+	}
+	return strings.Join(s, ", ")
+}
+
+// KV is a state machine factory, for NewClusterWithFSM, of KV stores whose
+// commands are "put key value", which sets the key, and "get key", which
+// responds with its value. Keys can't contain spaces. Clients record their
+// operations on it with a KVClient.
+func KV(id uint64) func([]byte) ([]byte, error) {
+	m := map[string]string{}
+	return func(cmd []byte) ([]byte, error) {
+		f := strings.SplitN(string(cmd), " ", 3)
+		switch {
+		case len(f) == 3 && f[0] == "put":
+			m[f[1]] = f[2]
+			return []byte{}, nil
+		case len(f) == 2 && f[0] == "get":
+			return []byte(m[f[1]]), nil
+		}
+		return nil, fmt.Errorf("bad KV command %q", cmd)
+	}
+}
+
+// KVClient makes operations on a cluster of KV state machines through its
+// leader, and records them in a history. Reads go through the log, like
+// writes, so every operation should be linearizable.
+type KVClient struct {
+	Id      int
+	Cluster *Cluster
+	History *History
+}
+
+// Put sets the key to the value.
+func (c *KVClient) Put(key, value string) error {
+	_, err := c.do(KVInput{Op: "put", Key: key, Value: value})
+	return err
+}
+
+// Get returns the value of the key.
+func (c *KVClient) Get(key string) (string, error) {
+	return c.do(KVInput{Op: "get", Key: key})
+}
+
+// do submits the operation to the leader, once. If there's no leader, it's
+// not recorded, and if the leader refuses it before appending it, because
+// it isn't the leader, or has no quorum, it's recorded as failed. If it fails
+// otherwise, e.g. because the leader's deposed, loses its quorum while the
+// operation waits, or it times out, its outcome is unknown: it may yet commit.
+func (c *KVClient) do(input KVInput) (string, error) {
+	leader := c.Cluster.Leader()
+	if leader == nil {
+		return "", ErrNoLeader
+	}
+	cmd := "get " + input.Key
+	if input.Op == "put" {
+		cmd = "put " + input.Key + " " + input.Value
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 4*leader.Config().MaxElectionTimeout)
+	defer cancel()
+	i := c.History.Invoke(c.Id, input)
+	resp, err := leader.Apply(ctx, []byte(cmd))
+	switch err {
+	case nil:
+	case raft.ErrNotLeader, raft.ErrUnknownLeader, raft.ErrNoQuorum:
+		c.History.Fail(i)
+		return "", err
+	default:
+		return "", err
+	}
+	if input.Op == "put" {
+		c.History.Return(i, "")
+		return "", nil
+	}
+	c.History.Return(i, string(resp))
+	return string(resp), nil
+}
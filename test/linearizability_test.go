@@ -0,0 +1,145 @@
+package rafttest_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/peterbourgon/raft"
+	"github.com/peterbourgon/raft/test"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckLinearizable(t *testing.T) {
+	at := func(ms int) time.Time { return time.Unix(0, 0).Add(time.Duration(ms) * time.Millisecond) }
+	put := func(client int, key, value string, call, ret int) rafttest.Operation {
+		op := rafttest.Operation{Client: client, Input: rafttest.KVInput{Op: "put", Key: key, Value: value}, Output: "", Call: at(call), Return: at(ret)}
+		if ret == 0 {
+			op.Output, op.Return = nil, time.Time{}
+		}
+		return op
+	}
+	get := func(client int, key, value string, call, ret int) rafttest.Operation {
+		return rafttest.Operation{Client: client, Input: rafttest.KVInput{Op: "get", Key: key}, Output: value, Call: at(call), Return: at(ret)}
+	}
+
+	for name, tc := range map[string]struct {
+		history      []rafttest.Operation
+		linearizable bool
+	}{
+		"sequential": {[]rafttest.Operation{
+			put(1, "x", "1", 1, 2),
+			get(2, "x", "1", 3, 4),
+		}, true},
+		"stale read": {[]rafttest.Operation{
+			put(1, "x", "1", 1, 2),
+			put(1, "x", "2", 3, 4),
+			get(2, "x", "1", 5, 6),
+		}, false},
+		"concurrent write read either way": {[]rafttest.Operation{
+			put(1, "x", "1", 1, 2),
+			put(1, "x", "2", 3, 10),
+			get(2, "x", "2", 4, 5),
+			get(3, "x", "1", 4, 6),
+		}, true},
+		"reads disagree on order": {[]rafttest.Operation{
+			put(1, "x", "1", 1, 10),
+			put(2, "x", "2", 1, 10),
+			get(3, "x", "1", 2, 3),
+			get(3, "x", "2", 4, 5),
+			get(4, "x", "2", 2, 3),
+			get(4, "x", "1", 4, 5),
+		}, false},
+		"unknown write may apply late": {[]rafttest.Operation{
+			put(1, "x", "1", 1, 0),
+			get(2, "x", "", 2, 3),
+			get(2, "x", "1", 4, 5),
+		}, true},
+		"unknown write may never apply": {[]rafttest.Operation{
+			put(1, "x", "1", 1, 2),
+			put(2, "x", "2", 3, 0),
+			get(3, "x", "1", 4, 5),
+		}, true},
+		"keys are independent": {[]rafttest.Operation{
+			put(1, "x", "1", 1, 2),
+			put(2, "y", "2", 1, 2),
+			get(3, "x", "1", 3, 4),
+			get(3, "y", "1", 3, 4),
+		}, false},
+	} {
+		err := rafttest.CheckLinearizable(rafttest.KVModel, tc.history)
+		if tc.linearizable && err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+		if !tc.linearizable && !errors.Is(err, rafttest.ErrNotLinearizable) {
+			t.Errorf("%s: expected %v, got %v", name, rafttest.ErrNotLinearizable, err)
+		}
+	}
+}
+
+func TestLinearizableUnderPartitions(t *testing.T) {
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	c := rafttest.NewClusterWithFSM(5, config, rafttest.KV)
+	c.Network.SetLinks(rafttest.Link{Delay: time.Millisecond, Jitter: time.Millisecond, Drop: 0.02})
+	c.Start()
+	defer c.Stop()
+	if _, err := c.WaitForLeader(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		history = &rafttest.History{}
+		stop    = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+	for id := 1; id <= 4; id++ {
+		wg.Add(1)
+		go func(client *rafttest.KVClient) {
+			defer wg.Done()
+			rand := rand.New(rand.NewSource(int64(client.Id)))
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("k%d", rand.Intn(2))
+				if rand.Intn(2) == 0 {
+					client.Put(key, fmt.Sprintf("%d-%d", client.Id, i))
+				} else {
+					client.Get(key)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(&rafttest.KVClient{Id: id, Cluster: c, History: history})
+	}
+
+	// depose the leader a few times, by cutting it off with a minority
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if leader := c.Leader(); leader != nil {
+			other := leader.Id()%5 + 1
+			var rest []uint64
+			for id := uint64(1); id <= 5; id++ {
+				if id != leader.Id() && id != other {
+					rest = append(rest, id)
+				}
+			}
+			c.Partition([]uint64{leader.Id(), other}, rest)
+		}
+		time.Sleep(300 * time.Millisecond)
+		c.Heal()
+		c.Network.SetLinks(rafttest.Link{Delay: time.Millisecond, Jitter: time.Millisecond, Drop: 0.02})
+	}
+	close(stop)
+	wg.Wait()
+
+	ops := history.Operations()
+	if len(ops) < 10 {
+		t.Fatalf("expected the clients to make some operations, got %d", len(ops))
+	}
+	if err := rafttest.CheckLinearizable(rafttest.KVModel, ops); err != nil {
+		t.Fatal(err)
+	}
+}
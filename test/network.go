@@ -0,0 +1,233 @@
+package rafttest
+
+import (
+	"context"
+	"errors"
+	"github.com/peterbourgon/raft"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	ErrPartitioned = errors.New("partitioned")
+	ErrDropped     = errors.New("message dropped")
+)
+
+// Link is how the network treats the messages sent from one server to
+// another: RPCs, and their responses, are each delayed, and may be dropped.
+// The zero Link delivers every message at once.
+type Link struct {
+	// Delay is added to every message, and Jitter is the most that's
+	// added on top of it, at random, so messages may arrive out of order.
+	Delay  time.Duration
+	Jitter time.Duration
+
+	// Drop is the probability that a message is lost. The sender of a lost
+	// RPC, or of an RPC whose response is lost, gets ErrDropped.
+	Drop float64
+
+	// Duplicate is the probability that an AppendEntries or RequestVote is
+	// delivered a second time, after its own delay. The response to the
+	// copy is discarded. Commands and snapshots are never duplicated.
+	Duplicate float64
+}
+
+// Network connects the servers of a cluster. It can be cut between any two
+// of them, and the links between them made slow and lossy. RPCs across a cut
+// fail at once, as if the connection were refused.
+type Network struct {
+	sync.RWMutex
+	cut   map[[2]uint64]bool
+	links map[[2]uint64]Link
+	all   Link // of servers without a link of their own
+	rand  *rand.Rand
+}
+
+func newNetwork() *Network {
+	return &Network{
+		cut:   map[[2]uint64]bool{},
+		links: map[[2]uint64]Link{},
+		rand:  rand.New(rand.NewSource(1)),
+	}
+}
+
+// Cut stops RPCs between the two servers, in both directions.
+func (n *Network) Cut(a, b uint64) {
+	n.Lock()
+	defer n.Unlock()
+	n.cut[[2]uint64{a, b}], n.cut[[2]uint64{b, a}] = true, true
+}
+
+// SetLink sets how the network treats messages from one server to the other,
+// in that direction only.
+func (n *Network) SetLink(from, to uint64, l Link) {
+	n.Lock()
+	defer n.Unlock()
+	n.links[[2]uint64{from, to}] = l
+}
+
+// SetLinks sets how the network treats messages between every two servers,
+// other than those given a link of their own with SetLink.
+func (n *Network) SetLinks(l Link) {
+	n.Lock()
+	defer n.Unlock()
+	n.all = l
+}
+
+// Seed seeds the source of the network's faults. Networks are seeded with 1,
+// so they're reproducible, as far as the servers' timing allows.
+func (n *Network) Seed(seed int64) {
+	n.Lock()
+	defer n.Unlock()
+	n.rand = rand.New(rand.NewSource(seed))
+}
+
+// Heal restores every connection, and makes every link perfect again.
+func (n *Network) Heal() {
+	n.Lock()
+	defer n.Unlock()
+	n.cut = map[[2]uint64]bool{}
+	n.links = map[[2]uint64]Link{}
+	n.all = Link{}
+}
+
+// Connected reports whether RPCs can pass between the two servers.
+func (n *Network) Connected(a, b uint64) bool {
+	n.RLock()
+	defer n.RUnlock()
+	return !n.cut[[2]uint64{a, b}]
+}
+
+// roll decides the fate of a message from one server to another: how long
+// it's delayed, and whether it's dropped.
+func (n *Network) roll(from, to uint64) (time.Duration, bool) {
+	n.Lock()
+	defer n.Unlock()
+	l, ok := n.links[[2]uint64{from, to}]
+	if !ok {
+		l = n.all
+	}
+	delay := l.Delay
+	if l.Jitter > 0 {
+		delay += time.Duration(n.rand.Int63n(int64(l.Jitter)))
+	}
+	return delay, l.Drop > 0 && n.rand.Float64() < l.Drop
+}
+
+// duplicate decides whether an RPC from one server to another is delivered
+// twice.
+func (n *Network) duplicate(from, to uint64) bool {
+	n.Lock()
+	defer n.Unlock()
+	l, ok := n.links[[2]uint64{from, to}]
+	if !ok {
+		l = n.all
+	}
+	return l.Duplicate > 0 && n.rand.Float64() < l.Duplicate
+}
+
+// send carries a message from one server to the other, and returns once
+// it's arrived, or ErrPartitioned, ErrDropped, or the context's error if it
+// doesn't.
+func (n *Network) send(ctx context.Context, from, to uint64) error {
+	if !n.Connected(from, to) {
+		return ErrPartitioned
+	}
+	delay, drop := n.roll(from, to)
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if drop {
+		return ErrDropped
+	}
+	return nil
+}
+
+// peer is how one server of the cluster sees another, through the network.
+type peer struct {
+	from    uint64
+	to      uint64
+	cluster *Cluster // to find the server, which is replaced if it crashes
+	network *Network
+}
+
+func (p *peer) Id() uint64 { return p.to }
+
+func (p *peer) AppendEntries(ae raft.AppendEntries) raft.AppendEntriesResponse {
+	resp, _ := p.AppendEntriesContext(context.Background(), ae)
+	return resp
+}
+
+func (p *peer) RequestVote(rv raft.RequestVote) raft.RequestVoteResponse {
+	resp, _ := p.RequestVoteContext(context.Background(), rv)
+	return resp
+}
+
+func (p *peer) Command(cmd []byte, response chan []byte) error {
+	if err := p.network.send(context.Background(), p.from, p.to); err != nil {
+		return err
+	}
+	return p.cluster.Server(p.to).Command(cmd, response)
+}
+
+func (p *peer) AppendEntriesContext(ctx context.Context, ae raft.AppendEntries) (raft.AppendEntriesResponse, error) {
+	if err := p.network.send(ctx, p.from, p.to); err != nil {
+		return raft.AppendEntriesResponse{}, err
+	}
+	if p.network.duplicate(p.from, p.to) {
+		go func() {
+			if p.network.send(context.Background(), p.from, p.to) == nil {
+				p.cluster.Server(p.to).AppendEntriesContext(context.Background(), ae)
+			}
+		}()
+	}
+	resp, err := p.cluster.Server(p.to).AppendEntriesContext(ctx, ae)
+	if err != nil {
+		return resp, err
+	}
+	if err := p.network.send(ctx, p.to, p.from); err != nil {
+		return raft.AppendEntriesResponse{}, err
+	}
+	return resp, nil
+}
+
+func (p *peer) RequestVoteContext(ctx context.Context, rv raft.RequestVote) (raft.RequestVoteResponse, error) {
+	if err := p.network.send(ctx, p.from, p.to); err != nil {
+		return raft.RequestVoteResponse{}, err
+	}
+	if p.network.duplicate(p.from, p.to) {
+		go func() {
+			if p.network.send(context.Background(), p.from, p.to) == nil {
+				p.cluster.Server(p.to).RequestVoteContext(context.Background(), rv)
+			}
+		}()
+	}
+	resp, err := p.cluster.Server(p.to).RequestVoteContext(ctx, rv)
+	if err != nil {
+		return resp, err
+	}
+	if err := p.network.send(ctx, p.to, p.from); err != nil {
+		return raft.RequestVoteResponse{}, err
+	}
+	return resp, nil
+}
+
+func (p *peer) InstallSnapshotContext(ctx context.Context, is raft.InstallSnapshot, data io.Reader) (raft.InstallSnapshotResponse, error) {
+	if err := p.network.send(ctx, p.from, p.to); err != nil {
+		return raft.InstallSnapshotResponse{}, err
+	}
+	resp, err := p.cluster.Server(p.to).InstallSnapshotContext(ctx, is, data)
+	if err != nil {
+		return resp, err
+	}
+	if err := p.network.send(ctx, p.to, p.from); err != nil {
+		return raft.InstallSnapshotResponse{}, err
+	}
+	return resp, nil
+}
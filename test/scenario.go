@@ -0,0 +1,216 @@
+package rafttest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/peterbourgon/raft"
+	"time"
+)
+
+var (
+	ErrNoLeader        = errors.New("no leader")
+	ErrNotCommitted    = errors.New("command not committed")
+	ErrNotConverged    = errors.New("servers haven't converged")
+	ErrLeaderUnchanged = errors.New("leader unchanged")
+)
+
+// Scenario is a sequence of steps run against a fresh cluster.
+type Scenario struct {
+	Name    string
+	Servers int
+
+	// Config is the config of every server. If its election timeouts are
+	// zero, they default to 25ms and 50ms, with a heartbeat every 2.5ms,
+	// which suits the in-memory network, and keeps scenarios quick.
+	Config raft.Config
+
+	// Timeout is how long each step may wait for what it expects. It
+	// defaults to 5s.
+	Timeout time.Duration
+
+	Steps []Step
+}
+
+// Step is one step of a scenario. Steps that expect something of the cluster
+// wait for it, up to the scenario's timeout, and fail if it doesn't happen.
+type Step interface {
+	Run(*Env) error
+}
+
+// Env is what a step acts on: the cluster, and what earlier steps did to it.
+type Env struct {
+	Cluster   *Cluster
+	Timeout   time.Duration
+	Leader    uint64   // as found by the last AwaitLeader
+	Submitted []string // commands submitted by Submit steps, in order
+}
+
+// Run runs the scenario, and returns the error of the first step to fail,
+// if any.
+func (sc Scenario) Run() error {
+	config := sc.Config
+	if config.MinElectionTimeout == 0 {
+		config.MinElectionTimeout = 25 * time.Millisecond
+		config.MaxElectionTimeout = 50 * time.Millisecond
+		config.HeartbeatInterval = 2500 * time.Microsecond
+	}
+	env := &Env{Cluster: NewCluster(sc.Servers, config), Timeout: sc.Timeout}
+	if env.Timeout <= 0 {
+		env.Timeout = 5 * time.Second
+	}
+	env.Cluster.Start()
+	defer env.Cluster.Stop()
+
+	for i, step := range sc.Steps {
+		if err := step.Run(env); err != nil {
+			return fmt.Errorf("step %d (%T): %s", i+1, step, err)
+		}
+	}
+	return nil
+}
+
+// AwaitLeader waits for a leader to be elected, and records its id, for later
+// steps.
+type AwaitLeader struct{}
+
+func (AwaitLeader) Run(env *Env) error {
+	leader, err := env.Cluster.WaitForLeader(env.Timeout)
+	if err != nil {
+		return err
+	}
+	env.Leader = leader.Id()
+	return nil
+}
+
+// ExpectNewLeader waits for a leader other than the one recorded by the last
+// AwaitLeader, e.g. after the old one was isolated, and records it.
+type ExpectNewLeader struct{}
+
+func (ExpectNewLeader) Run(env *Env) error {
+	old := env.Leader
+	return await(env.Timeout, func() error {
+		leader := env.Cluster.Leader()
+		if leader == nil {
+			return ErrNoLeader
+		}
+		if leader.Id() == old {
+			return ErrLeaderUnchanged
+		}
+		env.Leader = leader.Id()
+		return nil
+	})
+}
+
+// Partition cuts the network between the groups of servers. Servers that
+// aren't in any group are cut off from every other server.
+type Partition struct {
+	Groups [][]uint64
+}
+
+func (p Partition) Run(env *Env) error {
+	for _, ids := range p.Groups {
+		for _, id := range ids {
+			if env.Cluster.Server(id) == nil {
+				return fmt.Errorf("no server %d", id)
+			}
+		}
+	}
+	env.Cluster.Partition(p.Groups...)
+	return nil
+}
+
+// IsolateLeader cuts the leader recorded by the last AwaitLeader off from the
+// rest of the cluster.
+type IsolateLeader struct{}
+
+func (IsolateLeader) Run(env *Env) error {
+	if env.Leader == 0 {
+		return ErrNoLeader
+	}
+	for _, s := range env.Cluster.Servers {
+		if s.Id() != env.Leader {
+			env.Cluster.Network.Cut(env.Leader, s.Id())
+		}
+	}
+	return nil
+}
+
+// Faults makes every link in the network slow or lossy, as the Link says,
+// until the next Heal.
+type Faults struct {
+	Link Link
+}
+
+func (f Faults) Run(env *Env) error {
+	env.Cluster.Network.SetLinks(f.Link)
+	return nil
+}
+
+// Heal restores every connection in the network, and makes every link
+// perfect again.
+type Heal struct{}
+
+func (Heal) Run(env *Env) error {
+	env.Cluster.Heal()
+	return nil
+}
+
+// Submit submits N commands, one at a time, to the leader of the latest term,
+// and waits for each to commit. A command that isn't committed in time, e.g.
+// because its leader was deposed, is submitted again, so it may be applied
+// more than once.
+type Submit struct {
+	N int
+}
+
+func (s Submit) Run(env *Env) error {
+	for i := 0; i < s.N; i++ {
+		cmd := fmt.Sprintf("%d", len(env.Submitted)+1)
+		err := await(env.Timeout, func() error {
+			leader := env.Cluster.Leader()
+			if leader == nil {
+				return ErrNoLeader
+			}
+			response := make(chan []byte, 1)
+			if err := leader.Command([]byte(cmd), response); err != nil {
+				return err
+			}
+			select {
+			case _, ok := <-response:
+				if !ok {
+					return ErrNotCommitted // dropped
+				}
+				return nil
+			case <-time.After(leader.Config().MaxElectionTimeout * 4):
+				return ErrNotCommitted
+			}
+		})
+		if err != nil {
+			return err
+		}
+		env.Submitted = append(env.Submitted, cmd)
+	}
+	return nil
+}
+
+// ExpectConvergence waits for every server to have applied the same commands,
+// in the same order, including every command submitted so far.
+type ExpectConvergence struct{}
+
+func (ExpectConvergence) Run(env *Env) error {
+	return await(env.Timeout, func() error {
+		if err := env.Cluster.same(); err != nil {
+			return err
+		}
+		have := map[string]bool{}
+		for _, cmd := range env.Cluster.Applied(1) {
+			have[cmd] = true
+		}
+		for _, cmd := range env.Submitted {
+			if !have[cmd] {
+				return fmt.Errorf("%s: command %s is missing", ErrNotConverged, cmd)
+			}
+		}
+		return nil
+	})
+}
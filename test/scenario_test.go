@@ -0,0 +1,262 @@
+package rafttest_test
+
+import (
+	"context"
+	"errors"
+	"github.com/peterbourgon/raft"
+	"github.com/peterbourgon/raft/test"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestScenarios(t *testing.T) {
+	for _, sc := range []rafttest.Scenario{
+		{
+			Name:    "partitioned leader is replaced",
+			Servers: 3,
+			Steps: []rafttest.Step{
+				rafttest.AwaitLeader{},
+				rafttest.Submit{N: 3},
+				rafttest.IsolateLeader{},
+				rafttest.ExpectNewLeader{},
+				rafttest.Submit{N: 10},
+				rafttest.Heal{},
+				rafttest.ExpectConvergence{},
+			},
+		},
+		{
+			Name:    "minority partition catches up",
+			Servers: 5,
+			Steps: []rafttest.Step{
+				rafttest.AwaitLeader{},
+				rafttest.Partition{Groups: [][]uint64{{1, 2, 3}, {4, 5}}},
+				rafttest.Submit{N: 10},
+				rafttest.Heal{},
+				rafttest.Submit{N: 1},
+				rafttest.ExpectConvergence{},
+			},
+		},
+		{
+			Name:    "every server isolated, then healed",
+			Servers: 3,
+			Steps: []rafttest.Step{
+				rafttest.AwaitLeader{},
+				rafttest.Partition{},
+				rafttest.Heal{},
+				rafttest.Submit{N: 5},
+				rafttest.ExpectConvergence{},
+			},
+		},
+		{
+			Name:    "slow, lossy network",
+			Servers: 3,
+			Steps: []rafttest.Step{
+				rafttest.AwaitLeader{},
+				rafttest.Faults{Link: rafttest.Link{
+					Delay:     500 * time.Microsecond,
+					Jitter:    time.Millisecond,
+					Drop:      0.05,
+					Duplicate: 0.1,
+				}},
+				rafttest.Submit{N: 20},
+				rafttest.Heal{},
+				rafttest.ExpectConvergence{},
+			},
+		},
+	} {
+		sc := sc
+		t.Run(sc.Name, func(t *testing.T) {
+			if err := sc.Run(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestPartition(t *testing.T) {
+	c := rafttest.NewCluster(3, raft.Config{})
+	c.Partition([]uint64{1, 2}, []uint64{3})
+	for _, link := range []struct {
+		a, b      uint64
+		connected bool
+	}{
+		{1, 2, true},
+		{2, 1, true},
+		{1, 3, false},
+		{3, 2, false},
+	} {
+		if got := c.Network.Connected(link.a, link.b); got != link.connected {
+			t.Errorf("%d to %d: expected connected=%v, got %v", link.a, link.b, link.connected, got)
+		}
+	}
+	c.Heal()
+	if !c.Network.Connected(1, 3) || !c.Network.Connected(3, 2) {
+		t.Error("expected every server to be connected after healing")
+	}
+}
+
+func TestOneWayLink(t *testing.T) {
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	c := rafttest.NewCluster(3, config)
+	c.Start()
+	defer c.Stop()
+
+	// server 3 hears from the others, but they never hear back
+	c.Network.SetLink(3, 1, rafttest.Link{Drop: 1})
+	c.Network.SetLink(3, 2, rafttest.Link{Drop: 1})
+	if _, err := c.ApplyAndWait([]byte("cmd"), 5*time.Second); err != nil {
+		t.Fatalf("servers 1 and 2 never committed a command: %s", err)
+	}
+	if st := c.Server(3).Status(); st.State == raft.Leader {
+		t.Errorf("server 3 can't win votes, but is the leader in term %d", st.Term)
+	}
+}
+
+// counter is a state machine that counts the commands it applies.
+type counter struct {
+	n int
+}
+
+func (c *counter) apply(cmd []byte) ([]byte, error) {
+	c.n++
+	return []byte(strconv.Itoa(c.n)), nil
+}
+
+func TestClusterWithFSM(t *testing.T) {
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	counters := map[uint64]*counter{}
+	c := rafttest.NewClusterWithFSM(3, config, func(id uint64) func([]byte) ([]byte, error) {
+		counters[id] = &counter{}
+		return counters[id].apply
+	})
+	c.Start()
+	defer c.Stop()
+
+	leader, err := c.WaitForLeader(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		resp, err := c.ApplyAndWait([]byte("incr"), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := strconv.Itoa(i); string(resp) != expected {
+			t.Errorf("expected the counter at %s, got %s", expected, resp)
+		}
+	}
+	if err := c.EnsureSame(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(c.Applied(leader.Id())); got != 3 {
+		t.Errorf("expected 3 commands applied, got %d", got)
+	}
+	for _, f := range c.Followers() {
+		if f.Id() == leader.Id() {
+			t.Errorf("leader %d is among the followers", f.Id())
+		}
+	}
+}
+
+func TestCrash(t *testing.T) {
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	c := rafttest.NewCluster(3, config)
+	c.Start()
+	defer c.Stop()
+
+	leader, err := c.WaitForLeader(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower := leader.Id()%3 + 1
+	if err := c.Store(follower).SetFaults(raft.Faults{LoseUnsynced: true, SyncLatency: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{"a", "b", "c"} {
+		if _, err := c.ApplyAndWait([]byte(cmd), 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.EnsureSame(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the follower synced every entry it applied, so it recovers them all
+	c.Crash(follower)
+	if _, err := c.ApplyAndWait([]byte("d"), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.EnsureSame(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Applied(follower); len(got) != 4 {
+		t.Errorf("after its crash, expected server %d to apply 4 commands, got %v", follower, got)
+	}
+
+	// a command the leader's state machine rejects is rejected
+	c.FailApply(leader.Id(), 1, &raft.CommandError{Err: errors.New("rejected")})
+	if _, err := leader.Apply(context.Background(), []byte("e")); err == nil || err.Error() != "rejected" {
+		t.Errorf("expected the command to be rejected, got %v", err)
+	}
+	if err := c.EnsureSame(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCrashAfterAcknowledging(t *testing.T) {
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	c := rafttest.NewCluster(3, config)
+	c.Start()
+	defer c.Stop()
+
+	leader, err := c.WaitForLeader(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ApplyAndWait([]byte("a"), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	var followers []uint64
+	for id := uint64(1); id <= 3; id++ {
+		if id != leader.Id() {
+			followers = append(followers, id)
+			if err := c.Store(id).SetFaults(raft.Faults{LoseUnsynced: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// the leader's slow sync holds its commit of the command back, so the
+	// followers acknowledge it without learning that it's committed
+	if err := c.Store(leader.Id()).SetFaults(raft.Faults{SyncLatency: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	index := leader.Status().LastIndex + 1
+	go leader.Apply(context.Background(), []byte("b"))
+	for _, id := range followers {
+		for i := 0; c.Server(id).Status().LastIndex < index; i++ {
+			if i > 1000 {
+				t.Fatalf("server %d never appended the command", id)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// the followers crash before the next commit, without the leader, so
+	// they only have what they synced before acknowledging the command
+	c.Partition([]uint64{leader.Id()}, followers)
+	for _, id := range followers {
+		c.Crash(id)
+	}
+	for _, id := range followers {
+		for i := 0; ; i++ {
+			if applied := c.Applied(id); len(applied) == 2 && applied[1] == "b" {
+				break
+			} else if i > 1000 {
+				t.Fatalf("server %d: expected [a b] applied, got %v", id, applied)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
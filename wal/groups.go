@@ -0,0 +1,83 @@
+package raftwal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Groups keeps the logs of many Raft groups, hosted in one process with a
+// raft.MultiServer, under one directory. Each group has a subdirectory, named
+// for its id, which holds its log, in "wal", and can hold its other state,
+// e.g. its stable store and snapshots, too.
+type Groups struct {
+	sync.Mutex
+	dir         string
+	segmentSize int64
+	open        map[uint64]*WAL
+}
+
+// OpenGroups opens (or creates) the directory of groups' logs. Each log has
+// segments of about the given size, as with Open.
+func OpenGroups(dir string, segmentSize int64) (*Groups, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Groups{dir: dir, segmentSize: segmentSize, open: map[uint64]*WAL{}}, nil
+}
+
+// Dir returns the group's directory.
+func (g *Groups) Dir(group uint64) string {
+	return filepath.Join(g.dir, strconv.FormatUint(group, 10))
+}
+
+// List returns the ids of the groups with a directory, in order, e.g. to
+// restore them after a restart.
+func (g *Groups) List() ([]uint64, error) {
+	infos, err := ioutil.ReadDir(g.dir)
+	if err != nil {
+		return nil, err
+	}
+	groups := []uint64{}
+	for _, info := range infos {
+		group, err := strconv.ParseUint(info.Name(), 10, 64)
+		if err != nil || !info.IsDir() {
+			continue // not a group's
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i] < groups[j] })
+	return groups, nil
+}
+
+// Open opens (or creates) the group's log, or returns it, if it's open.
+func (g *Groups) Open(group uint64) (*WAL, error) {
+	g.Lock()
+	defer g.Unlock()
+	if w, ok := g.open[group]; ok {
+		return w, nil
+	}
+	w, err := Open(filepath.Join(g.Dir(group), "wal"), g.segmentSize)
+	if err != nil {
+		return nil, err
+	}
+	g.open[group] = w
+	return w, nil
+}
+
+// Close closes every group's log that's open. It returns the first error.
+func (g *Groups) Close() error {
+	g.Lock()
+	defer g.Unlock()
+	var err error
+	for group, w := range g.open {
+		if e := w.Close(); err == nil {
+			err = e
+		}
+		delete(g.open, group)
+	}
+	return err
+}
@@ -0,0 +1,466 @@
+// Package raftwal is a write-ahead log for Raft servers' logs, stored in a
+// directory of segment files. A WAL is an io.ReadWriter, so it can be passed
+// to raft.NewServer as the log's store:
+//
+//	wal, err := raftwal.Open("/var/lib/raft/log", 0)
+//	if err != nil {
+//		return err
+//	}
+//	defer wal.Close()
+//	server, err := raft.NewServerErr(id, wal, apply, config)
+//
+// Each write is a record, checksummed and synced before Write returns, unless
+// the WAL is in group commit mode, when records are synced together by Sync.
+// When a segment fills up, records go to a new one, so segments holding
+// entries the application no longer needs can be deleted whole, with Compact.
+package raftwal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// DefaultSegmentSize is the size of segments when Open is passed zero.
+const DefaultSegmentSize = 64 << 20
+
+var (
+	ErrCorrupt        = errors.New("write-ahead log is corrupt")
+	ErrRecordTooLarge = errors.New("record too large")
+)
+
+const (
+	headerSize    = 4 + 4 // payload length, and its checksum
+	segmentSuffix = ".wal"
+)
+
+// segment is a segment file, named for the ordinal of its first record.
+type segment struct {
+	first uint64
+	path  string
+}
+
+// WAL is a write-ahead log. Reads start at the first record of the first
+// segment, and return the payloads of the records in order; they're meant for
+// recovering the log, before anything is written. Writes append a record.
+type WAL struct {
+	sync.Mutex
+	dir         string
+	segmentSize int64
+	segments    []segment
+	f           *os.File // the last segment, open for appending
+	size        int64    // of the last segment
+	next        uint64   // the ordinal of the next record
+	group       bool     // sync in Sync, not Write
+	dirty       bool     // written since the last sync
+
+	// reading
+	r        *os.File
+	rs       int    // index in segments of r
+	rec      []byte // the payload of the record being read
+	pos      int    // in rec
+	lastRune int    // size of the last rune read, for UnreadRune
+}
+
+// Open opens (or creates) the write-ahead log in the given directory, with
+// segments of about the given size in bytes. A record that doesn't fit in a
+// segment's remaining space starts a new one, though a single large record
+// may make a segment larger.
+//
+// Records are checked as the log is opened. A record torn by a crash, at the
+// end of the last segment, is discarded, along with whatever follows it, so
+// new records follow the last good one. A bad record anywhere else fails with
+// ErrCorrupt, since it was once synced, and has been damaged since.
+func Open(dir string, segmentSize int64) (*WAL, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &WAL{dir: dir, segmentSize: segmentSize, next: 1}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	w.segments = segments
+	if len(segments) > 0 {
+		w.next = segments[0].first // earlier ones may have been compacted
+	}
+
+	for i, seg := range w.segments {
+		last := i == len(w.segments)-1
+		n, good, err := scanSegment(seg.path)
+		if err != nil {
+			return nil, err
+		}
+		if seg.first != w.next {
+			return nil, ErrCorrupt // a segment is missing
+		}
+		w.next += n
+		fi, err := os.Stat(seg.path)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Size() != good {
+			if !last {
+				return nil, ErrCorrupt
+			}
+			if err := os.Truncate(seg.path, good); err != nil {
+				return nil, err
+			}
+		}
+		if last {
+			w.size = good
+		}
+	}
+
+	if len(w.segments) == 0 {
+		if err := w.create(); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+	w.f, err = os.OpenFile(w.segments[len(w.segments)-1].path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.f.Sync(); err != nil { // make any truncation durable
+		w.f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// listSegments returns the segment files in the directory, in order.
+func listSegments(dir string) ([]segment, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := []segment{}
+	for _, fi := range infos {
+		name := fi.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 16, 64)
+		if err != nil {
+			continue // not one of ours
+		}
+		segments = append(segments, segment{first, filepath.Join(dir, name)})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].first < segments[j].first })
+	return segments, nil
+}
+
+// scanSegment returns the number of good records at the start of the segment,
+// and their size in bytes.
+func scanSegment(path string) (uint64, int64, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	n, good := uint64(0), int64(0)
+	for {
+		payload, ok := decodeRecord(buf[good:])
+		if !ok {
+			return n, good, nil
+		}
+		n++
+		good += int64(headerSize + len(payload))
+	}
+}
+
+// decodeRecord returns the payload of the record at the start of buf, if
+// it's complete and its checksum matches.
+func decodeRecord(buf []byte) ([]byte, bool) {
+	if len(buf) < headerSize {
+		return nil, false
+	}
+	length := binary.BigEndian.Uint32(buf[0:4])
+	if uint64(len(buf)-headerSize) < uint64(length) {
+		return nil, false
+	}
+	payload := buf[headerSize : headerSize+int(length)]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(buf[4:8]) {
+		return nil, false
+	}
+	return payload, true
+}
+
+func encodeRecord(payload []byte) []byte {
+	buf := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[headerSize:], payload)
+	return buf
+}
+
+// create starts a new segment, for the next record.
+func (w *WAL) create() error {
+	path := filepath.Join(w.dir, fmt.Sprintf("%016x%s", w.next, segmentSuffix))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(w.dir); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if w.f != nil {
+		w.f.Close()
+	}
+	w.f, w.size = f, 0
+	w.segments = append(w.segments, segment{w.next, path})
+	return nil
+}
+
+// Write appends p to the log as a single record, and syncs it. A record is
+// limited to 4GiB.
+func (w *WAL) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if uint64(len(p)) > 1<<32-1 {
+		return 0, ErrRecordTooLarge
+	}
+	rec := encodeRecord(p)
+	if w.size > 0 && w.size+int64(len(rec)) > w.segmentSize {
+		if err := w.create(); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := w.f.Write(rec); err != nil {
+		return 0, err
+	}
+	w.size += int64(len(rec))
+	w.next++
+	w.dirty = true
+	if !w.group {
+		if err := w.sync(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// SetGroupCommit puts the WAL in (or out of) group commit mode. In group
+// commit mode, Write doesn't sync, and records are made durable together by
+// Sync, which saves a sync per record when many are written at once. A raft
+// log syncs its store after writing each batch of committed entries, as a
+// raft.Syncer.
+func (w *WAL) SetGroupCommit(enabled bool) {
+	w.Lock()
+	defer w.Unlock()
+	w.group = enabled
+}
+
+// Sync makes every record written so far durable.
+func (w *WAL) Sync() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.sync()
+}
+
+func (w *WAL) sync() error {
+	if !w.dirty || w.f == nil {
+		return nil
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+// Read reads the payloads of the records, in order, from the first.
+func (w *WAL) Read(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if err := w.fill(); err != nil {
+		return 0, err
+	}
+	n := copy(p, w.rec[w.pos:])
+	w.pos += n
+	w.lastRune = 0
+	return n, nil
+}
+
+// ReadRune and UnreadRune make the WAL an io.RuneScanner, which the log's
+// decoder needs to read entries in the old text format without losing the
+// character after each field.
+func (w *WAL) ReadRune() (rune, int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if err := w.fill(); err != nil {
+		return 0, 0, err
+	}
+	r, size := utf8.DecodeRune(w.rec[w.pos:])
+	w.pos += size
+	w.lastRune = size
+	return r, size, nil
+}
+
+func (w *WAL) UnreadRune() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.lastRune == 0 {
+		return bufio.ErrInvalidUnreadRune
+	}
+	w.pos -= w.lastRune
+	w.lastRune = 0
+	return nil
+}
+
+// fill reads the next record, if we've read all of the current one.
+func (w *WAL) fill() error {
+	for w.pos >= len(w.rec) {
+		payload, err := w.readRecord()
+		if err != nil {
+			return err
+		}
+		w.rec, w.pos, w.lastRune = payload, 0, 0
+	}
+	return nil
+}
+
+// readRecord reads the next record, moving through the segments as each is
+// exhausted. It returns io.EOF after the last record of the last segment.
+func (w *WAL) readRecord() ([]byte, error) {
+	for {
+		if w.r == nil {
+			if w.rs >= len(w.segments) {
+				return nil, io.EOF
+			}
+			r, err := os.Open(w.segments[w.rs].path)
+			if err != nil {
+				return nil, err
+			}
+			w.r = r
+		}
+		header := make([]byte, headerSize)
+		_, err := io.ReadFull(w.r, header)
+		if err == io.EOF && w.rs < len(w.segments)-1 {
+			w.r.Close()
+			w.r, w.rs = nil, w.rs+1
+			continue
+		}
+		if err != nil {
+			return nil, err // EOF at the end of the last segment
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(w.r, payload); err != nil {
+			return nil, ErrCorrupt
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return nil, ErrCorrupt
+		}
+		return payload, nil
+	}
+}
+
+// Compact deletes the segments holding only records before the nth, counting
+// from 1, e.g. once the state machine has been snapshotted. A Raft server
+// writes a record for each entry it appends, in order, so the nth record
+// holds the entry with index n, or a record after it does, if entries were
+// replaced. The last segment is never deleted.
+func (w *WAL) Compact(n uint64) error {
+	w.Lock()
+	defer w.Unlock()
+
+	deleted := 0
+	var err error
+	for deleted < len(w.segments)-1 && w.segments[deleted+1].first <= n {
+		if deleted == w.rs && w.r != nil {
+			w.r.Close()
+			w.r = nil
+		}
+		if err = os.Remove(w.segments[deleted].path); err != nil {
+			break
+		}
+		deleted++
+	}
+	w.segments = w.segments[deleted:]
+	if w.rs -= deleted; w.rs < 0 {
+		w.rs = 0
+	}
+	if deleted > 0 {
+		if serr := syncDir(w.dir); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// Reset discards every record, so the next record written is the nth. A raft
+// log resets its store, as a raft.Resetter, when it's replaced by a snapshot
+// its entries don't reach, so the nth record still holds the entry with index
+// n. Segments are deleted newest first, so a crash part way leaves a shorter
+// log, which the server resets again when it restores the snapshot.
+func (w *WAL) Reset(n uint64) error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.r != nil {
+		w.r.Close()
+		w.r = nil
+	}
+	w.rs, w.rec, w.pos, w.lastRune = 0, nil, 0, 0
+	w.f.Close()
+	w.f, w.dirty = nil, false
+	for len(w.segments) > 0 {
+		last := w.segments[len(w.segments)-1]
+		if err := os.Remove(last.path); err != nil {
+			return err
+		}
+		w.segments = w.segments[:len(w.segments)-1]
+	}
+	w.next = n
+	return w.create()
+}
+
+// Close closes the log's files.
+func (w *WAL) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.r != nil {
+		w.r.Close()
+		w.r = nil
+	}
+	if err := w.sync(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// syncDir syncs the directory, so files created in (or removed from) it
+// survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,259 @@
+package raftwal_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/peterbourgon/raft"
+	"github.com/peterbourgon/raft/wal"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raftwal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// small segments, so the records span several
+	w, err := raftwal.Open(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []string{}
+	for i := 0; i < 10; i++ {
+		records = append(records, strings.Repeat(string('a'+rune(i)), 20))
+		if _, err := w.Write([]byte(records[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if len(segments) < 3 {
+		t.Fatalf("expected several segments, got %d", len(segments))
+	}
+
+	// a crash tears the last record
+	last := segments[len(segments)-1]
+	f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 20, 1, 2, 3, 4, 'z', 'z'})
+	f.Close()
+
+	// reopening discards it, and reads the rest
+	w, err = raftwal.Open(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(w); err != nil || string(got) != strings.Join(records, "") {
+		t.Errorf("expected %q, got %q (%v)", strings.Join(records, ""), got, err)
+	}
+	if _, err := w.Write([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// compaction deletes whole segments before the given record
+	w, err = raftwal.Open(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Compact(5); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if expected := strings.Join(records[4:], "") + "after"; !strings.HasSuffix(string(got), expected) || len(got) >= len(strings.Join(records, "")) {
+		t.Errorf("expected records from the 5th on (and maybe a few before), got %q", got)
+	}
+
+	// damage anywhere but the end of the last segment is corruption
+	segments, _ = filepath.Glob(filepath.Join(dir, "*.wal"))
+	buf, _ := ioutil.ReadFile(segments[0])
+	buf[len(buf)-1] ^= 0xff
+	ioutil.WriteFile(segments[0], buf, 0644)
+	if _, err := raftwal.Open(dir, 64); err != raftwal.ErrCorrupt {
+		t.Errorf("expected %v, got %v", raftwal.ErrCorrupt, err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raftwal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := raftwal.Open(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := w.Write([]byte(strings.Repeat("x", 20))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// after a reset, only the records written since are read, and the
+	// first is the 100th, for compaction
+	if err := w.Reset(100); err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []string{"one", "two"} {
+		if _, err := w.Write([]byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if expected, got := []string{filepath.Join(dir, "0000000000000064.wal")}, segments; len(got) != 1 || got[0] != expected[0] {
+		t.Errorf("expected segments %v, got %v", expected, got)
+	}
+	w, err = raftwal.Open(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if got, err := ioutil.ReadAll(w); err != nil || string(got) != "onetwo" {
+		t.Errorf("expected %q, got %q (%v)", "onetwo", got, err)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raftwal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := raftwal.Open(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetGroupCommit(true)
+	var _ raft.Syncer = w
+	for i := 0; i < 10; i++ {
+		if _, err := w.Write([]byte(strings.Repeat("x", 20))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	w, err = raftwal.Open(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if got, err := ioutil.ReadAll(w); err != nil || len(got) != 200 {
+		t.Errorf("expected 200 bytes, got %d (%v)", len(got), err)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raftwal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// each group's log is its own
+	g, err := raftwal.OpenGroups(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, group := range []uint64{2, 10} {
+		w, err := g.Open(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again, err := g.Open(group); err != nil || again != w {
+			t.Errorf("group %d: expected the open log, got %p (%v)", group, again, err)
+		}
+		if _, err := w.Write([]byte(fmt.Sprintf("group %d", group))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopened, the groups are listed, and their logs recovered
+	g, err = raftwal.OpenGroups(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	groups, err := g.List()
+	if expected := []uint64{2, 10}; err != nil || !reflect.DeepEqual(expected, groups) {
+		t.Fatalf("expected groups %v, got %v (%v)", expected, groups, err)
+	}
+	for _, group := range groups {
+		w, err := g.Open(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadAll(w); err != nil || string(got) != fmt.Sprintf("group %d", group) {
+			t.Errorf("group %d: expected its own record, got %q (%v)", group, got, err)
+		}
+	}
+}
+
+func TestServerWAL(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	dir, err := ioutil.TempDir("", "raftwal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+
+	w, err := raftwal.Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := raft.NewServer(1, w, noop, config)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server)))
+	server.Start()
+	response := make(chan []byte, 1)
+	for {
+		err := server.Command([]byte(`{}`), response)
+		if err == nil {
+			break
+		}
+		if err != raft.ErrUnknownLeader {
+			t.Fatal(err)
+		}
+		time.Sleep(config.MinElectionTimeout)
+	}
+	<-response
+	lastIndex := server.Status().CommitIndex
+	server.Stop()
+	w.Close()
+
+	// a restarted server recovers its log
+	w, err = raftwal.Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if got := raft.NewServer(1, w, noop, config).Status().LastIndex; got < lastIndex {
+		t.Errorf("expected last index of at least %d, got %d", lastIndex, got)
+	}
+}
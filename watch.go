@@ -0,0 +1,72 @@
+package raft
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Replicated is sent to a watch registered with WatchReplication, when the
+// leader learns that the follower has the watched entry. The event's Index is
+// the follower's matchIndex, and its Data is the follower's id, in decimal.
+// It isn't passed to the event handler.
+const Replicated = "Replicated"
+
+// replicationWatches are the watches registered with WatchReplication.
+type replicationWatches struct {
+	sync.Mutex
+	m map[chan Event]replicationWatch
+}
+
+type replicationWatch struct {
+	peer  uint64
+	index uint64
+}
+
+// WatchReplication watches for the follower with the given id to have the
+// entry at the given index in its log, e.g. to wait until a new server has
+// caught up before cutting traffic over to it. The chan receives a single
+// Replicated event once it does, as soon as the leader next hears from the
+// follower. Only the leader knows how far its followers have got, so a watch
+// on another server waits until it's the leader. The returned func cancels
+// the watch; it needn't be called once the event's been received.
+func (s *Server) WatchReplication(peer, index uint64) (<-chan Event, func()) {
+	c := make(chan Event, 1)
+	s.watches.Lock()
+	defer s.watches.Unlock()
+	if s.watches.m == nil {
+		s.watches.m = map[chan Event]replicationWatch{}
+	}
+	s.watches.m[c] = replicationWatch{peer, index}
+	return c, func() {
+		s.watches.Lock()
+		defer s.watches.Unlock()
+		delete(s.watches.m, c)
+	}
+}
+
+// notifyReplicated sends a Replicated event to each watch whose follower has
+// its entry, and forgets the watch. The leader calls it after every flush.
+func (s *Server) notifyReplicated(ni *nextIndex) {
+	s.watches.Lock()
+	defer s.watches.Unlock()
+	if len(s.watches.m) == 0 {
+		return
+	}
+	progress := ni.progress()
+	for c, w := range s.watches.m {
+		p, ok := progress[w.peer]
+		if !ok || p.MatchIndex < w.index {
+			continue
+		}
+		c <- Event{
+			Type:  Replicated,
+			Id:    s.id,
+			Term:  s.term,
+			Index: p.MatchIndex,
+			Time:  time.Now(),
+			Data:  []byte(strconv.FormatUint(w.peer, 10)),
+		}
+		delete(s.watches.m, c)
+	}
+}
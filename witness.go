@@ -0,0 +1,326 @@
+package raft
+
+import (
+	"context"
+	"sync"
+)
+
+// NoFaultTolerance is emitted when the voting members of the cluster, with
+// the witness, if any, can't lose a single one and still reach a quorum,
+// e.g. in a 2-server cluster without a witness. Single-server clusters are
+// assumed to be deliberate, and don't emit it.
+const NoFaultTolerance = "NoFaultTolerance"
+
+// FaultTolerance returns how many of the peers can fail, with the rest still
+// reaching a quorum. Clusters with an even number of voters tolerate no more
+// failures than with one fewer: 2 servers tolerate none, and 4 only one.
+func (p Peers) FaultTolerance() int {
+	if len(p) == 0 {
+		return 0
+	}
+	return len(p) - p.Quorum()
+}
+
+// Witness breaks ties in clusters with an even number of voters. It votes in
+// elections, and acknowledges the leader's log, like another voter would,
+// but holds no entries: it records only the term and index of the last entry
+// of the latest log it's acknowledged, and only votes for candidates whose
+// logs are at least as up-to-date. That's enough for it to count towards a
+// quorum without losing committed entries, so a 2-server cluster with a
+// witness carries on when its follower fails, and a 4-server cluster, split
+// evenly, carries on with the witness's half, if a server there is up to date.
+//
+// It doesn't tolerate the failure of any one server, though. Entries the
+// leader committed with only the witness's acknowledgement are on no other
+// server, so when the leader fails, the witness refuses its vote to survivors
+// that are behind the log it recorded, as electing one would lose them. A
+// 2-server cluster carries on without its leader only if the follower had
+// caught up.
+//
+// A witness is typically a small service outside the cluster, shared by the
+// servers, e.g. a row in a database, updated with compare-and-swap, or a
+// process of its own, served with NewWitnessPeer. Its state must survive
+// restarts, or it could vote twice in a term. See LocalWitness for the rules
+// it must follow.
+type Witness interface {
+	// Vote grants the candidate the witness's vote in the term, unless it's
+	// seen a later term, or voted for another candidate in the term, or
+	// recorded a log that's more up-to-date than the candidate's. It returns
+	// the latest term it's seen.
+	Vote(ctx context.Context, term, candidate, lastLogTerm, lastLogIndex uint64) (currentTerm uint64, granted bool, err error)
+
+	// Record records that the leader of the term has a log whose last entry
+	// has the index and the log term, unless the witness has seen a later
+	// term, or recorded a log that's more up-to-date. It returns the latest
+	// term it's seen, and whether it recorded the log.
+	Record(ctx context.Context, term, lastLogTerm, lastLogIndex uint64) (currentTerm uint64, ok bool, err error)
+}
+
+// SetWitness makes the witness a voter whenever the cluster has an even
+// number of voting members. The id identifies it in metrics, and must not be
+// a server's. It must be called before Start. Every server in the cluster
+// should use the same witness.
+func (s *Server) SetWitness(id uint64, w Witness) {
+	s.witness = &witnessPeer{id: id, w: w}
+}
+
+// voters returns the voting members other than this server, and the witness,
+// if the cluster needs it to break ties.
+func (s *Server) voters() Peers {
+	voters := s.peers.Except(s.id)
+	if s.witness != nil && len(s.peers)%2 == 0 {
+		voters = union(voters, Peers{s.witness.id: s.witness})
+	}
+	return voters
+}
+
+// checkFaultTolerance emits NoFaultTolerance when the voting members change
+// to tolerate no failures, and warns about clusters with an even number of
+// voters, which could tolerate as many failures with one fewer.
+func (s *Server) checkFaultTolerance() {
+	voters := union(s.voters(), Peers{s.id: nil})
+	tolerance := voters.FaultTolerance()
+	if len(voters) == s.voterCount {
+		return
+	}
+	s.voterCount = len(voters)
+	switch {
+	case len(voters) > 1 && tolerance == 0:
+		s.config().logf("id=%d: WARNING: %d voters tolerate no failures; add a server, or a witness", s.id, len(voters))
+		s.emit(NoFaultTolerance)
+	case len(voters)%2 == 0:
+		s.config().logf("id=%d: WARNING: %d voters tolerate %d failure(s), as %d would; consider a witness", s.id, len(voters), tolerance, len(voters)-1)
+	}
+}
+
+// witnessPeer makes a witness look like any other voter to elections and
+// replication.
+type witnessPeer struct {
+	id uint64
+	w  Witness
+}
+
+func (p *witnessPeer) Id() uint64 { return p.id }
+
+func (p *witnessPeer) AppendEntries(ae AppendEntries) AppendEntriesResponse {
+	resp, _ := p.AppendEntriesContext(context.Background(), ae)
+	return resp
+}
+
+func (p *witnessPeer) RequestVote(rv RequestVote) RequestVoteResponse {
+	resp, _ := p.RequestVoteContext(context.Background(), rv)
+	return resp
+}
+
+func (p *witnessPeer) Command([]byte, chan []byte) error { return ErrUnknownLeader }
+
+// AppendEntriesContext records the log the leader would have the witness
+// hold, were it a server.
+func (p *witnessPeer) AppendEntriesContext(ctx context.Context, ae AppendEntries) (AppendEntriesResponse, error) {
+	lastLogIndex, lastLogTerm := ae.PrevLogIndex, ae.PrevLogTerm
+	if n := len(ae.Entries); n > 0 {
+		lastLogIndex, lastLogTerm = ae.Entries[n-1].Index, ae.Entries[n-1].Term
+	}
+	term, ok, err := p.w.Record(ctx, ae.Term, lastLogTerm, lastLogIndex)
+	if err != nil {
+		return AppendEntriesResponse{}, err
+	}
+	resp := AppendEntriesResponse{Term: term, Success: ok}
+	switch {
+	case ok:
+	case term > ae.Term:
+		resp.Rejection = RejectStaleTerm
+	default:
+		resp.Rejection = RejectLogMismatch
+	}
+	return resp, nil
+}
+
+func (p *witnessPeer) RequestVoteContext(ctx context.Context, rv RequestVote) (RequestVoteResponse, error) {
+	term, granted, err := p.w.Vote(ctx, rv.Term, rv.CandidateId, rv.LastLogTerm, rv.LastLogIndex)
+	if err != nil {
+		return RequestVoteResponse{}, err
+	}
+	return RequestVoteResponse{Term: term, VoteGranted: granted}, nil
+}
+
+// NewWitnessPeer returns a peer that answers for the witness, so that a
+// transport can serve it, e.g. rafthttp.NewServer. Servers reach it with
+// RemoteWitness. That lets a witness run as its own small process, holding
+// no log, e.g. in a third location, to break ties between two others.
+func NewWitnessPeer(id uint64, w Witness) Peer {
+	return &witnessPeer{id: id, w: w}
+}
+
+// RemoteWitness returns the witness served by the peer, e.g. a rafthttp.Peer
+// dialed to a process serving NewWitnessPeer. Votes are RequestVotes, and
+// records are AppendEntries, with no entries, whose PrevLogIndex and
+// PrevLogTerm are the last entry of the leader's log.
+func RemoteWitness(p Peer) Witness {
+	return remoteWitness{p}
+}
+
+type remoteWitness struct {
+	peer Peer
+}
+
+func (w remoteWitness) Vote(ctx context.Context, term, candidate, lastLogTerm, lastLogIndex uint64) (uint64, bool, error) {
+	resp, err := requestVote(ctx, w.peer, RequestVote{
+		Term:         term,
+		CandidateId:  candidate,
+		LastLogIndex: lastLogIndex,
+		LastLogTerm:  lastLogTerm,
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return resp.Term, resp.VoteGranted, nil
+}
+
+func (w remoteWitness) Record(ctx context.Context, term, lastLogTerm, lastLogIndex uint64) (uint64, bool, error) {
+	resp, err := appendEntries(ctx, w.peer, AppendEntries{
+		Term:         term,
+		PrevLogIndex: lastLogIndex,
+		PrevLogTerm:  lastLogTerm,
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return resp.Term, resp.Success, nil
+}
+
+// LocalWitness is a Witness that runs in this process. NewLocalWitness keeps
+// its state in memory, so it's only safe for as long as its process lives;
+// it's useful for testing, and as a reference for witnesses that persist
+// their state. NewFileWitness keeps it on disk.
+type LocalWitness struct {
+	sync.Mutex
+	term         uint64
+	vote         uint64 // in term
+	lastLogTerm  uint64
+	lastLogIndex uint64
+	votes, log   *FileStableStore // if persisted
+}
+
+func NewLocalWitness() *LocalWitness { return &LocalWitness{} }
+
+// NewFileWitness opens (or creates) a witness that persists its term and vote
+// in a FileStableStore at the path, and the log it's recorded, as a last
+// term and index, in another at path + ".log". Each change is durable before
+// the witness answers. Both stores are fenced, so that only one witness can
+// use them at a time.
+func NewFileWitness(path string) (*LocalWitness, error) {
+	votes, err := NewFileStableStore(path)
+	if err != nil {
+		return nil, err
+	}
+	log, err := NewFileStableStore(path + ".log")
+	if err != nil {
+		votes.Close()
+		return nil, err
+	}
+	w := &LocalWitness{votes: votes, log: log}
+	for _, store := range []*FileStableStore{votes, log} {
+		if err := store.Fence(); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	state, _ := votes.LoadState()
+	w.term, w.vote = state.Term, state.Vote
+	state, _ = log.LoadState()
+	w.lastLogTerm, w.lastLogIndex = state.Term, state.Vote
+	return w, nil
+}
+
+// Close closes the witness's stores, if it has any.
+func (w *LocalWitness) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	var err error
+	for _, store := range []*FileStableStore{w.votes, w.log} {
+		if store == nil {
+			continue
+		}
+		if e := store.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (w *LocalWitness) Vote(ctx context.Context, term, candidate, lastLogTerm, lastLogIndex uint64) (uint64, bool, error) {
+	w.Lock()
+	defer w.Unlock()
+	if term < w.term {
+		return w.term, false, nil
+	}
+	vote := w.vote
+	if term > w.term {
+		vote = noVote
+	}
+	granted := (vote == noVote || vote == candidate) && upToDate(lastLogTerm, lastLogIndex, w.lastLogTerm, w.lastLogIndex)
+	if granted {
+		vote = candidate
+	}
+	if err := w.storeVote(term, vote); err != nil {
+		return w.term, false, err
+	}
+	return w.term, granted, nil
+}
+
+func (w *LocalWitness) Record(ctx context.Context, term, lastLogTerm, lastLogIndex uint64) (uint64, bool, error) {
+	w.Lock()
+	defer w.Unlock()
+	if term < w.term {
+		return w.term, false, nil
+	}
+	if term > w.term {
+		if err := w.storeVote(term, noVote); err != nil {
+			return w.term, false, err
+		}
+	}
+	if !upToDate(lastLogTerm, lastLogIndex, w.lastLogTerm, w.lastLogIndex) {
+		return w.term, false, nil
+	}
+	if err := w.storeLog(lastLogTerm, lastLogIndex); err != nil {
+		return w.term, false, err
+	}
+	return w.term, true, nil
+}
+
+// storeVote persists the term and vote, if they've changed, and then adopts
+// them.
+func (w *LocalWitness) storeVote(term, vote uint64) error {
+	if term == w.term && vote == w.vote {
+		return nil
+	}
+	if w.votes != nil {
+		if err := w.votes.StoreState(StableState{Term: term, Vote: vote}); err != nil {
+			return err
+		}
+	}
+	w.term, w.vote = term, vote
+	return nil
+}
+
+// storeLog persists the last term and index of the recorded log, if they've
+// changed, and then adopts them. The index is stored as the state's vote.
+func (w *LocalWitness) storeLog(lastLogTerm, lastLogIndex uint64) error {
+	if lastLogTerm == w.lastLogTerm && lastLogIndex == w.lastLogIndex {
+		return nil
+	}
+	if w.log != nil {
+		if err := w.log.StoreState(StableState{Term: lastLogTerm, Vote: lastLogIndex}); err != nil {
+			return err
+		}
+	}
+	w.lastLogTerm, w.lastLogIndex = lastLogTerm, lastLogIndex
+	return nil
+}
+
+// upToDate returns whether a log whose last entry has the index and term is
+// at least as up-to-date as another's, per 5.4.1.
+func upToDate(term, index, otherTerm, otherIndex uint64) bool {
+	return term > otherTerm || (term == otherTerm && index >= otherIndex)
+}
@@ -0,0 +1,160 @@
+package raft_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/peterbourgon/raft"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWitness(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	ctx := context.Background()
+	noop := func([]byte) ([]byte, error) { return []byte{}, nil }
+	status := func(server *raft.Server) raft.Status {
+		for cutoff := time.Now().Add(time.Second); time.Now().Before(cutoff); time.Sleep(time.Millisecond) {
+			if st := server.Status(); st.Quorum > 0 {
+				return st
+			}
+		}
+		t.Fatal("status never published")
+		return raft.Status{}
+	}
+
+	// without a witness, a 2-server cluster tolerates no failures, and says so
+	events := make(chan raft.Event, 10)
+	server := raft.NewServer(1, &bytes.Buffer{}, noop, config)
+	server.SetEventHandler(func(e raft.Event) { events <- e })
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), nonresponsivePeer(2)))
+	server.Start()
+	if e := <-events; e.Type != raft.NoFaultTolerance {
+		t.Errorf("expected a %s event, got %s", raft.NoFaultTolerance, e.Type)
+	}
+	if st := status(server); st.Quorum != 2 || st.FaultTolerance != 0 || st.Witness {
+		t.Errorf("without a witness, expected quorum 2, tolerating 0 failures, got %+v", st)
+	}
+	server.Stop()
+
+	// with a witness, the server carries on without its peer
+	applied := make(chan []byte, 1)
+	apply := func(cmd []byte) ([]byte, error) { applied <- cmd; return cmd, nil }
+	witness := raft.NewLocalWitness()
+	server = raft.NewServer(1, &bytes.Buffer{}, apply, config)
+	server.SetWitness(100, witness)
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), nonresponsivePeer(2)))
+	server.Start()
+	select {
+	case <-server.LeaderCh():
+	case <-time.After(10 * config.MaxElectionTimeout):
+		t.Fatal("never became leader, with the witness's vote")
+	}
+	if st := status(server); st.Quorum != 2 || st.FaultTolerance != 1 || !st.Witness {
+		t.Errorf("with a witness, expected quorum 2, tolerating 1 failure, got %+v", st)
+	}
+	if err := server.Command([]byte(`{}`), make(chan []byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-applied:
+	case <-time.After(2 * config.MaxElectionTimeout):
+		t.Fatal("command never committed, with the witness's acknowledgement")
+	}
+
+	// the witness votes once a term, and only for candidates at least as
+	// up-to-date as the log it's recorded
+	term := server.Status().Term
+	if _, granted, _ := witness.Vote(ctx, term+1, 2, 0, 0); granted {
+		t.Errorf("expected the witness to refuse a candidate with an empty log")
+	}
+	last := server.Status()
+	if _, granted, _ := witness.Vote(ctx, term+1, 2, last.LastTerm, last.LastIndex); !granted {
+		t.Errorf("expected the witness to vote for an up-to-date candidate")
+	}
+	if _, granted, _ := witness.Vote(ctx, term+1, 3, last.LastTerm, last.LastIndex); granted {
+		t.Errorf("expected the witness to vote once a term")
+	}
+
+	// so when the leader fails, a follower that missed the entries it
+	// committed with the witness can't take over, which would lose them
+	server.Stop()
+	follower := raft.NewServer(2, &bytes.Buffer{}, noop, config)
+	follower.SetWitness(100, witness)
+	follower.SetPeers(raft.MakePeers(nonresponsivePeer(1), raft.NewLocalPeer(follower)))
+	follower.Start()
+	defer follower.Stop()
+	select {
+	case <-follower.LeaderCh():
+		t.Errorf("expected the lagging follower not to be elected, with the witness's vote")
+	case <-time.After(10 * config.MaxElectionTimeout):
+	}
+}
+
+func TestFileWitness(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+	dir, err := ioutil.TempDir("", "raft-witness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := raft.Config{MinElectionTimeout: 25 * time.Millisecond, MaxElectionTimeout: 50 * time.Millisecond, HeartbeatInterval: 2500 * time.Microsecond}
+	ctx := context.Background()
+	applied := make(chan []byte, 1)
+	apply := func(cmd []byte) ([]byte, error) { applied <- cmd; return cmd, nil }
+
+	// a server reaches the witness as a peer, as it would over a transport
+	witness, err := raft.NewFileWitness(filepath.Join(dir, "witness"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raft.NewFileWitness(filepath.Join(dir, "witness")); err != raft.ErrFenced {
+		t.Errorf("expected a second witness on the same files to fail with %s, got %v", raft.ErrFenced, err)
+	}
+	server := raft.NewServer(1, &bytes.Buffer{}, apply, config)
+	server.SetWitness(100, raft.RemoteWitness(raft.NewWitnessPeer(100, witness)))
+	server.SetPeers(raft.MakePeers(raft.NewLocalPeer(server), nonresponsivePeer(2)))
+	server.Start()
+	select {
+	case <-server.LeaderCh():
+	case <-time.After(10 * config.MaxElectionTimeout):
+		t.Fatal("never became leader, with the witness's vote")
+	}
+	if err := server.Command([]byte(`{}`), make(chan []byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-applied:
+	case <-time.After(2 * config.MaxElectionTimeout):
+		t.Fatal("command never committed, with the witness's acknowledgement")
+	}
+	server.Stop()
+	last := server.Status()
+	witness.Close()
+
+	// reopened, the witness remembers the term, its vote, and the log
+	witness, err = raft.NewFileWitness(filepath.Join(dir, "witness"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer witness.Close()
+	if term, granted, _ := witness.Vote(ctx, last.Term, 2, last.LastTerm, last.LastIndex); granted || term != last.Term {
+		t.Errorf("expected the witness to refuse a second vote in term %d, got term %d, granted %v", last.Term, term, granted)
+	}
+	if _, granted, _ := witness.Vote(ctx, last.Term+1, 2, 0, 0); granted {
+		t.Errorf("expected the witness to refuse a candidate with an empty log")
+	}
+	if _, granted, _ := witness.Vote(ctx, last.Term+1, 2, last.LastTerm, last.LastIndex); !granted {
+		t.Errorf("expected the witness to vote for an up-to-date candidate")
+	}
+}